@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/qtopie/oget/pkg/oget"
+)
+
+// runDaemon implements "oget daemon": serve the JSON-RPC API until SIGINT or
+// SIGTERM, then stop active jobs so their state is saved for resume.
+func runDaemon(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:6800", "API address: a loopback host:port, or unix:/path for a Unix socket")
+	maxActive := fs.Int("max-active", 3, "jobs downloading at once")
+	concurrency := fs.Int("concurrency", 0, "concurrent workers per job (default 8 with autotune)")
+	limitRate := fs.String("limit-rate", "", "limit total download speed of all jobs in bytes/sec, e.g. 500K, 10M")
+	dir := fs.String("dir", "", "directory for jobs that do not set dir (default current directory)")
+	stateStore := fs.String("state-store", "json", "where resume state is kept: json or bolt")
+	manifest := fs.String("manifest", "", "directory of the bolt state database oget.db (default current directory)")
+	verbose := fs.Bool("verbose", false, "enable verbose output")
+	tokenFile := fs.String("token-file", oget.DefaultDaemonTokenFile(), "file to write the API token to, readable only by you; clients send it as 'Authorization: Bearer <token>'")
+	configFile := fs.String("config", "", "configuration file (default oget.json in the current directory, if present)")
+	fs.Parse(args)
+
+	if *tokenFile == "" {
+		fmt.Fprintln(os.Stderr, "No configuration directory for the API token, set -token-file")
+		os.Exit(exitUsage)
+	}
+
+	// oget.json, if any, sets the defaults; flags given on the command line win.
+	config := oget.DefaultConfig()
+	if _, err := os.Stat("oget.json"); *configFile != "" || err == nil {
+		if config, err = oget.LoadConfig(*configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -config: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["verbose"] {
+		config.Verbose = *verbose
+	}
+	if set["dir"] {
+		config.OutputDir = *dir
+	}
+	if set["state-store"] {
+		config.StateStoreType = *stateStore
+	}
+	if set["manifest"] {
+		config.ManifestPath = *manifest
+	}
+	if set["concurrency"] && *concurrency > 0 {
+		config.Concurrency = *concurrency
+	}
+	if set["limit-rate"] {
+		// An empty value lifts a limit set in oget.json.
+		var rate int64
+		if *limitRate != "" {
+			var err error
+			if rate, err = oget.ParseByteSize(*limitRate); err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid -limit-rate: %v\n", err)
+				os.Exit(exitUsage)
+			}
+		}
+		config.RateLimit = rate
+	}
+
+	// Held open for the daemon's lifetime so jobs share one bolt database
+	// instead of reopening it for each download.
+	store, err := oget.OpenStateStore(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -state-store: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	defer store.Close()
+
+	ln, err := oget.ListenDaemon(*listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot listen: %v\n", err)
+		os.Exit(exitFailure)
+	}
+
+	daemon := oget.NewDaemon(config)
+	daemon.MaxActive = *maxActive
+	// Written once listening, so a second daemon failing to start does not
+	// replace the token of the one running.
+	if err := oget.WriteDaemonToken(*tokenFile, daemon.Token); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot write -token-file: %v\n", err)
+		os.Exit(exitFailure)
+	}
+	defer os.Remove(*tokenFile)
+	server := &http.Server{Handler: daemon.Handler()}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(os.Stderr, "API server: %v\n", err)
+			stop()
+		}
+	}()
+	fmt.Fprintf(os.Stderr, "oget daemon listening on %s, token in %s\n", ln.Addr(), *tokenFile)
+
+	daemon.Run(ctx)
+	fmt.Fprintln(os.Stderr, "Shutting down, active jobs were saved for resume")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// /events streams never end on their own; Close drops them.
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+	}
+	oget.CleanupProtocols(shutdownCtx, config)
+}
@@ -2,29 +2,95 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/qtopie/oget/pkg/oget"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "daemon" {
+		runDaemon(os.Args[2:])
+		return
+	}
+
 	var fileName string
 	var concurrency int
 	var timeout int
+	var retries int
 	var verbose bool
 	var version bool
 	var checksum bool
+	var verifyResume bool
 	var dnsServer string
+	var limitRate string
+	var mirrors bool
+	var digest string
+	var quarantine bool
+	var naming string
+	var inputFile string
+	var stateStore string
+	var manifest string
+	var clusterDir string
+	var clusterID string
+	var recursive bool
+	var level int
+	var accept string
+	var reject string
+	var spanHosts bool
+	var s3Endpoint string
+	var s3PathStyle bool
+	var variant string
+	var user string
+	var tokenEnv string
+	var netrcFile string
+	var configFile string
+	var userAgent string
+	var loadCookies string
+	var saveCookies string
+	var headers headerList
 
 	flag.StringVar(&fileName, "file", "", "name or path to save file (only for single URL)")
 	flag.IntVar(&concurrency, "concurrency", 0, "number of concurrent workers (default 8 with autotune, 32 without)")
-	flag.IntVar(&timeout, "timeout", 0, "timeout for network operations in seconds (default 30)")
+	flag.IntVar(&timeout, "timeout", 0, "timeout for network operations in seconds, 0 for none (default 30)")
+	flag.IntVar(&retries, "retries", 0, "attempts per chunk before giving up, with exponential backoff between them (default 3)")
 	flag.BoolVar(&verbose, "verbose", false, "enable verbose output for dynamic detection")
 	flag.BoolVar(&version, "version", false, "show version information")
 	flag.BoolVar(&checksum, "checksum", false, "enable per-chunk SHA-256 checksum verification")
+	flag.BoolVar(&verifyResume, "verify-resume", false, "re-hash completed chunks when resuming and download corrupt ones again")
 	flag.StringVar(&dnsServer, "dns", "", "custom DNS server for BT tracker/peer resolution (e.g. 8.8.8.8 or 8.8.8.8:53)")
+	flag.StringVar(&limitRate, "limit-rate", "", "limit total download speed in bytes/sec, e.g. 500K, 10M (default unlimited)")
+	flag.BoolVar(&mirrors, "mirrors", false, "treat all URLs as mirrors of a single file and download from them in parallel")
+	flag.StringVar(&digest, "digest", "", "expected digest of the downloaded file, e.g. sha256:abcd... (only for single URL)")
+	flag.BoolVar(&quarantine, "quarantine", false, "rename a file failing -digest to <name>.corrupt instead of deleting it")
+	flag.StringVar(&inputFile, "i", "", "read URLs with per-entry options (out=, dir=, digest=, header=, mirror=) from a file, - for stdin")
+	flag.StringVar(&stateStore, "state-store", "json", "where resume state is kept: json (a hidden .<name>.oget file beside each download) or bolt (one database, see -manifest)")
+	flag.StringVar(&manifest, "manifest", "", "directory of the bolt state database oget.db (default current directory)")
+	flag.StringVar(&clusterDir, "cluster", "", "share chunk leases with other oget processes downloading the same URLs through this directory (e.g. on NFS)")
+	flag.StringVar(&clusterID, "cluster-id", "", "name of this process in -cluster leases (default hostname-pid)")
+	flag.BoolVar(&recursive, "r", false, "mirror the files linked from the directory listings and pages under each URL, keeping the remote directory structure")
+	flag.IntVar(&level, "level", 5, "with -r, how many links deep to follow (0 for no limit)")
+	flag.StringVar(&accept, "accept", "", "with -r, comma-separated globs of file names to download, e.g. '*.iso,*.sha256'")
+	flag.StringVar(&reject, "reject", "", "with -r, comma-separated globs of file names to skip")
+	flag.BoolVar(&spanHosts, "span-hosts", false, "with -r, also follow links to other hosts")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "", "endpoint of S3-compatible storage for s3:// URLs, e.g. http://localhost:9000 (default AWS, or AWS_ENDPOINT_URL_S3)")
+	flag.BoolVar(&s3PathStyle, "s3-path-style", false, "address S3 buckets in the path (endpoint/bucket/key) instead of the host name")
+	flag.StringVar(&user, "user", "", "user:password for HTTP Basic or Digest authentication on the hosts of the given URLs (default from ~/.netrc)")
+	flag.StringVar(&tokenEnv, "token-env", "", "environment variable holding a Bearer token for the hosts of the given URLs")
+	flag.StringVar(&netrcFile, "netrc-file", "", "netrc file with HTTP credentials by host (default $NETRC or ~/.netrc)")
+	flag.Var(&headers, "header", "extra request header 'Name: value' for every URL (repeatable); per-host headers go in host_headers of oget.json")
+	flag.StringVar(&userAgent, "user-agent", "", "User-Agent to send (default oget/<version>)")
+	flag.StringVar(&loadCookies, "load-cookies", "", "send the cookies of a Netscape cookies.txt file, e.g. exported from a browser")
+	flag.StringVar(&saveCookies, "save-cookies", "", "write the cookies, loaded and received, to a Netscape cookies.txt file when done")
+	flag.StringVar(&configFile, "config", "", "configuration file (default oget.json in the current directory, if present)")
+	flag.StringVar(&variant, "variant", "best", "variant of HLS (.m3u8) and DASH (.mpd) streams: best, worst, a height like 720p, or the highest bit rate up to e.g. 3M")
+	flag.StringVar(&naming, "naming", "auto", "how to name files without -file: auto (Content-Disposition, then redirect target), final-url, url")
 	flag.Parse()
 
 	if version {
@@ -33,21 +99,324 @@ func main() {
 	}
 
 	args := flag.Args()
-	if len(args) < 1 {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] <URL1> [URL2] ...\n", os.Args[0])
+	if len(args) < 1 && inputFile == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <URL1> [URL2] ...\n       %s [options] -i <file>\n       %s -r [options] <URL>\n       %s daemon [-listen addr] [options]\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 		return
 	}
 
-	downloader := oget.NewDownloader(args, concurrency)
-	downloader.Config.Verbose = verbose
-	downloader.Config.Checksum = checksum
-	downloader.Config.DNS = dnsServer
-	if timeout > 0 {
+	if recursive && (fileName != "" || digest != "" || mirrors) {
+		fmt.Fprintln(os.Stderr, "-r cannot be combined with -file, -digest or -mirrors")
+		os.Exit(exitUsage)
+	}
+	if fileName != "" && (len(args) == 0 || len(args) > 1 && !mirrors) {
+		fmt.Fprintln(os.Stderr, "-file can only be used with a single URL (use out= in an -i file)")
+		os.Exit(exitUsage)
+	}
+	switch naming {
+	case "auto", "final-url", "url":
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid -naming %q: want auto, final-url or url\n", naming)
+		os.Exit(exitUsage)
+	}
+	if stateStore != "json" && stateStore != "bolt" {
+		fmt.Fprintf(os.Stderr, "Invalid -state-store %q: want json or bolt\n", stateStore)
+		os.Exit(exitUsage)
+	}
+	if digest != "" {
+		if len(args) == 0 || len(args) > 1 && !mirrors {
+			fmt.Fprintln(os.Stderr, "-digest can only be used with a single URL (use digest= in an -i file)")
+			os.Exit(exitUsage)
+		}
+		if _, _, err := oget.ParseDigest(digest); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -digest: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	var bases []string
+	if recursive {
+		// The URLs are crawled for the files to download, below.
+		bases, args = args, nil
+	}
+	// oget.json, if any, sets the defaults; flags given on the command line win.
+	config := oget.DefaultConfig()
+	if _, err := os.Stat("oget.json"); configFile != "" || err == nil {
+		if config, err = oget.LoadConfig(configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -config: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["concurrency"] {
+		if concurrency <= 0 {
+			concurrency = oget.DefaultConfig().Concurrency
+		}
+		config.Concurrency = concurrency
+	}
+	downloader := oget.NewDownloaderWithConfig(args, config)
+	if mirrors && len(args) > 1 {
+		downloader.URLs = args[:1]
+		downloader.Mirrors = map[string][]string{args[0]: args[1:]}
+	}
+	if set["verbose"] {
+		downloader.Config.Verbose = verbose
+	}
+	if set["checksum"] {
+		downloader.Config.Checksum = checksum
+	}
+	if set["verify-resume"] {
+		downloader.Config.VerifyOnResume = verifyResume
+	}
+	if set["dns"] {
+		downloader.Config.DNS = dnsServer
+	}
+	if set["naming"] {
+		downloader.Config.Naming = naming
+	}
+	if set["state-store"] {
+		downloader.Config.StateStoreType = stateStore
+	}
+	if set["manifest"] {
+		downloader.Config.ManifestPath = manifest
+	}
+	if set["limit-rate"] {
+		// An empty value lifts a limit set in oget.json.
+		var rate int64
+		if limitRate != "" {
+			var err error
+			if rate, err = oget.ParseByteSize(limitRate); err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid -limit-rate: %v\n", err)
+				os.Exit(exitUsage)
+			}
+		}
+		downloader.Config.RateLimit = rate
+	}
+	if set["retries"] {
+		downloader.Config.RetryMaxAttempts = retries
+	}
+	if set["timeout"] {
+		// The fetchers of each scheme are created on first use, with it.
 		downloader.Config.Timeout = timeout
-		// Re-create fetcher with new timeout if it was already created
-		downloader.Fetcher = oget.NewHttpFetcher(downloader.Config)
 	}
-	downloader.Download(context.Background())
-	oget.CleanupProtocols(downloader.Config)
+	if set["s3-endpoint"] {
+		downloader.Config.S3Endpoint = s3Endpoint
+	}
+	if set["s3-path-style"] {
+		downloader.Config.S3PathStyle = s3PathStyle
+	}
+	if set["variant"] {
+		downloader.Config.StreamVariant = variant
+	}
+	if set["netrc-file"] {
+		downloader.Config.NetrcFile = netrcFile
+	}
+	if set["user-agent"] {
+		downloader.Config.UserAgent = userAgent
+	}
+	if set["load-cookies"] {
+		downloader.Config.CookieFile = loadCookies
+	}
+	if set["save-cookies"] {
+		downloader.Config.SaveCookieFile = saveCookies
+	}
+	for _, h := range headers {
+		if downloader.Config.Headers == nil {
+			downloader.Config.Headers = make(map[string]string)
+		}
+		name, value, _ := strings.Cut(h, ":")
+		downloader.Config.Headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	if digest != "" {
+		downloader.Digests = map[string]string{downloader.URLs[0]: digest}
+	}
+	if fileName != "" {
+		downloader.FileNames = map[string]string{downloader.URLs[0]: fileName}
+	}
+	var entries []*oget.InputEntry
+	if inputFile != "" {
+		var err error
+		if entries, err = readInputFile(inputFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -i %s: %v\n", inputFile, err)
+			os.Exit(exitUsage)
+		}
+	}
+	if user != "" || tokenEnv != "" {
+		if tokenEnv != "" && os.Getenv(tokenEnv) == "" {
+			fmt.Fprintf(os.Stderr, "Invalid -token-env: $%s is not set\n", tokenEnv)
+			os.Exit(exitUsage)
+		}
+		username, password, _ := strings.Cut(user, ":")
+		cred := oget.Credential{Username: username, Password: password, TokenEnv: tokenEnv}
+		// Only the hosts named on the command line or in the -i file, never
+		// those redirected to.
+		urls := append(append([]string(nil), downloader.URLs...), bases...)
+		for _, list := range downloader.Mirrors {
+			urls = append(urls, list...)
+		}
+		for _, e := range entries {
+			urls = append(append(urls, e.URL), e.Mirrors...)
+		}
+		for _, u := range urls {
+			if parsed, err := url.Parse(u); err == nil && parsed.Host != "" {
+				if downloader.Config.Credentials == nil {
+					downloader.Config.Credentials = make(map[string]oget.Credential)
+				}
+				downloader.Config.Credentials[strings.ToLower(parsed.Host)] = cred
+			}
+		}
+	}
+	if set["quarantine"] {
+		downloader.Config.DigestMismatch = "delete"
+		if quarantine {
+			downloader.Config.DigestMismatch = "quarantine"
+		}
+	}
+	if clusterDir != "" {
+		cluster, err := oget.OpenClusterStore(clusterDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -cluster: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		downloader.Cluster = cluster
+		downloader.ClusterID = clusterID
+	}
+	// Last: entries with their own options copy downloader.Config as it is
+	// now, so every flag and credential that changes it is applied above.
+	for _, e := range entries {
+		if err := downloader.AddEntry(e); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -i %s: %v\n", inputFile, err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	// The first SIGINT/SIGTERM cancels the download so workers stop and the
+	// state is flushed for resume; a second one quits immediately.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		fmt.Fprintln(os.Stderr, "\nInterrupted, saving state... (press Ctrl-C again to force quit)")
+		cancel()
+		<-sigs
+		fmt.Fprintln(os.Stderr, "Forced quit, progress since the last chunk may be lost")
+		os.Exit(exitInterrupted)
+	}()
+
+	if recursive {
+		opts := oget.CrawlOptions{
+			MaxDepth:  level,
+			Accept:    splitList(accept),
+			Reject:    splitList(reject),
+			SpanHosts: spanHosts,
+		}
+		for _, base := range bases {
+			entries, err := oget.Crawl(ctx, downloader.Config, base, opts)
+			if errors.Is(err, context.Canceled) {
+				os.Exit(exitInterrupted)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", base, err)
+				os.Exit(exitCode(err))
+			}
+			for _, e := range entries {
+				// Only fails for a file already found under an earlier URL.
+				downloader.AddEntry(e)
+			}
+		}
+		if len(downloader.URLs) == 0 {
+			fmt.Fprintln(os.Stderr, "No files found to download")
+			os.Exit(exitNotFound)
+		}
+	}
+
+	results, err := downloader.Download(ctx)
+	oget.CleanupProtocols(ctx, downloader.Config)
+	if downloader.Cluster != nil {
+		downloader.Cluster.Close()
+	}
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintf(os.Stderr, "Download interrupted. Run the same command again to resume:\n  %s\n", strings.Join(os.Args, " "))
+		os.Exit(exitInterrupted)
+	}
+	code := exitOK
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s: %v\n", r.URL, r.Status, r.Err)
+		}
+		if c := exitCode(r.Err); c > code {
+			code = c
+		}
+	}
+	if err != nil && code == exitOK {
+		code = exitFailure
+	}
+	os.Exit(code)
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// headerList collects repeated -header flags.
+type headerList []string
+
+func (h *headerList) String() string { return strings.Join(*h, ", ") }
+
+func (h *headerList) Set(value string) error {
+	if name, _, ok := strings.Cut(value, ":"); !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("want 'Name: value', got %q", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// readInputFile parses the -i file, "-" meaning stdin.
+func readInputFile(path string) ([]*oget.InputEntry, error) {
+	if path == "-" {
+		return oget.ParseInputFile(os.Stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return oget.ParseInputFile(f)
+}
+
+// Exit codes, so scripts can tell why a download failed. With several URLs
+// the highest applicable code wins.
+const (
+	exitOK              = 0
+	exitFailure         = 1 // any other error
+	exitUsage           = 2
+	exitNotFound        = 3
+	exitServerChanged   = 4
+	exitChecksumFailure = 5
+	exitInterrupted     = 130
+)
+
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, oget.ErrChecksumMismatch):
+		return exitChecksumFailure
+	case errors.Is(err, oget.ErrServerChanged):
+		return exitServerChanged
+	case errors.Is(err, oget.ErrNotFound):
+		return exitNotFound
+	default:
+		return exitFailure
+	}
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qtopie/oget/ogettest"
+)
+
+// runMain runs main with args in a child process, since it exits, and
+// returns its exit code.
+func runMain(t *testing.T, dir string, args ...string) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainProcess$")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "OGET_TEST_MAIN_ARGS="+strings.Join(args, "\n"))
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		t.Logf("oget %s:\n%s", strings.Join(args, " "), out)
+		return exit.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exitOK
+}
+
+// TestMainProcess is the child process of runMain.
+func TestMainProcess(t *testing.T) {
+	args, ok := os.LookupEnv("OGET_TEST_MAIN_ARGS")
+	if !ok {
+		t.Skip("only run by runMain")
+	}
+	os.Args = append([]string{"oget"}, strings.Split(args, "\n")...)
+	main()
+	os.Exit(exitOK)
+}
+
+func TestTimeoutKeepsSchemeFetchers(t *testing.T) {
+	content := bytes.Repeat([]byte("ftp data "), 1000)
+	server := ogettest.NewFtpServer(map[string][]byte{"/pub/file.bin": content})
+	defer server.Close()
+
+	// -timeout must not swap the fetcher of every scheme for the HTTP one.
+	dir := t.TempDir()
+	if code := runMain(t, dir, "-timeout", "5", server.URL+"/pub/file.bin"); code != exitOK {
+		t.Fatalf("exit code %d, want %d", code, exitOK)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "file.bin"))
+	if err != nil || !bytes.Equal(data, content) {
+		t.Errorf("downloaded %d bytes, %v; want the %d served", len(data), err, len(content))
+	}
+}
+
+func TestInputFileQuarantine(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte("not what was promised")))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	list := filepath.Join(dir, "urls.txt")
+	// dir= gives the entry a copy of the configuration, which must carry
+	// -quarantine although the flag is applied after -i is read.
+	entry := server.URL + "/file.bin\n  dir=" + filepath.Join(dir, "out") + "\n  digest=sha256:" + strings.Repeat("0", 64) + "\n"
+	if err := os.WriteFile(list, []byte(entry), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := runMain(t, dir, "-quarantine", "-i", list); code != exitChecksumFailure {
+		t.Errorf("exit code %d, want %d", code, exitChecksumFailure)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out", "file.bin.corrupt")); err != nil {
+		t.Errorf("file failing its digest not quarantined: %v", err)
+	}
+}
+
+func TestFlagsOverrideConfigFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte("not what was promised")))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "oget.json"), []byte(`{"digest_mismatch": "quarantine"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A false boolean given explicitly must win over oget.json too.
+	code := runMain(t, dir, "-quarantine=false", "-digest", "sha256:"+strings.Repeat("0", 64), server.URL+"/file.bin")
+	if code != exitChecksumFailure {
+		t.Errorf("exit code %d, want %d", code, exitChecksumFailure)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "file.bin.corrupt")); err == nil {
+		t.Error("file quarantined despite -quarantine=false")
+	}
+}
+
+func TestDaemonLoadsConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "oget.json"), []byte(`{"state_store_type": "nosuch"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A non-loopback address is refused once the state store opens, so the
+	// daemon exits either way instead of serving.
+	args := []string{"daemon", "-listen", "0.0.0.0:0", "-token-file", filepath.Join(dir, "token")}
+	if code := runMain(t, dir, args...); code != exitUsage {
+		t.Errorf("exit code %d with the state store of oget.json, want %d", code, exitUsage)
+	}
+	if code := runMain(t, dir, append(args, "-state-store", "json")...); code != exitFailure {
+		t.Errorf("exit code %d with -state-store json, want %d", code, exitFailure)
+	}
+}
@@ -5,10 +5,12 @@ go 1.25.5
 require (
 	github.com/cenkalti/rain v1.13.0
 	github.com/fxamacker/cbor/v2 v2.9.1
-	github.com/jlaffaye/ftp v0.2.0
+	github.com/pkg/sftp v1.13.10
 	github.com/quic-go/quic-go v0.58.0
 	github.com/schollz/progressbar/v3 v3.19.0
 	github.com/spf13/viper v1.21.0
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/crypto v0.52.0
 	golang.org/x/net v0.55.0
 	golang.org/x/sys v0.45.0
 )
@@ -29,6 +31,7 @@ require (
 	github.com/jackpal/bencode-go v1.0.0 // indirect
 	github.com/juju/ratelimit v1.0.2 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.3 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/minio/sha256-simd v1.0.0 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
@@ -54,9 +57,7 @@ require (
 	github.com/x448/float16 v0.8.4 // indirect
 	github.com/youtube/vitess v3.0.0-rc.3+incompatible // indirect
 	github.com/zeebo/bencode v1.0.0 // indirect
-	go.etcd.io/bbolt v1.3.11 // indirect
 	go.yaml.in/yaml/v3 v3.0.4 // indirect
-	golang.org/x/crypto v0.52.0 // indirect
 	golang.org/x/term v0.43.0 // indirect
 	golang.org/x/text v0.37.0 // indirect
 	google.golang.org/protobuf v1.36.10 // indirect
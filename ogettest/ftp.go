@@ -0,0 +1,540 @@
+package ogettest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FtpServer is a minimal in-process FTP server for tests. It serves files
+// from memory over passive data connections (EPSV and PASV), supports REST,
+// ABOR during RETR, SIZE, MDTM, MLST, a Unix-style LIST and explicit or
+// implicit FTPS, and counts the logins, transfers and aborts it sees.
+type FtpServer struct {
+	Listen      string         // address to listen on; "127.0.0.1:0" if empty
+	User        string         // required user name; any login is accepted if empty
+	Password    string         // required password with User
+	MaxConns    int            // control connections beyond this are refused with 421; 0 for no limit
+	DisableEPSV bool           // answer EPSV with 502, so clients fall back to PASV
+	DisableSIZE bool           // answer SIZE with 502, like servers predating RFC 3659
+	DisableMLST bool           // answer MLST with 502
+	ModTime     time.Time      // reported by MDTM
+	BytesPerSec int64          // per-transfer speed limit; 0 for none
+	TLS         *tls.Config    // server TLS configuration, set by StartTLS
+	RootCAs     *x509.CertPool // trusts the certificate in TLS, set by StartTLS
+
+	Addr string // host:port the server listens on, set by Start
+	URL  string // ftp://, ftpes:// (explicit TLS) or ftps:// (implicit TLS) base URL
+
+	Logins    atomic.Int64 // successful PASS commands
+	Transfers atomic.Int64 // RETR commands that started a transfer
+	Aborts    atomic.Int64 // transfers ended by ABOR
+	PeakConns atomic.Int64 // most control connections open at once
+
+	ln     net.Listener
+	mu     sync.Mutex
+	files  map[string][]byte
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+	closed atomic.Bool
+}
+
+// NewUnstartedFtpServer returns a server for files, keyed by absolute path
+// such as "/pub/file.bin". Set its fields, then call Start or StartTLS.
+func NewUnstartedFtpServer(files map[string][]byte) *FtpServer {
+	s := &FtpServer{
+		files:   make(map[string][]byte),
+		conns:   make(map[net.Conn]struct{}),
+		ModTime: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	for name, data := range files {
+		s.files[name] = data
+	}
+	return s
+}
+
+// NewFtpServer starts a plain FTP server for files.
+func NewFtpServer(files map[string][]byte) *FtpServer {
+	s := NewUnstartedFtpServer(files)
+	s.Start()
+	return s
+}
+
+// SetFile adds or replaces a served file.
+func (s *FtpServer) SetFile(name string, data []byte) {
+	s.mu.Lock()
+	s.files[name] = data
+	s.mu.Unlock()
+}
+
+// Start serves plain FTP.
+func (s *FtpServer) Start() {
+	s.start("ftp", false)
+}
+
+// StartTLS serves FTPS with a self-signed certificate, trusted by RootCAs:
+// implicit TLS from the first byte, or explicit TLS after AUTH TLS.
+func (s *FtpServer) StartTLS(implicit bool) {
+	cert, pool, err := selfSignedCert()
+	if err != nil {
+		panic(fmt.Sprintf("ogettest: %v", err))
+	}
+	s.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s.RootCAs = pool
+	if implicit {
+		s.start("ftps", true)
+	} else {
+		s.start("ftpes", false)
+	}
+}
+
+func (s *FtpServer) start(scheme string, implicit bool) {
+	addr := s.Listen
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(fmt.Sprintf("ogettest: failed to listen on %s: %v", addr, err))
+	}
+	s.ln = ln
+	s.Addr = ln.Addr().String()
+	s.URL = scheme + "://" + s.Addr
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if implicit {
+				conn = tls.Server(conn, s.TLS)
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(conn)
+			}()
+		}
+	}()
+}
+
+// Close stops the server and drops every connection.
+func (s *FtpServer) Close() {
+	if s.closed.Swap(true) {
+		return
+	}
+	s.ln.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// ftpSession is one control connection.
+type ftpSession struct {
+	s        *FtpServer
+	conn     net.Conn
+	r        *bufio.Reader
+	writeMu  sync.Mutex
+	user     string
+	loggedIn bool
+	protData bool         // PROT P: data connections use TLS
+	pasv     net.Listener // listener of the pending passive data connection
+	rest     int64
+
+	xferMu sync.Mutex
+	xfer   *ftpTransfer // the RETR in progress
+}
+
+type ftpTransfer struct {
+	data    net.Conn
+	aborted atomic.Bool
+	done    chan struct{}
+}
+
+func (s *FtpServer) serve(conn net.Conn) {
+	s.mu.Lock()
+	if s.MaxConns > 0 && len(s.conns) >= s.MaxConns {
+		s.mu.Unlock()
+		io.WriteString(conn, "421 Too many connections\r\n")
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	if n := int64(len(s.conns)); n > s.PeakConns.Load() {
+		s.PeakConns.Store(n)
+	}
+	s.mu.Unlock()
+
+	sess := &ftpSession{s: s, conn: conn, r: bufio.NewReader(conn)}
+	defer func() {
+		sess.endTransfer(true)
+		if sess.pasv != nil {
+			sess.pasv.Close()
+		}
+		sess.conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	sess.reply(220, "oget test server ready")
+	for {
+		line, err := sess.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		if !sess.handle(strings.ToUpper(cmd), arg) {
+			return
+		}
+	}
+}
+
+func (sess *ftpSession) reply(code int, msg string) {
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	fmt.Fprintf(sess.conn, "%d %s\r\n", code, msg)
+}
+
+// handle runs one command and reports whether the session goes on.
+func (sess *ftpSession) handle(cmd, arg string) bool {
+	s := sess.s
+	switch cmd {
+	case "AUTH":
+		if s.TLS == nil || !strings.EqualFold(arg, "TLS") {
+			sess.reply(502, "TLS not available")
+			return true
+		}
+		sess.reply(234, "AUTH TLS successful")
+		tlsConn := tls.Server(sess.conn, s.TLS)
+		s.mu.Lock()
+		delete(s.conns, sess.conn)
+		s.conns[tlsConn] = struct{}{}
+		s.mu.Unlock()
+		sess.conn = tlsConn
+		sess.r = bufio.NewReader(tlsConn)
+		return true
+	case "USER":
+		sess.user = arg
+		sess.reply(331, "Password required")
+		return true
+	case "PASS":
+		if s.User != "" && (sess.user != s.User || arg != s.Password) {
+			sess.reply(530, "Login incorrect")
+			return true
+		}
+		sess.loggedIn = true
+		s.Logins.Add(1)
+		sess.reply(230, "Logged in")
+		return true
+	case "QUIT":
+		sess.reply(221, "Goodbye")
+		return false
+	case "NOOP":
+		sess.reply(200, "NOOP ok")
+		return true
+	case "ABOR":
+		if sess.endTransfer(true) {
+			s.Aborts.Add(1)
+			sess.reply(226, "ABOR successful")
+		} else {
+			sess.reply(225, "No transfer to abort")
+		}
+		return true
+	case "FEAT":
+		sess.writeMu.Lock()
+		feats := " EPSV\r\n MDTM\r\n PASV\r\n REST STREAM\r\n"
+		if !s.DisableSIZE {
+			feats += " SIZE\r\n"
+		}
+		if !s.DisableMLST {
+			feats += " MLST size*;modify*;type*;\r\n"
+		}
+		io.WriteString(sess.conn, "211-Features:\r\n"+feats+"211 End\r\n")
+		sess.writeMu.Unlock()
+		return true
+	}
+	if !sess.loggedIn {
+		sess.reply(530, "Please login with USER and PASS")
+		return true
+	}
+
+	switch cmd {
+	case "PBSZ":
+		sess.reply(200, "PBSZ=0")
+	case "PROT":
+		sess.protData = strings.EqualFold(arg, "P")
+		sess.reply(200, "PROT ok")
+	case "TYPE":
+		sess.reply(200, "Type set")
+	case "SYST":
+		sess.reply(215, "UNIX Type: L8")
+	case "PWD":
+		sess.reply(257, `"/" is the current directory`)
+	case "SIZE":
+		if s.DisableSIZE {
+			sess.reply(502, "SIZE not implemented")
+		} else if data, ok := sess.file(arg); ok {
+			sess.reply(213, strconv.Itoa(len(data)))
+		} else {
+			sess.reply(550, "No such file")
+		}
+	case "MDTM":
+		if _, ok := sess.file(arg); ok {
+			sess.reply(213, s.ModTime.UTC().Format("20060102150405"))
+		} else {
+			sess.reply(550, "No such file")
+		}
+	case "EPSV":
+		if s.DisableEPSV {
+			sess.reply(502, "EPSV not implemented")
+			return true
+		}
+		port, err := sess.listenData()
+		if err != nil {
+			sess.reply(425, "Cannot open data connection")
+			return true
+		}
+		sess.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+	case "PASV":
+		ip := sess.conn.LocalAddr().(*net.TCPAddr).IP.To4()
+		if ip == nil {
+			sess.reply(502, "PASV needs IPv4, use EPSV")
+			return true
+		}
+		port, err := sess.listenData()
+		if err != nil {
+			sess.reply(425, "Cannot open data connection")
+			return true
+		}
+		sess.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+	case "REST":
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || n < 0 {
+			sess.reply(501, "Invalid offset")
+			return true
+		}
+		sess.rest = n
+		sess.reply(350, fmt.Sprintf("Restarting at %d", n))
+	case "MLST":
+		if s.DisableMLST {
+			sess.reply(502, "MLST not implemented")
+		} else if data, ok := sess.file(arg); ok {
+			sess.writeMu.Lock()
+			fmt.Fprintf(sess.conn, "250-Listing %s\r\n type=file;size=%d;modify=%s; %s\r\n250 End\r\n",
+				arg, len(data), s.ModTime.UTC().Format("20060102150405"), arg)
+			sess.writeMu.Unlock()
+		} else {
+			sess.reply(550, "No such file")
+		}
+	case "RETR":
+		sess.retr(arg)
+	case "LIST":
+		sess.list(arg)
+	default:
+		sess.reply(502, "Command not implemented")
+	}
+	return true
+}
+
+func (sess *ftpSession) file(name string) ([]byte, bool) {
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	sess.s.mu.Lock()
+	defer sess.s.mu.Unlock()
+	data, ok := sess.s.files[name]
+	return data, ok
+}
+
+// listenData opens the passive listener on the control connection's address.
+func (sess *ftpSession) listenData() (int, error) {
+	if sess.pasv != nil {
+		sess.pasv.Close()
+	}
+	host := sess.conn.LocalAddr().(*net.TCPAddr).IP.String()
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return 0, err
+	}
+	sess.pasv = ln
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (sess *ftpSession) retr(name string) {
+	offset := sess.rest
+	sess.rest = 0
+	ln := sess.pasv
+	sess.pasv = nil
+	if ln == nil {
+		sess.reply(425, "Use EPSV or PASV first")
+		return
+	}
+	data, ok := sess.file(name)
+	if !ok {
+		ln.Close()
+		sess.reply(550, "No such file")
+		return
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	sess.reply(150, "Opening BINARY mode data connection")
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
+	conn, err := ln.Accept()
+	ln.Close()
+	if err != nil {
+		sess.reply(425, "Data connection not opened")
+		return
+	}
+	if sess.protData {
+		conn = tls.Server(conn, sess.s.TLS)
+	}
+	sess.s.Transfers.Add(1)
+
+	x := &ftpTransfer{data: conn, done: make(chan struct{})}
+	sess.xferMu.Lock()
+	sess.xfer = x
+	sess.xferMu.Unlock()
+	go func() {
+		defer close(x.done)
+		err := sess.send(conn, data[offset:])
+		conn.Close()
+		switch {
+		case x.aborted.Load() || err != nil:
+			sess.reply(426, "Connection closed; transfer aborted")
+		default:
+			sess.reply(226, "Transfer complete")
+		}
+		sess.xferMu.Lock()
+		if sess.xfer == x {
+			sess.xfer = nil
+		}
+		sess.xferMu.Unlock()
+	}()
+}
+
+// list sends an "ls -l" style listing of the files directly in dir.
+func (sess *ftpSession) list(dir string) {
+	ln := sess.pasv
+	sess.pasv = nil
+	if ln == nil {
+		sess.reply(425, "Use EPSV or PASV first")
+		return
+	}
+	defer ln.Close()
+	if dir = strings.TrimSuffix(dir, "/") + "/"; !strings.HasPrefix(dir, "/") {
+		dir = "/" + dir
+	}
+	var listing strings.Builder
+	stamp := sess.s.ModTime.UTC().Format("Jan 02 15:04")
+	sess.s.mu.Lock()
+	for name, data := range sess.s.files {
+		if rest, ok := strings.CutPrefix(name, dir); ok && !strings.Contains(rest, "/") {
+			fmt.Fprintf(&listing, "-rw-r--r--   1 ftp      ftp      %10d %s %s\r\n", len(data), stamp, rest)
+		}
+	}
+	sess.s.mu.Unlock()
+
+	sess.reply(150, "Here comes the directory listing")
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
+	conn, err := ln.Accept()
+	if err != nil {
+		sess.reply(425, "Data connection not opened")
+		return
+	}
+	if sess.protData {
+		conn = tls.Server(conn, sess.s.TLS)
+	}
+	_, err = io.WriteString(conn, listing.String())
+	conn.Close()
+	if err != nil {
+		sess.reply(426, "Connection closed; transfer aborted")
+		return
+	}
+	sess.reply(226, "Directory send OK")
+}
+
+func (sess *ftpSession) send(w io.Writer, data []byte) error {
+	const piece = 32 * 1024
+	for len(data) > 0 {
+		n := min(piece, len(data))
+		start := time.Now()
+		if _, err := w.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+		if bps := sess.s.BytesPerSec; bps > 0 {
+			time.Sleep(time.Duration(n)*time.Second/time.Duration(bps) - time.Since(start))
+		}
+	}
+	return nil
+}
+
+// endTransfer stops the transfer in progress, if any, and waits for its
+// final reply. It reports whether there was one.
+func (sess *ftpSession) endTransfer(abort bool) bool {
+	sess.xferMu.Lock()
+	x := sess.xfer
+	sess.xferMu.Unlock()
+	if x == nil {
+		return false
+	}
+	if abort {
+		x.aborted.Store(true)
+		x.data.Close()
+	}
+	<-x.done
+	return true
+}
+
+// selfSignedCert makes a certificate for the loopback addresses.
+func selfSignedCert() (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "oget test server"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool, nil
+}
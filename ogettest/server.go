@@ -90,12 +90,14 @@ type EnhancedServer struct {
 	BytesPerSec int64
 	Latency     time.Duration
 	ETag        string
+	ModTime     time.Time // sent as Last-Modified
 }
 
 func NewEnhancedServer(content *DummyContent) *EnhancedServer {
 	s := &EnhancedServer{
 		Content: content,
 		ETag:    "initial-etag",
+		ModTime: time.Now(),
 	}
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -121,7 +123,7 @@ func NewEnhancedServer(content *DummyContent) *EnhancedServer {
 
 		// Important: Create a fresh reader for each request to avoid seek conflicts
 		reader := &DummyContent{Size: s.Content.Size}
-		http.ServeContent(fakeResponseWriter{w, writer}, r, "testfile.bin", time.Now(), reader)
+		http.ServeContent(fakeResponseWriter{w, writer}, r, "testfile.bin", s.ModTime, reader)
 	})
 
 	s.Server = httptest.NewServer(handler)
@@ -163,8 +165,9 @@ func NewLargeRangeServer(sizeMB int) *EnhancedServer {
 }
 
 func NewSimpleRangeServer() *httptest.Server {
+	modTime := time.Now()
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeContent(w, r, "", time.Now(), &DummyContent{Size: int64(len(DefaultWebContent))})
+		http.ServeContent(w, r, "", modTime, &DummyContent{Size: int64(len(DefaultWebContent))})
 	}))
 }
 
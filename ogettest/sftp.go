@@ -0,0 +1,296 @@
+package ogettest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SftpServer is a minimal in-process SSH server for tests. It serves files
+// from memory over SFTP, read-only, to logins with one of AuthorizedKeys or
+// with Password, and counts the logins and SFTP sessions it sees.
+type SftpServer struct {
+	Listen         string          // address to listen on; "127.0.0.1:0" if empty
+	User           string          // required user name; any is accepted if empty
+	Password       string          // accepted as well as AuthorizedKeys if set
+	AuthorizedKeys []ssh.PublicKey // public keys accepted for logins
+	MaxSessions    int             // session channels per connection beyond this are refused, like OpenSSH's MaxSessions; 0 for no limit
+	ModTime        time.Time       // modification time of every file
+	HostKey        ssh.Signer      // generated by NewUnstartedSftpServer
+
+	Addr string // host:port the server listens on, set by Start
+	URL  string // sftp:// base URL
+
+	Logins       atomic.Int64 // successful SSH logins
+	Sessions     atomic.Int64 // SFTP sessions started
+	PeakSessions atomic.Int64 // most SFTP sessions open at once on one connection
+	Opens        atomic.Int64 // files opened for reading
+
+	ln     net.Listener
+	mu     sync.Mutex
+	files  map[string][]byte
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+	closed atomic.Bool
+}
+
+// NewUnstartedSftpServer returns a server for files, keyed by absolute
+// path such as "/pub/file.bin", with a new host key. Set its fields, then
+// call Start.
+func NewUnstartedSftpServer(files map[string][]byte) *SftpServer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("ogettest: %v", err))
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		panic(fmt.Sprintf("ogettest: %v", err))
+	}
+	s := &SftpServer{
+		files:   make(map[string][]byte),
+		conns:   make(map[net.Conn]struct{}),
+		ModTime: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		HostKey: signer,
+	}
+	for name, data := range files {
+		s.files[name] = data
+	}
+	return s
+}
+
+// NewSftpServer starts a server for files accepting the given keys.
+func NewSftpServer(files map[string][]byte, keys ...ssh.PublicKey) *SftpServer {
+	s := NewUnstartedSftpServer(files)
+	s.AuthorizedKeys = keys
+	s.Start()
+	return s
+}
+
+// KnownHostsLine returns the known_hosts line for the server's host key.
+func (s *SftpServer) KnownHostsLine() string {
+	return knownhosts.Line([]string{knownhosts.Normalize(s.Addr)}, s.HostKey.PublicKey())
+}
+
+// Start listens and serves.
+func (s *SftpServer) Start() {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if s.User != "" && meta.User() != s.User {
+				return nil, errors.New("unknown user")
+			}
+			for _, k := range s.AuthorizedKeys {
+				if bytes.Equal(k.Marshal(), key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, errors.New("key not authorized")
+		},
+	}
+	if s.Password != "" {
+		config.PasswordCallback = func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if (s.User == "" || meta.User() == s.User) && string(password) == s.Password {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		}
+	}
+	config.AddHostKey(s.HostKey)
+
+	addr := s.Listen
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(fmt.Sprintf("ogettest: failed to listen on %s: %v", addr, err))
+	}
+	s.ln = ln
+	s.Addr = ln.Addr().String()
+	s.URL = "sftp://" + s.Addr
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns[conn] = struct{}{}
+			s.mu.Unlock()
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(conn, config)
+				conn.Close()
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+			}()
+		}
+	}()
+}
+
+// Close stops the server and drops every connection.
+func (s *SftpServer) Close() {
+	if s.closed.Swap(true) {
+		return
+	}
+	s.ln.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *SftpServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	s.Logins.Add(1)
+	go ssh.DiscardRequests(reqs)
+
+	var open atomic.Int64
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		if s.MaxSessions > 0 && open.Load() >= int64(s.MaxSessions) {
+			nc.Reject(ssh.Prohibited, "too many sessions")
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		n := open.Add(1)
+		for {
+			peak := s.PeakSessions.Load()
+			if n <= peak || s.PeakSessions.CompareAndSwap(peak, n) {
+				break
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer open.Add(-1)
+			defer ch.Close()
+			s.session(ch, chReqs)
+		}()
+	}
+}
+
+// session serves the sftp subsystem on a session channel.
+func (s *SftpServer) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		// The payload is the subsystem name as an SSH string.
+		if req.Type != "subsystem" || len(req.Payload) < 4 || string(req.Payload[4:]) != "sftp" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		go ssh.DiscardRequests(reqs)
+		s.Sessions.Add(1)
+		fsys := &sftpFS{s: s}
+		server := sftp.NewRequestServer(ch, sftp.Handlers{FileGet: fsys, FilePut: fsys, FileCmd: fsys, FileList: fsys})
+		server.Serve()
+		server.Close()
+		return
+	}
+}
+
+// sftpFS serves the files of an SftpServer to the request server.
+type sftpFS struct {
+	s *SftpServer
+}
+
+func (fsys *sftpFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	fsys.s.mu.Lock()
+	data, ok := fsys.s.files[r.Filepath]
+	fsys.s.mu.Unlock()
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	fsys.s.Opens.Add(1)
+	return bytes.NewReader(data), nil
+}
+
+func (fsys *sftpFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return nil, os.ErrPermission
+}
+
+func (fsys *sftpFS) Filecmd(r *sftp.Request) error {
+	return os.ErrPermission
+}
+
+func (fsys *sftpFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	if r.Method != "Stat" && r.Method != "Lstat" {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	fsys.s.mu.Lock()
+	defer fsys.s.mu.Unlock()
+	if data, ok := fsys.s.files[r.Filepath]; ok {
+		return sftpLister{sftpFileInfo{name: path.Base(r.Filepath), size: int64(len(data)), modTime: fsys.s.ModTime}}, nil
+	}
+	dir := strings.TrimSuffix(r.Filepath, "/") + "/"
+	for name := range fsys.s.files {
+		if strings.HasPrefix(name, dir) {
+			return sftpLister{sftpFileInfo{name: path.Base(r.Filepath), mode: fs.ModeDir | 0755, modTime: fsys.s.ModTime}}, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+type sftpLister []os.FileInfo
+
+func (l sftpLister) ListAt(f []os.FileInfo, off int64) (int, error) {
+	if off >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(f, l[off:])
+	if n < len(f) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+type sftpFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi sftpFileInfo) Name() string { return fi.name }
+func (fi sftpFileInfo) Size() int64  { return fi.size }
+func (fi sftpFileInfo) Mode() fs.FileMode {
+	if fi.mode == 0 {
+		return 0644
+	}
+	return fi.mode
+}
+func (fi sftpFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi sftpFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi sftpFileInfo) Sys() any           { return nil }
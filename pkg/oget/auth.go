@@ -0,0 +1,496 @@
+package oget
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+HTTP authentication.
+
+Credentials are looked up per request host, in this order: the user info of
+the URL, Config.Credentials (by host:port, then host name), then the netrc
+file. Bearer tokens go out on every request. A user name and password are
+answered to the server's challenge: Digest if it offers it, Basic otherwise.
+Over https, Basic is sent up front until the host is known to want Digest;
+over plain http the password waits for a challenge. Challenges are kept per
+host for the life of the process, so after the probe every chunk request is
+authorized on the first try.
+
+Only the origin (scheme, host and port) of the URL the client asked for gets
+credentials up front. A request redirected to another origin gets none until
+its server asks, and then only those configured for its own host: the netrc
+default entry answers the original origin only. Nothing is sent over plain
+http after a redirect from https, and authorization headers set by the caller
+(Config.Headers, URL user info) are dropped on a redirect to another origin.
+*/
+
+// Credential authenticates requests to one host.
+type Credential struct {
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	Token    string `mapstructure:"token"`     // sent as "Authorization: Bearer <token>"
+	TokenEnv string `mapstructure:"token_env"` // environment variable holding the token, read when used
+}
+
+// httpAuthChallenges holds the last challenge of each host, shared by the
+// probers and fetchers of all downloads.
+var httpAuthChallenges sync.Map // host -> *authChallenge
+
+// authChallenge is a parsed WWW-Authenticate challenge.
+type authChallenge struct {
+	Scheme string            // lower case, e.g. "digest"
+	Params map[string]string // keys in lower case
+	nc     atomic.Uint32     // Digest nonce count
+}
+
+// authTransport adds credentials to the requests of an http.Client.
+type authTransport struct {
+	next   http.RoundTripper
+	config *Config
+
+	netrcOnce sync.Once
+	netrc     []netrcEntry
+}
+
+func newAuthTransport(config *Config, next http.RoundTripper) *authTransport {
+	return &authTransport{next: next, config: config}
+}
+
+// checkRedirect follows up to 10 redirects, like http.Client does by
+// default, and drops any Authorization header copied to another origin.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if !sameOrigin(req.URL, via[0].URL) {
+		req.Header.Del("Authorization")
+	}
+	return nil
+}
+
+// originalURL returns the URL the client was asked for before any redirect
+// led to req.
+func originalURL(req *http.Request) *url.URL {
+	for req.Response != nil && req.Response.Request != nil {
+		req = req.Response.Request
+	}
+	return req.URL
+}
+
+// sameOrigin reports whether a and b have the same scheme, host and port.
+func sameOrigin(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) && strings.EqualFold(a.Hostname(), b.Hostname()) && urlPort(a) == urlPort(b)
+}
+
+func urlPort(u *url.URL) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	if strings.EqualFold(u.Scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
+
+// credential returns the credential for req, or nil, and whether it may be
+// sent before the server asks for it: only to the original origin.
+func (t *authTransport) credential(req *http.Request) (c *Credential, preemptive bool) {
+	u, origin := req.URL, originalURL(req)
+	if !strings.EqualFold(u.Scheme, "https") && strings.EqualFold(origin.Scheme, "https") {
+		return nil, false // never in the clear after a redirect from https
+	}
+	preemptive = sameOrigin(u, origin)
+	if u.User != nil {
+		password, _ := u.User.Password()
+		return &Credential{Username: u.User.Username(), Password: password}, preemptive
+	}
+	host := strings.ToLower(u.Host)
+	if t.config != nil {
+		for _, key := range []string{host, strings.ToLower(u.Hostname())} {
+			if c, ok := t.config.Credentials[key]; ok {
+				return &c, preemptive
+			}
+		}
+	}
+	t.netrcOnce.Do(t.loadNetrc)
+	e := lookupNetrc(t.netrc, u.Hostname())
+	if e == nil {
+		return nil, false
+	}
+	c = &Credential{Username: e.Login, Password: e.Password}
+	if e.Machine == "" {
+		// The default entry would go to any host, so it only answers the
+		// original origin, and only once that host has challenged.
+		if !preemptive {
+			return nil, false
+		}
+		_, challenged := httpAuthChallenges.Load(host)
+		return c, challenged
+	}
+	return c, preemptive
+}
+
+func (c *Credential) token() string {
+	if c.Token != "" {
+		return c.Token
+	}
+	if c.TokenEnv != "" {
+		return os.Getenv(c.TokenEnv)
+	}
+	return ""
+}
+
+// loadNetrc reads Config.NetrcFile, $NETRC or ~/.netrc.
+func (t *authTransport) loadNetrc() {
+	file := ""
+	if t.config != nil {
+		file = t.config.NetrcFile
+	}
+	if file == "" {
+		file = os.Getenv("NETRC")
+	}
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return
+		}
+		file = filepath.Join(home, ".netrc")
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: failed to read %s: %v", file, err)
+		}
+		return
+	}
+	t.netrc = parseNetrc(data)
+}
+
+// authorization returns the Authorization header for req and the challenge
+// it answers, if any, or "" to send the request without and wait for one.
+func (t *authTransport) authorization(req *http.Request, c *Credential) (string, *authChallenge) {
+	if token := c.token(); token != "" {
+		return "Bearer " + token, nil
+	}
+	if c.Username == "" {
+		return "", nil
+	}
+	if v, ok := httpAuthChallenges.Load(strings.ToLower(req.URL.Host)); ok {
+		ch := v.(*authChallenge)
+		return ch.authorization(req, c), ch
+	}
+	if req.URL.Scheme == "https" {
+		return basicAuthorization(c.Username, c.Password), nil
+	}
+	return "", nil
+}
+
+// authorization answers the challenge for req, or returns "" if it cannot.
+func (ch *authChallenge) authorization(req *http.Request, c *Credential) string {
+	if ch.Scheme == "digest" {
+		return ch.digestAuthorization(req.Method, req.URL.RequestURI(), c.Username, c.Password, newCnonce())
+	}
+	return basicAuthorization(c.Username, c.Password)
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c, preemptive := t.credential(req)
+	if c == nil {
+		return t.next.RoundTrip(req)
+	}
+	// Headers set by the caller, e.g. an S3 signature, take precedence, but
+	// not the Basic header http.Client makes of the URL's user info.
+	callerAuth := req.Header.Get("Authorization")
+	if req.URL.User != nil && callerAuth == basicAuthorization(c.Username, c.Password) {
+		callerAuth = ""
+	}
+	out := req
+	var answered *authChallenge
+	if callerAuth == "" && preemptive {
+		var auth string
+		if auth, answered = t.authorization(req, c); auth != "" {
+			out = req.Clone(req.Context())
+			out.Header.Set("Authorization", auth)
+		}
+	}
+	resp, err := t.next.RoundTrip(out)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || c.Username == "" || req.Body != nil && req.GetBody == nil {
+		return resp, err
+	}
+
+	// Answer the challenge, and once more if a Digest nonce was stale.
+	for retry := 0; retry < 2; retry++ {
+		ch := pickChallenge(resp.Header.Values("WWW-Authenticate"))
+		if ch == nil {
+			return resp, nil
+		}
+		// Refused an answer to this very challenge: the credentials are wrong.
+		if answered != nil && answered.Scheme == ch.Scheme && answered.Params["nonce"] == ch.Params["nonce"] && !strings.EqualFold(ch.Params["stale"], "true") {
+			return resp, nil
+		}
+		auth := ch.authorization(req, c)
+		if auth == "" {
+			return resp, nil // an algorithm or qop we cannot answer
+		}
+		httpAuthChallenges.Store(strings.ToLower(req.URL.Host), ch)
+		answered = ch
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+
+		out = req.Clone(req.Context())
+		if req.GetBody != nil {
+			if out.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		out.Header.Set("Authorization", auth)
+		if resp, err = t.next.RoundTrip(out); err != nil || resp.StatusCode != http.StatusUnauthorized {
+			return resp, err
+		}
+	}
+	return resp, nil
+}
+
+func basicAuthorization(username, password string) string {
+	req := http.Request{Header: http.Header{}}
+	req.SetBasicAuth(username, password)
+	return req.Header.Get("Authorization")
+}
+
+func newCnonce() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseChallenges parses WWW-Authenticate values, each of which may hold
+// several challenges: `Digest realm="x", nonce="y", Basic realm="x"`.
+func parseChallenges(values []string) []*authChallenge {
+	var challenges []*authChallenge
+	for _, s := range values {
+		var cur *authChallenge
+		for {
+			s = strings.TrimLeft(s, " \t,")
+			if s == "" {
+				break
+			}
+			end := strings.IndexAny(s, " \t,=")
+			if end < 0 {
+				end = len(s)
+			}
+			token := s[:end]
+			rest := strings.TrimLeft(s[end:], " \t")
+			if cur != nil && strings.HasPrefix(rest, "=") {
+				value, remaining := parseAuthParamValue(strings.TrimLeft(rest[1:], " \t"))
+				cur.Params[strings.ToLower(token)] = value
+				s = remaining
+				continue
+			}
+			cur = &authChallenge{Scheme: strings.ToLower(token), Params: map[string]string{}}
+			challenges = append(challenges, cur)
+			s = rest
+		}
+	}
+	return challenges
+}
+
+// parseAuthParamValue reads a token or quoted string and returns it with
+// the rest of s.
+func parseAuthParamValue(s string) (value, rest string) {
+	if !strings.HasPrefix(s, `"`) {
+		end := strings.IndexAny(s, " \t,")
+		if end < 0 {
+			return s, ""
+		}
+		return s[:end], s[end:]
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), s[i+1:]
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), ""
+}
+
+// pickChallenge returns the Digest challenge if there is one we can
+// answer, else the Basic one.
+func pickChallenge(values []string) *authChallenge {
+	var basic *authChallenge
+	for _, ch := range parseChallenges(values) {
+		switch ch.Scheme {
+		case "digest":
+			if digestHash(ch.Params["algorithm"]) != nil && ch.Params["nonce"] != "" {
+				return ch
+			}
+		case "basic":
+			basic = ch
+		}
+	}
+	return basic
+}
+
+// digestHash returns the hash of a Digest algorithm, or nil if unsupported.
+func digestHash(algorithm string) func() hash.Hash {
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(algorithm), "-sess")) {
+	case "", "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+// digestAuthorization answers a Digest challenge (RFC 7616) for a request,
+// or returns "" if the challenge cannot be answered.
+func (ch *authChallenge) digestAuthorization(method, uri, username, password, cnonce string) string {
+	algorithm := ch.Params["algorithm"]
+	newHash := digestHash(algorithm)
+	if newHash == nil {
+		return ""
+	}
+	h := func(s string) string {
+		d := newHash()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	realm, nonce := ch.Params["realm"], ch.Params["nonce"]
+
+	qop := ""
+	if offered := ch.Params["qop"]; offered != "" {
+		for _, q := range strings.Split(offered, ",") {
+			if strings.TrimSpace(q) == "auth" {
+				qop = "auth"
+			}
+		}
+		if qop == "" {
+			return "" // auth-int only
+		}
+	}
+
+	ha1 := h(username + ":" + realm + ":" + password)
+	if strings.HasSuffix(strings.ToLower(algorithm), "-sess") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `Digest username="%s", realm="%s", nonce="%s", uri="%s"`, digestQuote(username), digestQuote(realm), digestQuote(nonce), digestQuote(uri))
+	if algorithm != "" {
+		fmt.Fprintf(&b, ", algorithm=%s", algorithm)
+	}
+	if qop != "" {
+		nc := fmt.Sprintf("%08x", ch.nc.Add(1))
+		fmt.Fprintf(&b, `, response="%s", qop=%s, nc=%s, cnonce="%s"`, h(ha1+":"+nonce+":"+nc+":"+cnonce+":"+qop+":"+ha2), qop, nc, cnonce)
+	} else {
+		fmt.Fprintf(&b, `, response="%s"`, h(ha1+":"+nonce+":"+ha2))
+	}
+	if opaque, ok := ch.Params["opaque"]; ok {
+		fmt.Fprintf(&b, `, opaque="%s"`, digestQuote(opaque))
+	}
+	return b.String()
+}
+
+func digestQuote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// netrcEntry is a machine, or the default, of a netrc file.
+type netrcEntry struct {
+	Machine  string // "" for default
+	Login    string
+	Password string
+}
+
+// parseNetrc parses the machine, default, login and password tokens of a
+// netrc file, skipping macro definitions.
+func parseNetrc(data []byte) []netrcEntry {
+	var entries []netrcEntry
+	var cur *netrcEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	inMacro := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			// A macro ends at an empty line.
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			if strings.HasPrefix(fields[i], "#") {
+				break
+			}
+			next := func() string {
+				if i+1 < len(fields) {
+					i++
+					return fields[i]
+				}
+				return ""
+			}
+			switch fields[i] {
+			case "machine":
+				entries = append(entries, netrcEntry{Machine: next()})
+				cur = &entries[len(entries)-1]
+			case "default":
+				entries = append(entries, netrcEntry{})
+				cur = &entries[len(entries)-1]
+			case "login":
+				if v := next(); cur != nil {
+					cur.Login = v
+				}
+			case "password":
+				if v := next(); cur != nil {
+					cur.Password = v
+				}
+			case "account":
+				next()
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	return entries
+}
+
+// lookupNetrc returns the entry for host, the default entry, or nil.
+func lookupNetrc(entries []netrcEntry, host string) *netrcEntry {
+	var def *netrcEntry
+	for i := range entries {
+		e := &entries[i]
+		if e.Machine == "" {
+			if def == nil {
+				def = e
+			}
+		} else if strings.EqualFold(e.Machine, host) {
+			return e
+		}
+	}
+	return def
+}
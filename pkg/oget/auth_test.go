@@ -0,0 +1,305 @@
+package oget
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseNetrc(t *testing.T) {
+	entries := parseNetrc([]byte(`# comment
+machine artifactory.example.com login ci password s3cret
+macdef init
+  cd /pub
+  machine evil.example.com login x password y
+
+machine nexus.example.com
+  login deploy
+  account ignored
+  password "p@ss"
+default login anonymous password me@example.com
+`))
+	if len(entries) != 3 {
+		t.Fatalf("parsed %d entries, want 3: %+v", len(entries), entries)
+	}
+	if e := lookupNetrc(entries, "ARTIFACTORY.example.com"); e == nil || e.Login != "ci" || e.Password != "s3cret" {
+		t.Errorf("artifactory entry = %+v", e)
+	}
+	if e := lookupNetrc(entries, "nexus.example.com"); e == nil || e.Login != "deploy" || e.Password != `"p@ss"` {
+		t.Errorf("nexus entry = %+v", e)
+	}
+	if e := lookupNetrc(entries, "evil.example.com"); e == nil || e.Login != "anonymous" {
+		t.Errorf("a machine inside macdef was parsed: %+v", e)
+	}
+	if e := lookupNetrc(entries[:2], "other.example.com"); e != nil {
+		t.Errorf("no default, got %+v", e)
+	}
+}
+
+func TestParseChallenges(t *testing.T) {
+	chs := parseChallenges([]string{
+		`Digest realm="api, v2", qop="auth,auth-int", nonce="abc\"def", algorithm=SHA-256, Basic realm="api"`,
+		`Bearer`,
+	})
+	if len(chs) != 3 {
+		t.Fatalf("parsed %d challenges, want 3: %+v", len(chs), chs)
+	}
+	if d := chs[0]; d.Scheme != "digest" || d.Params["realm"] != "api, v2" || d.Params["nonce"] != `abc"def` || d.Params["algorithm"] != "SHA-256" || d.Params["qop"] != "auth,auth-int" {
+		t.Errorf("digest challenge = %+v", d)
+	}
+	if chs[1].Scheme != "basic" || chs[1].Params["realm"] != "api" || chs[2].Scheme != "bearer" {
+		t.Errorf("challenges = %+v %+v", chs[1], chs[2])
+	}
+	if ch := pickChallenge([]string{`Basic realm="x"`, `Digest realm="x", nonce="n"`}); ch == nil || ch.Scheme != "digest" {
+		t.Errorf("pickChallenge preferred %+v over Digest", ch)
+	}
+	if ch := pickChallenge([]string{`Digest realm="x", nonce="n", algorithm=SHA-512-256`, `Basic realm="x"`}); ch == nil || ch.Scheme != "basic" {
+		t.Errorf("pickChallenge took an unsupported Digest algorithm: %+v", ch)
+	}
+}
+
+func TestDigestAuthorization(t *testing.T) {
+	// The example of RFC 2617, section 3.5.
+	ch := parseChallenges([]string{`Digest realm="testrealm@host.com", qop="auth,auth-int", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`})[0]
+	got := ch.digestAuthorization("GET", "/dir/index.html", "Mufasa", "Circle Of Life", "0a4f113b")
+	want := `Digest username="Mufasa", realm="testrealm@host.com", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", uri="/dir/index.html", ` +
+		`response="6629fae49393a05397450978507c4ef1", qop=auth, nc=00000001, cnonce="0a4f113b", opaque="5ccc069c403ebaf9f0171e9517f40e41"`
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+	// The nonce count goes up with every request.
+	if got := ch.digestAuthorization("GET", "/dir/index.html", "Mufasa", "Circle Of Life", "0a4f113b"); !strings.Contains(got, "nc=00000002") {
+		t.Errorf("second request: %s", got)
+	}
+	if ch := parseChallenges([]string{`Digest realm="r", nonce="n", qop="auth-int"`})[0]; ch.digestAuthorization("GET", "/", "u", "p", "c") != "" {
+		t.Error("answered an auth-int only challenge")
+	}
+}
+
+// redirected returns a request for to, redirected from a request for from.
+func redirected(t *testing.T, from, to string) *http.Request {
+	t.Helper()
+	first, err := http.NewRequest(http.MethodGet, from, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, to, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Response = &http.Response{Request: first}
+	return req
+}
+
+func TestAuthCredentialScope(t *testing.T) {
+	tr := newAuthTransport(&Config{Credentials: map[string]Credential{
+		"repo.example.com": {Username: "ci", Password: "s3cret"},
+	}}, nil)
+	tr.netrcOnce.Do(func() {})
+	tr.netrc = parseNetrc([]byte("machine mirror.example.com login m password mp\ndefault login anonymous password me@example.com\n"))
+
+	tests := []struct {
+		name       string
+		req        *http.Request
+		user       string
+		preemptive bool
+	}{
+		{"original origin", redirected(t, "https://repo.example.com/a", "https://repo.example.com/b"), "ci", true},
+		{"another port", redirected(t, "https://repo.example.com/a", "https://repo.example.com:8443/b"), "ci", false},
+		{"https to http", redirected(t, "https://repo.example.com/a", "http://repo.example.com/b"), "", false},
+		{"netrc machine after a redirect", redirected(t, "https://repo.example.com/a", "https://mirror.example.com/b"), "m", false},
+		{"netrc default after a redirect", redirected(t, "https://repo.example.com/a", "https://cdn.example.com/b"), "", false},
+		{"netrc default before a challenge", redirected(t, "http://other.example.com/a", "http://other.example.com/b"), "anonymous", false},
+	}
+	for _, tt := range tests {
+		c, preemptive := tr.credential(tt.req)
+		user := ""
+		if c != nil {
+			user = c.Username
+		}
+		if user != tt.user || preemptive != tt.preemptive {
+			t.Errorf("%s: credential %q, preemptive %v; want %q, %v", tt.name, user, preemptive, tt.user, tt.preemptive)
+		}
+	}
+}
+
+// digestServer serves content to user:password with Digest authentication
+// and counts the requests it challenged.
+func digestServer(t *testing.T, user, password string, content []byte) (*httptest.Server, *atomic.Int64) {
+	var challenged atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ch := parseChallenges([]string{`Digest realm="oget", qop="auth", nonce="7f1d3", algorithm=SHA-256, opaque="op"`})[0]
+		got := parseChallenges([]string{r.Header.Get("Authorization")})
+		ok := len(got) == 1 && got[0].Scheme == "digest" && got[0].Params["username"] == user && got[0].Params["uri"] == r.URL.RequestURI()
+		if ok {
+			p := got[0].Params
+			nc, _ := strconv.ParseUint(p["nc"], 16, 32)
+			ch.nc.Store(uint32(nc) - 1) // digestAuthorization counts it up again
+			want := parseChallenges([]string{ch.digestAuthorization(r.Method, r.URL.RequestURI(), user, password, p["cnonce"])})[0]
+			ok = p["response"] == want.Params["response"] && p["opaque"] == "op"
+		}
+		if !ok {
+			challenged.Add(1)
+			w.Header().Set("WWW-Authenticate", `Basic realm="oget"`)
+			w.Header().Add("WWW-Authenticate", `Digest realm="oget", qop="auth", nonce="7f1d3", algorithm=SHA-256, opaque="op"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	return server, &challenged
+}
+
+func downloadAuth(t *testing.T, resource string, config func(*Config)) ([]byte, error) {
+	t.Helper()
+	d := NewDownloader([]string{resource}, 4)
+	d.Config.AutoTune = false
+	d.Config.OutputDir = t.TempDir()
+	d.Quiet = true
+	if config != nil {
+		config(d.Config)
+	}
+	results, err := d.Download(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(results[0].File)
+}
+
+func TestHttpAuthDigest(t *testing.T) {
+	content := randomContent(t, 6*RangeSize+99)
+	server, challenged := digestServer(t, "ci", "s3cret", content)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	if err := os.WriteFile(netrc, []byte("machine "+u.Hostname()+" login ci password s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NETRC", netrc)
+	data, err := downloadAuth(t, server.URL+"/file.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Error("downloaded content differs")
+	}
+	// Only the first request of the probe is challenged; the chunks reuse it.
+	if n := challenged.Load(); n != 1 {
+		t.Errorf("%d requests challenged, want 1", n)
+	}
+
+	// The same, with the password in the URL.
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "missing"))
+	u.User = url.UserPassword("ci", "s3cret")
+	if _, err := downloadAuth(t, u.String()+"/file.bin", nil); err != nil {
+		t.Errorf("credentials in the URL: %v", err)
+	}
+
+	// A wrong password fails for good, without looping on the challenge.
+	before := challenged.Load()
+	_, err = downloadAuth(t, server.URL+"/file.bin", func(c *Config) {
+		c.Credentials = map[string]Credential{u.Host: {Username: "ci", Password: "wrong"}}
+	})
+	if err == nil || IsRetryable(err) {
+		t.Errorf("wrong password: %v, want a fatal error", err)
+	}
+	if n := challenged.Load() - before; n > 8 {
+		t.Errorf("wrong password challenged %d times", n)
+	}
+}
+
+func TestHttpAuthNetrcDefault(t *testing.T) {
+	content := randomContent(t, 2*RangeSize)
+	// The file redirects to a CDN that asks for a password: the netrc
+	// default entry, meant for the original host, must not answer it.
+	var cdnAuth atomic.Int64
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			cdnAuth.Add(1)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="cdn"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer cdn.Close()
+	origin := httptest.NewServer(http.RedirectHandler(cdn.URL+"/file.bin", http.StatusFound))
+	defer origin.Close()
+
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	if err := os.WriteFile(netrc, []byte("default login anonymous password me@example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := downloadAuth(t, origin.URL+"/file.bin", func(c *Config) { c.NetrcFile = netrc })
+	if err == nil {
+		t.Error("download succeeded with the netrc default sent to the redirect target")
+	}
+	if n := cdnAuth.Load(); n != 0 {
+		t.Errorf("the redirect target got the netrc default %d times", n)
+	}
+}
+
+func TestHttpAuthBearer(t *testing.T) {
+	content := randomContent(t, 3*RangeSize)
+	// The file is redirected to a CDN on another host, which must never see
+	// the token.
+	var leaked atomic.Int64
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			leaked.Add(1)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer cdn.Close()
+	var unauthorized atomic.Int64
+	repo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok-123" {
+			unauthorized.Add(1)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/redirect.bin" {
+			http.Redirect(w, r, cdn.URL+"/file.bin", http.StatusFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer repo.Close()
+	repoURL, _ := url.Parse(repo.URL)
+
+	t.Setenv("OGET_TEST_TOKEN", "tok-123")
+	withToken := func(c *Config) {
+		c.Credentials = map[string]Credential{repoURL.Host: {TokenEnv: "OGET_TEST_TOKEN"}}
+	}
+	data, err := downloadAuth(t, repo.URL+"/file.bin", withToken)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("download with a token: %v", err)
+	}
+	if n := unauthorized.Load(); n != 0 {
+		t.Errorf("%d requests without the token", n)
+	}
+
+	if _, err := downloadAuth(t, repo.URL+"/redirect.bin", withToken); err != nil {
+		t.Fatal(err)
+	}
+	// An Authorization header of Config.Headers is not forwarded either.
+	_, err = downloadAuth(t, repo.URL+"/redirect.bin", func(c *Config) {
+		c.Headers = map[string]string{"Authorization": "Bearer tok-123"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := leaked.Load(); n != 0 {
+		t.Errorf("%d requests to the redirect target carried credentials", n)
+	}
+}
@@ -0,0 +1,487 @@
+package oget
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+/*
+Cluster mode lets several oget processes, typically on hosts sharing storage,
+download one file together into the same output path. They coordinate
+through a ClusterStore holding, per download:
+
+  - the DownloadState header, so every process resumes the same download,
+  - the completion bitset, shared by all processes,
+  - a lease per chunk being downloaded: owner and expiry.
+
+Before fetching a chunk a worker leases it. A chunk leased by another
+process is checked again later: by then it is either complete, and counted
+as done here too, or its lease has expired because that process died, and
+it is taken over. Leases are renewed while the chunk downloads. A process is
+done when every chunk is complete cluster-wide.
+
+Lease expiry compares wall clocks across hosts, so they should be roughly in
+sync; Config.LeaseTTL is generous for that reason.
+*/
+
+// leaseRecheckInterval is how long a chunk leased by another process waits
+// before it is checked again.
+const leaseRecheckInterval = 2 * time.Second
+
+// ErrNoUpdate, returned by the function passed to ClusterStore.Update,
+// leaves the record unchanged; Update then returns nil.
+var ErrNoUpdate = errors.New("no update")
+
+// errLeaseLost means another process took over a chunk while it downloaded.
+var errLeaseLost = errors.New("chunk lease lost to another process")
+
+// ClusterRecord is the shared state of one cluster download.
+type ClusterRecord struct {
+	Meta   []byte             `cbor:"meta"`   // CBOR of the DownloadState header; nil if there is no download
+	Done   []byte             `cbor:"done"`   // completion bitset, one bit per chunk
+	Leases map[int]ChunkLease `cbor:"leases"` // chunks being downloaded
+}
+
+// ChunkLease is a process's claim on a chunk.
+type ChunkLease struct {
+	Owner   string `cbor:"owner"`
+	Expires int64  `cbor:"expires"` // Unix time in milliseconds
+}
+
+func (rec *ClusterRecord) isDone(chunkID int) bool {
+	return chunkID/8 < len(rec.Done) && rec.Done[chunkID/8]&(1<<uint(chunkID%8)) != 0
+}
+
+func (rec *ClusterRecord) setDone(chunkID int, done bool) {
+	for chunkID/8 >= len(rec.Done) {
+		rec.Done = append(rec.Done, 0)
+	}
+	if done {
+		rec.Done[chunkID/8] |= 1 << uint(chunkID%8)
+	} else {
+		rec.Done[chunkID/8] &^= 1 << uint(chunkID%8)
+	}
+}
+
+// ClusterStore holds the shared state of cluster downloads.
+type ClusterStore interface {
+	// Update calls fn with the record of key, an empty one if there is none,
+	// and saves what fn leaves, deleting the record if its Meta is nil. It
+	// must be atomic with respect to every process using the store. Nothing
+	// is saved if fn returns an error.
+	Update(ctx context.Context, key string, fn func(rec *ClusterRecord) error) error
+	Close() error
+}
+
+// updateRecord runs fn through store.Update with ErrNoUpdate handled, for
+// stores that do not.
+func updateRecord(ctx context.Context, store ClusterStore, key string, fn func(rec *ClusterRecord) error) error {
+	err := store.Update(ctx, key, fn)
+	if errors.Is(err, ErrNoUpdate) {
+		return nil
+	}
+	return err
+}
+
+// MemoryClusterStore is a ClusterStore for processes sharing memory, i.e.
+// several Downloaders in one program or tests.
+type MemoryClusterStore struct {
+	mu      sync.Mutex
+	records map[string][]byte // CBOR, so callers never share a record
+}
+
+// NewMemoryClusterStore creates an empty MemoryClusterStore.
+func NewMemoryClusterStore() *MemoryClusterStore {
+	return &MemoryClusterStore{records: make(map[string][]byte)}
+}
+
+func (st *MemoryClusterStore) Update(ctx context.Context, key string, fn func(rec *ClusterRecord) error) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var rec ClusterRecord
+	if data, ok := st.records[key]; ok {
+		if err := cbor.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+	}
+	if err := fn(&rec); err != nil {
+		if errors.Is(err, ErrNoUpdate) {
+			return nil
+		}
+		return err
+	}
+	if rec.Meta == nil {
+		delete(st.records, key)
+		return nil
+	}
+	data, err := cbor.Marshal(&rec)
+	if err != nil {
+		return err
+	}
+	st.records[key] = data
+	return nil
+}
+
+func (st *MemoryClusterStore) Close() error { return nil }
+
+// dirClusterStore keeps one file per download in a directory on shared
+// storage, updated under a lock file.
+type dirClusterStore struct {
+	dir string
+	mu  sync.Mutex // POSIX locks do not exclude goroutines of the same process
+}
+
+// OpenClusterStore opens a ClusterStore in dir, a directory every process
+// of the cluster can reach, e.g. on the NFS share the downloads go to.
+func OpenClusterStore(dir string) (ClusterStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cluster directory %s: %w", dir, err)
+	}
+	return &dirClusterStore{dir: dir}, nil
+}
+
+func (st *dirClusterStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(st.dir, hex.EncodeToString(sum[:8])+".cluster")
+}
+
+func (st *dirClusterStore) Update(ctx context.Context, key string, fn func(rec *ClusterRecord) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	path := st.path(key)
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return fmt.Errorf("failed to lock %s: %w", lock.Name(), err)
+	}
+
+	var rec ClusterRecord
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := cbor.Unmarshal(data, &rec); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+	if err := fn(&rec); err != nil {
+		if errors.Is(err, ErrNoUpdate) {
+			return nil
+		}
+		return err
+	}
+	if rec.Meta == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	if data, err = cbor.Marshal(&rec); err != nil {
+		return err
+	}
+	// Replace the file so a crash never leaves a torn record.
+	tmp, err := os.CreateTemp(st.dir, ".cluster-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (st *dirClusterStore) Close() error { return nil }
+
+// clusterStateStore keeps DownloadStates in a ClusterStore, so all
+// processes of the cluster share them.
+type clusterStateStore struct {
+	cluster ClusterStore
+}
+
+func (st clusterStateStore) Load(key string) (*DownloadState, error) {
+	var state *DownloadState
+	err := updateRecord(context.Background(), st.cluster, key, func(rec *ClusterRecord) error {
+		if rec.Meta == nil {
+			return fmt.Errorf("no saved state for %s: %w", key, os.ErrNotExist)
+		}
+		var s DownloadState
+		if err := cbor.Unmarshal(rec.Meta, &s); err != nil {
+			return fmt.Errorf("failed to decode cbor state: %w", err)
+		}
+		state = &s
+		state.loadClusterBits(rec)
+		return ErrNoUpdate
+	})
+	if err != nil {
+		return nil, err
+	}
+	state.backend = &clusterBackend{cluster: st.cluster, key: key}
+	return state, nil
+}
+
+// Create starts a new shared state, unless another process has just
+// created one for the same file, which is then joined instead.
+func (st clusterStateStore) Create(key, url string, fileSize, chunkSize int64) (*DownloadState, error) {
+	state := &DownloadState{
+		Version:   stateVersion,
+		URL:       url,
+		FileSize:  fileSize,
+		ChunkSize: chunkSize,
+		UpdatedAt: time.Now(),
+	}
+	meta, err := cbor.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	joined := false
+	err = updateRecord(context.Background(), st.cluster, key, func(rec *ClusterRecord) error {
+		var other DownloadState
+		if rec.Meta != nil && cbor.Unmarshal(rec.Meta, &other) == nil &&
+			other.URL == url && other.FileSize == fileSize && other.ChunkSize == chunkSize {
+			state.loadClusterBits(rec)
+			joined = true
+			return ErrNoUpdate
+		}
+		*rec = ClusterRecord{Meta: meta}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !joined {
+		state.loadClusterBits(&ClusterRecord{})
+	}
+	state.backend = &clusterBackend{cluster: st.cluster, key: key}
+	return state, nil
+}
+
+func (st clusterStateStore) Remove(key string) error {
+	return updateRecord(context.Background(), st.cluster, key, func(rec *ClusterRecord) error {
+		*rec = ClusterRecord{}
+		return nil
+	})
+}
+
+// Close does nothing: the ClusterStore belongs to the caller.
+func (st clusterStateStore) Close() error { return nil }
+
+// loadClusterBits sizes the bitset and digests for the state's layout and
+// copies the shared completion bits into it. Chunk digests are not shared.
+func (s *DownloadState) loadClusterBits(rec *ClusterRecord) {
+	numChunks, numBytes := stateLayout(s.FileSize, s.ChunkSize)
+	s.bits = make([]byte, numBytes)
+	copy(s.bits, rec.Done)
+	s.hashes = make([]byte, numChunks*chunkHashSize)
+}
+
+// clusterBackend saves a DownloadState to a ClusterStore. It never recreates
+// a record another process removed after the download completed.
+type clusterBackend struct {
+	cluster ClusterStore
+	key     string
+}
+
+func (b *clusterBackend) saveMeta(s *DownloadState) error {
+	meta, err := cbor.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return updateRecord(context.Background(), b.cluster, b.key, func(rec *ClusterRecord) error {
+		if rec.Meta == nil || bytes.Equal(rec.Meta, meta) {
+			return ErrNoUpdate
+		}
+		rec.Meta = meta
+		return nil
+	})
+}
+
+func (b *clusterBackend) saveChunk(s *DownloadState, chunkID int) error {
+	done := s.bits[chunkID/8]&(1<<uint(chunkID%8)) != 0
+	return updateRecord(context.Background(), b.cluster, b.key, func(rec *ClusterRecord) error {
+		if rec.Meta == nil || rec.isDone(chunkID) == done {
+			return ErrNoUpdate
+		}
+		rec.setDone(chunkID, done)
+		if done {
+			delete(rec.Leases, chunkID)
+		}
+		return nil
+	})
+}
+
+func (b *clusterBackend) sync(s *DownloadState) error { return nil }
+
+func (b *clusterBackend) close() error { return nil }
+
+// leaseStatus is the outcome of trying to lease a chunk.
+type leaseStatus int
+
+const (
+	leaseAcquired leaseStatus = iota // this process may download the chunk
+	leaseHeld                        // another process is downloading it
+	leaseDone                        // it is already complete
+)
+
+// clusterLease leases the chunks of one download for this process.
+type clusterLease struct {
+	cluster ClusterStore
+	key     string
+	owner   string
+	ttl     time.Duration
+}
+
+// acquire leases a chunk, or renews this process's lease on it.
+func (l *clusterLease) acquire(ctx context.Context, chunkID int) (leaseStatus, error) {
+	status := leaseAcquired
+	err := updateRecord(ctx, l.cluster, l.key, func(rec *ClusterRecord) error {
+		// A record removed since this process joined means another process
+		// finished the download and cleaned up.
+		if rec.Meta == nil || rec.isDone(chunkID) {
+			status = leaseDone
+			return ErrNoUpdate
+		}
+		if lease, ok := rec.Leases[chunkID]; ok && lease.Owner != l.owner && time.Now().UnixMilli() < lease.Expires {
+			status = leaseHeld
+			return ErrNoUpdate
+		}
+		if rec.Leases == nil {
+			rec.Leases = make(map[int]ChunkLease)
+		}
+		rec.Leases[chunkID] = ChunkLease{Owner: l.owner, Expires: time.Now().Add(l.ttl).UnixMilli()}
+		return nil
+	})
+	return status, err
+}
+
+// release gives up this process's lease on a chunk so others can take it.
+func (l *clusterLease) release(ctx context.Context, chunkID int) error {
+	return updateRecord(ctx, l.cluster, l.key, func(rec *ClusterRecord) error {
+		if lease, ok := rec.Leases[chunkID]; !ok || lease.Owner != l.owner {
+			return ErrNoUpdate
+		}
+		delete(rec.Leases, chunkID)
+		return nil
+	})
+}
+
+// hold renews the lease on a chunk while it downloads and cancels the
+// returned context if another process takes the chunk over. The returned
+// function stops renewing; given the fetch error, it releases the lease if
+// the fetch failed and returns errLeaseLost if the lease was lost.
+func (l *clusterLease) hold(ctx context.Context, chunkID int) (context.Context, func(error) error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				status, err := l.acquire(ctx, chunkID)
+				if err != nil {
+					// The lease is still good until it expires; try again next tick.
+					log.Printf("Warning: failed to renew lease on chunk %d of %s: %v", chunkID, l.key, err)
+				} else if status == leaseHeld {
+					cancel(errLeaseLost)
+					return
+				}
+			}
+		}
+	}()
+	return ctx, func(err error) error {
+		close(stop)
+		lost := errors.Is(context.Cause(ctx), errLeaseLost)
+		cancel(nil)
+		if err == nil {
+			return nil // completed; the lease went with it
+		}
+		if lost {
+			return fmt.Errorf("chunk %d: %w", chunkID, errLeaseLost)
+		}
+		if rerr := l.release(context.Background(), chunkID); rerr != nil {
+			log.Printf("Warning: failed to release lease on chunk %d of %s: %v", chunkID, l.key, rerr)
+		}
+		return err
+	}
+}
+
+// claimChunk leases the chunk of a cluster task before it is fetched. It
+// returns false if the task must not be fetched now: the chunk was completed
+// by another process, and the task is completed here too, or another process
+// holds it, and the task is queued to be checked again later.
+func (d *Downloader) claimChunk(ctx context.Context, task *ChunkTask) bool {
+	status, err := task.lease.acquire(ctx, task.ChunkID)
+	switch {
+	case err != nil:
+		log.Printf("Warning: failed to lease chunk %d of %s: %v", task.ChunkID, task.FileID, err)
+		task.Retries++
+		if task.Retries >= d.retryPolicy.MaxAttempts {
+			if task.OnChunkFailed != nil {
+				task.OnChunkFailed(task.ChunkID, err)
+			}
+			ReleaseChunkTask(task)
+			return false
+		}
+		d.retryLater(ctx, task, d.retryPolicy.Backoff(task.Retries, err))
+		return false
+	case status == leaseDone:
+		if d.Config.Verbose {
+			log.Printf("[Cluster] Chunk %d of %s was downloaded by another process", task.ChunkID, task.FileID)
+		}
+		if task.OnChunkComplete != nil {
+			task.OnChunkComplete(task.ChunkID, "")
+		}
+		ReleaseChunkTask(task)
+		return false
+	case status == leaseHeld:
+		time.AfterFunc(leaseRecheckInterval, func() {
+			if ctx.Err() != nil {
+				ReleaseChunkTask(task)
+				return
+			}
+			d.addTask(task)
+		})
+		return false
+	}
+	return true
+}
+
+// clusterOwner names this process in cluster leases.
+func clusterOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
@@ -0,0 +1,158 @@
+package oget
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClusterLease(t *testing.T) {
+	dir, err := os.MkdirTemp("", "oget-cluster-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dirStore, err := OpenClusterStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, cluster := range map[string]ClusterStore{"memory": NewMemoryClusterStore(), "dir": dirStore} {
+		ctx := context.Background()
+		const key = "http://example.com/dataset.tar"
+		states := clusterStateStore{cluster: cluster}
+		state, err := states.Create(key, key, 4*1024*1024, 1024*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a := &clusterLease{cluster: cluster, key: key, owner: "a", ttl: 50 * time.Millisecond}
+		b := &clusterLease{cluster: cluster, key: key, owner: "b", ttl: time.Minute}
+		expect := func(l *clusterLease, chunk int, want leaseStatus) {
+			t.Helper()
+			if got, err := l.acquire(ctx, chunk); err != nil || got != want {
+				t.Errorf("%s: %s leasing chunk %d = %v, %v; want %v", name, l.owner, chunk, got, err, want)
+			}
+		}
+
+		expect(a, 0, leaseAcquired)
+		expect(a, 0, leaseAcquired) // renewal
+		expect(b, 0, leaseHeld)
+		time.Sleep(80 * time.Millisecond)
+		expect(b, 0, leaseAcquired) // a's lease expired
+		expect(a, 0, leaseHeld)
+
+		expect(a, 1, leaseAcquired)
+		if err := a.release(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		expect(b, 1, leaseAcquired)
+
+		// Completing a chunk in one process's state shows in the others.
+		state.MarkComplete(2, "")
+		expect(a, 2, leaseDone)
+		joined, err := states.Create(key, key, 4*1024*1024, 1024*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !joined.IsComplete(2) {
+			t.Errorf("%s: a second process did not join the existing download", name)
+		}
+
+		if err := states.Remove(key); err != nil {
+			t.Fatal(err)
+		}
+		expect(b, 3, leaseDone) // removed once another process finished
+		if _, err := states.Load(key); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: state still present after Remove: %v", name, err)
+		}
+	}
+}
+
+func TestDownloader_Cluster(t *testing.T) {
+	content := bytes.Repeat([]byte("oget cluster mode "), 4*1024*1024/18)
+	var mu sync.Mutex
+	served := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			served[r.Header.Get("Range")]++
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "dataset.tar", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "oget-cluster-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const chunkSize = 256 * 1024
+	url := server.URL + "/dataset.tar"
+	cluster := NewMemoryClusterStore()
+
+	// A host that leased chunk 0 and died: its lease must expire and the
+	// chunk be taken over.
+	if _, err := (clusterStateStore{cluster: cluster}).Create(url, url, int64(len(content)), chunkSize); err != nil {
+		t.Fatal(err)
+	}
+	dead := &clusterLease{cluster: cluster, key: url, owner: "dead", ttl: time.Second}
+	if _, err := dead.acquire(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]*Result, 2)
+	errs := make([]error, 2)
+	for i, id := range []string{"host-a", "host-b"} {
+		d := NewDownloader([]string{url}, 2)
+		d.Config.AutoTune = false
+		d.Config.Endgame = false
+		d.Config.OutputDir = dir
+		d.Config.ClusterChunkSize = chunkSize
+		d.Config.LeaseTTL = 1
+		d.Fetcher = &HttpFetcher{Client: &http.Client{}, Config: d.Config}
+		d.Quiet = true
+		d.Cluster = cluster
+		d.ClusterID = id
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = d.Download(context.Background())
+		}()
+	}
+	wg.Wait()
+
+	for i := range results {
+		if errs[i] != nil || results[i][0].Status != StatusCompleted {
+			t.Fatalf("host %d: %v", i, errs[i])
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "dataset.tar"))
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("shared file differs: %d bytes, %v", len(data), err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for rng, n := range served {
+		if n > 1 {
+			t.Errorf("range %q fetched %d times", rng, n)
+		}
+	}
+	if want := (len(content) + chunkSize - 1) / chunkSize; len(served) != want {
+		t.Errorf("fetched %d ranges, want %d", len(served), want)
+	}
+	if _, err := (clusterStateStore{cluster: cluster}).Load(url); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("shared state kept after the download: %v", err)
+	}
+}
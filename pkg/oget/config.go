@@ -1,8 +1,10 @@
 package oget
 
 import (
-	"github.com/spf13/viper"
+	"crypto/tls"
 	"log"
+
+	"github.com/spf13/viper"
 )
 
 var (
@@ -16,8 +18,8 @@ type Config struct {
 	MaxConcurrency     int    `mapstructure:"max_concurrency"`
 	AutoTune           bool   `mapstructure:"autotune"`        // Enable dynamic bandwidth detection
 	StorageType        string `mapstructure:"storage_type"`    // "file", "db", "uring"
-	StateStoreType     string `mapstructure:"state_store_type"` // "json", "bolt", "redis"
-	ManifestPath       string `mapstructure:"manifest_path"`   // Path to save .oget state files
+	StateStoreType     string `mapstructure:"state_store_type"` // "json" (a .name.oget file beside each download) or "bolt"
+	ManifestPath       string `mapstructure:"manifest_path"`   // Directory of the bolt state database (oget.db)
 	OutputDir          string // Directory to write downloaded files (default: ".")
 	ProxyURL           string `mapstructure:"proxy_url"`       // e.g., "http://localhost:8080"
 	Timeout            int    `mapstructure:"timeout"`         // Timeout for network operations in seconds
@@ -28,6 +30,34 @@ type Config struct {
 	MagnetProbeTimeout int      `mapstructure:"magnet_probe_timeout"` // Timeout for finding magnet metadata in seconds
 	Checksum           bool     `mapstructure:"checksum"`             // Enable per-chunk SHA-256 checksum verification
 	DNS                string   `mapstructure:"dns"`                  // Custom DNS server for BT tracker/peer resolution (e.g. "8.8.8.8:53")
+	Endgame            bool     `mapstructure:"endgame"`              // Race duplicate requests for the slowest chunks once the queues drain
+	RateLimit          int64            `mapstructure:"rate_limit"`       // Global download cap in bytes/sec (0 = unlimited)
+	HostRateLimits     map[string]int64 `mapstructure:"host_rate_limits"` // Per-host caps in bytes/sec, keyed by host[:port]
+	URLRateLimits      map[string]int64 `mapstructure:"url_rate_limits"`  // Per-URL caps in bytes/sec
+	DigestMismatch     string           `mapstructure:"digest_mismatch"`  // What to do with a file failing digest verification: "delete", "quarantine"
+	VerifyOnResume     bool             `mapstructure:"verify_on_resume"` // Re-hash completed chunks against their recorded SHA-256 when resuming
+	RetryMaxAttempts   int              `mapstructure:"retry_max_attempts"`  // Attempts per chunk before giving up
+	RetryBaseDelay     int              `mapstructure:"retry_base_delay_ms"` // First retry delay in milliseconds, doubled per attempt
+	RetryMaxDelay      int              `mapstructure:"retry_max_delay_ms"`  // Upper bound for the retry delay in milliseconds
+	RetryJitter        float64          `mapstructure:"retry_jitter"`        // Random fraction (0-1) taken off each delay
+	Naming             string           `mapstructure:"naming"`              // How output files are named: "auto" (Content-Disposition, then redirect target), "final-url", "url"
+	Headers            map[string]string `mapstructure:"headers"`            // Extra HTTP request headers, e.g. {"Authorization": "Bearer ..."}
+	HostHeaders        map[string]map[string]string `mapstructure:"host_headers"` // Extra HTTP request headers by host or host:port, replacing those of Headers
+	UserAgent          string           `mapstructure:"user_agent"`          // User-Agent of HTTP requests; empty for oget/<version>
+	CookieFile         string           `mapstructure:"cookie_file"`         // Netscape cookies.txt whose cookies are sent with HTTP requests
+	SaveCookieFile     string           `mapstructure:"save_cookie_file"`    // Netscape cookies.txt the cookie jar is written to by CleanupProtocols
+	LeaseTTL           int              `mapstructure:"lease_ttl"`           // Cluster mode: seconds a chunk lease lasts without renewal
+	ClusterChunkSize   int64            `mapstructure:"cluster_chunk_size"`  // Cluster mode: chunk size in bytes, larger than usual since each chunk is leased
+	TLSConfig          *tls.Config      `mapstructure:"-"`                   // TLS settings for FTPS, e.g. RootCAs; nil for the system defaults
+	SSHKeyFiles        []string         `mapstructure:"ssh_key_files"`       // Private keys for SFTP logins, besides those of ssh-agent; empty for ~/.ssh/id_ed25519, id_ecdsa and id_rsa
+	KnownHostsFile     string           `mapstructure:"known_hosts_file"`    // Host keys SFTP servers are checked against; empty for ~/.ssh/known_hosts
+	S3Endpoint         string           `mapstructure:"s3_endpoint"`         // S3-compatible storage for s3:// URLs, e.g. "http://localhost:9000" for MinIO; empty for AWS
+	S3Region           string           `mapstructure:"s3_region"`           // Region requests are signed for; empty for AWS_REGION, then the profile's, then us-east-1
+	S3Profile          string           `mapstructure:"s3_profile"`          // Profile in ~/.aws/credentials; empty for AWS_PROFILE or "default"
+	S3PathStyle        bool             `mapstructure:"s3_path_style"`       // Address buckets as endpoint/bucket/key instead of bucket.endpoint/key
+	Credentials        map[string]Credential `mapstructure:"credentials"` // HTTP credentials by host or host:port, see auth.go
+	NetrcFile          string           `mapstructure:"netrc_file"`          // Credentials by host name for HTTP; empty for $NETRC or ~/.netrc
+	StreamVariant      string           `mapstructure:"stream_variant"`      // HLS/DASH variant: "best" (default), "worst", a height like "720p" or a bit rate like "3M"
 }
 
 // DefaultConfig returns a configuration with default values.
@@ -51,6 +81,15 @@ func DefaultConfig() *Config {
 		},
 		MagnetProbeTimeout: 60,
 		Checksum:           false,
+		Endgame:            true,
+		DigestMismatch:     "delete",
+		RetryMaxAttempts:   MaxFetchRetries,
+		RetryBaseDelay:     500,
+		RetryMaxDelay:      30000,
+		RetryJitter:        0.5,
+		Naming:             "auto",
+		LeaseTTL:           60,
+		ClusterChunkSize:   16 * 1024 * 1024,
 	}
 }
 
@@ -81,6 +120,17 @@ func LoadConfig(configPath string) (*Config, error) {
 	})
 	v.SetDefault("magnet_probe_timeout", 60)
 	v.SetDefault("checksum", false)
+	v.SetDefault("endgame", true)
+	v.SetDefault("rate_limit", 0)
+	v.SetDefault("digest_mismatch", "delete")
+	v.SetDefault("verify_on_resume", false)
+	v.SetDefault("retry_max_attempts", MaxFetchRetries)
+	v.SetDefault("retry_base_delay_ms", 500)
+	v.SetDefault("retry_max_delay_ms", 30000)
+	v.SetDefault("retry_jitter", 0.5)
+	v.SetDefault("naming", "auto")
+	v.SetDefault("lease_ttl", 60)
+	v.SetDefault("cluster_chunk_size", 16*1024*1024)
 
 	v.AutomaticEnv() // Read from environment variables
 
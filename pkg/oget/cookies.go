@@ -0,0 +1,259 @@
+package oget
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cookies are kept in one jar per Config.CookieFile and SaveCookieFile pair,
+// shared by the probers and fetchers of every download, so a session cookie
+// set by a login redirect during the probe goes out with each chunk request.
+// net/http/cookiejar decides which cookies a request gets; the jar also keeps
+// them in Netscape form to write them back.
+
+var (
+	cookieJarsMu sync.Mutex
+	cookieJars   = make(map[string]*cookieJar) // CookieFile + "\x00" + SaveCookieFile
+)
+
+// netscapeCookie is a line of a Netscape cookies.txt file.
+type netscapeCookie struct {
+	Domain            string // without a leading dot
+	IncludeSubdomains bool
+	Path              string
+	Secure            bool
+	HttpOnly          bool
+	Expires           int64 // Unix time; 0 for a session cookie
+	Name              string
+	Value             string
+}
+
+func (c *netscapeCookie) key() string {
+	return c.Domain + "\t" + c.Path + "\t" + c.Name
+}
+
+// cookieJar is an http.CookieJar that remembers its cookies for saving.
+type cookieJar struct {
+	jar      *cookiejar.Jar
+	saveFile string
+
+	mu      sync.Mutex
+	cookies map[string]*netscapeCookie
+}
+
+// cookieJarFor returns the jar of config's cookie files, loading it on first
+// use, or nil if neither is set.
+func cookieJarFor(config *Config) http.CookieJar {
+	if config == nil || config.CookieFile == "" && config.SaveCookieFile == "" {
+		return nil
+	}
+	key := config.CookieFile + "\x00" + config.SaveCookieFile
+	cookieJarsMu.Lock()
+	defer cookieJarsMu.Unlock()
+	if j, ok := cookieJars[key]; ok {
+		return j
+	}
+	jar, _ := cookiejar.New(nil)
+	j := &cookieJar{jar: jar, saveFile: config.SaveCookieFile, cookies: make(map[string]*netscapeCookie)}
+	if config.CookieFile != "" {
+		data, err := os.ReadFile(config.CookieFile)
+		switch {
+		case errors.Is(err, os.ErrNotExist) && config.CookieFile == config.SaveCookieFile:
+			// Created when saved.
+		case err != nil:
+			log.Printf("Warning: failed to load cookies: %v", err)
+		default:
+			cookies, err := parseCookieFile(data)
+			if err != nil {
+				log.Printf("Warning: failed to load cookies from %s: %v", config.CookieFile, err)
+			}
+			j.load(cookies, time.Now())
+		}
+	}
+	cookieJars[key] = j
+	return j
+}
+
+// load adds cookies read from a file, skipping expired ones.
+func (j *cookieJar) load(cookies []*netscapeCookie, now time.Time) {
+	for _, c := range cookies {
+		if c.Expires != 0 && c.Expires <= now.Unix() {
+			continue
+		}
+		u := &url.URL{Scheme: "http", Host: c.Domain, Path: c.Path}
+		if c.Secure {
+			u.Scheme = "https"
+		}
+		hc := &http.Cookie{Name: c.Name, Value: c.Value, Path: c.Path, Secure: c.Secure, HttpOnly: c.HttpOnly}
+		if c.IncludeSubdomains {
+			hc.Domain = c.Domain
+		}
+		if c.Expires != 0 {
+			hc.Expires = time.Unix(c.Expires, 0)
+		}
+		j.jar.SetCookies(u, []*http.Cookie{hc})
+		j.mu.Lock()
+		j.cookies[c.key()] = c
+		j.mu.Unlock()
+	}
+}
+
+func (j *cookieJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+func (j *cookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+	now := time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, hc := range cookies {
+		c := &netscapeCookie{
+			Domain:   strings.ToLower(u.Hostname()),
+			Path:     hc.Path,
+			Secure:   hc.Secure,
+			HttpOnly: hc.HttpOnly,
+			Name:     hc.Name,
+			Value:    hc.Value,
+		}
+		if d := strings.TrimPrefix(strings.ToLower(hc.Domain), "."); d != "" && net.ParseIP(c.Domain) == nil {
+			if c.Domain != d && !strings.HasSuffix(c.Domain, "."+d) {
+				continue // refused by the jar as well
+			}
+			c.Domain, c.IncludeSubdomains = d, true
+		}
+		if !strings.HasPrefix(c.Path, "/") {
+			// The default path: the directory of the request path.
+			c.Path = "/"
+			if i := strings.LastIndex(u.Path, "/"); i > 0 {
+				c.Path = u.Path[:i]
+			}
+		}
+		switch {
+		case hc.MaxAge < 0:
+			delete(j.cookies, c.key())
+			continue
+		case hc.MaxAge > 0:
+			c.Expires = now.Unix() + int64(hc.MaxAge)
+		case !hc.Expires.IsZero():
+			if !hc.Expires.After(now) {
+				delete(j.cookies, c.key())
+				continue
+			}
+			c.Expires = hc.Expires.Unix()
+		}
+		j.cookies[c.key()] = c
+	}
+}
+
+// save writes the unexpired cookies to saveFile, replacing it atomically.
+func (j *cookieJar) save(now time.Time) error {
+	j.mu.Lock()
+	cookies := make([]*netscapeCookie, 0, len(j.cookies))
+	for _, c := range j.cookies {
+		if c.Expires == 0 || c.Expires > now.Unix() {
+			cookies = append(cookies, c)
+		}
+	}
+	j.mu.Unlock()
+	sort.Slice(cookies, func(a, b int) bool { return cookies[a].key() < cookies[b].key() })
+
+	var buf bytes.Buffer
+	buf.WriteString("# Netscape HTTP Cookie File\n# Written by oget; edit at your own risk.\n\n")
+	bools := map[bool]string{true: "TRUE", false: "FALSE"}
+	for _, c := range cookies {
+		domain := c.Domain
+		if c.IncludeSubdomains {
+			domain = "." + domain
+		}
+		if c.HttpOnly {
+			domain = "#HttpOnly_" + domain
+		}
+		fmt.Fprintf(&buf, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, bools[c.IncludeSubdomains], c.Path, bools[c.Secure], c.Expires, c.Name, c.Value)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(j.saveFile), ".cookies-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), j.saveFile)
+}
+
+// saveCookieJars writes every jar with a SaveCookieFile and forgets them all,
+// so later downloads load the files afresh.
+func saveCookieJars() {
+	cookieJarsMu.Lock()
+	defer cookieJarsMu.Unlock()
+	for key, j := range cookieJars {
+		if j.saveFile != "" {
+			if err := j.save(time.Now()); err != nil {
+				log.Printf("Warning: failed to save cookies to %s: %v", j.saveFile, err)
+			}
+		}
+		delete(cookieJars, key)
+	}
+}
+
+// parseCookieFile parses a Netscape cookies.txt file, as written by curl,
+// wget and browser extensions.
+func parseCookieFile(data []byte) ([]*netscapeCookie, error) {
+	var cookies []*netscapeCookie
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := false
+		if rest, ok := strings.CutPrefix(line, "#HttpOnly_"); ok {
+			line, httpOnly = rest, true
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) == 6 {
+			fields = append(fields, "") // an empty value
+		}
+		if len(fields) != 7 {
+			return cookies, fmt.Errorf("line %d: want 7 tab-separated fields, got %d", n, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return cookies, fmt.Errorf("line %d: invalid expiry %q", n, fields[4])
+		}
+		domain := strings.ToLower(fields[0])
+		cookies = append(cookies, &netscapeCookie{
+			Domain:            strings.TrimPrefix(domain, "."),
+			IncludeSubdomains: strings.EqualFold(fields[1], "TRUE"),
+			Path:              fields[2],
+			Secure:            strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly:          httpOnly,
+			Expires:           expires,
+			Name:              fields[5],
+			Value:             fields[6],
+		})
+	}
+	return cookies, scanner.Err()
+}
@@ -0,0 +1,157 @@
+package oget
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseCookieFile(t *testing.T) {
+	cookies, err := parseCookieFile([]byte("# Netscape HTTP Cookie File\r\n" +
+		"\n" +
+		".example.com\tTRUE\t/\tFALSE\t0\tsession\tabc\r\n" +
+		"#HttpOnly_files.example.com\tFALSE\t/dl\tTRUE\t4102444800\ttoken\tx=y\n" +
+		"# a comment\n" +
+		"example.org\tFALSE\t/\tFALSE\t0\tempty\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cookies) != 3 {
+		t.Fatalf("parsed %d cookies, want 3: %+v", len(cookies), cookies)
+	}
+	if c := cookies[0]; c.Domain != "example.com" || !c.IncludeSubdomains || c.Name != "session" || c.Value != "abc" || c.Expires != 0 {
+		t.Errorf("domain cookie = %+v", c)
+	}
+	if c := cookies[1]; c.Domain != "files.example.com" || c.IncludeSubdomains || !c.HttpOnly || !c.Secure || c.Path != "/dl" || c.Value != "x=y" {
+		t.Errorf("HttpOnly cookie = %+v", c)
+	}
+	if c := cookies[2]; c.Name != "empty" || c.Value != "" {
+		t.Errorf("cookie without a value = %+v", c)
+	}
+	for _, bad := range []string{"example.com\tTRUE\t/\n", "example.com\tTRUE\t/\tFALSE\tsoon\tn\tv\n"} {
+		if _, err := parseCookieFile([]byte(bad)); err == nil {
+			t.Errorf("parseCookieFile(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestCookieJarSave(t *testing.T) {
+	dir := t.TempDir()
+	load := filepath.Join(dir, "cookies.txt")
+	save := filepath.Join(dir, "saved.txt")
+	if err := os.WriteFile(load, []byte(".example.com\tTRUE\t/\tFALSE\t0\tsession\tabc\n"+
+		"example.com\tFALSE\t/\tFALSE\t1000\told\tgone\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	jar := cookieJarFor(&Config{CookieFile: load, SaveCookieFile: save})
+	if jar != cookieJarFor(&Config{CookieFile: load, SaveCookieFile: save}) {
+		t.Error("the same files gave two jars")
+	}
+	u, _ := url.Parse("https://cdn.example.com/files/a.bin")
+	if got := jar.Cookies(u); len(got) != 1 || got[0].Name != "session" {
+		t.Errorf("cookies for a subdomain = %v, want the session cookie only", got)
+	}
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "token", Value: "t1", HttpOnly: true, Secure: true, MaxAge: 3600},
+		{Name: "session", Value: "", Domain: "example.com", Path: "/", MaxAge: -1},
+	})
+	saveCookieJars()
+
+	data, err := os.ReadFile(save)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies, err := parseCookieFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cookies) != 1 {
+		t.Fatalf("saved %d cookies, want 1:\n%s", len(cookies), data)
+	}
+	if c := cookies[0]; c.Domain != "cdn.example.com" || c.IncludeSubdomains || c.Path != "/files" || !c.HttpOnly || !c.Secure || c.Expires <= time.Now().Unix() {
+		t.Errorf("saved cookie = %+v", c)
+	}
+	if fi, err := os.Stat(save); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("saved file mode = %v, %v; want 0600", fi.Mode(), err)
+	}
+	if cookieJarFor(&Config{}) != nil {
+		t.Error("a jar without cookie files")
+	}
+}
+
+func TestHeadersAndCookies(t *testing.T) {
+	content := randomContent(t, 5*RangeSize+7)
+	// The file is only served to a browser with the session cookie, which the
+	// first response renews. The redirect target must not see the per-host
+	// header; it gets the cookie, as cookies do not depend on the port.
+	var rejected, leaked atomic.Int64
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "" {
+			leaked.Add(1)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie("session")
+		if err != nil || !strings.HasPrefix(c.Value, "abc") || r.UserAgent() != "Mozilla/5.0" ||
+			r.Header.Get("X-Api-Key") != "k1" || r.Header.Get("Referer") != "https://example.com/" {
+			rejected.Add(1)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/redirect.bin" {
+			http.Redirect(w, r, other.URL+"/file.bin", http.StatusFound)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc2", Path: "/"})
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	dir := t.TempDir()
+	cookieFile := filepath.Join(dir, "cookies.txt")
+	if err := os.WriteFile(cookieFile, []byte(serverURL.Hostname()+"\tFALSE\t/\tFALSE\t0\tsession\tabc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	withHeaders := func(c *Config) {
+		c.UserAgent = "Mozilla/5.0"
+		c.Headers = map[string]string{"Referer": "https://example.com/"}
+		c.HostHeaders = map[string]map[string]string{serverURL.Host: {"X-Api-Key": "k1"}}
+		c.CookieFile = cookieFile
+		c.SaveCookieFile = cookieFile
+	}
+	data, err := downloadAuth(t, server.URL+"/file.bin", withHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Error("downloaded content differs")
+	}
+	if _, err := downloadAuth(t, server.URL+"/redirect.bin", withHeaders); err != nil {
+		t.Fatal(err)
+	}
+	if n := rejected.Load(); n != 0 {
+		t.Errorf("%d requests without the headers or the cookie", n)
+	}
+	if n := leaked.Load(); n != 0 {
+		t.Errorf("%d requests to the redirect target carried the per-host header", n)
+	}
+
+	saveCookieJars()
+	saved, err := os.ReadFile(cookieFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(saved), "\tsession\tabc2\n") {
+		t.Errorf("renewed cookie not saved:\n%s", saved)
+	}
+}
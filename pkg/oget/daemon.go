@@ -0,0 +1,450 @@
+package oget
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Daemon mode keeps one process running for many downloads. Each job gets its
+own Downloader, but all of them share the daemon's Fetcher (and with it the
+HTTP connection pools), one BandwidthLimiter and the BitTorrent session, so
+scripts queueing work do not each bring their own.
+
+Jobs start in priority order, at most MaxActive at a time. Pausing cancels a
+job's Downloader, which flushes its state file; resuming queues it again and
+the next run picks up from that state.
+*/
+
+// JobState is the lifecycle state of a daemon job.
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobActive    JobState = "active"
+	JobPaused    JobState = "paused"
+	JobCompleted JobState = "completed"
+	JobFailed    JobState = "failed"
+	JobRemoved   JobState = "removed"
+)
+
+// ErrJobNotFound is returned for an unknown job ID.
+var ErrJobNotFound = errors.New("job not found")
+
+// JobStatus is a snapshot of a job as reported by the API.
+type JobStatus struct {
+	ID         int       `json:"id"`
+	URL        string    `json:"url"`
+	State      JobState  `json:"state"`
+	Priority   int       `json:"priority"`
+	File       string    `json:"file,omitempty"`
+	TotalBytes int64     `json:"total_bytes"` // bytes this daemon has to fetch, -1 while unknown
+	DoneBytes  int64     `json:"done_bytes"`  // bytes this daemon has fetched so far
+	Speed      int64     `json:"speed"`       // bytes/sec over the last seconds
+	Error      string    `json:"error,omitempty"`
+	Added      time.Time `json:"added"`
+}
+
+// Event reports a job changing state.
+type Event struct {
+	ID    int       `json:"id"`
+	URL   string    `json:"url"`
+	State JobState  `json:"state"`
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// job is a queued download. Fields are guarded by Daemon.mu.
+type job struct {
+	id       int
+	entry    InputEntry
+	state    JobState
+	priority int
+	added    time.Time
+	file     string
+	err      error
+
+	dl       *Downloader        // current run, nil when not running
+	cancel   context.CancelFunc // stops the current run
+	doneBase int64              // bytes fetched by earlier runs
+	total    int64              // TotalBytes once known
+	lastDone int64              // DoneBytes at the previous speed sample
+	speed    float64
+}
+
+// Daemon runs queued download jobs on shared resources.
+type Daemon struct {
+	Config    *Config
+	MaxActive int     // jobs downloading at once; 3 if zero
+	Fetcher   Fetcher // shared by all jobs; a DispatchFetcher for Config if nil
+	Limiter   *BandwidthLimiter
+	Token     string // API clients send "Authorization: Bearer <Token>"; NewDaemon makes a random one
+
+	mu      sync.Mutex
+	ctx     context.Context // set by Run; jobs only start while it is live
+	jobs    map[int]*job
+	nextID  int
+	subs    map[chan Event]struct{}
+	running sync.WaitGroup
+}
+
+// NewDaemon creates a Daemon; call Run to start processing jobs.
+func NewDaemon(config *Config) *Daemon {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	return &Daemon{
+		Config:  config,
+		Fetcher: NewDispatchFetcher(config),
+		Limiter: NewBandwidthLimiter(config),
+		Token:   rand.Text(),
+		jobs:    make(map[int]*job),
+		subs:    make(map[chan Event]struct{}),
+	}
+}
+
+// Run starts queued jobs until ctx is done, then stops the active ones,
+// leaving their state files for a later resume, and waits for them.
+func (d *Daemon) Run(ctx context.Context) error {
+	d.mu.Lock()
+	d.ctx = ctx
+	d.schedule()
+	d.mu.Unlock()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			d.running.Wait()
+			return nil
+		case <-ticker.C:
+			d.sampleSpeed()
+		}
+	}
+}
+
+// Add queues a download and returns its job ID. Higher priorities start first.
+func (d *Daemon) Add(entry InputEntry, priority int) (int, error) {
+	if entry.URL == "" {
+		return 0, fmt.Errorf("missing url")
+	}
+	if entry.Digest != "" {
+		if _, _, err := ParseDigest(entry.Digest); err != nil {
+			return 0, err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, j := range d.jobs {
+		if j.entry.URL == entry.URL && (j.state == JobQueued || j.state == JobActive || j.state == JobPaused || j.dl != nil) {
+			return 0, fmt.Errorf("%s is already job %d", entry.URL, j.id)
+		}
+	}
+	d.nextID++
+	j := &job{
+		id:       d.nextID,
+		entry:    entry,
+		state:    JobQueued,
+		priority: priority,
+		added:    time.Now(),
+		total:    -1,
+	}
+	d.jobs[j.id] = j
+	d.emit(j)
+	d.schedule()
+	return j.id, nil
+}
+
+// Pause stops a queued or active job; its progress is kept.
+func (d *Daemon) Pause(id int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	j, err := d.lookup(id)
+	if err != nil {
+		return err
+	}
+	switch j.state {
+	case JobPaused:
+		return nil
+	case JobQueued, JobActive:
+	default:
+		return fmt.Errorf("job %d is %s", id, j.state)
+	}
+	if j.cancel != nil {
+		j.cancel()
+	}
+	j.state = JobPaused
+	d.emit(j)
+	d.schedule()
+	return nil
+}
+
+// Resume queues a paused or failed job again.
+func (d *Daemon) Resume(id int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	j, err := d.lookup(id)
+	if err != nil {
+		return err
+	}
+	switch j.state {
+	case JobQueued, JobActive:
+		return nil
+	case JobPaused, JobFailed:
+	default:
+		return fmt.Errorf("job %d is %s", id, j.state)
+	}
+	j.state = JobQueued
+	j.err = nil
+	d.emit(j)
+	d.schedule()
+	return nil
+}
+
+// Remove stops a job and forgets it. Files already written stay on disk.
+func (d *Daemon) Remove(id int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	j, err := d.lookup(id)
+	if err != nil {
+		return err
+	}
+	if j.cancel != nil {
+		j.cancel()
+	}
+	j.state = JobRemoved
+	if j.dl == nil {
+		delete(d.jobs, id)
+	} // else kept until its run has flushed, see finish
+	d.emit(j)
+	d.schedule()
+	return nil
+}
+
+// SetPriority changes the order in which queued jobs start. Running jobs are
+// not preempted.
+func (d *Daemon) SetPriority(id, priority int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	j, err := d.lookup(id)
+	if err != nil {
+		return err
+	}
+	j.priority = priority
+	d.schedule()
+	return nil
+}
+
+// lookup finds a job that has not been removed. Called with d.mu held.
+func (d *Daemon) lookup(id int) (*job, error) {
+	j, ok := d.jobs[id]
+	if !ok || j.state == JobRemoved {
+		return nil, fmt.Errorf("%w: %d", ErrJobNotFound, id)
+	}
+	return j, nil
+}
+
+// Status returns a snapshot of one job.
+func (d *Daemon) Status(id int) (JobStatus, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	j, err := d.lookup(id)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	return j.status(), nil
+}
+
+// List returns a snapshot of every job, by ID.
+func (d *Daemon) List() []JobStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]JobStatus, 0, len(d.jobs))
+	for _, j := range d.jobs {
+		if j.state != JobRemoved {
+			list = append(list, j.status())
+		}
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].ID < list[b].ID })
+	return list
+}
+
+// Subscribe returns a channel receiving every state change from now on and a
+// function to stop. Events are dropped for a subscriber that falls behind.
+func (d *Daemon) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 64)
+	d.mu.Lock()
+	d.subs[ch] = struct{}{}
+	d.mu.Unlock()
+	return ch, func() {
+		d.mu.Lock()
+		delete(d.subs, ch)
+		d.mu.Unlock()
+	}
+}
+
+// emit sends the job's current state to all subscribers. Called with d.mu held.
+func (d *Daemon) emit(j *job) {
+	ev := Event{ID: j.id, URL: j.entry.URL, State: j.state, Time: time.Now()}
+	if j.err != nil {
+		ev.Error = j.err.Error()
+	}
+	for ch := range d.subs {
+		select {
+		case ch <- ev:
+		default:
+			log.Printf("Warning: event subscriber is not keeping up, dropping event for job %d", j.id)
+		}
+	}
+}
+
+// schedule starts queued jobs, highest priority first, while fewer than
+// MaxActive are running. Called with d.mu held.
+func (d *Daemon) schedule() {
+	if d.ctx == nil || d.ctx.Err() != nil {
+		return
+	}
+	maxActive := d.MaxActive
+	if maxActive <= 0 {
+		maxActive = 3
+	}
+
+	active := 0
+	var queued []*job
+	for _, j := range d.jobs {
+		switch {
+		case j.dl != nil:
+			active++ // includes paused or removed jobs still flushing
+		case j.state == JobQueued:
+			queued = append(queued, j)
+		}
+	}
+	sort.Slice(queued, func(a, b int) bool {
+		if queued[a].priority != queued[b].priority {
+			return queued[a].priority > queued[b].priority
+		}
+		return queued[a].id < queued[b].id
+	})
+	for _, j := range queued {
+		if active >= maxActive {
+			break
+		}
+		d.start(j)
+		active++
+	}
+}
+
+// start runs a job's Downloader in the background. Called with d.mu held.
+func (d *Daemon) start(j *job) {
+	cfg := *d.Config
+	dl := &Downloader{
+		Concurrency:       cfg.Concurrency,
+		Config:            &cfg,
+		Fetcher:           d.Fetcher,
+		Limiter:           d.Limiter,
+		Quiet:             true,
+		targetConcurrency: int32(cfg.Concurrency),
+	}
+	entry := j.entry
+	if err := dl.AddEntry(&entry); err != nil {
+		j.state, j.err = JobFailed, err
+		d.emit(j)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	j.dl, j.cancel = dl, cancel
+	j.lastDone, j.speed = 0, 0
+	j.state = JobActive
+	d.emit(j)
+
+	d.running.Add(1)
+	go func() {
+		defer d.running.Done()
+		defer cancel()
+		results, err := dl.Download(ctx)
+		d.finish(j, dl, results, err)
+	}()
+}
+
+// finish records the outcome of a job's run and starts the next jobs.
+func (d *Daemon) finish(j *job, dl *Downloader, results []*Result, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	done := atomic.LoadInt64(&dl.TotalProcessed)
+	j.total = j.doneBase + atomic.LoadInt64(&dl.TotalSize)
+	j.doneBase += done
+	j.dl, j.cancel = nil, nil
+	j.speed = 0
+	if len(results) > 0 && results[0].File != "" {
+		j.file = results[0].File
+	}
+
+	switch {
+	case j.state == JobRemoved:
+		delete(d.jobs, j.id)
+	case j.state != JobActive:
+		// Paused while running; already reported.
+	case d.ctx.Err() != nil:
+		// The daemon is shutting down: leave it queued with its state file.
+		j.state = JobQueued
+	case err != nil:
+		j.state, j.err = JobFailed, err
+		d.emit(j)
+	default:
+		j.state = JobCompleted
+		j.total = j.doneBase
+		d.emit(j)
+	}
+	d.schedule()
+}
+
+// sampleSpeed updates the speed of running jobs; called once a second.
+func (d *Daemon) sampleSpeed() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, j := range d.jobs {
+		if j.dl == nil {
+			continue
+		}
+		done := atomic.LoadInt64(&j.dl.TotalProcessed)
+		// Smooth over a few seconds so bursts do not make the number jump.
+		j.speed = 0.5*j.speed + 0.5*float64(done-j.lastDone)
+		j.lastDone = done
+	}
+}
+
+// status returns the API view of the job. Called with Daemon.mu held.
+func (j *job) status() JobStatus {
+	s := JobStatus{
+		ID:         j.id,
+		URL:        j.entry.URL,
+		State:      j.state,
+		Priority:   j.priority,
+		File:       j.file,
+		TotalBytes: j.total,
+		DoneBytes:  j.doneBase,
+		Speed:      int64(j.speed),
+		Added:      j.added,
+	}
+	if j.dl != nil {
+		s.DoneBytes += atomic.LoadInt64(&j.dl.TotalProcessed)
+		if size := atomic.LoadInt64(&j.dl.TotalSize); size > 0 {
+			s.TotalBytes = j.doneBase + size
+		}
+	}
+	if j.err != nil {
+		s.Error = j.err.Error()
+	}
+	return s
+}
@@ -0,0 +1,269 @@
+package oget
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+The daemon API is JSON-RPC 2.0 over HTTP, one request per POST to /jsonrpc:
+
+	{"jsonrpc":"2.0","id":1,"method":"add","params":{"url":"https://...","priority":5}}
+
+Methods: add (InputEntry fields plus priority, returns {"id":N}), pause,
+resume, remove, status (params {"id":N}), setPriority ({"id":N,"priority":P})
+and list. GET /events streams every state change as one JSON Event per line.
+
+Every request must carry the daemon's token as "Authorization: Bearer
+<token>"; the daemon command writes it to a file only its user can read.
+Requests with an Origin header or a Host other than a loopback one are
+refused, so web pages cannot reach the API through the browser, even with
+DNS rebinding, and RPC requests must be sent as application/json, which
+a cross-site form cannot do.
+*/
+
+// JSON-RPC 2.0 error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcJobError       = -32000 // the daemon refused the call
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// rpcParams covers the parameters of every method.
+type rpcParams struct {
+	InputEntry
+	ID       int `json:"id"`
+	Priority int `json:"priority"`
+}
+
+// Handler returns the HTTP handler serving the daemon API.
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jsonrpc", d.serveRPC)
+	mux.HandleFunc("/events", d.serveEvents)
+	return d.authorize(mux)
+}
+
+// authorize refuses requests from browsers and those without the token.
+func (d *Daemon) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" || !isLoopbackHost(r.Host) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || d.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(d.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="oget"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackHost reports whether the Host header names this machine.
+// Clients of a Unix socket send anything, so they send localhost too.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (d *Daemon) serveRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+		http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	resp := rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null")}
+	var req rpcRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp.Error = &rpcError{rpcParseError, "parse error: " + err.Error()}
+	} else {
+		if req.ID != nil {
+			resp.ID = req.ID
+		}
+		if req.JSONRPC != "2.0" || req.Method == "" {
+			resp.Error = &rpcError{rpcInvalidRequest, "invalid request"}
+		} else {
+			resp.Result, resp.Error = d.call(req.Method, req.Params)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// call runs one API method.
+func (d *Daemon) call(method string, raw json.RawMessage) (interface{}, *rpcError) {
+	var p rpcParams
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, &rpcError{rpcInvalidParams, "invalid params: " + err.Error()}
+		}
+	}
+
+	var result interface{}
+	var err error
+	switch method {
+	case "add":
+		if p.URL == "" {
+			return nil, &rpcError{rpcInvalidParams, "missing url"}
+		}
+		var id int
+		id, err = d.Add(p.InputEntry, p.Priority)
+		result = map[string]int{"id": id}
+	case "pause":
+		err = d.Pause(p.ID)
+	case "resume":
+		err = d.Resume(p.ID)
+	case "remove":
+		err = d.Remove(p.ID)
+	case "setPriority":
+		err = d.SetPriority(p.ID, p.Priority)
+	case "status":
+		result, err = d.Status(p.ID)
+	case "list":
+		result = d.List()
+	default:
+		return nil, &rpcError{rpcMethodNotFound, fmt.Sprintf("method %q not found", method)}
+	}
+	if err != nil {
+		return nil, &rpcError{rpcJobError, err.Error()}
+	}
+	if result == nil {
+		result = "ok"
+	}
+	return result, nil
+}
+
+func (d *Daemon) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	events, stop := d.Subscribe()
+	defer stop()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// ListenDaemon opens the daemon's API listener. addr is either a Unix socket
+// ("unix:/path" or any path containing a slash) or host:port, which must be a
+// loopback address: the token keeps out other users, not other machines.
+func ListenDaemon(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok || strings.Contains(addr, "/") {
+		if !ok {
+			path = addr
+		}
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			// Only a socket left behind by a daemon that did not shut
+			// down cleanly may go, not that of one still running.
+			if conn, err := net.Dial("unix", path); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("a daemon is already listening on %s", path)
+			}
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, errors.New("daemon API must listen on a loopback address or Unix socket, not " + addr)
+		}
+	}
+	return net.Listen("tcp", addr)
+}
+
+// DefaultDaemonTokenFile is where the daemon command writes its token unless
+// told otherwise: oget/daemon.token in the user's configuration directory,
+// or "" if there is none.
+func DefaultDaemonTokenFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "oget", "daemon.token")
+}
+
+// WriteDaemonToken saves token to path, creating its directory, readable
+// only by the current user. A file left there before is replaced rather than
+// rewritten, so it cannot keep looser permissions.
+func WriteDaemonToken(path, token string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(token + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
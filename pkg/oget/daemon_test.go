@@ -0,0 +1,344 @@
+package oget
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDaemonToken is the API token of the daemons of newTestDaemon.
+const testDaemonToken = "test-token"
+
+// newTestDaemon runs a daemon saving to a temporary directory and serves its
+// API; it returns the daemon, the directory and the API URL.
+func newTestDaemon(t *testing.T) (*Daemon, string, string) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "oget-daemon-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	config := DefaultConfig()
+	config.AutoTune = false
+	config.Concurrency = 2
+	config.OutputDir = dir
+	d := NewDaemon(config)
+	d.Fetcher = &HttpFetcher{Client: &http.Client{}, Config: config}
+	d.Token = testDaemonToken
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	api := httptest.NewServer(d.Handler())
+	t.Cleanup(api.Close)
+	return d, dir, api.URL
+}
+
+// rpcPost posts body to the JSON-RPC endpoint with the test token.
+func rpcPost(t *testing.T, url string, body []byte) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url+"/jsonrpc", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testDaemonToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// rpcCall posts one JSON-RPC request and decodes the response.
+func rpcCall(t *testing.T, url, method string, params interface{}) rpcResponse {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+	resp := rpcPost(t, url, body)
+	defer resp.Body.Close()
+	var out rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// waitEvent reads events until one for job id reaches state.
+func waitEvent(t *testing.T, events *bufio.Scanner, id int, state JobState) Event {
+	t.Helper()
+	for events.Scan() {
+		var ev Event
+		if err := json.Unmarshal(events.Bytes(), &ev); err != nil {
+			t.Fatalf("bad event %q: %v", events.Text(), err)
+		}
+		if ev.ID == id && ev.State == state {
+			return ev
+		}
+		if ev.ID == id && ev.State == JobFailed {
+			t.Fatalf("job %d failed: %s", id, ev.Error)
+		}
+	}
+	t.Fatalf("event stream ended waiting for job %d to be %s: %v", id, state, events.Err())
+	return Event{}
+}
+
+func openEvents(t *testing.T, url string) *bufio.Scanner {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url+"/events", nil)
+	req.Header.Set("Authorization", "Bearer "+testDaemonToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return bufio.NewScanner(resp.Body)
+}
+
+func TestDaemon_AddAndComplete(t *testing.T) {
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "hello.txt", time.Time{}, strings.NewReader("Hello World!"))
+	}))
+	defer files.Close()
+
+	d, dir, api := newTestDaemon(t)
+	events := openEvents(t, api)
+
+	resp := rpcCall(t, api, "add", map[string]interface{}{"url": files.URL + "/hello.txt", "out": "greeting.txt", "priority": 5})
+	if resp.Error != nil {
+		t.Fatalf("add: %+v", resp.Error)
+	}
+	id := int(resp.Result.(map[string]interface{})["id"].(float64))
+	waitEvent(t, events, id, JobCompleted)
+
+	data, err := os.ReadFile(filepath.Join(dir, "greeting.txt"))
+	if err != nil || string(data) != "Hello World!" {
+		t.Errorf("downloaded %q, %v", data, err)
+	}
+
+	st, err := d.Status(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.State != JobCompleted || st.DoneBytes != 12 || st.Priority != 5 || st.File != filepath.Join(dir, "greeting.txt") {
+		t.Errorf("status = %+v", st)
+	}
+	if list := rpcCall(t, api, "list", nil).Result.([]interface{}); len(list) != 1 {
+		t.Errorf("list returned %d jobs, want 1", len(list))
+	}
+
+	if resp := rpcCall(t, api, "remove", map[string]int{"id": id}); resp.Error != nil {
+		t.Fatalf("remove: %+v", resp.Error)
+	}
+	if _, err := d.Status(id); err == nil {
+		t.Error("removed job still has a status")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "greeting.txt")); err != nil {
+		t.Errorf("remove deleted the file: %v", err)
+	}
+}
+
+func TestDaemon_PauseResume(t *testing.T) {
+	release := make(chan struct{})
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Let probes through but hold the download until released.
+		if r.Method == http.MethodGet && r.Header.Get("Range") != "bytes=0-0" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, strings.NewReader(strings.Repeat("x", 4096)))
+	}))
+	defer files.Close()
+
+	d, dir, api := newTestDaemon(t)
+	events := openEvents(t, api)
+
+	id, err := d.Add(InputEntry{URL: files.URL + "/data.bin"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Add(InputEntry{URL: files.URL + "/data.bin"}, 0); err == nil {
+		t.Error("expected an error adding the same URL twice")
+	}
+	waitEvent(t, events, id, JobActive)
+
+	if resp := rpcCall(t, api, "pause", map[string]int{"id": id}); resp.Error != nil {
+		t.Fatalf("pause: %+v", resp.Error)
+	}
+	waitEvent(t, events, id, JobPaused)
+	if st, _ := d.Status(id); st.State != JobPaused {
+		t.Errorf("state after pause = %s", st.State)
+	}
+
+	close(release)
+	if resp := rpcCall(t, api, "resume", map[string]int{"id": id}); resp.Error != nil {
+		t.Fatalf("resume: %+v", resp.Error)
+	}
+	waitEvent(t, events, id, JobCompleted)
+	if data, err := os.ReadFile(filepath.Join(dir, "data.bin")); err != nil || len(data) != 4096 {
+		t.Errorf("downloaded %d bytes, %v", len(data), err)
+	}
+}
+
+func TestDaemon_RPCErrors(t *testing.T) {
+	_, _, api := newTestDaemon(t)
+
+	tests := []struct {
+		method string
+		params interface{}
+		code   int
+	}{
+		{"frobnicate", nil, rpcMethodNotFound},
+		{"add", map[string]interface{}{"priority": 1}, rpcInvalidParams},
+		{"add", map[string]interface{}{"url": "https://example.com/x", "digest": "crc32:00"}, rpcJobError},
+		{"status", map[string]int{"id": 42}, rpcJobError},
+		{"pause", "not an object", rpcInvalidParams},
+	}
+	for _, tt := range tests {
+		resp := rpcCall(t, api, tt.method, tt.params)
+		if resp.Error == nil || resp.Error.Code != tt.code {
+			t.Errorf("%s(%v) error = %+v, want code %d", tt.method, tt.params, resp.Error, tt.code)
+		}
+	}
+
+	resp := rpcPost(t, api, []byte("{"))
+	defer resp.Body.Close()
+	var out rpcResponse
+	json.NewDecoder(resp.Body).Decode(&out)
+	if out.Error == nil || out.Error.Code != rpcParseError {
+		t.Errorf("malformed body error = %+v, want parse error", out.Error)
+	}
+}
+
+func TestDaemon_RejectsUnauthorized(t *testing.T) {
+	_, _, api := newTestDaemon(t)
+	body := `{"jsonrpc":"2.0","id":1,"method":"list"}`
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		host   string
+		status int
+	}{
+		{"no token", map[string]string{"Content-Type": "application/json"}, "", http.StatusUnauthorized},
+		{"wrong token", map[string]string{"Content-Type": "application/json", "Authorization": "Bearer guess"}, "", http.StatusUnauthorized},
+		{"form", map[string]string{"Content-Type": "text/plain", "Authorization": "Bearer " + testDaemonToken}, "", http.StatusUnsupportedMediaType},
+		{"browser", map[string]string{"Content-Type": "application/json", "Authorization": "Bearer " + testDaemonToken, "Origin": "https://example.com"}, "", http.StatusForbidden},
+		{"rebound host", map[string]string{"Content-Type": "application/json", "Authorization": "Bearer " + testDaemonToken}, "attacker.example:6800", http.StatusForbidden},
+		{"allowed", map[string]string{"Content-Type": "application/json; charset=utf-8", "Authorization": "Bearer " + testDaemonToken}, "localhost:6800", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodPost, api+"/jsonrpc", strings.NewReader(body))
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		if tt.host != "" {
+			req.Host = tt.host
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+	}
+
+	// The event stream needs the token too.
+	resp, err := http.Get(api + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("events without a token: status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestWriteDaemonToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oget", "daemon.token")
+	// A token file readable by others is replaced, not rewritten in place.
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteDaemonToken(path, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("token file mode %v, want 0600", fi.Mode().Perm())
+	}
+	if data, _ := os.ReadFile(path); string(data) != "secret\n" {
+		t.Errorf("token file holds %q", data)
+	}
+}
+
+func TestListenDaemon(t *testing.T) {
+	if _, err := ListenDaemon("0.0.0.0:0"); err == nil {
+		t.Error("expected a non-loopback address to be refused")
+	}
+	ln, err := ListenDaemon("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	dir, err := os.MkdirTemp("", "oget-sock-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "oget.sock")
+	ln, err = ListenDaemon("unix:" + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The socket of a running daemon is left alone...
+	if _, err := ListenDaemon("unix:" + sock); err == nil {
+		t.Error("expected a second daemon on the same socket to be refused")
+	}
+	if conn, err := net.Dial("unix", sock); err != nil {
+		t.Errorf("first daemon's socket gone: %v", err)
+	} else {
+		conn.Close()
+	}
+	ln.Close()
+
+	// ...but one left behind by a daemon that died is replaced.
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err = ListenDaemon("unix:" + sock)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	ln.Close()
+}
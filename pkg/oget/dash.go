@@ -0,0 +1,395 @@
+package oget
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The subset of an MPEG-DASH MPD needed to list the segments of a
+// representation: BaseURL, SegmentTemplate (with or without a timeline),
+// SegmentList and SegmentBase.
+type dashMPD struct {
+	Type                      string       `xml:"type,attr"`
+	MediaPresentationDuration string       `xml:"mediaPresentationDuration,attr"`
+	BaseURL                   []string     `xml:"BaseURL"`
+	Periods                   []dashPeriod `xml:"Period"`
+}
+
+type dashPeriod struct {
+	Duration       string              `xml:"duration,attr"`
+	BaseURL        []string            `xml:"BaseURL"`
+	AdaptationSets []dashAdaptationSet `xml:"AdaptationSet"`
+}
+
+type dashAdaptationSet struct {
+	MimeType        string               `xml:"mimeType,attr"`
+	ContentType     string               `xml:"contentType,attr"`
+	BaseURL         []string             `xml:"BaseURL"`
+	SegmentTemplate *dashSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *dashSegmentList     `xml:"SegmentList"`
+	Representations []dashRepresentation `xml:"Representation"`
+}
+
+type dashRepresentation struct {
+	ID              string               `xml:"id,attr"`
+	Bandwidth       int64                `xml:"bandwidth,attr"`
+	Width           int                  `xml:"width,attr"`
+	Height          int                  `xml:"height,attr"`
+	MimeType        string               `xml:"mimeType,attr"`
+	BaseURL         []string             `xml:"BaseURL"`
+	SegmentTemplate *dashSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *dashSegmentList     `xml:"SegmentList"`
+	SegmentBase     *struct{}            `xml:"SegmentBase"`
+}
+
+type dashSegmentTemplate struct {
+	Media          string               `xml:"media,attr"`
+	Initialization string               `xml:"initialization,attr"`
+	StartNumber    string               `xml:"startNumber,attr"`
+	Timescale      int64                `xml:"timescale,attr"`
+	Duration       int64                `xml:"duration,attr"`
+	Timeline       *dashSegmentTimeline `xml:"SegmentTimeline"`
+}
+
+type dashSegmentTimeline struct {
+	S []struct {
+		T *int64 `xml:"t,attr"`
+		D int64  `xml:"d,attr"`
+		R int64  `xml:"r,attr"`
+	} `xml:"S"`
+}
+
+type dashSegmentList struct {
+	Initialization *struct {
+		SourceURL string `xml:"sourceURL,attr"`
+		Range     string `xml:"range,attr"`
+	} `xml:"Initialization"`
+	SegmentURLs []struct {
+		Media      string `xml:"media,attr"`
+		MediaRange string `xml:"mediaRange,attr"`
+	} `xml:"SegmentURL"`
+}
+
+// parseDASH parses an MPD relative to base and returns the segments of the
+// representation variant picks, one per period.
+func parseDASH(data []byte, base *url.URL, variant string) (*mediaStream, error) {
+	var mpd dashMPD
+	if err := xml.Unmarshal(data, &mpd); err != nil {
+		return nil, fmt.Errorf("invalid MPD: %w", err)
+	}
+	if len(mpd.Periods) == 0 {
+		return nil, errors.New("MPD has no periods")
+	}
+	stream := &mediaStream{Live: mpd.Type == "dynamic"}
+	mpdBase, err := dashBaseURL(base, mpd.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, period := range mpd.Periods {
+		duration := period.Duration
+		if duration == "" && len(mpd.Periods) == 1 {
+			duration = mpd.MediaPresentationDuration
+		}
+		periodBase, err := dashBaseURL(mpdBase, period.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+		set := dashMainAdaptationSet(period.AdaptationSets)
+		if set == nil {
+			return nil, fmt.Errorf("period %d has no representations", i)
+		}
+		variants := make([]mediaVariant, len(set.Representations))
+		for j, rep := range set.Representations {
+			variants[j] = mediaVariant{Bandwidth: rep.Bandwidth, Width: rep.Width, Height: rep.Height}
+		}
+		j, err := selectVariant(variants, variant)
+		if err != nil {
+			return nil, err
+		}
+		rep := set.Representations[j]
+		setBase, err := dashBaseURL(periodBase, set.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+		repBase, err := dashBaseURL(setBase, rep.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+
+		segments, err := dashSegments(set, &rep, repBase, duration)
+		if err != nil {
+			return nil, fmt.Errorf("representation %s: %w", rep.ID, err)
+		}
+		stream.Segments = append(stream.Segments, segments...)
+		if stream.Ext == "" {
+			mime := rep.MimeType
+			if mime == "" {
+				mime = set.MimeType
+			}
+			stream.Ext = dashExtension(mime)
+		}
+	}
+	return stream, nil
+}
+
+// dashBaseURL resolves the first of refs, if any, against base.
+func dashBaseURL(base *url.URL, refs []string) (*url.URL, error) {
+	if len(refs) == 0 || strings.TrimSpace(refs[0]) == "" {
+		return base, nil
+	}
+	u, err := url.Parse(strings.TrimSpace(refs[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid BaseURL %q: %w", refs[0], err)
+	}
+	return base.ResolveReference(u), nil
+}
+
+// dashMainAdaptationSet picks the video adaptation set, or the first one
+// with representations if there is no video.
+func dashMainAdaptationSet(sets []dashAdaptationSet) *dashAdaptationSet {
+	var first *dashAdaptationSet
+	for i := range sets {
+		set := &sets[i]
+		if len(set.Representations) == 0 {
+			continue
+		}
+		if first == nil {
+			first = set
+		}
+		mime := set.MimeType
+		if mime == "" {
+			mime = set.Representations[0].MimeType
+		}
+		if set.ContentType == "video" || strings.HasPrefix(mime, "video/") {
+			return set
+		}
+	}
+	return first
+}
+
+// dashExtension returns the file extension for a MIME type.
+func dashExtension(mime string) string {
+	switch mime {
+	case "video/webm", "audio/webm":
+		return ".webm"
+	case "audio/mp4":
+		return ".m4a"
+	case "video/mp2t":
+		return ".ts"
+	default:
+		return ".mp4"
+	}
+}
+
+// dashSegments lists the segments of rep, whose addressing may be inherited
+// from its adaptation set.
+func dashSegments(set *dashAdaptationSet, rep *dashRepresentation, base *url.URL, periodDuration string) ([]mediaSegment, error) {
+	resolve := func(ref string) (string, error) {
+		u, err := url.Parse(ref)
+		if err != nil {
+			return "", fmt.Errorf("invalid URL %q: %w", ref, err)
+		}
+		return base.ResolveReference(u).String(), nil
+	}
+
+	tmpl := mergeDashTemplates(rep.SegmentTemplate, set.SegmentTemplate)
+	list := rep.SegmentList
+	if list == nil && tmpl == nil {
+		list = set.SegmentList
+	}
+	switch {
+	case tmpl != nil:
+		return dashTemplateSegments(tmpl, rep, periodDuration, resolve)
+	case list != nil:
+		var segments []mediaSegment
+		add := func(ref, byteRange string) error {
+			u := base.String()
+			if ref != "" {
+				var err error
+				if u, err = resolve(ref); err != nil {
+					return err
+				}
+			}
+			seg := mediaSegment{URL: u, Length: -1}
+			if byteRange != "" {
+				start, end, ok := strings.Cut(byteRange, "-")
+				first, err1 := strconv.ParseInt(start, 10, 64)
+				last, err2 := strconv.ParseInt(end, 10, 64)
+				if !ok || err1 != nil || err2 != nil || last < first {
+					return fmt.Errorf("invalid range %q", byteRange)
+				}
+				seg.Offset, seg.Length = first, last-first+1
+			}
+			segments = append(segments, seg)
+			return nil
+		}
+		if init := list.Initialization; init != nil {
+			if err := add(init.SourceURL, init.Range); err != nil {
+				return nil, err
+			}
+		}
+		for _, s := range list.SegmentURLs {
+			if err := add(s.Media, s.MediaRange); err != nil {
+				return nil, err
+			}
+		}
+		return segments, nil
+	default:
+		// SegmentBase, or a plain BaseURL: the representation is one file.
+		return []mediaSegment{{URL: base.String(), Length: -1}}, nil
+	}
+}
+
+// mergeDashTemplates fills what rep leaves unset from set's template.
+func mergeDashTemplates(rep, set *dashSegmentTemplate) *dashSegmentTemplate {
+	if rep == nil || set == nil {
+		if rep != nil {
+			return rep
+		}
+		return set
+	}
+	merged := *rep
+	if merged.Media == "" {
+		merged.Media = set.Media
+	}
+	if merged.Initialization == "" {
+		merged.Initialization = set.Initialization
+	}
+	if merged.StartNumber == "" {
+		merged.StartNumber = set.StartNumber
+	}
+	if merged.Timescale == 0 {
+		merged.Timescale = set.Timescale
+	}
+	if merged.Duration == 0 {
+		merged.Duration = set.Duration
+	}
+	if merged.Timeline == nil {
+		merged.Timeline = set.Timeline
+	}
+	return &merged
+}
+
+// dashTemplateSegments expands a SegmentTemplate into segment URLs.
+func dashTemplateSegments(tmpl *dashSegmentTemplate, rep *dashRepresentation, periodDuration string, resolve func(string) (string, error)) ([]mediaSegment, error) {
+	if tmpl.Media == "" {
+		return nil, errors.New("SegmentTemplate without media")
+	}
+	number := int64(1)
+	if tmpl.StartNumber != "" {
+		n, err := strconv.ParseInt(tmpl.StartNumber, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid startNumber %q", tmpl.StartNumber)
+		}
+		number = n
+	}
+	var segments []mediaSegment
+	add := func(pattern string, number, time int64) error {
+		u, err := resolve(expandDashTemplate(pattern, rep, number, time))
+		if err != nil {
+			return err
+		}
+		segments = append(segments, mediaSegment{URL: u, Length: -1})
+		return nil
+	}
+	if tmpl.Initialization != "" {
+		if err := add(tmpl.Initialization, 0, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	if tmpl.Timeline != nil {
+		var time int64
+		for _, s := range tmpl.Timeline.S {
+			if s.T != nil {
+				time = *s.T
+			}
+			if s.D <= 0 {
+				return nil, errors.New("SegmentTimeline entry without a duration")
+			}
+			if s.R < 0 {
+				// Repeat up to the end of the period; only live streams use it.
+				return nil, errors.New("open-ended SegmentTimeline repeat is not supported")
+			}
+			for i := int64(0); i <= s.R; i++ {
+				if err := add(tmpl.Media, number, time); err != nil {
+					return nil, err
+				}
+				number++
+				time += s.D
+			}
+		}
+		return segments, nil
+	}
+
+	if tmpl.Duration <= 0 {
+		return nil, errors.New("SegmentTemplate without a duration or timeline")
+	}
+	seconds, err := parseISODuration(periodDuration)
+	if err != nil {
+		return nil, fmt.Errorf("period duration: %w", err)
+	}
+	timescale := tmpl.Timescale
+	if timescale <= 0 {
+		timescale = 1
+	}
+	count := int64(math.Ceil(seconds * float64(timescale) / float64(tmpl.Duration)))
+	for i := int64(0); i < count; i++ {
+		if err := add(tmpl.Media, number+i, i*tmpl.Duration); err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
+
+var dashTemplateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time)(%0(\d+)d)?\$|\$\$`)
+
+// expandDashTemplate substitutes the identifiers of a SegmentTemplate URL,
+// e.g. "$RepresentationID$/seg-$Number%05d$.m4s".
+func expandDashTemplate(pattern string, rep *dashRepresentation, number, time int64) string {
+	return dashTemplateIdentifier.ReplaceAllStringFunc(pattern, func(m string) string {
+		if m == "$$" {
+			return "$"
+		}
+		sub := dashTemplateIdentifier.FindStringSubmatch(m)
+		var value int64
+		switch sub[1] {
+		case "RepresentationID":
+			return rep.ID
+		case "Number":
+			value = number
+		case "Bandwidth":
+			value = rep.Bandwidth
+		case "Time":
+			value = time
+		}
+		width, _ := strconv.Atoi(sub[3])
+		return fmt.Sprintf("%0*d", width, value)
+	})
+}
+
+var isoDuration = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration parses an xs:duration such as "PT1H2M3.5S" into seconds.
+// Years and months, which have no fixed length, are not accepted.
+func parseISODuration(s string) (float64, error) {
+	m := isoDuration.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil || s == "P" || s == "PT" {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	var seconds float64
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		if m[i+1] != "" {
+			v, _ := strconv.ParseFloat(m[i+1], 64)
+			seconds += v * unit
+		}
+	}
+	return seconds, nil
+}
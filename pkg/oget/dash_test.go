@@ -0,0 +1,177 @@
+package oget
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDASH(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/movies/film/manifest.mpd")
+	mpd := `<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT9.5S">
+  <Period>
+    <AdaptationSet contentType="audio" mimeType="audio/mp4">
+      <Representation id="a" bandwidth="128000"/>
+    </AdaptationSet>
+    <AdaptationSet mimeType="video/mp4">
+      <BaseURL>video/</BaseURL>
+      <SegmentTemplate media="$RepresentationID$/seg-$Number%03d$-$Bandwidth$.m4s" initialization="$RepresentationID$/init.mp4" timescale="1000" duration="4000" startNumber="0"/>
+      <Representation id="v360" bandwidth="800000" width="640" height="360"/>
+      <Representation id="v720" bandwidth="2500000" width="1280" height="720">
+        <SegmentTemplate timescale="90">
+          <SegmentTimeline>
+            <S t="900" d="360" r="1"/>
+            <S d="180"/>
+          </SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	urls := func(s *mediaStream) string {
+		var list []string
+		for _, seg := range s.Segments {
+			list = append(list, strings.TrimPrefix(seg.URL, "https://cdn.example.com/movies/film/"))
+		}
+		return strings.Join(list, " ")
+	}
+
+	stream, err := parseDASH([]byte(mpd), base, "360p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "video/v360/init.mp4 video/v360/seg-000-800000.m4s video/v360/seg-001-800000.m4s video/v360/seg-002-800000.m4s"
+	if got := urls(stream); got != want || stream.Ext != ".mp4" || stream.Live {
+		t.Errorf("360p with a duration: %s (%s)\nwant %s", got, stream.Ext, want)
+	}
+
+	// $Time$ comes from the timeline, which the representation adds to the
+	// adaptation set's template.
+	timeMPD := strings.Replace(mpd, "seg-$Number%03d$", "t$Time$", 1)
+	stream, err = parseDASH([]byte(timeMPD), base, "best")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "video/v720/init.mp4 video/v720/t900-2500000.m4s video/v720/t1260-2500000.m4s video/v720/t1620-2500000.m4s"
+	if got := urls(stream); got != want {
+		t.Errorf("720p with a timeline: %s\nwant %s", got, want)
+	}
+
+	list := `<MPD type="static">
+  <BaseURL>https://media.example.com/</BaseURL>
+  <Period>
+    <AdaptationSet mimeType="video/webm">
+      <Representation id="1" bandwidth="1000">
+        <BaseURL>one.webm</BaseURL>
+        <SegmentList>
+          <Initialization range="0-99"/>
+          <SegmentURL mediaRange="100-1099"/>
+          <SegmentURL media="two.webm"/>
+        </SegmentList>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+  <Period>
+    <AdaptationSet mimeType="video/webm">
+      <Representation id="2" bandwidth="1000"><BaseURL>three.webm</BaseURL><SegmentBase indexRange="0-10"/></Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	stream, err = parseDASH([]byte(list), base, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.Segments) != 4 || stream.Ext != ".webm" {
+		t.Fatalf("SegmentList periods = %+v", stream)
+	}
+	segs := stream.Segments
+	if segs[0].URL != "https://media.example.com/one.webm" || segs[0].Offset != 0 || segs[0].Length != 100 ||
+		segs[1].Offset != 100 || segs[1].Length != 1000 ||
+		segs[2].URL != "https://media.example.com/two.webm" || segs[2].Length != -1 ||
+		segs[3].URL != "https://media.example.com/three.webm" || segs[3].Length != -1 {
+		t.Errorf("SegmentList and SegmentBase segments = %+v", segs)
+	}
+
+	for _, bad := range []string{
+		"not xml",
+		`<MPD></MPD>`,
+		`<MPD><Period><AdaptationSet><Representation id="x"><SegmentTemplate media="$Number$"/></Representation></AdaptationSet></Period></MPD>`,
+	} {
+		if _, err := parseDASH([]byte(bad), base, ""); err == nil {
+			t.Errorf("parseDASH(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestParseISODuration(t *testing.T) {
+	tests := map[string]float64{
+		"PT9.5S":      9.5,
+		"PT1H2M3S":    3723,
+		"P1DT1M":      86460,
+		"PT0.25S":     0.25,
+		"PT10M":       600,
+		"P2D":         172800,
+		"PT1H30M0.5S": 5400.5,
+	}
+	for s, want := range tests {
+		if got, err := parseISODuration(s); err != nil || got != want {
+			t.Errorf("parseISODuration(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "P", "PT", "1H", "P1Y", "PT-1S"} {
+		if _, err := parseISODuration(bad); err == nil {
+			t.Errorf("parseISODuration(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestDASHDownload(t *testing.T) {
+	var want bytes.Buffer
+	files := map[string][]byte{
+		"/dash/stream.mpd": []byte(`<MPD type="static" mediaPresentationDuration="PT12S">
+  <Period>
+    <AdaptationSet mimeType="video/mp4">
+      <SegmentTemplate media="$RepresentationID$/$Number$.m4s" initialization="$RepresentationID$/init.mp4" duration="2"/>
+      <Representation id="lo" bandwidth="400000" height="240"/>
+      <Representation id="hi" bandwidth="1600000" height="480"/>
+    </AdaptationSet>
+  </Period>
+</MPD>`),
+	}
+	for _, rep := range []string{"lo", "hi"} {
+		for i := 0; i <= 6; i++ {
+			name := fmt.Sprintf("/dash/%s/%d.m4s", rep, i)
+			if i == 0 {
+				name = "/dash/" + rep + "/init.mp4"
+			}
+			data := randomContent(t, int64(50000+i*1000))
+			files[name] = data
+			if rep == "hi" {
+				want.Write(data)
+			}
+		}
+	}
+	server := newMediaTestServer(files)
+	defer server.Close()
+
+	dir := t.TempDir()
+	results, err := downloadMedia(t, server.URL+"/dash/stream.mpd", dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(results[0].File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want.Bytes()) || filepath.Base(results[0].File) != "stream.mp4" {
+		t.Errorf("got %s with %d bytes, want stream.mp4 with %d", results[0].File, len(data), want.Len())
+	}
+	if n := server.count("/dash/lo/1.m4s"); n != 0 {
+		t.Errorf("the other representation was fetched %d times", n)
+	}
+}
@@ -0,0 +1,134 @@
+package oget
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// ParseDigest splits an expected digest such as "sha256:ab12..." or
+// "sha-1=ab12..." into a normalized hash type and lower-case hex value.
+// A bare hex string is accepted and its type inferred from its length.
+func ParseDigest(digest string) (string, string, error) {
+	digest = strings.TrimSpace(digest)
+	algo, value := "", digest
+	if i := strings.IndexAny(digest, ":="); i >= 0 {
+		algo, value = normalizeHashType(digest[:i]), digest[i+1:]
+	}
+	value = strings.ToLower(strings.TrimSpace(value))
+	if _, err := hex.DecodeString(value); err != nil || value == "" {
+		return "", "", fmt.Errorf("invalid digest value %q", value)
+	}
+
+	if algo == "" {
+		switch len(value) {
+		case 32:
+			algo = "md5"
+		case 40:
+			algo = "sha1"
+		case 64:
+			algo = "sha256"
+		case 96:
+			algo = "sha384"
+		case 128:
+			algo = "sha512"
+		default:
+			return "", "", fmt.Errorf("cannot infer hash type of %q, use type:hex", value)
+		}
+	}
+
+	h, err := newHash(algo)
+	if err != nil {
+		return "", "", err
+	}
+	if len(value) != h.Size()*2 {
+		return "", "", fmt.Errorf("%s digest must be %d hex characters, got %d", algo, h.Size()*2, len(value))
+	}
+	return algo, value, nil
+}
+
+// VerifyFileDigest hashes the file at path and compares it with digest.
+// A mismatch is reported as ErrChecksumMismatch.
+func VerifyFileDigest(path, digest string) error {
+	algo, want, err := ParseDigest(digest)
+	if err != nil {
+		return err
+	}
+	h, _ := newHash(algo)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+	if _, err := io.CopyBuffer(h, f, buf); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("%w: %s: got %s:%s, want %s:%s", ErrChecksumMismatch, path, algo, got, algo, want)
+	}
+	return nil
+}
+
+// VerifyDigest checks the finished file against the expected Digest, if any.
+// On mismatch the file is deleted, or renamed to *.corrupt when the config
+// asks for quarantine, so a corrupt download is never left under its real name.
+func (r *Requester) VerifyDigest() error {
+	var errs []error
+	for _, child := range r.children {
+		if err := child.VerifyDigest(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(r.children) > 0 {
+		return errors.Join(errs...)
+	}
+	if r.Digest == "" {
+		return nil
+	}
+
+	fileName := r.outputPath()
+	err := VerifyFileDigest(fileName, r.Digest)
+	if err == nil {
+		if r.Config.Verbose {
+			log.Printf("Digest verified for %s", fileName)
+		}
+		return nil
+	}
+
+	if r.Config.DigestMismatch == "quarantine" {
+		quarantined := fileName + ".corrupt"
+		if rerr := os.Rename(fileName, quarantined); rerr == nil {
+			log.Printf("Digest mismatch, moved %s to %s", fileName, quarantined)
+		}
+	} else {
+		if rerr := os.Remove(fileName); rerr == nil {
+			log.Printf("Digest mismatch, removed %s", fileName)
+		}
+	}
+	return err
+}
+
+// bestDigest picks the strongest whole-file hash from a metalink entry as "type:hex".
+func bestDigest(hashes map[string]string) string {
+	var best string
+	for algo := range hashes {
+		if _, err := newHash(algo); err != nil {
+			continue
+		}
+		if best == "" || hashStrength(algo) > hashStrength(best) {
+			best = algo
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return best + ":" + hashes[best]
+}
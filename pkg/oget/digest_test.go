@@ -0,0 +1,83 @@
+package oget
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/qtopie/oget/ogettest"
+)
+
+func TestParseDigest(t *testing.T) {
+	sha256Hex := "E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855"
+	tests := []struct {
+		in, algo string
+		ok       bool
+	}{
+		{"sha256:" + sha256Hex, "sha256", true},
+		{"SHA-256=" + sha256Hex, "sha256", true},
+		{sha256Hex, "sha256", true},
+		{"md5:d41d8cd98f00b204e9800998ecf8427e", "md5", true},
+		{"sha1:" + sha256Hex, "", false},
+		{"sha256:zz", "", false},
+		{"crc32:00000000", "", false},
+		{"abcd", "", false},
+	}
+	for _, tt := range tests {
+		algo, value, err := ParseDigest(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseDigest(%q) error = %v, want ok=%v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && (algo != tt.algo || value != strings.ToLower(tt.in[len(tt.in)-len(value):])) {
+			t.Errorf("ParseDigest(%q) => %s:%s", tt.in, algo, value)
+		}
+	}
+}
+
+func TestDownloader_Digest(t *testing.T) {
+	server := ogettest.NewLargeRangeServer(1)
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "oget-digest-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u := server.URL + "/testfile.bin"
+	download := func(digest, onMismatch string) error {
+		d := NewDownloader([]string{u}, 4)
+		d.Config.AutoTune = false
+		d.Config.OutputDir = dir
+		d.Config.DigestMismatch = onMismatch
+		d.Digests = map[string]string{u: digest}
+		d.Fetcher = &HttpFetcher{Client: &http.Client{}, Config: d.Config}
+		_, err := d.Download(context.Background())
+		return err
+	}
+	out := filepath.Join(dir, "testfile.bin")
+
+	if err := download("sha256:"+server.Content.CalculateSHA256(), "delete"); err != nil {
+		t.Fatalf("matching digest rejected: %v", err)
+	}
+	if _, err := os.Stat(out); err != nil {
+		t.Fatalf("verified file missing: %v", err)
+	}
+	os.Remove(out)
+
+	wrong := "sha256:" + "00000000000000000000000000000000" + "00000000000000000000000000000000"
+	if err := download(wrong, "quarantine"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Error("corrupt file left under its real name")
+	}
+	if _, err := os.Stat(out + ".corrupt"); err != nil {
+		t.Errorf("corrupt file not quarantined: %v", err)
+	}
+}
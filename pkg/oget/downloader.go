@@ -2,7 +2,9 @@ package oget
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/url"
 	"os"
@@ -16,14 +18,29 @@ import (
 // Downloader handles the execution of download tasks for multiple URLs.
 type Downloader struct {
 	URLs           []string
+	Mirrors        map[string][]string // Extra mirror URLs for entries of URLs, downloaded as one file
+	Digests        map[string]string   // Expected whole-file digests ("sha256:hex") for entries of URLs
+	FileNames      map[string]string   // Output paths for entries of URLs, relative to Config.OutputDir; named per Config.Naming if missing
+	Configs        map[string]*Config  // Per-resource settings (output dir, headers) for entries of URLs; Config if missing
 	Concurrency    int
 	Config         *Config
 	TotalProcessed int64 // Atomic counter for progress
 	TotalSize      int64 // Total size of all files
 
+	// Cluster, if set, shares the downloads with other oget processes writing
+	// to the same output: chunks are leased from it, see cluster.go.
+	Cluster ClusterStore
+	// ClusterID names this process in Cluster; hostname and PID if empty.
+	ClusterID string
+
 	// Description is shown as the progress bar label (e.g. "Downloading jaeger").
 	// If empty, defaults to "Downloading".
 	Description string
+	// Quiet hides the progress bar and completion message, e.g. in daemon mode.
+	Quiet bool
+	// Limiter caps bandwidth; set it to share one budget between Downloaders.
+	// Built from Config on first use if nil.
+	Limiter *BandwidthLimiter
 
 	// Dynamic Concurrency control
 	activeWorkers     int32
@@ -34,6 +51,15 @@ type Downloader struct {
 	hostQueues sync.Map // map[string]chan *ChunkTask
 	hostKeys   []string
 	mu         sync.RWMutex
+
+	// Endgame: in-flight attempts per chunk, keyed by FileID and ChunkID
+	races  map[string]*chunkRace
+	raceMu sync.Mutex
+
+	// Retries of failed chunks, built from Config when Download starts
+	retryPolicy RetryPolicy
+
+	limiterOnce sync.Once
 }
 
 // NewDownloader creates a new Downloader instance with dynamic control.
@@ -42,6 +68,11 @@ func NewDownloader(urls []string, concurrency int) *Downloader {
 	if concurrency > 0 {
 		cfg.Concurrency = concurrency
 	}
+	return NewDownloaderWithConfig(urls, cfg)
+}
+
+// NewDownloaderWithConfig creates a Downloader using config, e.g. from LoadConfig.
+func NewDownloaderWithConfig(urls []string, cfg *Config) *Downloader {
 	return &Downloader{
 		URLs:              urls,
 		Concurrency:       cfg.Concurrency,
@@ -51,6 +82,32 @@ func NewDownloader(urls []string, concurrency int) *Downloader {
 	}
 }
 
+// bandwidth returns the limiter shared by all workers, built from Config on
+// first use unless one was given.
+func (d *Downloader) bandwidth() *BandwidthLimiter {
+	d.limiterOnce.Do(func() {
+		if d.Limiter == nil {
+			d.Limiter = NewBandwidthLimiter(d.Config)
+		}
+	})
+	return d.Limiter
+}
+
+// SetRateLimit changes the global download cap in bytes/sec while downloading. 0 removes it.
+func (d *Downloader) SetRateLimit(bytesPerSec int64) {
+	d.bandwidth().SetRate(bytesPerSec)
+}
+
+// SetHostRateLimit changes the download cap in bytes/sec for a single host.
+func (d *Downloader) SetHostRateLimit(host string, bytesPerSec int64) {
+	d.bandwidth().SetHostRate(host, bytesPerSec)
+}
+
+// SetURLRateLimit changes the download cap in bytes/sec for a single URL.
+func (d *Downloader) SetURLRateLimit(resource string, bytesPerSec int64) {
+	d.bandwidth().SetURLRate(resource, bytesPerSec)
+}
+
 // getHostQueue returns the queue for a specific host, creating it if needed.
 func (d *Downloader) getHostQueue(host string) chan *ChunkTask {
 	if q, ok := d.hostQueues.Load(host); ok {
@@ -131,6 +188,16 @@ func (d *Downloader) spawnWorker(ctx context.Context, wg *sync.WaitGroup) {
 				}
 			}
 
+			if task == nil && d.Config.Endgame {
+				// Queues are drained: help the slowest in-flight chunk instead of idling.
+				if dup := d.endgameTask(); dup != nil {
+					if d.Config.Verbose {
+						log.Printf("[Endgame] Racing chunk %d of %s from offset %d", dup.ChunkID, dup.FileID, dup.Offset+dup.Written)
+					}
+					task, ok = dup, true
+				}
+			}
+
 			if task == nil {
 				select {
 				case <-ctx.Done():
@@ -147,24 +214,46 @@ func (d *Downloader) spawnWorker(ctx context.Context, wg *sync.WaitGroup) {
 			if !ok {
 				continue
 			}
+			if task.lease != nil && !d.claimChunk(ctx, task) {
+				continue
+			}
 
-			err := d.Fetcher.Fetch(ctx, task)
-			if err != nil {
+			fetchCtx, attempt := d.beginAttempt(ctx, task)
+			err := d.fetch(fetchCtx, task)
+			retry := d.endAttempt(attempt, err)
+			if err != nil && ctx.Err() != nil {
+				// Shutting down: the chunk stays incomplete in the state and is
+				// fetched again on resume.
+				ReleaseChunkTask(task)
+				return
+			}
+			if err != nil && retry && errors.Is(err, errLeaseLost) {
+				// Another process took the chunk over; check on it again later.
+				retryTask := NewChunkTask()
+				*retryTask = *task
+				d.retryLater(ctx, retryTask, leaseRecheckInterval)
+				ReleaseChunkTask(task)
+				continue
+			}
+			if err != nil && retry {
 				log.Printf("Error fetching chunk %d for %s: %v", task.ChunkID, task.FileID, err)
 				task.Retries++
-				if task.Retries < MaxFetchRetries {
+				if task.Retries < d.retryPolicy.MaxAttempts && d.shouldRetry(task, err) {
 					// Re-enqueue the chunk for retry with the same parameters.
 					// Do NOT call OnChunkComplete — that would mark partial/corrupt data
 					// as complete in the bitset and cause the download to finish with a bad file.
+					if task.Result != nil {
+						task.Result.addRetry()
+					}
 					retryTask := NewChunkTask()
 					*retryTask = *task // Copy all fields (Retries, StorageHandler, OnChunkComplete, etc.)
-					d.addTask(retryTask)
+					d.retryLater(ctx, retryTask, d.retryPolicy.Backoff(task.Retries, err))
 				} else {
-					log.Printf("Chunk %d for %s exceeded max retries (%d), file may be corrupt",
-						task.ChunkID, task.FileID, MaxFetchRetries)
-					// Only mark complete after exhausting retries — last resort to avoid hang.
-					if task.OnChunkComplete != nil {
-						task.OnChunkComplete(task.ChunkID, "error")
+					log.Printf("Chunk %d for %s failed after %d attempts, giving up",
+						task.ChunkID, task.FileID, task.Retries)
+					// The chunk stays incomplete in the state so a later run can resume it.
+					if task.OnChunkFailed != nil {
+						task.OnChunkFailed(task.ChunkID, err)
 					}
 				}
 			}
@@ -173,13 +262,74 @@ func (d *Downloader) spawnWorker(ctx context.Context, wg *sync.WaitGroup) {
 	}()
 }
 
-// PrepareAllTasks probes all URLs and returns a flattened list of tasks and the requesters.
+// shouldRetry reports whether a failed chunk is worth another attempt. Errors
+// that are fatal for one server are still retried while other mirrors remain.
+func (d *Downloader) shouldRetry(task *ChunkTask, err error) bool {
+	if IsRetryable(err) {
+		return true
+	}
+	return task.Mirrors != nil && len(task.Mirrors.URLs()) > 1 && !errors.Is(err, ErrServerChanged)
+}
+
+// retryLater re-enqueues task after delay without holding up a worker.
+func (d *Downloader) retryLater(ctx context.Context, task *ChunkTask, delay time.Duration) {
+	if delay <= 0 {
+		d.addTask(task)
+		return
+	}
+	if d.Config.Verbose {
+		log.Printf("Retrying chunk %d of %s in %v", task.ChunkID, task.FileID, delay.Round(time.Millisecond))
+	}
+	time.AfterFunc(delay, func() {
+		if ctx.Err() != nil {
+			ReleaseChunkTask(task) // shutting down; the chunk is resumed from the state file
+			return
+		}
+		d.addTask(task)
+	})
+}
+
+// fetch runs a task, spreading it over its mirrors when it has any. The
+// lease of a cluster task is held while it runs.
+func (d *Downloader) fetch(ctx context.Context, task *ChunkTask) (err error) {
+	if task.lease != nil {
+		var end func(error) error
+		ctx, end = task.lease.hold(ctx, task.ChunkID)
+		defer func() { err = end(err) }()
+	}
+	var fetcher Fetcher = d.Fetcher
+	if task.Verify != nil {
+		// Verify inside the mirror attempt so a mirror serving bad data gets demoted.
+		fetcher = &verifyingFetcher{Fetcher: d.Fetcher}
+	}
+	// Throttle inside the mirror attempt too, by the host the mirror is on.
+	fetcher = &limitedFetcher{Fetcher: fetcher, limiter: d.bandwidth()}
+	if task.Mirrors != nil {
+		return task.Mirrors.Fetch(ctx, fetcher, task)
+	}
+	return fetcher.Fetch(ctx, task)
+}
+
+// PrepareAllTasks probes all URLs and returns a flattened list of tasks and
+// one requester per URL. A requester that failed to prepare has no tasks and
+// its Result is already marked StatusFailed.
 func (d *Downloader) PrepareAllTasks(ctx context.Context) ([]*ChunkTask, []*Requester, error) {
 	var allTasks []*ChunkTask
 	var requesters []*Requester
 	for _, u := range d.URLs {
-		req := NewRequester(u, d.Config)
+		cfg := d.Config
+		if c, ok := d.Configs[u]; ok {
+			cfg = c
+		}
+		req := NewRequester(u, cfg)
 		req.Fetcher = d.Fetcher
+		req.Mirrors = d.Mirrors[u]
+		req.FileName = d.FileNames[u]
+		req.Cluster = d.Cluster
+		req.ClusterID = d.ClusterID
+		if digest, ok := d.Digests[u]; ok {
+			req.Digest = digest
+		}
 
 		var urlTasks []*ChunkTask
 		req.SubmitTask = func(tasks ...*ChunkTask) {
@@ -188,6 +338,9 @@ func (d *Downloader) PrepareAllTasks(ctx context.Context) ([]*ChunkTask, []*Requ
 
 		if err := req.PrepareTasks(ctx); err != nil {
 			log.Printf("Warning: failed to prepare tasks for %s: %v", u, err)
+			req.Close() // whatever was opened before the failure
+			req.Result().finish(StatusFailed, err)
+			requesters = append(requesters, req)
 			continue
 		}
 		
@@ -203,33 +356,43 @@ func (d *Downloader) PrepareAllTasks(ctx context.Context) ([]*ChunkTask, []*Requ
 }
 
 // Download starts the download process with Adaptive Concurrency Control.
-func (d *Downloader) Download(ctx context.Context) {
+// It returns one Result per URL, in the order of URLs, and an error joining
+// the errors of every URL that did not complete.
+func (d *Downloader) Download(ctx context.Context) ([]*Result, error) {
 	parentCtx := ctx
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	var wg sync.WaitGroup
 	var tasksWg sync.WaitGroup
+	d.retryPolicy = NewRetryPolicy(d.Config)
 
 	// 1. Pre-download Probing
 	allTasks, requesters, err := d.PrepareAllTasks(ctx)
 	if err != nil {
 		log.Printf("Error: %v", err)
-		return
+		return nil, err
 	}
+	var failedChunks int32
 
 	// Enhanced Progress Bar
 	description := d.Description
 	if description == "" {
 		description = "Downloading"
 	}
+	var barWriter io.Writer = os.Stderr
+	if d.Quiet {
+		barWriter = io.Discard
+	}
 	bar := progressbar.NewOptions64(d.TotalSize,
 		progressbar.OptionSetDescription(description),
-		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionSetWriter(barWriter),
 		progressbar.OptionShowBytes(true),
 		progressbar.OptionShowCount(),
 		progressbar.OptionOnCompletion(func() {
-			fmt.Fprintln(os.Stderr, "\nDownload finished.")
+			if !d.Quiet && parentCtx.Err() == nil && atomic.LoadInt32(&failedChunks) == 0 {
+				fmt.Fprintln(os.Stderr, "\nDownload finished.")
+			}
 		}),
 		progressbar.OptionSetWidth(15),
 		progressbar.OptionShowElapsedTimeOnFinish(),
@@ -250,22 +413,44 @@ func (d *Downloader) Download(ctx context.Context) {
 
 	// 2. Submit already prepared tasks
 	for _, t := range allTasks {
+		res := t.Result
+		if res == nil {
+			res = newResult(t.URL)
+			t.Result = res
+		}
+		atomic.AddInt64(&res.pending, 1)
+
 		// Create a local variable for the progress bar to be used in the closure
 		onProgress := func(n int) {
 			atomic.AddInt64(&d.TotalProcessed, int64(n))
+			res.addBytes(n)
 			_ = bar.Add(n)
 		}
 		
 		t.OnProgress = onProgress
 		
-		// Track task completion
+		// Track task completion. Endgame duplicates share these callbacks,
+		// so the once guard keeps the bitset and the WaitGroup marked exactly once.
 		tasksWg.Add(1)
 		originalOnComplete := t.OnChunkComplete
+		var completeOnce sync.Once
 		t.OnChunkComplete = func(chunkID int, hash string) {
-			if originalOnComplete != nil {
-				originalOnComplete(chunkID, hash)
-			}
-			tasksWg.Done()
+			completeOnce.Do(func() {
+				if originalOnComplete != nil {
+					originalOnComplete(chunkID, hash)
+				}
+				res.chunkDone()
+				tasksWg.Done()
+			})
+		}
+		fileID := t.FileID
+		t.OnChunkFailed = func(chunkID int, err error) {
+			completeOnce.Do(func() {
+				atomic.AddInt32(&failedChunks, 1)
+				res.fail(fmt.Errorf("%w: chunk %d of %s: %w", ErrIncomplete, chunkID, fileID, err))
+				res.chunkDone()
+				tasksWg.Done()
+			})
 		}
 	}
 	d.addTask(allTasks...)
@@ -330,12 +515,61 @@ func (d *Downloader) Download(ctx context.Context) {
 	}()
 
 	wg.Wait()
-	_ = bar.Finish()
 
-	// Cleanup state files if download completed successfully
-	if parentCtx.Err() == nil {
+	// Interrupted: flush what we have and keep the state files for resume.
+	if parentCtx.Err() != nil {
+		_ = bar.Exit()
+		err := fmt.Errorf("download interrupted: %w", parentCtx.Err())
+		results, _ := d.results(requesters)
 		for _, r := range requesters {
-			r.Cleanup()
+			if r.Result().Status == StatusFailed {
+				continue // never prepared
+			}
+			r.Close()
+			r.Result().finish(StatusInterrupted, err)
+		}
+		return results, err
+	}
+	_ = bar.Finish()
+
+	// Cleanup state files if download completed successfully, then check digests
+	// on the synced files. A URL with abandoned chunks keeps its state for resume.
+	for _, r := range requesters {
+		res := r.Result()
+		if res.Status == StatusFailed {
+			continue // never prepared
+		}
+		if res.err() != nil {
+			r.Close()
+			res.finish(StatusFailed, nil)
+			continue
+		}
+		if err := r.assembleMedia(parentCtx); err != nil {
+			log.Printf("Error: %v", err)
+			r.Close()
+			res.finish(StatusFailed, err)
+			continue
+		}
+		r.Cleanup()
+		if err := r.VerifyDigest(); err != nil {
+			log.Printf("Error: %v", err)
+			res.fail(err)
+		}
+		res.finish(StatusCompleted, nil)
+	}
+	return d.results(requesters)
+}
+
+// results collects the Result of every requester and joins their errors.
+func (d *Downloader) results(requesters []*Requester) ([]*Result, error) {
+	results := make([]*Result, 0, len(requesters))
+	var errs []error
+	for _, r := range requesters {
+		res := r.Result()
+		results = append(results, res)
+		if err := res.err(); err != nil {
+			errs = append(errs, err)
 		}
 	}
+	return results, errors.Join(errs...)
 }
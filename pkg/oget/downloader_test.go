@@ -0,0 +1,272 @@
+package oget
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qtopie/oget/ogettest"
+)
+
+func TestDownloader_InterruptResume(t *testing.T) {
+	// A fixed modification time, so the resumed run sees an unchanged file.
+	content := &ogettest.DummyContent{Size: 8 * 1024 * 1024}
+	modTime := time.Now().Add(-time.Hour)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "testfile.bin", modTime, &ogettest.DummyContent{Size: content.Size})
+	}))
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "oget-interrupt-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u := server.URL + "/testfile.bin"
+	newDownloader := func() *Downloader {
+		d := NewDownloader([]string{u}, 2)
+		d.Config.AutoTune = false
+		d.Config.OutputDir = dir
+		d.Fetcher = &HttpFetcher{Client: &http.Client{}, Config: d.Config}
+		return d
+	}
+
+	// Throttle the first run so the interrupt lands mid-download.
+	first := newDownloader()
+	first.Config.RateLimit = 2 * 1024 * 1024
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	if _, err := first.Download(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected an interrupted download, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".testfile.bin.oget")); err != nil {
+		t.Fatalf("state file not kept after interrupt: %v", err)
+	}
+
+	second := newDownloader()
+	if _, err := second.Download(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if second.TotalSize >= content.Size {
+		t.Errorf("resume re-downloaded everything (%d bytes)", second.TotalSize)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "testfile.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != content.CalculateSHA256() {
+		t.Error("resumed file does not match the served content")
+	}
+}
+
+func TestDownloader_NoRangeSupport(t *testing.T) {
+	content := &ogettest.DummyContent{Size: 3 * 1024 * 1024}
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&gets, 1)
+		}
+		r.Header.Del("Range") // ranges are not supported
+		http.ServeContent(w, r, "", time.Time{}, &ogettest.DummyContent{Size: content.Size})
+	}))
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "oget-norange-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := NewDownloader([]string{server.URL + "/testfile.bin"}, 4)
+	d.Config.AutoTune = false
+	d.Config.OutputDir = dir
+	d.Config.Checksum = true
+	d.Fetcher = &HttpFetcher{Client: &http.Client{}, Config: d.Config}
+	results, err := d.Download(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0]; r.Status != StatusCompleted || r.Bytes != content.Size {
+		t.Errorf("%s %v, %d bytes", r.Status, r.Err, r.Bytes)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "testfile.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != content.CalculateSHA256() {
+		t.Error("downloaded file does not match the served content")
+	}
+	// One probe GET for the first byte, then a single stream for the body.
+	if gets != 2 {
+		t.Errorf("expected 2 GET requests, got %d", gets)
+	}
+}
+
+func TestDownloader_Results(t *testing.T) {
+	good := ogettest.NewLargeRangeServer(2)
+	defer good.Close()
+
+	// Probes fine, then fails every chunk.
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			good.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	// Serves a different ETag once chunks are requested.
+	changed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("ETag", `"v2"`)
+		} else {
+			w.Header().Set("ETag", `"v1"`)
+		}
+		http.ServeContent(w, r, "", time.Now(), &ogettest.DummyContent{Size: 1024 * 1024})
+	}))
+	defer changed.Close()
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	dir, err := os.MkdirTemp("", "oget-results-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	urls := []string{
+		good.URL + "/good.bin",
+		missing.URL + "/missing.bin",
+		unavailable.URL + "/unavailable.bin",
+		changed.URL + "/changed.bin",
+	}
+
+	d := NewDownloader(urls, 4)
+	d.Config.AutoTune = false
+	d.Config.OutputDir = dir
+	d.Fetcher = &HttpFetcher{Client: &http.Client{}, Config: d.Config}
+	results, err := d.Download(context.Background())
+	if err == nil {
+		t.Fatal("expected an error for the failed URLs")
+	}
+	if len(results) != len(urls) {
+		t.Fatalf("expected %d results, got %d", len(urls), len(results))
+	}
+
+	if r := results[0]; r.Status != StatusCompleted || r.Err != nil || r.Bytes != good.Content.Size || r.Protocol != "http" {
+		t.Errorf("good: %s %v, %d bytes via %s", r.Status, r.Err, r.Bytes, r.Protocol)
+	}
+	if r := results[1]; r.Status != StatusFailed || !errors.Is(r.Err, ErrNotFound) {
+		t.Errorf("missing: %s %v", r.Status, r.Err)
+	}
+	// Two chunks, each retried at most MaxFetchRetries-1 times, endgame duplicates included.
+	if r := results[2]; r.Status != StatusFailed || !errors.Is(r.Err, ErrIncomplete) || r.Retries == 0 || r.Retries > 2*(MaxFetchRetries-1) {
+		t.Errorf("unavailable: %s %v after %d retries", r.Status, r.Err, r.Retries)
+	}
+	if r := results[3]; r.Status != StatusFailed || !errors.Is(r.Err, ErrServerChanged) {
+		t.Errorf("changed: %s %v", r.Status, r.Err)
+	}
+	// A failed download keeps its state so it can be resumed.
+	if _, err := os.Stat(filepath.Join(dir, ".unavailable.bin.oget")); err != nil {
+		t.Errorf("state of the failed download was removed: %v", err)
+	}
+}
+
+func TestDownloader_ResumeUnknownLength(t *testing.T) {
+	content := make([]byte, 3*1024*1024)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+
+	for _, honourRange := range []bool{true, false} {
+		var ranges []string
+		var slow atomic.Bool
+		slow.Store(true)
+		// Streams without Content-Length, so the size is unknown until EOF.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				return
+			}
+			start := 0
+			if rng := r.Header.Get("Range"); rng != "" {
+				ranges = append(ranges, rng)
+				if honourRange {
+					fmt.Sscanf(rng, "bytes=%d-", &start)
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", start, len(content)-1))
+					w.WriteHeader(http.StatusPartialContent)
+				}
+			}
+			for off := start; off < len(content); off += 64 * 1024 {
+				if _, err := w.Write(content[off:min(off+64*1024, len(content))]); err != nil {
+					return
+				}
+				w.(http.Flusher).Flush()
+				if slow.Load() {
+					time.Sleep(20 * time.Millisecond)
+				}
+			}
+		}))
+
+		dir, err := os.MkdirTemp("", "oget-stream-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		newDownloader := func() *Downloader {
+			d := NewDownloader([]string{server.URL + "/archive.tar"}, 1)
+			d.Config.AutoTune = false
+			d.Config.OutputDir = dir
+			d.Fetcher = &HttpFetcher{Client: &http.Client{}, Config: d.Config}
+			return d
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		if _, err := newDownloader().Download(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected an interrupted download, got %v", err)
+		}
+		cancel()
+		state, err := LoadState(filepath.Join(dir, ".archive.tar.oget"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset := state.StreamOffset
+		state.Close()
+		if offset <= 0 || offset >= int64(len(content)) {
+			t.Fatalf("unexpected stream offset %d after interrupt", offset)
+		}
+
+		slow.Store(false)
+		if _, err := newDownloader().Download(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "archive.tar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, content) {
+			t.Errorf("honourRange=%v: resumed file differs (%d bytes, want %d)", honourRange, len(data), len(content))
+		}
+		if want := fmt.Sprintf("bytes=%d-", offset); len(ranges) != 1 || ranges[0] != want {
+			t.Errorf("honourRange=%v: expected one %q request, got %v", honourRange, want, ranges)
+		}
+
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
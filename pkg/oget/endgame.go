@@ -0,0 +1,183 @@
+package oget
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// endgameMinRemaining is the smallest unfinished tail worth racing a duplicate for.
+const endgameMinRemaining int64 = 64 * 1024
+
+// chunkRace tracks every in-flight attempt at one chunk. Near the end of a
+// download an idle worker may start a duplicate attempt for the tail of the
+// slowest chunk; the first attempt to finish wins and the others are cancelled.
+type chunkRace struct {
+	attempts   []*chunkAttempt
+	onProgress func(int) // the chunk's progress callback before any attempt wrapped it
+	onComplete func(int, string)
+	reported   int64 // bytes of this chunk already passed to onProgress
+	duplicated bool  // an endgame duplicate has been handed out
+	won        bool
+}
+
+// chunkAttempt is a single worker fetching (part of) a chunk.
+type chunkAttempt struct {
+	task    *ChunkTask
+	start   ChunkTask // copy of task when the attempt began; the fetch may rewrite task.URL and callbacks
+	cancel  context.CancelFunc
+	covered int64 // bytes from task.Offset known to be on disk for this attempt
+}
+
+func raceKey(task *ChunkTask) string {
+	return fmt.Sprintf("%s#%d", task.FileID, task.ChunkID)
+}
+
+// beginAttempt registers task as in-flight and wires its progress so that
+// racing attempts never report the same bytes twice.
+func (d *Downloader) beginAttempt(ctx context.Context, task *ChunkTask) (context.Context, *chunkAttempt) {
+	ctx, cancel := context.WithCancel(ctx)
+	a := &chunkAttempt{task: task, start: *task, cancel: cancel, covered: task.Written}
+
+	d.raceMu.Lock()
+	defer d.raceMu.Unlock()
+	if d.races == nil {
+		d.races = make(map[string]*chunkRace)
+	}
+	key := raceKey(task)
+	race, ok := d.races[key]
+	if !ok {
+		race = &chunkRace{onProgress: task.OnProgress, onComplete: task.OnChunkComplete, reported: task.Written}
+		d.races[key] = race
+	}
+	race.attempts = append(race.attempts, a)
+
+	task.OnProgress = func(n int) {
+		d.raceMu.Lock()
+		a.covered += int64(n)
+		delta := a.covered - race.reported
+		if delta > 0 {
+			race.reported = a.covered
+		}
+		d.raceMu.Unlock()
+		if delta > 0 && race.onProgress != nil {
+			race.onProgress(int(delta))
+		}
+	}
+	return ctx, a
+}
+
+// endAttempt unregisters a finished attempt and restores the task's original
+// progress callback. It reports whether the caller should retry the chunk,
+// which is never the case if another attempt already won or is still running.
+func (d *Downloader) endAttempt(a *chunkAttempt, err error) (retry bool) {
+	d.raceMu.Lock()
+	defer d.raceMu.Unlock()
+
+	a.cancel()
+	key := raceKey(a.task)
+	race := d.races[key]
+	if race == nil {
+		return err != nil
+	}
+	a.task.OnProgress = race.onProgress
+
+	for i, other := range race.attempts {
+		if other == a {
+			race.attempts = append(race.attempts[:i], race.attempts[i+1:]...)
+			break
+		}
+	}
+
+	if err == nil && !race.won {
+		race.won = true
+		for _, other := range race.attempts {
+			other.cancel()
+		}
+	}
+
+	if len(race.attempts) == 0 {
+		delete(d.races, key)
+	}
+	if err == nil || race.won {
+		return false
+	}
+	return len(race.attempts) == 0
+}
+
+// endgameTask returns a duplicate of the in-flight chunk with the most bytes
+// left, resuming from what is already on disk, or nil if nothing is worth racing.
+func (d *Downloader) endgameTask() *ChunkTask {
+	d.raceMu.Lock()
+	defer d.raceMu.Unlock()
+
+	var slowest *chunkAttempt
+	var slowestRemaining int64
+	for _, race := range d.races {
+		// One duplicate per chunk is enough; more only adds load on the server.
+		if race.won || race.duplicated || len(race.attempts) != 1 {
+			continue
+		}
+		a := race.attempts[0]
+		if a.start.Length <= 0 || a.start.Sequential || isSwarmResource(a.start.URL) {
+			continue
+		}
+		remaining := a.start.Length - a.covered
+		if remaining >= endgameMinRemaining && remaining > slowestRemaining {
+			slowest = a
+			slowestRemaining = remaining
+		}
+	}
+	if slowest == nil {
+		return nil
+	}
+
+	dup := NewChunkTask()
+	*dup = slowest.start
+	dup.Written = slowest.covered
+	// Retries stays as is: if the duplicate outlives the original and fails,
+	// it is the one retried, and the chunk must not get fresh attempts.
+	// The in-flight task's callbacks may be wrapped for this attempt only.
+	race := d.races[raceKey(&slowest.start)]
+	race.duplicated = true
+	dup.OnProgress = race.onProgress
+	dup.OnChunkComplete = race.onComplete
+	if dup.Written > 0 && (d.Config.Checksum || d.Config.VerifyOnResume) {
+		// The fetcher only hashes what it downloaded itself, so the duplicate
+		// would finish without a digest: hash the whole chunk from disk.
+		dup.OnChunkComplete = func(chunkID int, hash string) {
+			if hash == "" {
+				var err error
+				if hash, err = hashRange(dup.StorageHandler, dup.Offset, dup.Length); err != nil {
+					log.Printf("Warning: failed to hash chunk %d of %s: %v", chunkID, dup.FileID, err)
+					hash = ""
+				}
+			}
+			if race.onComplete != nil {
+				race.onComplete(chunkID, hash)
+			}
+		}
+	}
+	return dup
+}
+
+// hashRange returns the hex SHA-256 of length bytes of storage at offset.
+func hashRange(storage StorageHandler, offset, length int64) (string, error) {
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+	h := sha256.New()
+	if _, err := io.CopyBuffer(h, io.NewSectionReader(storage, offset, length), buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isSwarmResource reports whether the URL is handled by BitTorrent, which
+// manages its own piece scheduling and must never be duplicated.
+func isSwarmResource(resource string) bool {
+	return strings.HasPrefix(strings.ToLower(resource), "magnet:") || isTorrentResource(resource)
+}
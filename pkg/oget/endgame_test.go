@@ -0,0 +1,108 @@
+package oget
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEndgameRace(t *testing.T) {
+	d := NewDownloader(nil, 1)
+
+	var reported int
+	task := &ChunkTask{
+		FileID:  "file",
+		ChunkID: 3,
+		Length:  RangeSize,
+		URL:     "http://example.com/file",
+		OnProgress: func(n int) {
+			reported += n
+		},
+	}
+
+	ctx1, first := d.beginAttempt(context.Background(), task)
+	task.OnProgress(100 * 1024)
+
+	dup := d.endgameTask()
+	if dup == nil {
+		t.Fatal("expected a duplicate for the slow chunk")
+	}
+	if dup.Written != 100*1024 {
+		t.Errorf("duplicate should resume at 100KB, got %d", dup.Written)
+	}
+	if d.endgameTask() != nil {
+		t.Error("expected no second duplicate while one is racing")
+	}
+
+	ctx2, second := d.beginAttempt(context.Background(), dup)
+	// The duplicate re-covers the same region; only new bytes are reported.
+	dup.OnProgress(50 * 1024)
+	task.OnProgress(10 * 1024)
+	if reported != 150*1024 {
+		t.Errorf("got %d reported bytes, want %d", reported, 150*1024)
+	}
+
+	if retry := d.endAttempt(second, nil); retry {
+		t.Error("winner should not be retried")
+	}
+	if ctx1.Err() == nil {
+		t.Error("losing attempt should be cancelled")
+	}
+	if ctx2.Err() == nil {
+		t.Error("finished attempt context should be released")
+	}
+	if retry := d.endAttempt(first, errors.New("cancelled")); retry {
+		t.Error("loser should not be retried after the race was won")
+	}
+	if len(d.races) != 0 {
+		t.Errorf("expected race bookkeeping to be cleared, got %d entries", len(d.races))
+	}
+}
+
+func TestEndgameSkipsTorrent(t *testing.T) {
+	d := NewDownloader(nil, 1)
+	task := &ChunkTask{FileID: "iso", Length: 10 * RangeSize, URL: "magnet:?xt=urn:btih:abc"}
+	d.beginAttempt(context.Background(), task)
+	if d.endgameTask() != nil {
+		t.Error("BitTorrent tasks must never be duplicated")
+	}
+}
+
+func TestEndgameDuplicateHash(t *testing.T) {
+	d := NewDownloader(nil, 1)
+	d.Config.Checksum = true
+	content := randomContent(t, RangeSize)
+	file, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteAt(content, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	task := &ChunkTask{
+		FileID:          "file",
+		Length:          RangeSize,
+		URL:             "http://example.com/file",
+		StorageHandler:  &FileStorageHandler{File: file},
+		OnChunkComplete: func(_ int, hash string) { got = hash },
+	}
+	d.beginAttempt(context.Background(), task)
+	task.OnProgress(100 * 1024)
+	dup := d.endgameTask()
+	if dup == nil {
+		t.Fatal("expected a duplicate for the slow chunk")
+	}
+	// The duplicate's fetcher only saw the tail and reports no digest.
+	dup.OnChunkComplete(0, "")
+	sum := sha256.Sum256(content)
+	if want := hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("duplicate completed with hash %q, want the whole chunk's %s", got, want)
+	}
+}
@@ -0,0 +1,76 @@
+package oget
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+// Errors reported in Result.Err. Match them with errors.Is; they are wrapped
+// with the URL or chunk they apply to.
+var (
+	// ErrNotFound means the server reported the resource as missing (404, 410).
+	ErrNotFound = errors.New("resource not found")
+	// ErrServerChanged means the resource changed on the server mid-download.
+	ErrServerChanged = errors.New("resource changed on server")
+	// ErrIncomplete means some chunks could not be fetched; the state file is
+	// kept so the download can be resumed.
+	ErrIncomplete = errors.New("download incomplete")
+	// ErrRangeNotSupported means the server answered a range request with the
+	// whole body, so the chunk cannot be placed at its offset.
+	ErrRangeNotSupported = errors.New("server does not support range requests")
+)
+
+// StatusError is an HTTP response with an unexpected status code.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	RetryAfter time.Duration // from the Retry-After header of a 429 or 503, if any
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.URL)
+}
+
+// Is makes 404 and 410 responses match ErrNotFound.
+func (e *StatusError) Is(target error) bool {
+	return target == ErrNotFound && (e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone)
+}
+
+// FtpError is an FTP reply with an unexpected code. 4xx replies are
+// transient, 5xx ones permanent.
+type FtpError struct {
+	Code int
+	Msg  string
+}
+
+func (e *FtpError) Error() string {
+	return fmt.Sprintf("ftp reply %d %s", e.Code, e.Msg)
+}
+
+// Is makes 550 (file unavailable) replies match ErrNotFound.
+func (e *FtpError) Is(target error) bool {
+	return target == ErrNotFound && e.Code == 550
+}
+
+// SftpError is an SSH or SFTP failure that retrying cannot fix: a refused
+// login, a host key not matching known_hosts, a missing file or a denied
+// permission.
+type SftpError struct {
+	Err error
+}
+
+func (e *SftpError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SftpError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes missing files match ErrNotFound.
+func (e *SftpError) Is(target error) bool {
+	return target == ErrNotFound && errors.Is(e.Err, fs.ErrNotExist)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
@@ -13,6 +14,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -166,13 +169,114 @@ type ChunkTask struct {
 	FetcherHandler  Fetcher
 	OnProgress      func(bytesRead int)
 	OnChunkComplete func(chunkID int, hash string)
-	Retries         int   // Number of times this chunk has been retried
-	Written         int64 // Bytes already written to storage (used for resume on retry)
+	Retries         int        // Number of times this chunk has been retried
+	Written         int64      // Bytes already written to storage (used for resume on retry)
+	Mirrors         *MirrorSet // Optional alternative sources; URL is rewritten per attempt
+	// Verify, if set, checks the chunk on storage after a successful fetch.
+	// The chunk is only marked complete if it returns nil; otherwise it is re-fetched.
+	Verify func(task *ChunkTask) error
+	// OnChunkFailed is called instead of OnChunkComplete when the chunk is given up on.
+	OnChunkFailed func(chunkID int, err error)
+	ETag          string            // Entity tag seen when probing; a response with another one fails with ErrServerChanged
+	LastModified  string            // Last-Modified seen when probing, used like ETag when there is none
+	Result        *Result           // Per-URL accounting shared by all chunks of a resource
+	Headers       map[string]string // Extra request headers (Config.Headers of the resource)
+	// Sequential marks the only chunk of a file whose server cannot serve
+	// ranges: it is fetched without Range, from the start on every attempt,
+	// and never raced by endgame.
+	Sequential bool
+	// lease, in cluster mode, is taken on the chunk before each fetch.
+	lease *clusterLease
 }
 
-// MaxFetchRetries is the maximum number of times a chunk fetch will be retried on failure.
+// ifRange returns the validator to send in If-Range: the ETag if it is a
+// well-formed strong one, otherwise the Last-Modified date. Servers ignore
+// the range for weak or unquoted tags, which would look like a change.
+func (t *ChunkTask) ifRange() string {
+	if len(t.ETag) >= 2 && strings.HasPrefix(t.ETag, `"`) && strings.HasSuffix(t.ETag, `"`) {
+		return t.ETag
+	}
+	return t.LastModified
+}
+
+// checkValidators returns ErrServerChanged if the response carries an ETag or
+// Last-Modified that differs from the one the download started with.
+func (t *ChunkTask) checkValidators(h http.Header) error {
+	if etag := h.Get("ETag"); t.ETag != "" && etag != "" && etag != t.ETag {
+		return fmt.Errorf("%w: %s now has ETag %s, expected %s", ErrServerChanged, t.URL, etag, t.ETag)
+	}
+	if t.ETag == "" {
+		if lm := h.Get("Last-Modified"); t.LastModified != "" && lm != "" && lm != t.LastModified {
+			return fmt.Errorf("%w: %s now last modified %s, expected %s", ErrServerChanged, t.URL, lm, t.LastModified)
+		}
+	}
+	return nil
+}
+
+// parseContentRange parses a "bytes start-end/total" Content-Range header.
+// total is -1 if the server gave "*".
+func parseContentRange(s string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(s), "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	rng, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil || total <= end {
+			return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+		}
+	}
+	return start, end, total, nil
+}
+
+// MaxFetchRetries is the default number of attempts per chunk (Config.RetryMaxAttempts).
 const MaxFetchRetries = 3
 
+// ErrChecksumMismatch is returned when downloaded data does not match its expected digest.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// verifyingFetcher holds back OnChunkComplete until task.Verify accepts the
+// data on storage, so bad chunks are re-fetched instead of marked complete.
+type verifyingFetcher struct {
+	Fetcher
+}
+
+func (f *verifyingFetcher) Fetch(ctx context.Context, task *ChunkTask) error {
+	onChunkComplete := task.OnChunkComplete
+	var completed bool
+	var hash string
+	task.OnChunkComplete = func(chunkID int, h string) {
+		completed, hash = true, h
+	}
+	err := f.Fetcher.Fetch(ctx, task)
+	task.OnChunkComplete = onChunkComplete
+	if err != nil || !completed {
+		return err
+	}
+	if err := task.Verify(task); err != nil {
+		task.Written = 0 // the whole chunk has to be fetched again
+		return err
+	}
+	if onChunkComplete != nil {
+		onChunkComplete(task.ChunkID, hash)
+	}
+	return nil
+}
+
 // HttpFetcher implements Fetcher for HTTP protocol.
 type HttpFetcher struct {
 	Client *http.Client
@@ -181,6 +285,12 @@ type HttpFetcher struct {
 
 // NewHttpFetcher creates a new HttpFetcher with BBR, Keepalive, H2, H3 and Proxy support.
 func NewHttpFetcher(config *Config) *HttpFetcher {
+	return newHttpFetcher(config, nil)
+}
+
+// newHttpFetcher is NewHttpFetcher with sign, if not nil, wrapped around the
+// innermost transport, so it sees every request as it is sent.
+func newHttpFetcher(config *Config, sign func(http.RoundTripper) http.RoundTripper) *HttpFetcher {
 	if config == nil {
 		config = DefaultConfig()
 	}
@@ -250,11 +360,17 @@ func NewHttpFetcher(config *Config) *HttpFetcher {
 		}
 	}
 
+	var transport http.RoundTripper = &hybridRoundTripper{
+		h12: t1,
+		h3:  h3Transport,
+	}
+	if sign != nil {
+		transport = sign(transport)
+	}
 	client := &http.Client{
-		Transport: &hybridRoundTripper{
-			h12: t1,
-			h3:  h3Transport,
-		},
+		Transport:     newAuthTransport(config, newHostHeaderTransport(config, transport)),
+		CheckRedirect: checkRedirect,
+		Jar:           cookieJarFor(config),
 	}
 
 	return &HttpFetcher{
@@ -281,6 +397,48 @@ func (h *hybridRoundTripper) RoundTrip(req *http.Request) (*http.Response, error
 	return h.h12.RoundTrip(req)
 }
 
+// setRequestHeaders sets the User-Agent of config, oget's by default, and
+// then the extra headers, which may replace it.
+func setRequestHeaders(req *http.Request, config *Config, extra map[string]string) {
+	userAgent := "oget/" + Version
+	if config != nil && config.UserAgent != "" {
+		userAgent = config.UserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+	for k, v := range extra {
+		req.Header.Set(k, v)
+	}
+}
+
+// hostHeaderTransport sets Config.HostHeaders on requests to their host,
+// including those redirected there, and only on those.
+type hostHeaderTransport struct {
+	next   http.RoundTripper
+	config *Config
+}
+
+func newHostHeaderTransport(config *Config, next http.RoundTripper) *hostHeaderTransport {
+	return &hostHeaderTransport{next: next, config: config}
+}
+
+func (t *hostHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.config == nil || len(t.config.HostHeaders) == 0 {
+		return t.next.RoundTrip(req)
+	}
+	headers, ok := t.config.HostHeaders[strings.ToLower(req.URL.Host)]
+	if !ok {
+		headers, ok = t.config.HostHeaders[strings.ToLower(req.URL.Hostname())]
+	}
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	out := req.Clone(req.Context())
+	for k, v := range headers {
+		out.Header.Set(k, v)
+	}
+	return t.next.RoundTrip(out)
+}
+
 // Fetch executes a single ChunkTask with context support.
 // On partial success (error with written > 0), task.Written is updated so the
 // caller can retry with Range starting from task.Offset+task.Written, skipping
@@ -291,13 +449,31 @@ func (f *HttpFetcher) Fetch(ctx context.Context, task *ChunkTask) error {
 		return err
 	}
 
-	req.Header.Set("User-Agent", "oget/"+Version)
+	setRequestHeaders(req, f.Config, task.Headers)
 	// Resume from task.Written if this is a retry — the first `Written` bytes
 	// were already written to storage by a previous attempt and need not be re-downloaded.
+	if task.Sequential {
+		task.Written = 0 // no way to ask for the rest: plain GET, start over
+	}
 	rangeStart := task.Offset + task.Written
-	rangeEnd := task.Offset + task.Length - 1
-	rangeHeader := fmt.Sprintf("bytes=%d-%d", rangeStart, rangeEnd)
-	req.Header.Set("Range", rangeHeader)
+	rangeEnd := int64(-1)
+	switch {
+	case task.Sequential:
+	case task.Length == -1:
+		// Unknown length: stream to EOF, asking for the rest once something is on disk.
+		if rangeStart > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", rangeStart))
+		}
+	default:
+		rangeEnd = task.Offset + task.Length - 1
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rangeStart, rangeEnd))
+	}
+	// If-Range makes a server whose copy changed send the new version in
+	// full (200) instead of a range of it, which is detected below.
+	ifRange := task.ifRange()
+	if ifRange != "" && req.Header.Get("Range") != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
 
 	resp, err := f.Client.Do(req)
 	if err != nil {
@@ -306,23 +482,60 @@ func (f *HttpFetcher) Fetch(ctx context.Context, task *ChunkTask) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return &StatusError{
+			URL:        task.URL,
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	if err := task.checkValidators(resp.Header); err != nil {
+		return err
+	}
+
+	written := task.Written
+	if resp.StatusCode == http.StatusPartialContent {
+		start, end, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return fmt.Errorf("%s: %w", task.URL, err)
+		}
+		// A shorter range than asked for is fine, the rest is fetched on
+		// retry; anything else would put bytes at the wrong offset.
+		if start != rangeStart || (rangeEnd >= 0 && end > rangeEnd) {
+			return fmt.Errorf("%s: got Content-Range bytes %d-%d for Range %s",
+				task.URL, start, end, req.Header.Get("Range"))
+		}
+	} else if req.Header.Get("Range") != "" {
+		// 200 to a range request: with If-Range this means the validator no
+		// longer matches, unless the response shows the very same one.
+		if ifRange != "" && resp.Header.Get("ETag") != ifRange && resp.Header.Get("Last-Modified") != ifRange {
+			return fmt.Errorf("%w: %s no longer matches If-Range %s", ErrServerChanged, task.URL, ifRange)
+		}
+		switch {
+		case task.Length == -1:
+			// The server ignored the range and sent the whole body: start over.
+			log.Printf("Server ignored range for %s, restarting stream from the beginning", task.URL)
+			written = 0
+		case rangeStart > 0:
+			// The body starts at byte 0, not at the chunk's offset.
+			return fmt.Errorf("%w: %s answered Range %s with the whole body", ErrRangeNotSupported, task.URL, req.Header.Get("Range"))
+		}
 	}
 
 	var h hash.Hash
 	var body io.Reader = resp.Body
 	// Only compute SHA-256 when downloading the full chunk from scratch.
-	// When resuming (task.Written > 0), the data stream only covers the
+	// When resuming (written > 0), the data stream only covers the
 	// remaining bytes, so a partial hash would be meaningless.
-	if f.Config != nil && f.Config.Checksum && task.Written == 0 {
+	// The digest is also recorded in the state file for VerifyOnResume.
+	if f.Config != nil && (f.Config.Checksum || f.Config.VerifyOnResume) && written == 0 {
 		h = sha256.New()
 		body = io.TeeReader(resp.Body, h)
 	}
 
-	written := task.Written
 	for {
 		select {
 		case <-ctx.Done():
+			task.Written = written // save progress for resume
 			return ctx.Err()
 		default:
 		}
@@ -344,12 +557,18 @@ func (f *HttpFetcher) Fetch(ctx context.Context, task *ChunkTask) error {
 		}
 
 		if err != nil {
-			if err != io.EOF && err != io.ErrUnexpectedEOF {
+			// A stream of unknown length cut short is only detectable here.
+			if err != io.EOF && (err != io.ErrUnexpectedEOF || task.Length == -1) {
 				task.Written = written // save progress for resume
 				return err
 			}
 			break
 		}
+		if n == 0 {
+			// EOF; a chunk cut short, e.g. by a shorter Content-Range,
+			// fails below and the rest is fetched on retry.
+			break
+		}
 	}
 
 	if task.Length != -1 && written < task.Length {
@@ -2,11 +2,15 @@ package oget
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHttpFetcher_Fetch(t *testing.T) {
@@ -170,3 +174,179 @@ func TestHttpFetcher_FetchChecksum(t *testing.T) {
 	}
 }
 
+
+func TestHttpFetcher_IfRange(t *testing.T) {
+	content := "0123456789abcdefghij"
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	etag := `"v1"`
+	ignoreRange := false
+	var gotIfRange string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotIfRange = r.Header.Get("If-Range")
+		w.Header().Set("ETag", etag)
+		if ignoreRange {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(w, r, "", modTime, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	fileName := "test_fetch_if_range"
+	file, _ := os.Create(fileName)
+	defer os.Remove(fileName)
+	defer file.Close()
+	fetcher := &HttpFetcher{Client: &http.Client{}}
+	newTask := func() *ChunkTask {
+		return &ChunkTask{
+			FileID:         fileName,
+			Offset:         10,
+			Length:         5,
+			URL:            server.URL,
+			StorageHandler: &FileStorageHandler{File: file},
+			FetcherHandler: fetcher,
+			ETag:           `"v1"`,
+			LastModified:   modTime.Format(http.TimeFormat),
+		}
+	}
+
+	// Unchanged: the range is served and lands at its offset.
+	if err := fetcher.Fetch(context.TODO(), newTask()); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if gotIfRange != `"v1"` {
+		t.Errorf("expected If-Range %q, got %q", `"v1"`, gotIfRange)
+	}
+	data, _ := os.ReadFile(fileName)
+	if string(data[10:]) != "abcde" {
+		t.Errorf("got %q at offset 10, want %q", data[10:], "abcde")
+	}
+
+	// Changed: the server sends the new version in full, which must not be
+	// written at the chunk's offset.
+	etag = `"v2"`
+	file.Truncate(0)
+	if err := fetcher.Fetch(context.TODO(), newTask()); !errors.Is(err, ErrServerChanged) {
+		t.Errorf("expected ErrServerChanged, got %v", err)
+	}
+	if fi, _ := file.Stat(); fi.Size() != 0 {
+		t.Errorf("changed resource was written to storage (%d bytes)", fi.Size())
+	}
+
+	// A weak ETag cannot be used in If-Range; Last-Modified is sent instead.
+	etag = `W/"v1"`
+	task := newTask()
+	task.ETag = `W/"v1"`
+	if err := fetcher.Fetch(context.TODO(), task); err != nil {
+		t.Fatalf("Fetch with Last-Modified validator failed: %v", err)
+	}
+	if gotIfRange != modTime.Format(http.TimeFormat) {
+		t.Errorf("expected If-Range with Last-Modified, got %q", gotIfRange)
+	}
+
+	// Same version but no range support: refuse rather than write byte 0 at offset 10.
+	etag = `"v1"`
+	ignoreRange = true
+	file.Truncate(0)
+	if err := fetcher.Fetch(context.TODO(), newTask()); !errors.Is(err, ErrRangeNotSupported) {
+		t.Errorf("expected ErrRangeNotSupported, got %v", err)
+	}
+	if fi, _ := file.Stat(); fi.Size() != 0 {
+		t.Errorf("full body was written to storage (%d bytes)", fi.Size())
+	}
+}
+
+func TestHttpFetcher_ContentRangeMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Always answers with the first bytes, whatever was asked for.
+		w.Header().Set("Content-Range", "bytes 0-4/20")
+		w.WriteHeader(http.StatusPartialContent)
+		fmt.Fprint(w, "01234")
+	}))
+	defer server.Close()
+
+	fileName := "test_fetch_content_range"
+	file, _ := os.Create(fileName)
+	defer os.Remove(fileName)
+	defer file.Close()
+
+	fetcher := &HttpFetcher{Client: &http.Client{}}
+	task := &ChunkTask{
+		FileID:         fileName,
+		Offset:         10,
+		Length:         5,
+		URL:            server.URL,
+		StorageHandler: &FileStorageHandler{File: file},
+		FetcherHandler: fetcher,
+	}
+	if err := fetcher.Fetch(context.TODO(), task); err == nil {
+		t.Error("Fetch should have failed for a mismatched Content-Range")
+	}
+	if fi, _ := file.Stat(); fi.Size() != 0 {
+		t.Errorf("mismatched range was written to storage (%d bytes)", fi.Size())
+	}
+}
+
+func TestHttpFetcher_ShortContentRange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Sends the first half of the range asked for, which is allowed.
+		w.Header().Set("Content-Range", "bytes 10-14/20")
+		w.Header().Set("Content-Length", "5")
+		w.WriteHeader(http.StatusPartialContent)
+		fmt.Fprint(w, "abcde")
+	}))
+	defer server.Close()
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "short_range"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	fetcher := &HttpFetcher{Client: &http.Client{}}
+	task := &ChunkTask{
+		FileID:         file.Name(),
+		Offset:         10,
+		Length:         10,
+		URL:            server.URL,
+		StorageHandler: &FileStorageHandler{File: file},
+		FetcherHandler: fetcher,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = fetcher.Fetch(ctx, task)
+	if err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Fetch = %v, want an incomplete download error", err)
+	}
+	// The bytes received are kept for the retry to resume after.
+	if task.Written != 5 {
+		t.Errorf("Written = %d, want 5", task.Written)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		in                string
+		start, end, total int64
+		ok                bool
+	}{
+		{"bytes 0-99/1000", 0, 99, 1000, true},
+		{"bytes 100-199/*", 100, 199, -1, true},
+		{"bytes 5-5/6", 5, 5, 6, true},
+		{"bytes 10-5/20", 0, 0, 0, false},
+		{"bytes 0-99/50", 0, 0, 0, false},
+		{"bytes */1000", 0, 0, 0, false},
+		{"items 0-9/10", 0, 0, 0, false},
+		{"", 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, end, total, err := parseContentRange(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseContentRange(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && (start != tt.start || end != tt.end || total != tt.total) {
+			t.Errorf("parseContentRange(%q) = %d, %d, %d, want %d, %d, %d",
+				tt.in, start, end, total, tt.start, tt.end, tt.total)
+		}
+	}
+}
@@ -0,0 +1,735 @@
+package oget
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+FTP support: ftp://, ftps:// (implicit TLS, port 990) and ftpes:// (explicit
+TLS via AUTH TLS, port 21). Both FTPS forms protect data connections too.
+
+Logging in costs several round trips and servers ban clients that keep
+reconnecting, so control connections are kept logged in, in a pool per
+server and account holding at most Config.Concurrency of them. A chunk is a
+REST and RETR on a pooled connection. FTP has no ranged RETR, so once the
+chunk is read the transfer is stopped with ABOR. Servers answer that with
+426 and 226, with only 226 or 225 if the transfer had already ended, so a
+NOOP follows and replies are skipped up to its 200.
+
+Data connections use EPSV, which works over IPv6, and fall back to PASV.
+They always go to the control connection's address, ignoring the one in a
+PASV reply, which is often wrong behind NAT and could point anywhere.
+*/
+
+// ftpIdleTimeout is how long a pooled connection may sit idle before it is
+// assumed the server has dropped it.
+const ftpIdleTimeout = time.Minute
+
+var pasvReply = regexp.MustCompile(`(\d+),(\d+),(\d+),(\d+),(\d+),(\d+)`)
+
+// ftpConn is a logged-in FTP control connection in binary mode.
+type ftpConn struct {
+	raw      net.Conn // TCP connection, for deadlines
+	text     *textproto.Conn
+	host     string      // server IP, for data connections
+	dataTLS  *tls.Config // nil unless data connections are protected
+	timeout  time.Duration
+	noEPSV   bool
+	reused   bool // taken from the pool rather than dialled
+	lastUsed time.Time
+}
+
+// dialFtp connects and logs in to the server of u.
+func dialFtp(ctx context.Context, u *url.URL, config *Config, tlsConfig *tls.Config) (*ftpConn, error) {
+	scheme := strings.ToLower(u.Scheme)
+	port := u.Port()
+	if port == "" {
+		port = "21"
+		if scheme == "ftps" {
+			port = "990"
+		}
+	}
+	timeout := time.Duration(config.Timeout) * time.Second
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	raw, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { raw.SetDeadline(time.Now()) })
+	defer stop()
+
+	c := &ftpConn{raw: raw, host: raw.RemoteAddr().(*net.TCPAddr).IP.String(), timeout: timeout}
+	var conn net.Conn = raw
+	if scheme == "ftps" {
+		conn = tls.Client(raw, tlsConfig)
+	}
+	c.text = textproto.NewConn(conn)
+	if err := c.login(u, scheme, tlsConfig); err != nil {
+		c.text.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	c.raw.SetDeadline(time.Time{})
+	c.lastUsed = time.Now()
+	return c, nil
+}
+
+func (c *ftpConn) login(u *url.URL, scheme string, tlsConfig *tls.Config) error {
+	c.raw.SetDeadline(deadline(c.timeout))
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		return ftpReplyError(err)
+	}
+	if scheme == "ftpes" {
+		if _, _, err := c.cmd(234, "AUTH TLS"); err != nil {
+			return fmt.Errorf("server refused explicit TLS: %w", err)
+		}
+		c.text = textproto.NewConn(tls.Client(c.raw, tlsConfig))
+	}
+
+	user, pass := "anonymous", "anonymous"
+	if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			pass = p
+		}
+	}
+	code, _, err := c.cmd(0, "USER %s", user)
+	if err == nil && code == 331 {
+		code, _, err = c.cmd(0, "PASS %s", pass)
+	}
+	if err != nil {
+		return err
+	}
+	if code != 230 && code != 202 {
+		return fmt.Errorf("ftp login as %s failed: %w", user, &FtpError{Code: code, Msg: "login rejected"})
+	}
+
+	if scheme == "ftps" || scheme == "ftpes" {
+		if _, _, err := c.cmd(200, "PBSZ 0"); err != nil {
+			return err
+		}
+		if _, _, err := c.cmd(200, "PROT P"); err != nil {
+			return err
+		}
+		c.dataTLS = tlsConfig
+	}
+	_, _, err = c.cmd(200, "TYPE I")
+	return err
+}
+
+// deadline returns when an operation starting now times out, or the zero
+// time, meaning never, for a timeout of 0 as with HTTP.
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// cmd sends a command and reads its reply, which must have code expect
+// (one to three leading digits; 0 accepts any 1xx-3xx reply).
+func (c *ftpConn) cmd(expect int, format string, args ...any) (int, string, error) {
+	c.raw.SetDeadline(deadline(c.timeout))
+	if _, err := c.text.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	code, msg, err := c.text.ReadResponse(expect)
+	if expect == 0 && err == nil && code >= 400 {
+		err = &FtpError{Code: code, Msg: msg}
+	}
+	return code, msg, ftpReplyError(err)
+}
+
+// ftpReplyError turns a textproto reply error into an *FtpError.
+func ftpReplyError(err error) error {
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		return &FtpError{Code: te.Code, Msg: te.Msg}
+	}
+	return err
+}
+
+// openData opens a passive data connection.
+func (c *ftpConn) openData(ctx context.Context) (net.Conn, error) {
+	var port int
+	if !c.noEPSV {
+		_, msg, err := c.cmd(229, "EPSV")
+		var fe *FtpError
+		switch {
+		case err == nil:
+			port, err = parseEpsvReply(msg)
+			if err != nil {
+				return nil, err
+			}
+		case errors.As(err, &fe):
+			c.noEPSV = true // not supported; use PASV from now on
+		default:
+			return nil, err
+		}
+	}
+	if port == 0 {
+		_, msg, err := c.cmd(227, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		m := pasvReply.FindStringSubmatch(msg)
+		if m == nil {
+			return nil, fmt.Errorf("invalid PASV reply %q", msg)
+		}
+		p1, _ := strconv.Atoi(m[5])
+		p2, _ := strconv.Atoi(m[6])
+		port = p1<<8 | p2
+	}
+
+	dialer := &net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(c.host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	if c.dataTLS != nil {
+		conn = tls.Client(conn, c.dataTLS)
+	}
+	return conn, nil
+}
+
+// parseEpsvReply reads the port from "Entering Extended Passive Mode (|||port|)".
+func parseEpsvReply(msg string) (int, error) {
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end < start+5 {
+		return 0, fmt.Errorf("invalid EPSV reply %q", msg)
+	}
+	fields := msg[start+1 : end]
+	d := fields[:1]
+	parts := strings.Split(fields, d)
+	if len(parts) != 5 {
+		return 0, fmt.Errorf("invalid EPSV reply %q", msg)
+	}
+	port, err := strconv.Atoi(parts[3])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid EPSV reply %q", msg)
+	}
+	return port, nil
+}
+
+// retr starts downloading path from offset and returns the data connection.
+func (c *ftpConn) retr(ctx context.Context, path string, offset int64) (net.Conn, error) {
+	data, err := c.openData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, _, err := c.cmd(350, "REST %d", offset); err != nil {
+			data.Close()
+			return nil, err
+		}
+	}
+	if _, _, err := c.cmd(1, "RETR %s", path); err != nil {
+		data.Close()
+		return nil, err
+	}
+	return data, nil
+}
+
+// finish reads the reply that ends a transfer the server completed.
+func (c *ftpConn) finish() error {
+	c.raw.SetDeadline(deadline(c.timeout))
+	_, _, err := c.text.ReadResponse(2)
+	return ftpReplyError(err)
+}
+
+// abort stops the transfer in progress and waits until the connection is
+// ready for the next command.
+func (c *ftpConn) abort() error {
+	c.raw.SetDeadline(deadline(c.timeout))
+	if _, err := c.text.Cmd("ABOR"); err != nil {
+		return err
+	}
+	if _, err := c.text.Cmd("NOOP"); err != nil {
+		return err
+	}
+	// At most the transfer's reply and ABOR's precede NOOP's.
+	for range 3 {
+		code, _, err := c.text.ReadResponse(0)
+		if err != nil {
+			return err
+		}
+		if code == 200 {
+			return nil
+		}
+	}
+	return errors.New("no reply to NOOP after ABOR")
+}
+
+func (c *ftpConn) close() {
+	c.raw.SetDeadline(time.Now().Add(time.Second))
+	c.text.Cmd("QUIT")
+	c.text.Close()
+}
+
+// Pools of logged-in control connections, by server and account; closed
+// by CleanupProtocols.
+var (
+	ftpPoolsMu sync.Mutex
+	ftpPools   = make(map[string]*ftpPool)
+)
+
+type ftpPool struct {
+	url       *url.URL
+	config    *Config
+	tlsConfig *tls.Config
+
+	mu       sync.Mutex
+	idle     []*ftpConn
+	open     int
+	limit    int
+	released chan struct{} // closed when a connection is returned or dropped
+}
+
+// getFtpPool returns the pool for the server and account of u.
+func getFtpPool(u *url.URL, config *Config) *ftpPool {
+	key := strings.ToLower(u.Scheme) + "://" + u.User.String() + "@" + u.Host
+	ftpPoolsMu.Lock()
+	defer ftpPoolsMu.Unlock()
+	if p, ok := ftpPools[key]; ok {
+		return p
+	}
+	tlsConfig := &tls.Config{}
+	if config.TLSConfig != nil {
+		tlsConfig = config.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	// Servers such as vsftpd require data connections to resume the
+	// control connection's TLS session.
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	p := &ftpPool{
+		url:       &url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host},
+		config:    config,
+		tlsConfig: tlsConfig,
+		limit:     max(config.Concurrency, 1),
+		released:  make(chan struct{}),
+	}
+	ftpPools[key] = p
+	return p
+}
+
+// get returns an idle connection or dials a new one, waiting while the
+// pool is at its limit.
+func (p *ftpPool) get(ctx context.Context) (*ftpConn, error) {
+	for {
+		p.mu.Lock()
+		for len(p.idle) > 0 {
+			c := p.idle[len(p.idle)-1]
+			p.idle = p.idle[:len(p.idle)-1]
+			if time.Since(c.lastUsed) < ftpIdleTimeout {
+				p.mu.Unlock()
+				c.reused = true
+				return c, nil
+			}
+			c.close()
+			p.open--
+		}
+		if p.open < p.limit {
+			p.open++
+			p.mu.Unlock()
+			c, err := dialFtp(ctx, p.url, p.config, p.tlsConfig)
+			if err == nil {
+				return c, nil
+			}
+			p.mu.Lock()
+			p.open--
+			p.notify()
+			// 421 is how servers refuse more connections per client:
+			// make do with the ones already open.
+			var fe *FtpError
+			if errors.As(err, &fe) && fe.Code == 421 && p.open > 0 {
+				p.limit = p.open
+				if p.config.Verbose {
+					log.Printf("%s allows %d connections", p.url.Host, p.limit)
+				}
+				p.mu.Unlock()
+				continue
+			}
+			p.mu.Unlock()
+			return nil, err
+		}
+		released := p.released
+		p.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// put returns a connection to the pool, or closes it if it is not usable.
+func (p *ftpPool) put(c *ftpConn, usable bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if usable {
+		c.lastUsed = time.Now()
+		c.raw.SetDeadline(time.Time{})
+		p.idle = append(p.idle, c)
+	} else {
+		c.close()
+		p.open--
+	}
+	p.notify()
+}
+
+func (p *ftpPool) notify() {
+	close(p.released)
+	p.released = make(chan struct{})
+}
+
+// acquire returns a pooled connection on which fn succeeded; the caller
+// puts it back. A reused connection failing outside an FTP reply was
+// probably dropped by the server while idle, so fn is run once more on a
+// new one.
+func (p *ftpPool) acquire(ctx context.Context, fn func(c *ftpConn) error) (*ftpConn, error) {
+	for {
+		c, err := p.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err = fn(c); err == nil {
+			return c, nil
+		}
+		usable := isFtpReply(err)
+		p.put(c, usable)
+		if usable || !c.reused || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// closeFtpPools logs out of every pooled connection.
+func closeFtpPools() {
+	ftpPoolsMu.Lock()
+	pools := ftpPools
+	ftpPools = make(map[string]*ftpPool)
+	ftpPoolsMu.Unlock()
+	for _, p := range pools {
+		p.mu.Lock()
+		for _, c := range p.idle {
+			c.close()
+		}
+		p.open -= len(p.idle)
+		p.idle = nil
+		p.mu.Unlock()
+	}
+}
+
+// ftpPath returns the file path of an FTP URL. The path is sent in commands
+// on the control connection, so a line break (%0d%0a in the URL) that would
+// start another command is refused.
+func ftpPath(u *url.URL) (string, error) {
+	if u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return "", fmt.Errorf("%s does not name a file", u.Redacted())
+	}
+	if strings.ContainsAny(u.Path, "\r\n") {
+		return "", fmt.Errorf("%s: line break in the path", u.Redacted())
+	}
+	return u.Path, nil
+}
+
+// FtpProber implements Prober for FTP and FTPS.
+type FtpProber struct {
+	Config *Config
+}
+
+func NewFtpProber(config *Config) *FtpProber {
+	return &FtpProber{Config: config}
+}
+
+func (p *FtpProber) Probe(ctx context.Context, resource string) (*ResourceMetadata, error) {
+	u, err := url.Parse(resource)
+	if err != nil {
+		return nil, err
+	}
+	path, err := ftpPath(u)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &ResourceMetadata{}
+	pool := getFtpPool(u, p.Config)
+	c, err := pool.acquire(ctx, func(c *ftpConn) error {
+		_, msg, err := c.cmd(213, "SIZE %s", path)
+		switch {
+		case err == nil:
+			if meta.Size, err = strconv.ParseInt(strings.TrimSpace(msg), 10, 64); err != nil {
+				return fmt.Errorf("invalid SIZE reply %q", msg)
+			}
+		case !isFtpReply(err):
+			return err
+		default:
+			// Without SIZE, MLST or a LIST of the directory may tell;
+			// otherwise the length is unknown and the file is fetched as
+			// one stream.
+			if size, mlstErr := c.mlstSize(path); mlstErr == nil {
+				meta.Size = size
+				break
+			} else if !isFtpReply(mlstErr) {
+				return mlstErr
+			}
+			size, found, listErr := c.listSize(ctx, path)
+			switch {
+			case listErr != nil && !isFtpReply(listErr):
+				return listErr
+			case found:
+				meta.Size = size
+			case errors.Is(err, ErrNotFound):
+				return err
+			}
+		}
+
+		_, msg, err = c.cmd(213, "MDTM %s", path)
+		if err != nil && !isFtpReply(err) {
+			return err
+		}
+		if err == nil {
+			// YYYYMMDDhhmmss, possibly with fractional seconds.
+			stamp, _, _ := strings.Cut(strings.TrimSpace(msg), ".")
+			if t, err := time.Parse("20060102150405", stamp); err == nil {
+				meta.LastModified = t.Format(http.TimeFormat)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", u.Redacted(), err)
+	}
+	pool.put(c, true)
+	// REST works with every server worth using; one that refuses it fails
+	// the chunk instead of corrupting it.
+	meta.AcceptRanges = meta.Size > 0
+	return meta, nil
+}
+
+// mlstSize reads the size fact of MLST (RFC 3659), for servers without SIZE.
+func (c *ftpConn) mlstSize(path string) (int64, error) {
+	_, msg, err := c.cmd(250, "MLST %s", path)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(msg, "\n") {
+		facts, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+		for _, fact := range strings.Split(facts, ";") {
+			if k, v, ok := strings.Cut(fact, "="); ok && strings.EqualFold(k, "size") {
+				return strconv.ParseInt(v, 10, 64)
+			}
+		}
+	}
+	return 0, errors.New("MLST reply has no size")
+}
+
+// listSize looks path up in a LIST of its directory, for servers with
+// neither SIZE nor MLST. found is false if the listing does not show it as
+// a file in a format understood by listLineSize.
+func (c *ftpConn) listSize(ctx context.Context, path string) (size int64, found bool, err error) {
+	i := strings.LastIndex(path, "/")
+	dir, name := path[:i+1], path[i+1:]
+	data, err := c.openData(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	if _, _, err := c.cmd(1, "LIST %s", dir); err != nil {
+		data.Close()
+		return 0, false, err
+	}
+	data.SetReadDeadline(deadline(c.timeout))
+	listing, err := io.ReadAll(data)
+	data.Close()
+	if err != nil {
+		return 0, false, err
+	}
+	if err := c.finish(); err != nil {
+		return 0, false, err
+	}
+	for _, line := range strings.Split(string(listing), "\n") {
+		if size, ok := listLineSize(strings.TrimRight(line, "\r"), name); ok {
+			return size, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// listLineSize reads the size of file name from a LIST line in the Unix
+// "ls -l" format or the DOS one of IIS:
+//
+//	-rw-r--r--   1 ftp  ftp   1000 May 01 12:00 name
+//	05-01-24  12:00PM         1000 name
+func listLineSize(line, name string) (int64, bool) {
+	fields := strings.Fields(line)
+	var size, rest string
+	switch {
+	case len(fields) >= 9 && strings.HasPrefix(fields[0], "-"):
+		size, rest = fields[4], afterFields(line, 8)
+	case len(fields) >= 4 && strings.Count(fields[0], "-") == 2:
+		// "<DIR>" for directories, which fails to parse.
+		size, rest = fields[2], afterFields(line, 3)
+	default:
+		return 0, false
+	}
+	if rest != name {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	return n, err == nil
+}
+
+// afterFields returns what follows the first n space-separated fields of
+// line, which keeps the spaces in a file name.
+func afterFields(line string, n int) string {
+	for range n {
+		line = strings.TrimLeft(line, " ")
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return ""
+		}
+		line = line[i:]
+	}
+	return strings.TrimLeft(line, " ")
+}
+
+func isFtpReply(err error) bool {
+	var fe *FtpError
+	return errors.As(err, &fe)
+}
+
+// FtpFetcher implements Fetcher for FTP and FTPS.
+type FtpFetcher struct {
+	Config *Config
+}
+
+func NewFtpFetcher(config *Config) *FtpFetcher {
+	return &FtpFetcher{Config: config}
+}
+
+func (f *FtpFetcher) Fetch(ctx context.Context, task *ChunkTask) error {
+	u, err := url.Parse(task.URL)
+	if err != nil {
+		return err
+	}
+	path, err := ftpPath(u)
+	if err != nil {
+		return err
+	}
+	pool := getFtpPool(u, f.Config)
+
+	var data net.Conn
+	c, err := pool.acquire(ctx, func(c *ftpConn) error {
+		data, err = c.retr(ctx, path, task.Offset+task.Written)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("ftp RETR %s: %w", u.Redacted(), err)
+	}
+
+	stop := context.AfterFunc(ctx, func() { data.Close() })
+	written, eof, err := f.read(task, data)
+	stop()
+	data.Close()
+
+	// The control connection is reusable once the transfer's replies are
+	// read: the final one if the server sent the whole file, otherwise
+	// those to ABOR.
+	usable := false
+	switch {
+	case ctx.Err() != nil:
+		err = ctx.Err()
+	case eof && err == nil:
+		ferr := c.finish()
+		usable = ferr == nil || isFtpReply(ferr)
+	default:
+		usable = c.abort() == nil
+	}
+	pool.put(c, usable)
+
+	if err == nil && task.Length != -1 && written < task.Length {
+		err = fmt.Errorf("ftp download incomplete: got %d bytes, want %d", written, task.Length)
+	}
+	if err != nil {
+		task.Written = written // save progress for resume
+		return err
+	}
+	return nil
+}
+
+// read copies the chunk from data to storage and reports whether the
+// transfer reached the end of the file.
+func (f *FtpFetcher) read(task *ChunkTask, data net.Conn) (written int64, eof bool, err error) {
+	written = task.Written
+	var h hash.Hash
+	var body io.Reader = data
+	if f.Config != nil && (f.Config.Checksum || f.Config.VerifyOnResume) && written == 0 {
+		h = sha256.New()
+		body = io.TeeReader(data, h)
+	}
+
+	for task.Length == -1 || written < task.Length {
+		remaining := task.Length - written
+		if task.Length == -1 {
+			remaining = 32 * 1024
+		}
+		data.SetReadDeadline(deadline(time.Duration(f.Config.Timeout) * time.Second))
+		n, err := task.StorageHandler.ReadAtFrom(body, task.Offset+written, remaining)
+		if n > 0 {
+			written += n
+			if task.OnProgress != nil {
+				task.OnProgress(int(n))
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == nil && n < remaining {
+			eof = true
+			break
+		}
+		if err != nil {
+			return written, false, err
+		}
+	}
+
+	if !eof {
+		// The chunk is in. If it was the end of the file the server closes
+		// the data connection now, which saves an ABOR.
+		var one [1]byte
+		if n, err := data.Read(one[:]); n == 0 && err == io.EOF {
+			eof = true
+		}
+	}
+	if task.Length != -1 && written < task.Length {
+		return written, eof, nil
+	}
+	if task.OnChunkComplete != nil {
+		var hashStr string
+		if h != nil {
+			hashStr = hex.EncodeToString(h.Sum(nil))
+		}
+		task.OnChunkComplete(task.ChunkID, hashStr)
+	}
+	return written, eof, nil
+}
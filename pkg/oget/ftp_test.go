@@ -0,0 +1,275 @@
+package oget
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/qtopie/oget/ogettest"
+)
+
+// downloadFtp fetches the file at path from server with the given number of
+// workers and returns its content.
+func downloadFtp(t *testing.T, server *ogettest.FtpServer, path string, concurrency int) []byte {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "oget-ftp-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := NewDownloader([]string{server.URL + path}, concurrency)
+	d.Config.AutoTune = false
+	d.Config.Endgame = false
+	d.Config.OutputDir = dir
+	d.Config.Timeout = 5
+	if server.RootCAs != nil {
+		d.Config.TLSConfig = &tls.Config{RootCAs: server.RootCAs}
+	}
+	d.Quiet = true
+	results, err := d.Download(context.Background())
+	closeFtpPools()
+	if err != nil {
+		t.Fatalf("download %s: %v", server.URL+path, err)
+	}
+	data, err := os.ReadFile(results[0].File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(results[0].File) != filepath.Base(path) {
+		t.Errorf("saved as %s", results[0].File)
+	}
+	return data
+}
+
+func randomContent(t *testing.T, n int64) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestFtpDownload(t *testing.T) {
+	content := randomContent(t, 6*RangeSize+12345)
+	server := ogettest.NewFtpServer(map[string][]byte{"/pub/data.bin": content})
+	defer server.Close()
+
+	if got := downloadFtp(t, server, "/pub/data.bin", 3); !bytes.Equal(got, content) {
+		t.Fatalf("downloaded %d bytes that differ from the %d served", len(got), len(content))
+	}
+	// 7 chunks over at most 3 pooled connections, one login each; every
+	// chunk short of the end is cut off with ABOR.
+	if n := server.Logins.Load(); n > 3 {
+		t.Errorf("logged in %d times, want at most 3", n)
+	}
+	if n := server.PeakConns.Load(); n > 3 {
+		t.Errorf("%d connections open at once, want at most 3", n)
+	}
+	if n := server.Transfers.Load(); n != 7 {
+		t.Errorf("%d transfers, want 7", n)
+	}
+	if n := server.Aborts.Load(); n == 0 || n > 6 {
+		t.Errorf("%d transfers aborted, want 1-6", n)
+	}
+}
+
+func TestFtpDownload_TLS(t *testing.T) {
+	content := randomContent(t, 3*RangeSize)
+	for _, implicit := range []bool{false, true} {
+		server := ogettest.NewUnstartedFtpServer(map[string][]byte{"/secure.bin": content})
+		server.User, server.Password = "alice", "s3cret"
+		server.StartTLS(implicit)
+		defer server.Close()
+		server.URL = server.URL[:len(server.URL)-len(server.Addr)] + "alice:s3cret@" + server.Addr
+
+		if got := downloadFtp(t, server, "/secure.bin", 2); !bytes.Equal(got, content) {
+			t.Errorf("%s: downloaded file differs", server.URL)
+		}
+		if n := server.Logins.Load(); n == 0 || n > 2 {
+			t.Errorf("%s: logged in %d times", server.URL, n)
+		}
+	}
+}
+
+func TestFtpDownload_PassiveModes(t *testing.T) {
+	content := randomContent(t, 2*RangeSize+1)
+
+	// A server without EPSV gets PASV.
+	server := ogettest.NewUnstartedFtpServer(map[string][]byte{"/f.bin": content})
+	server.DisableEPSV = true
+	server.Start()
+	defer server.Close()
+	if got := downloadFtp(t, server, "/f.bin", 2); !bytes.Equal(got, content) {
+		t.Error("PASV download differs")
+	}
+
+	// PASV cannot describe IPv6 addresses; EPSV can.
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	ln.Close()
+	server6 := ogettest.NewUnstartedFtpServer(map[string][]byte{"/f.bin": content})
+	server6.Listen = "[::1]:0"
+	server6.Start()
+	defer server6.Close()
+	if got := downloadFtp(t, server6, "/f.bin", 2); !bytes.Equal(got, content) {
+		t.Error("IPv6 download differs")
+	}
+}
+
+func TestFtpDownload_ConnectionLimit(t *testing.T) {
+	content := randomContent(t, 8*RangeSize)
+	server := ogettest.NewUnstartedFtpServer(map[string][]byte{"/f.bin": content})
+	server.MaxConns = 2
+	server.Start()
+	defer server.Close()
+
+	// The pool shrinks to what the server allows instead of failing chunks.
+	if got := downloadFtp(t, server, "/f.bin", 6); !bytes.Equal(got, content) {
+		t.Fatal("download differs")
+	}
+	if n := server.PeakConns.Load(); n > 2 {
+		t.Errorf("%d connections open at once, want at most 2", n)
+	}
+}
+
+func TestFtpDownload_NoTimeout(t *testing.T) {
+	content := randomContent(t, 2*RangeSize+1)
+	server := ogettest.NewFtpServer(map[string][]byte{"/f.bin": content})
+	defer server.Close()
+
+	// A timeout of 0 means none, as for HTTP, not an expired deadline.
+	d := NewDownloader([]string{server.URL + "/f.bin"}, 2)
+	d.Config.AutoTune = false
+	d.Config.OutputDir = t.TempDir()
+	d.Config.Timeout = 0
+	d.Quiet = true
+	results, err := d.Download(context.Background())
+	closeFtpPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(results[0].File); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("downloaded %d bytes, %v; want the %d served", len(got), err, len(content))
+	}
+}
+
+func TestFtpProbe_WithoutSIZE(t *testing.T) {
+	config := DefaultConfig()
+	config.Timeout = 5
+	for _, noMLST := range []bool{false, true} {
+		server := ogettest.NewUnstartedFtpServer(map[string][]byte{
+			"/pub/a.bin":       make([]byte, 3*RangeSize),
+			"/pub/a.bin.asc":   make([]byte, 10),
+			"/pub/other/a.bin": make([]byte, 1),
+		})
+		server.DisableSIZE = true
+		server.DisableMLST = noMLST
+		server.Start()
+		defer server.Close()
+
+		// MLST gives the size, else a LIST of the directory does, so the
+		// file is still fetched in chunks.
+		meta, err := NewFtpProber(config).Probe(context.Background(), server.URL+"/pub/a.bin")
+		closeFtpPools()
+		if err != nil {
+			t.Fatalf("without MLST %v: %v", noMLST, err)
+		}
+		if meta.Size != 3*RangeSize || !meta.AcceptRanges {
+			t.Errorf("without MLST %v: Probe = %+v, want size %d with ranges", noMLST, meta, 3*RangeSize)
+		}
+
+		_, err = NewFtpProber(config).Probe(context.Background(), server.URL+"/pub/missing.bin")
+		closeFtpPools()
+		if err != nil {
+			t.Errorf("without MLST %v: probing a file missing from the listing: %v", noMLST, err)
+		}
+	}
+}
+
+func TestListLineSize(t *testing.T) {
+	tests := []struct {
+		line, name string
+		size       int64
+		ok         bool
+	}{
+		{"-rw-r--r--   1 ftp      ftp          1000 May 01 12:00 a.bin", "a.bin", 1000, true},
+		{"-rw-r--r--   1 ftp      ftp             7 May 01  2023 my a.bin", "my a.bin", 7, true},
+		{"-rw-r--r--   1 ftp      ftp             7 May 01  2023 my a.bin", "a.bin", 0, false},
+		{"drwxr-xr-x   2 ftp      ftp          4096 May 01 12:00 a.bin", "a.bin", 0, false},
+		{"05-01-24  12:00PM                 2048 a.bin", "a.bin", 2048, true},
+		{"05-01-24  12:00PM       <DIR>          a.bin", "a.bin", 0, false},
+		{"-rw-r--r--   1 ftp      ftp          1000 May 01 12:00 b.bin", "a.bin", 0, false},
+	}
+	for _, tt := range tests {
+		size, ok := listLineSize(tt.line, tt.name)
+		if size != tt.size || ok != tt.ok {
+			t.Errorf("listLineSize(%q, %q) = %d, %v; want %d, %v", tt.line, tt.name, size, ok, tt.size, tt.ok)
+		}
+	}
+}
+
+func TestFtpPathInjection(t *testing.T) {
+	server := ogettest.NewFtpServer(map[string][]byte{"/a.bin": make([]byte, 1000)})
+	defer server.Close()
+	defer closeFtpPools()
+	config := DefaultConfig()
+	config.Timeout = 5
+
+	// The decoded path would end SIZE and send DELE as a command of its own.
+	resource := server.URL + "/a.bin%0d%0aDELE%20/a.bin"
+	if _, err := NewFtpProber(config).Probe(context.Background(), resource); err == nil {
+		t.Error("probing a path with a line break succeeded")
+	}
+	task := &ChunkTask{URL: resource, Length: 1000, StorageHandler: &FileStorageHandler{}}
+	if err := NewFtpFetcher(config).Fetch(context.Background(), task); err == nil {
+		t.Error("fetching a path with a line break succeeded")
+	}
+	if n := server.Logins.Load(); n != 0 {
+		t.Errorf("logged in %d times, want no commands sent", n)
+	}
+}
+
+func TestFtpProbe(t *testing.T) {
+	server := ogettest.NewFtpServer(map[string][]byte{"/a.bin": make([]byte, 1000)})
+	defer server.Close()
+	defer closeFtpPools()
+	config := DefaultConfig()
+	config.Timeout = 5
+
+	meta, err := NewFtpProber(config).Probe(context.Background(), server.URL+"/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != 1000 || !meta.AcceptRanges || meta.LastModified != "Wed, 01 May 2024 12:00:00 GMT" {
+		t.Errorf("Probe = %+v", meta)
+	}
+
+	_, err = NewFtpProber(config).Probe(context.Background(), server.URL+"/missing.bin")
+	if !errors.Is(err, ErrNotFound) || IsRetryable(err) {
+		t.Errorf("probing a missing file: %v, want a fatal ErrNotFound", err)
+	}
+	// Both probes shared one login.
+	if n := server.Logins.Load(); n != 1 {
+		t.Errorf("logged in %d times, want 1", n)
+	}
+
+	badLogin := ogettest.NewUnstartedFtpServer(nil)
+	badLogin.User, badLogin.Password = "bob", "right"
+	badLogin.Start()
+	defer badLogin.Close()
+	_, err = NewFtpProber(config).Probe(context.Background(), "ftp://bob:wrong@"+badLogin.Addr+"/a.bin")
+	var fe *FtpError
+	if !errors.As(err, &fe) || fe.Code != 530 || IsRetryable(err) {
+		t.Errorf("bad login: %v, want a fatal 530", err)
+	}
+}
@@ -0,0 +1,244 @@
+package oget
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// hlsPlaylist is a parsed HLS playlist: a master playlist lists Variants,
+// a media playlist has a Stream.
+type hlsPlaylist struct {
+	Variants []hlsVariant
+	Stream   *mediaStream
+}
+
+// hlsVariant is one EXT-X-STREAM-INF of a master playlist.
+type hlsVariant struct {
+	mediaVariant
+	URI string
+}
+
+// parseHLS parses an M3U8 playlist whose URIs are relative to base.
+func parseHLS(data []byte, base *url.URL) (*hlsPlaylist, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	playlist := &hlsPlaylist{}
+	stream := &mediaStream{Live: true}
+	var (
+		header     bool
+		variant    *hlsVariant // EXT-X-STREAM-INF waiting for its URI
+		sequence   int64
+		key        *mediaKey
+		keyIV      []byte
+		keys       = map[string]*mediaKey{}
+		mapSeg     *mediaSegment // current EXT-X-MAP
+		lastMap    *mediaSegment // EXT-X-MAP last added to the stream
+		byteRange  string        // EXT-X-BYTERANGE for the next segment
+		rangeEnds  = map[string]int64{}
+		hasMapTags bool
+	)
+	resolve := func(ref string) (string, error) {
+		u, err := url.Parse(ref)
+		if err != nil {
+			return "", fmt.Errorf("invalid URI %q: %w", ref, err)
+		}
+		return base.ResolveReference(u).String(), nil
+	}
+	// applyRange sets the byte range spec "n[@o]" on seg; without an offset
+	// the range follows the previous one of the same URI.
+	applyRange := func(seg *mediaSegment, spec string) error {
+		seg.Length = -1
+		if spec == "" {
+			return nil
+		}
+		lengthStr, offsetStr, hasOffset := strings.Cut(spec, "@")
+		length, err := strconv.ParseInt(lengthStr, 10, 64)
+		if err != nil || length < 0 {
+			return fmt.Errorf("invalid byte range %q", spec)
+		}
+		offset := rangeEnds[seg.URL]
+		if hasOffset {
+			if offset, err = strconv.ParseInt(offsetStr, 10, 64); err != nil || offset < 0 {
+				return fmt.Errorf("invalid byte range %q", spec)
+			}
+		}
+		seg.Offset, seg.Length = offset, length
+		rangeEnds[seg.URL] = offset + length
+		return nil
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !header {
+			if line != "#EXTM3U" {
+				return nil, errors.New("not an M3U8 playlist: missing #EXTM3U")
+			}
+			header = true
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			uri, err := resolve(line)
+			if err != nil {
+				return nil, err
+			}
+			if variant != nil {
+				variant.URI = uri
+				playlist.Variants = append(playlist.Variants, *variant)
+				variant = nil
+				continue
+			}
+			if mapSeg != nil && mapSeg != lastMap {
+				stream.Segments = append(stream.Segments, *mapSeg)
+				lastMap = mapSeg
+			}
+			seg := mediaSegment{URL: uri}
+			if err := applyRange(&seg, byteRange); err != nil {
+				return nil, err
+			}
+			byteRange = ""
+			if key != nil {
+				seg.Key, seg.IV = key, keyIV
+				if seg.IV == nil {
+					seg.IV = make([]byte, 16)
+					binary.BigEndian.PutUint64(seg.IV[8:], uint64(sequence))
+				}
+			}
+			stream.Segments = append(stream.Segments, seg)
+			sequence++
+			continue
+		}
+
+		tag, value, _ := strings.Cut(line, ":")
+		switch tag {
+		case "#EXT-X-STREAM-INF":
+			attrs := parseHLSAttributes(value)
+			variant = &hlsVariant{}
+			variant.Bandwidth, _ = strconv.ParseInt(attrs["BANDWIDTH"], 10, 64)
+			if w, h, ok := strings.Cut(attrs["RESOLUTION"], "x"); ok {
+				variant.Width, _ = strconv.Atoi(w)
+				variant.Height, _ = strconv.Atoi(h)
+			}
+		case "#EXT-X-MEDIA-SEQUENCE":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid EXT-X-MEDIA-SEQUENCE %q", value)
+			}
+			sequence = n
+		case "#EXT-X-KEY":
+			attrs := parseHLSAttributes(value)
+			switch attrs["METHOD"] {
+			case "NONE":
+				key, keyIV = nil, nil
+			case "AES-128":
+				uri, err := resolve(attrs["URI"])
+				if err != nil || attrs["URI"] == "" {
+					return nil, fmt.Errorf("EXT-X-KEY without a valid URI: %s", value)
+				}
+				if key = keys[uri]; key == nil {
+					key = &mediaKey{URI: uri}
+					keys[uri] = key
+				}
+				keyIV = nil
+				if iv := attrs["IV"]; iv != "" {
+					b, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X"))
+					if err != nil || len(b) != 16 {
+						return nil, fmt.Errorf("invalid EXT-X-KEY IV %q", iv)
+					}
+					keyIV = b
+				}
+			default:
+				// SAMPLE-AES encrypts inside the container; that is a player's job.
+				return nil, fmt.Errorf("unsupported encryption method %q", attrs["METHOD"])
+			}
+		case "#EXT-X-MAP":
+			attrs := parseHLSAttributes(value)
+			uri, err := resolve(attrs["URI"])
+			if err != nil || attrs["URI"] == "" {
+				return nil, fmt.Errorf("EXT-X-MAP without a valid URI: %s", value)
+			}
+			seg := &mediaSegment{URL: uri}
+			if err := applyRange(seg, attrs["BYTERANGE"]); err != nil {
+				return nil, err
+			}
+			if key != nil {
+				if keyIV == nil {
+					return nil, errors.New("encrypted EXT-X-MAP without an IV")
+				}
+				seg.Key, seg.IV = key, keyIV
+			}
+			if lastMap == nil || seg.URL != lastMap.URL || seg.Offset != lastMap.Offset || seg.Length != lastMap.Length {
+				mapSeg = seg
+			}
+			hasMapTags = true
+		case "#EXT-X-BYTERANGE":
+			byteRange = value
+		case "#EXT-X-ENDLIST":
+			stream.Live = false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !header {
+		return nil, errors.New("not an M3U8 playlist: empty")
+	}
+	if len(playlist.Variants) > 0 {
+		return playlist, nil
+	}
+
+	stream.Ext = ".ts"
+	if hasMapTags {
+		stream.Ext = ".mp4"
+	} else if len(stream.Segments) > 0 {
+		if u, err := url.Parse(stream.Segments[0].URL); err == nil {
+			switch ext := strings.ToLower(path.Ext(u.Path)); ext {
+			case ".aac", ".mp3", ".mp4", ".m4a", ".vtt":
+				stream.Ext = ext
+			case ".m4s":
+				stream.Ext = ".mp4"
+			}
+		}
+	}
+	playlist.Stream = stream
+	return playlist, nil
+}
+
+// parseHLSAttributes parses an attribute list such as
+// BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2",RESOLUTION=1280x720.
+func parseHLSAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for s != "" {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		name = strings.TrimSpace(name)
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+			_, rest, _ = strings.Cut(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attrs[name] = value
+		s = rest
+	}
+	return attrs
+}
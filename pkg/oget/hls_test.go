@@ -0,0 +1,298 @@
+package oget
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseHLS(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/live/master.m3u8?token=x")
+	master := `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS="avc1.4d401e,mp4a.40.2",RESOLUTION=640x360
+360p/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720
+https://other.example.com/720p/index.m3u8
+`
+	playlist, err := parseHLS([]byte(master), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(playlist.Variants) != 2 || playlist.Stream != nil {
+		t.Fatalf("master playlist parsed as %+v", playlist)
+	}
+	v := playlist.Variants[0]
+	if v.URI != "https://cdn.example.com/live/360p/index.m3u8" || v.Bandwidth != 800000 || v.Width != 640 || v.Height != 360 {
+		t.Errorf("first variant = %+v", v)
+	}
+
+	media := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4.0,
+seg10.m4s
+#EXT-X-KEY:METHOD=AES-128,URI="/keys/k1",IV=0x000102030405060708090a0b0c0d0e0f
+#EXTINF:4.0,
+seg11.m4s
+#EXT-X-KEY:METHOD=AES-128,URI="/keys/k1"
+#EXT-X-BYTERANGE:1000@500
+#EXTINF:4.0,
+all.m4s
+#EXT-X-BYTERANGE:300
+#EXTINF:4.0,
+all.m4s
+#EXT-X-KEY:METHOD=NONE
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4.0,
+seg14.m4s
+#EXT-X-ENDLIST
+`
+	playlist, err = parseHLS([]byte(media), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := playlist.Stream
+	if s.Live || s.Ext != ".mp4" || len(s.Segments) != 6 {
+		t.Fatalf("media playlist parsed as %+v", s)
+	}
+	if s.Segments[0].URL != "https://cdn.example.com/live/init.mp4" || s.Segments[0].Length != -1 {
+		t.Errorf("init section = %+v", s.Segments[0])
+	}
+	if s.Segments[1].Key != nil {
+		t.Errorf("segment before EXT-X-KEY is encrypted")
+	}
+	if seg := s.Segments[2]; seg.Key == nil || seg.Key.URI != "https://cdn.example.com/keys/k1" || hex.EncodeToString(seg.IV) != "000102030405060708090a0b0c0d0e0f" {
+		t.Errorf("segment with explicit IV = %+v", seg)
+	}
+	if seg := s.Segments[3]; seg.Offset != 500 || seg.Length != 1000 || hex.EncodeToString(seg.IV) != "0000000000000000000000000000000c" {
+		t.Errorf("byte range segment = %+v, IV %x", seg, seg.IV)
+	}
+	if s.Segments[2].Key != s.Segments[3].Key {
+		t.Error("a key URI is fetched once, want the segments to share it")
+	}
+	if seg := s.Segments[4]; seg.Offset != 1500 || seg.Length != 300 {
+		t.Errorf("byte range without offset = %+v, want 300@1500", seg)
+	}
+	if seg := s.Segments[5]; seg.Key != nil || !strings.HasSuffix(seg.URL, "seg14.m4s") {
+		t.Errorf("repeated EXT-X-MAP added the init section again, or METHOD=NONE ignored: %+v", seg)
+	}
+
+	live, err := parseHLS([]byte("#EXTM3U\n#EXTINF:2,\na.ts\n"), base)
+	if err != nil || !live.Stream.Live || live.Stream.Ext != ".ts" {
+		t.Errorf("playlist without EXT-X-ENDLIST = %+v, %v", live.Stream, err)
+	}
+	for _, bad := range []string{
+		"",
+		"<html></html>",
+		"#EXTM3U\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"k\"\na.ts\n",
+		"#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\",IV=0x01\na.ts\n",
+		"#EXTM3U\n#EXT-X-BYTERANGE:x\na.ts\n",
+	} {
+		if _, err := parseHLS([]byte(bad), base); err == nil {
+			t.Errorf("parseHLS(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestSelectVariant(t *testing.T) {
+	variants := []mediaVariant{
+		{Bandwidth: 2500000, Width: 1280, Height: 720},
+		{Bandwidth: 800000, Width: 640, Height: 360},
+		{Bandwidth: 6000000, Width: 1920, Height: 1080},
+		{Bandwidth: 1200000, Width: 854, Height: 480},
+	}
+	tests := []struct {
+		spec string
+		want int
+	}{
+		{"", 2},
+		{"best", 2},
+		{"worst", 1},
+		{"720p", 0},
+		{"1000p", 0},
+		{"240p", 1},
+		{"3M", 0},
+		{"1200k", 3},
+		{"1500000", 3},
+		{"100k", 1},
+	}
+	for _, tt := range tests {
+		got, err := selectVariant(variants, tt.spec)
+		if err != nil || got != tt.want {
+			t.Errorf("selectVariant(%q) = %d, %v; want %d", tt.spec, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"hd", "p", "-1M"} {
+		if _, err := selectVariant(variants, bad); err == nil {
+			t.Errorf("selectVariant(%q) succeeded", bad)
+		}
+	}
+}
+
+// encryptSegment encrypts data like an HLS packager: AES-128-CBC with
+// PKCS#7 padding.
+func encryptSegment(t *testing.T, key, iv, data []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	out := append(append([]byte(nil), data...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+	return out
+}
+
+// mediaTestServer serves files by path and counts the requests for each.
+type mediaTestServer struct {
+	*httptest.Server
+	mu    sync.Mutex
+	files map[string][]byte
+	hits  map[string]int
+}
+
+func newMediaTestServer(files map[string][]byte) *mediaTestServer {
+	s := &mediaTestServer{files: files, hits: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.hits[r.URL.Path]++
+		data, ok := s.files[r.URL.Path]
+		s.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	return s
+}
+
+func (s *mediaTestServer) set(path string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[path] = data
+}
+
+func (s *mediaTestServer) count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[path]
+}
+
+func downloadMedia(t *testing.T, resource, dir, variant string) ([]*Result, error) {
+	t.Helper()
+	d := NewDownloader([]string{resource}, 4)
+	d.Config.AutoTune = false
+	d.Config.OutputDir = dir
+	d.Config.StreamVariant = variant
+	d.Config.RetryBaseDelay = 1
+	d.Quiet = true
+	return d.Download(context.Background())
+}
+
+func TestHLSDownload(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := []byte("fedcba9876543210")
+	var plain [][]byte
+	for i := 0; i < 6; i++ {
+		plain = append(plain, randomContent(t, int64(100000+i*7777)))
+	}
+	// Segments 3 and 4 are byte ranges of one file.
+	joined := append(append([]byte(nil), plain[3]...), plain[4]...)
+	seqIV := func(n int) []byte {
+		b := make([]byte, 16)
+		b[15] = byte(n)
+		return b
+	}
+	files := map[string][]byte{
+		"/video/master.m3u8": []byte("#EXTM3U\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=500000,RESOLUTION=640x360\nlow/index.m3u8\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=3000000,RESOLUTION=1280x720\nhigh/index.m3u8\n"),
+		"/video/low/index.m3u8": []byte("#EXTM3U\n#EXTINF:4,\nlow.ts\n#EXT-X-ENDLIST\n"),
+		"/video/low/low.ts":     []byte("low quality"),
+		"/video/high/index.m3u8": []byte(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:1
+#EXTINF:4,
+s1.ts
+#EXT-X-KEY:METHOD=AES-128,URI="/keys/high.key"
+#EXTINF:4,
+s2.ts
+#EXTINF:4,
+s3.ts
+#EXT-X-KEY:METHOD=NONE
+#EXT-X-BYTERANGE:` + fmt.Sprint(len(plain[3])) + `@0
+#EXTINF:4,
+joined.ts
+#EXT-X-BYTERANGE:` + fmt.Sprint(len(plain[4])) + `
+#EXTINF:4,
+joined.ts
+#EXT-X-KEY:METHOD=AES-128,URI="/keys/high.key",IV=0x` + hex.EncodeToString(iv) + `
+#EXTINF:4,
+s6.ts
+#EXT-X-ENDLIST
+`),
+		"/keys/high.key":        key,
+		"/video/high/s1.ts":     plain[0],
+		"/video/high/s2.ts":     encryptSegment(t, key, seqIV(2), plain[1]),
+		"/video/high/s3.ts":     encryptSegment(t, key, seqIV(3), plain[2]),
+		"/video/high/joined.ts": joined,
+	}
+	server := newMediaTestServer(files)
+	defer server.Close()
+	dir := t.TempDir()
+	manifest := server.URL + "/video/master.m3u8"
+
+	// s6.ts is missing: the download fails and keeps the other segments.
+	_, err := downloadMedia(t, manifest, dir, "")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("download with a missing segment: %v, want ErrNotFound", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".master.ts.segments")); err != nil {
+		t.Fatalf("segments not kept after a failure: %v", err)
+	}
+
+	server.set("/video/high/s6.ts", encryptSegment(t, key, iv, plain[5]))
+	results, err := downloadMedia(t, manifest, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(results[0].File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Join(plain, nil); !bytes.Equal(data, want) || filepath.Base(results[0].File) != "master.ts" {
+		t.Errorf("got %s with %d bytes, want master.ts with the %d plain bytes", results[0].File, len(data), len(want))
+	}
+	if n := server.count("/video/high/s1.ts"); n != 1 {
+		t.Errorf("s1.ts fetched %d times, want 1: finished segments are kept between runs", n)
+	}
+	if n := server.count("/keys/high.key"); n != 1 {
+		t.Errorf("key fetched %d times, want 1", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".master.ts.segments")); !os.IsNotExist(err) {
+		t.Errorf("segments left behind: %v", err)
+	}
+
+	results, err = downloadMedia(t, manifest, dir, "worst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(results[0].File); string(data) != "low quality" {
+		t.Errorf("worst variant = %q", data)
+	}
+}
@@ -0,0 +1,148 @@
+package oget
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+Input files (oget -i) list one URL, or local .torrent/.meta4 path, per line.
+Lines indented with spaces or tabs below a URL set options for it:
+
+	https://example.com/download?id=123
+	  out=report.pdf
+	  dir=reports
+	  digest=sha256:9f86d081...
+	  header=Authorization: Bearer abc
+	  mirror=https://mirror.example.com/report.pdf
+
+header= and mirror= may be repeated. Blank lines and lines starting with #
+are ignored.
+*/
+
+// InputEntry is one URL with its own options, from an input file or added
+// to a Daemon.
+type InputEntry struct {
+	URL     string            `json:"url"`
+	Out     string            `json:"out,omitempty"`     // output path, relative to Dir
+	Dir     string            `json:"dir,omitempty"`     // output directory; Config.OutputDir if empty
+	Digest  string            `json:"digest,omitempty"`  // expected whole-file digest, e.g. "sha256:hex"
+	Headers map[string]string `json:"headers,omitempty"` // extra request headers
+	Mirrors []string          `json:"mirrors,omitempty"` // other URLs serving the same file
+}
+
+// ParseInputFile reads an input file. Errors name the offending line.
+func ParseInputFile(r io.Reader) ([]*InputEntry, error) {
+	var entries []*InputEntry
+	var cur *InputEntry
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			// Local .torrent and .meta4 paths are allowed, as on the command line.
+			if strings.ContainsAny(trimmed, " \t") {
+				return nil, fmt.Errorf("line %d: unexpected text after URL %q", n, trimmed)
+			}
+			cur = &InputEntry{URL: trimmed}
+			entries = append(entries, cur)
+			continue
+		}
+
+		if cur == nil {
+			return nil, fmt.Errorf("line %d: option before the first URL", n)
+		}
+		key, value, ok := strings.Cut(trimmed, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected name=value, got %q", n, trimmed)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch key {
+		case "out":
+			cur.Out = value
+		case "dir":
+			cur.Dir = value
+		case "digest":
+			if _, _, err := ParseDigest(value); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			cur.Digest = value
+		case "header":
+			name, hv, ok := strings.Cut(value, ":")
+			if !ok || strings.TrimSpace(name) == "" {
+				return nil, fmt.Errorf("line %d: expected header=Name: value, got %q", n, value)
+			}
+			if cur.Headers == nil {
+				cur.Headers = make(map[string]string)
+			}
+			cur.Headers[strings.TrimSpace(name)] = strings.TrimSpace(hv)
+		case "mirror":
+			if !validateURL(value) {
+				return nil, fmt.Errorf("line %d: invalid mirror URL %q", n, value)
+			}
+			cur.Mirrors = append(cur.Mirrors, value)
+		default:
+			return nil, fmt.Errorf("line %d: unknown option %q", n, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// AddEntry queues e for download with its own settings. Options not set in
+// the entry come from d.Config as it is when AddEntry is called, so apply
+// global settings first.
+func (d *Downloader) AddEntry(e *InputEntry) error {
+	for _, u := range d.URLs {
+		if u == e.URL {
+			return fmt.Errorf("%s is listed more than once", e.URL)
+		}
+	}
+	d.URLs = append(d.URLs, e.URL)
+	if len(e.Mirrors) > 0 {
+		if d.Mirrors == nil {
+			d.Mirrors = make(map[string][]string)
+		}
+		d.Mirrors[e.URL] = e.Mirrors
+	}
+	if e.Digest != "" {
+		if d.Digests == nil {
+			d.Digests = make(map[string]string)
+		}
+		d.Digests[e.URL] = e.Digest
+	}
+	if e.Out != "" {
+		if d.FileNames == nil {
+			d.FileNames = make(map[string]string)
+		}
+		d.FileNames[e.URL] = e.Out
+	}
+	if e.Dir != "" || len(e.Headers) > 0 {
+		cfg := *d.Config
+		if e.Dir != "" {
+			cfg.OutputDir = e.Dir
+		}
+		if len(e.Headers) > 0 {
+			cfg.Headers = make(map[string]string, len(d.Config.Headers)+len(e.Headers))
+			for k, v := range d.Config.Headers {
+				cfg.Headers[k] = v
+			}
+			for k, v := range e.Headers {
+				cfg.Headers[k] = v
+			}
+		}
+		if d.Configs == nil {
+			d.Configs = make(map[string]*Config)
+		}
+		d.Configs[e.URL] = &cfg
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package oget
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseInputFile(t *testing.T) {
+	input := `# nightly batch
+https://example.com/download?id=123
+  out=report.pdf
+	dir=reports
+  digest=sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+  header=Authorization: Bearer abc
+  header=X-Trace: 1
+  mirror=https://mirror.example.com/report.pdf
+
+./local.torrent
+`
+	entries, err := ParseInputFile(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*InputEntry{
+		{
+			URL:     "https://example.com/download?id=123",
+			Out:     "report.pdf",
+			Dir:     "reports",
+			Digest:  "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+			Headers: map[string]string{"Authorization": "Bearer abc", "X-Trace": "1"},
+			Mirrors: []string{"https://mirror.example.com/report.pdf"},
+		},
+		{URL: "./local.torrent"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got %+v, want %+v", entries, want)
+	}
+}
+
+func TestParseInputFile_Errors(t *testing.T) {
+	tests := []struct {
+		input, err string
+	}{
+		{"  out=x\n", "line 1: option before the first URL"},
+		{"https://a/x\n  out\n", "line 2: expected name=value"},
+		{"https://a/x\n  colour=red\n", `line 2: unknown option "colour"`},
+		{"https://a/x\n  digest=crc32:00\n", "line 2:"},
+		{"https://a/x\n  header=NoColon\n", "line 2: expected header=Name: value"},
+		{"https://a/x\n  mirror=not a url\n", "line 2: invalid mirror URL"},
+		{"https://a/x https://b/x\n", "line 1: unexpected text after URL"},
+	}
+	for _, tt := range tests {
+		_, err := ParseInputFile(strings.NewReader(tt.input))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseInputFile(%q) error = %v, want %q", tt.input, err, tt.err)
+		}
+	}
+}
+
+func TestDownloader_InputEntries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/private" && r.Header.Get("Authorization") != "Bearer abc" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		io.WriteString(w, "Hello World!")
+	}))
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "oget-input-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entries, err := ParseInputFile(strings.NewReader(server.URL + "/public\n" +
+		server.URL + "/private\n" +
+		"  out=secret.txt\n" +
+		"  dir=" + filepath.Join(dir, "private") + "\n" +
+		"  header=Authorization: Bearer abc\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDownloader(nil, 2)
+	d.Config.AutoTune = false
+	d.Config.OutputDir = dir
+	d.Fetcher = &HttpFetcher{Client: &http.Client{}, Config: d.Config}
+	for _, e := range entries {
+		if err := d.AddEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.AddEntry(entries[0]); err == nil {
+		t.Error("expected an error for a URL listed twice")
+	}
+
+	results, err := d.Download(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := results[0].File; got != filepath.Join(dir, "public") {
+		t.Errorf("public saved as %q", got)
+	}
+	if got := results[1].File; got != filepath.Join(dir, "private", "secret.txt") {
+		t.Errorf("private saved as %q", got)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "private", "secret.txt"))
+	if err != nil || string(data) != "Hello World!" {
+		t.Errorf("private entry not downloaded with its header: %q, %v", data, err)
+	}
+	if d.Config.Headers != nil {
+		t.Error("entry headers leaked into the global config")
+	}
+}
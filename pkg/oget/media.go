@@ -0,0 +1,521 @@
+package oget
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+HLS (.m3u8) and DASH (.mpd) streams are downloaded into a single file.
+
+The manifest is parsed into the segments of one variant, chosen by
+Config.StreamVariant, and every segment becomes a ChunkTask for the
+Downloader's workers. Segment sizes are unknown up front, so each segment
+streams into its own file in a hidden ".<name>.segments" directory beside
+the output; a finished segment is renamed from its .part file, which is all
+a restart needs to skip it. Once every segment is in, they are concatenated
+in order into the output, decrypting AES-128 HLS segments on the way, and
+the directory is removed.
+
+Only the chosen variant's own stream is kept: separate audio renditions of
+HLS and the other adaptation sets of DASH are not muxed in.
+*/
+
+// mediaStream is what a manifest resolves to: the segments of one variant.
+type mediaStream struct {
+	Segments []mediaSegment
+	Ext      string // extension of the output, e.g. ".ts" or ".mp4"
+	Live     bool   // the manifest is still growing; only what it lists is downloaded
+}
+
+// mediaSegment is one part of a stream, in playback order.
+type mediaSegment struct {
+	URL    string
+	Offset int64     // start of the byte range in URL
+	Length int64     // length of the byte range; -1 for the whole resource
+	Key    *mediaKey // nil unless encrypted
+	IV     []byte    // AES-128 initialisation vector with Key
+}
+
+// mediaKey is an AES-128 key, fetched once per URI.
+type mediaKey struct {
+	URI  string
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// mediaVariant is a rendition to choose from: an HLS variant stream or a
+// DASH representation.
+type mediaVariant struct {
+	Bandwidth int64 // bits per second
+	Width     int
+	Height    int
+}
+
+// isMediaManifest reports whether resource is an HLS or DASH manifest.
+func isMediaManifest(resource string) bool {
+	lower := strings.ToLower(resource)
+	if u, err := url.Parse(resource); err == nil && u.Scheme != "" {
+		lower = strings.ToLower(u.Path)
+	}
+	return strings.HasSuffix(lower, ".m3u8") || strings.HasSuffix(lower, ".mpd")
+}
+
+// selectVariant returns the index of the variant spec picks: "best" or ""
+// for the highest bandwidth, "worst" for the lowest, a height such as
+// "720p" for the best variant at most that tall, or a bit rate such as
+// "3M" or "800k" for the best one at most that fast. If none is small
+// enough, the smallest is taken.
+func selectVariant(variants []mediaVariant, spec string) (int, error) {
+	if len(variants) == 0 {
+		return 0, errors.New("no variants")
+	}
+	order := make([]int, len(variants))
+	for i := range order {
+		order[i] = i
+	}
+	// Ascending by height, then bandwidth.
+	sort.SliceStable(order, func(a, b int) bool {
+		va, vb := variants[order[a]], variants[order[b]]
+		if va.Height != vb.Height {
+			return va.Height < vb.Height
+		}
+		return va.Bandwidth < vb.Bandwidth
+	})
+	byBandwidth := append([]int(nil), order...)
+	sort.SliceStable(byBandwidth, func(a, b int) bool {
+		return variants[byBandwidth[a]].Bandwidth < variants[byBandwidth[b]].Bandwidth
+	})
+
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	switch {
+	case spec == "" || spec == "best":
+		return byBandwidth[len(byBandwidth)-1], nil
+	case spec == "worst":
+		return byBandwidth[0], nil
+	case strings.HasSuffix(spec, "p"):
+		height, err := strconv.Atoi(strings.TrimSuffix(spec, "p"))
+		if err != nil || height <= 0 {
+			return 0, fmt.Errorf("invalid stream variant %q", spec)
+		}
+		pick := order[0]
+		for _, i := range order {
+			if variants[i].Height <= height {
+				pick = i
+			}
+		}
+		return pick, nil
+	}
+
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(spec, "k"):
+		mult, spec = 1000, strings.TrimSuffix(spec, "k")
+	case strings.HasSuffix(spec, "m"):
+		mult, spec = 1000*1000, strings.TrimSuffix(spec, "m")
+	}
+	rate, err := strconv.ParseFloat(spec, 64)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("invalid stream variant %q: want best, worst, a height like 720p or a bit rate like 3M", spec)
+	}
+	pick := byBandwidth[0]
+	for _, i := range byBandwidth {
+		if float64(variants[i].Bandwidth) <= rate*float64(mult) {
+			pick = i
+		}
+	}
+	return pick, nil
+}
+
+// fetchManifest reads a manifest from a local path or URL and returns it
+// with the URL its references are relative to, after redirects.
+func fetchManifest(ctx context.Context, config *Config, resource string) ([]byte, *url.URL, error) {
+	if _, err := os.Stat(resource); err == nil {
+		data, err := os.ReadFile(resource)
+		abs, _ := filepath.Abs(resource)
+		return data, &url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, resource, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	setRequestHeaders(req, config, config.Headers)
+	resp, err := NewHttpProber(config).httpClient().Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &StatusError{URL: resource, StatusCode: resp.StatusCode}
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	return data, resp.Request.URL, err
+}
+
+// MediaProber implements Prober for HLS and DASH manifests. The size is not
+// known before every segment is in; the per-segment work is done by
+// Requester.
+type MediaProber struct {
+	Config *Config
+}
+
+func NewMediaProber(config *Config) *MediaProber {
+	return &MediaProber{Config: config}
+}
+
+// Load fetches the manifest, and for an HLS master playlist the chosen
+// variant's playlist, and returns the segments to download.
+func (p *MediaProber) Load(ctx context.Context, resource string) (*mediaStream, error) {
+	data, base, err := fetchManifest(ctx, p.Config, resource)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(strings.ToLower(base.Path), ".mpd") || strings.Contains(string(data[:min(len(data), 512)]), "<MPD") {
+		return parseDASH(data, base, p.Config.StreamVariant)
+	}
+
+	playlist, err := parseHLS(data, base)
+	if err != nil {
+		return nil, err
+	}
+	if len(playlist.Variants) > 0 {
+		variants := make([]mediaVariant, len(playlist.Variants))
+		for i, v := range playlist.Variants {
+			variants[i] = v.mediaVariant
+		}
+		i, err := selectVariant(variants, p.Config.StreamVariant)
+		if err != nil {
+			return nil, err
+		}
+		v := playlist.Variants[i]
+		if p.Config.Verbose {
+			log.Printf("Picked variant %s (%d bit/s, %dx%d) of %d", v.URI, v.Bandwidth, v.Width, v.Height, len(variants))
+		}
+		if data, base, err = fetchManifest(ctx, p.Config, v.URI); err != nil {
+			return nil, fmt.Errorf("variant %s: %w", v.URI, err)
+		}
+		if playlist, err = parseHLS(data, base); err != nil {
+			return nil, fmt.Errorf("variant %s: %w", v.URI, err)
+		}
+		if len(playlist.Variants) > 0 {
+			return nil, fmt.Errorf("variant %s is a master playlist too", v.URI)
+		}
+	}
+	return playlist.Stream, nil
+}
+
+func (p *MediaProber) Probe(ctx context.Context, resource string) (*ResourceMetadata, error) {
+	if _, err := p.Load(ctx, resource); err != nil {
+		return nil, err
+	}
+	return &ResourceMetadata{}, nil
+}
+
+// mediaFileName names the output after the manifest, with the extension of
+// the stream.
+func mediaFileName(resource string, stream *mediaStream) string {
+	name := parseFileName(resource)
+	return strings.TrimSuffix(name, path.Ext(name)) + stream.Ext
+}
+
+// mediaSegmentsDir returns where the segments of the output file are kept.
+func mediaSegmentsDir(output string) string {
+	return filepath.Join(filepath.Dir(output), "."+filepath.Base(output)+".segments")
+}
+
+// mediaSegmentFile names segment i by its position and source, so a
+// manifest that changed between runs does not reuse another's segments.
+func mediaSegmentFile(i int, seg mediaSegment) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s %d %d", seg.URL, seg.Offset, seg.Length)))
+	return fmt.Sprintf("%06d-%s", i, hex.EncodeToString(sum[:4]))
+}
+
+// prepareMedia submits a task per segment of an HLS or DASH stream that is
+// not on disk yet.
+func (r *Requester) prepareMedia(ctx context.Context) error {
+	prober, ok := r.Prober.(*MediaProber)
+	if !ok {
+		prober = NewMediaProber(r.Config)
+	}
+	stream, err := prober.Load(ctx, r.Resource)
+	if err != nil {
+		return fmt.Errorf("failed to load stream %s: %w", r.Resource, err)
+	}
+	if len(stream.Segments) == 0 {
+		return fmt.Errorf("stream %s has no segments", r.Resource)
+	}
+	if stream.Live {
+		log.Printf("Warning: %s is a live stream, downloading the %d segments listed now", r.Resource, len(stream.Segments))
+	}
+	if r.FileName == "" {
+		r.FileName = mediaFileName(r.Resource, stream)
+	}
+	fileName := r.outputPath()
+	r.result.File = fileName
+	dir := mediaSegmentsDir(fileName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	r.media = &mediaDownload{stream: stream, dir: dir}
+
+	var tasks []*ChunkTask
+	for i, seg := range stream.Segments {
+		segPath := filepath.Join(dir, mediaSegmentFile(i, seg))
+		r.media.files = append(r.media.files, segPath)
+		if _, err := os.Stat(segPath); err == nil {
+			continue // finished in an earlier run
+		}
+		storage := &segmentStorage{path: segPath, offset: seg.Offset}
+		r.storages = append(r.storages, storage)
+
+		task := NewChunkTask()
+		task.FileID = fileName
+		task.ChunkID = i
+		task.Offset = seg.Offset
+		task.Length = seg.Length
+		task.URL = seg.URL
+		task.StorageHandler = storage
+		task.FetcherHandler = r.Fetcher
+		task.OnProgress = r.OnProgress
+		task.OnChunkComplete = func(chunkID int, hash string) {
+			if err := storage.commit(); err != nil {
+				log.Printf("Warning: failed to save segment %d of %s: %v", chunkID, fileName, err)
+			}
+			if r.OnChunkComplete != nil {
+				r.OnChunkComplete(chunkID, hash)
+			}
+		}
+		task.Headers = r.Config.Headers
+		task.Result = r.result
+		tasks = append(tasks, task)
+	}
+	log.Printf("Preparing tasks for %s (%s, %d segments, %d to download)",
+		r.Resource, fileName, len(stream.Segments), len(tasks))
+
+	batchSize := r.Config.TaskBatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	for len(tasks) > 0 && r.SubmitTask != nil {
+		n := min(batchSize, len(tasks))
+		r.SubmitTask(tasks[:n]...)
+		tasks = tasks[n:]
+	}
+	return nil
+}
+
+// mediaDownload is the stream a Requester downloads segment by segment.
+type mediaDownload struct {
+	stream *mediaStream
+	dir    string
+	files  []string // per segment
+}
+
+// assemble concatenates the segments into output, decrypting them as needed.
+func (m *mediaDownload) assemble(ctx context.Context, config *Config, output string) error {
+	out, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	for i, seg := range m.stream.Segments {
+		if err := m.appendSegment(ctx, config, out, i, seg); err != nil {
+			return fmt.Errorf("segment %d (%s): %w", i, seg.URL, err)
+		}
+	}
+	return out.Sync()
+}
+
+func (m *mediaDownload) appendSegment(ctx context.Context, config *Config, out io.Writer, i int, seg mediaSegment) error {
+	f, err := os.Open(m.files[i])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if seg.Key == nil {
+		_, err = io.Copy(out, f)
+		return err
+	}
+
+	key, err := seg.Key.load(ctx, config)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return fmt.Errorf("encrypted segment of %d bytes is not a whole number of AES blocks", len(data))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	cipher.NewCBCDecrypter(block, seg.IV).CryptBlocks(data, data)
+	// PKCS#7 padding.
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return errors.New("bad padding after decryption, wrong key?")
+	}
+	_, err = out.Write(data[:len(data)-pad])
+	return err
+}
+
+// load fetches the key the first time it is needed.
+func (k *mediaKey) load(ctx context.Context, config *Config) ([]byte, error) {
+	k.once.Do(func() {
+		var data []byte
+		data, _, k.err = fetchManifest(ctx, config, k.URI)
+		if k.err == nil && len(data) != 16 {
+			k.err = fmt.Errorf("key %s has %d bytes, want 16", k.URI, len(data))
+		}
+		k.data = data
+	})
+	return k.data, k.err
+}
+
+// segmentStorage writes a segment to path+".part", opened on the first
+// write so thousands of segments do not hold as many files open, and moves
+// it to path once complete. Offsets are those of the segment's byte range
+// in its URL.
+type segmentStorage struct {
+	path   string
+	offset int64
+
+	mu        sync.Mutex
+	file      *os.File
+	committed bool
+}
+
+func (s *segmentStorage) open() (*FileStorageHandler, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.committed {
+		return nil, fmt.Errorf("segment %s already complete", filepath.Base(s.path))
+	}
+	if s.file == nil {
+		// A leftover .part of an earlier run is fetched again from the start.
+		f, err := os.OpenFile(s.path+".part", os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+		if err != nil {
+			return nil, err
+		}
+		s.file = f
+	}
+	return &FileStorageHandler{File: s.file}, nil
+}
+
+func (s *segmentStorage) ReadAtFrom(r io.Reader, off int64, count int64) (int64, error) {
+	h, err := s.open()
+	if err != nil {
+		return 0, err
+	}
+	return h.ReadAtFrom(r, off-s.offset, count)
+}
+
+func (s *segmentStorage) SpliceFrom(fd uintptr, off int64, count int64) (int64, error) {
+	h, err := s.open()
+	if err != nil {
+		return 0, err
+	}
+	return h.SpliceFrom(fd, off-s.offset, count)
+}
+
+func (s *segmentStorage) WriteAt(p []byte, off int64) (int, error) {
+	h, err := s.open()
+	if err != nil {
+		return 0, err
+	}
+	return h.WriteAt(p, off-s.offset)
+}
+
+func (s *segmentStorage) ReadAt(p []byte, off int64) (int, error) {
+	h, err := s.open()
+	if err != nil {
+		return 0, err
+	}
+	return h.ReadAt(p, off-s.offset)
+}
+
+func (s *segmentStorage) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("segment storage does not seek")
+}
+
+func (s *segmentStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Sync()
+}
+
+func (s *segmentStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// commit moves the finished segment into place.
+func (s *segmentStorage) commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.committed {
+		return nil
+	}
+	if s.file == nil {
+		// An empty segment: nothing was written.
+		f, err := os.Create(s.path + ".part")
+		if err != nil {
+			return err
+		}
+		s.file = f
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	s.committed = true
+	return os.Rename(s.path+".part", s.path)
+}
+
+// assembleMedia joins the segments of an HLS or DASH stream into the output
+// file and removes them. It does nothing for other resources.
+func (r *Requester) assembleMedia(ctx context.Context) error {
+	if r.media == nil {
+		return nil
+	}
+	r.closeFiles()
+	if err := r.media.assemble(ctx, r.Config, r.result.File); err != nil {
+		return fmt.Errorf("failed to assemble %s: %w", r.result.File, err)
+	}
+	if err := os.RemoveAll(r.media.dir); err != nil {
+		log.Printf("Warning: failed to remove segments of %s: %v", r.result.File, err)
+	}
+	return nil
+}
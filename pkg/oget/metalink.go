@@ -0,0 +1,331 @@
+package oget
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+Metalink support (RFC 5854 .meta4 and the older v3 .metalink format).
+
+Both formats are decoded with a single set of structs: encoding/xml matches
+elements by local name, and the v3-only wrappers (<files>, <resources>,
+<verification>) simply map to extra fields that are merged after decoding.
+*/
+
+// Metalink is the parsed content of a .meta4 or .metalink document.
+type Metalink struct {
+	Files []MetalinkFile
+}
+
+// MetalinkFile describes a single file and where to get it.
+type MetalinkFile struct {
+	Name        string
+	Size        int64
+	Hashes      map[string]string // whole-file digests keyed by normalized type ("sha256", ...)
+	PieceType   string            // normalized hash type of PieceHashes
+	PieceLength int64
+	PieceHashes []string
+	URLs        []MetalinkURL // sorted by preference, best first
+}
+
+// MetalinkURL is one mirror of a MetalinkFile.
+type MetalinkURL struct {
+	URL      string
+	Priority int    // lower is preferred (RFC 5854 semantics)
+	Location string // ISO 3166-1 country code, if given
+}
+
+type xmlMetalink struct {
+	Files   []xmlFile `xml:"file"`
+	FilesV3 []xmlFile `xml:"files>file"`
+}
+
+type xmlFile struct {
+	Name   string      `xml:"name,attr"`
+	Size   int64       `xml:"size"`
+	Hashes []xmlHash   `xml:"hash"`
+	Pieces []xmlPieces `xml:"pieces"`
+	URLs   []xmlURL    `xml:"url"`
+
+	// v3 layout
+	VerifyHashes  []xmlHash   `xml:"verification>hash"`
+	VerifyPieces  []xmlPieces `xml:"verification>pieces"`
+	ResourcesURLs []xmlURL    `xml:"resources>url"`
+}
+
+type xmlHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type xmlPieces struct {
+	Type   string    `xml:"type,attr"`
+	Length int64     `xml:"length,attr"`
+	Hashes []xmlHash `xml:"hash"`
+}
+
+type xmlURL struct {
+	Priority   int    `xml:"priority,attr"`
+	Preference int    `xml:"preference,attr"` // v3: higher is preferred, 0-100
+	Location   string `xml:"location,attr"`
+	Type       string `xml:"type,attr"`
+	Value      string `xml:",chardata"`
+}
+
+// ParseMetalink decodes a metalink v3 or v4 document.
+func ParseMetalink(data []byte) (*Metalink, error) {
+	var doc xmlMetalink
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse metalink: %w", err)
+	}
+
+	ml := &Metalink{}
+	for _, xf := range append(doc.Files, doc.FilesV3...) {
+		f := MetalinkFile{
+			Name:   xf.Name,
+			Size:   xf.Size,
+			Hashes: make(map[string]string),
+		}
+		for _, h := range append(xf.Hashes, xf.VerifyHashes...) {
+			f.Hashes[normalizeHashType(h.Type)] = strings.ToLower(strings.TrimSpace(h.Value))
+		}
+		for _, p := range append(xf.Pieces, xf.VerifyPieces...) {
+			// Prefer the strongest piece hash offered.
+			if f.PieceType != "" && hashStrength(normalizeHashType(p.Type)) <= hashStrength(f.PieceType) {
+				continue
+			}
+			f.PieceType = normalizeHashType(p.Type)
+			f.PieceLength = p.Length
+			f.PieceHashes = f.PieceHashes[:0]
+			for _, h := range p.Hashes {
+				f.PieceHashes = append(f.PieceHashes, strings.ToLower(strings.TrimSpace(h.Value)))
+			}
+		}
+		for _, u := range xf.URLs {
+			f.URLs = append(f.URLs, MetalinkURL{URL: strings.TrimSpace(u.Value), Priority: u.Priority, Location: u.Location})
+		}
+		for _, u := range xf.ResourcesURLs {
+			if u.Type != "" && u.Type != "http" && u.Type != "https" && u.Type != "ftp" {
+				continue
+			}
+			// Map v3 preference (100 best) onto v4 priority (1 best).
+			f.URLs = append(f.URLs, MetalinkURL{URL: strings.TrimSpace(u.Value), Priority: 101 - u.Preference, Location: u.Location})
+		}
+
+		var usable []MetalinkURL
+		for _, u := range f.URLs {
+			if pu, err := url.Parse(u.URL); err == nil {
+				switch strings.ToLower(pu.Scheme) {
+				case "http", "https", "ftp", "ftps", "ftpes":
+					if u.Priority <= 0 {
+						u.Priority = 999999 // RFC 5854: no priority means least preferred
+					}
+					usable = append(usable, u)
+				}
+			}
+		}
+		sort.SliceStable(usable, func(i, j int) bool { return usable[i].Priority < usable[j].Priority })
+		f.URLs = usable
+
+		if f.Name == "" {
+			return nil, fmt.Errorf("metalink file entry without a name")
+		}
+		ml.Files = append(ml.Files, f)
+	}
+	if len(ml.Files) == 0 {
+		return nil, fmt.Errorf("metalink contains no files")
+	}
+	return ml, nil
+}
+
+// normalizeHashType maps "SHA-256", "sha256" etc. onto "sha256".
+func normalizeHashType(t string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(t)), "-", "")
+}
+
+func hashStrength(t string) int {
+	switch t {
+	case "sha512":
+		return 4
+	case "sha384":
+		return 3
+	case "sha256":
+		return 2
+	case "sha1":
+		return 1
+	default:
+		return 0
+	}
+}
+
+// newHash returns a hash.Hash for a normalized hash type.
+func newHash(t string) (hash.Hash, error) {
+	switch normalizeHashType(t) {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha384":
+		return sha512.New384(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash type %q", t)
+	}
+}
+
+func isMetalinkResource(resource string) bool {
+	lower := strings.ToLower(resource)
+	if u, err := url.Parse(resource); err == nil && u.Scheme != "" {
+		lower = strings.ToLower(u.Path)
+	}
+	return strings.HasSuffix(lower, ".meta4") || strings.HasSuffix(lower, ".metalink")
+}
+
+// fetchMetalinkContent reads a metalink document from a local path or URL.
+func fetchMetalinkContent(ctx context.Context, resource string, config *Config) ([]byte, error) {
+	if _, err := os.Stat(resource); err == nil {
+		return os.ReadFile(resource)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, resource, nil)
+	if err != nil {
+		return nil, err
+	}
+	setRequestHeaders(req, config, config.Headers)
+	resp, err := NewHttpProber(config).httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{URL: resource, StatusCode: resp.StatusCode}
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+}
+
+// MetalinkProber implements Prober for metalink documents. The reported size
+// is the sum of all files; the per-file work is done by Requester.
+type MetalinkProber struct {
+	Config *Config
+}
+
+func NewMetalinkProber(config *Config) *MetalinkProber {
+	return &MetalinkProber{Config: config}
+}
+
+// Load fetches and parses the metalink document.
+func (p *MetalinkProber) Load(ctx context.Context, resource string) (*Metalink, error) {
+	data, err := fetchMetalinkContent(ctx, resource, p.Config)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMetalink(data)
+}
+
+func (p *MetalinkProber) Probe(ctx context.Context, resource string) (*ResourceMetadata, error) {
+	ml, err := p.Load(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, f := range ml.Files {
+		total += f.Size
+	}
+	return &ResourceMetadata{Size: total}, nil
+}
+
+// sanitizeRelativePath turns a server-supplied name into a path that stays
+// inside the output directory.
+func sanitizeRelativePath(name string) string {
+	name = filepath.Clean(filepath.FromSlash(strings.ReplaceAll(name, "\\", "/")))
+	if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		name = filepath.Base(name)
+	}
+	if name == "." || name == ".." || name == string(filepath.Separator) || name == "" {
+		return "download"
+	}
+	return name
+}
+
+// prepareMetalink expands a metalink into one child Requester per file, each
+// downloading from the listed mirrors with piece verification.
+func (r *Requester) prepareMetalink(ctx context.Context) error {
+	prober, ok := r.Prober.(*MetalinkProber)
+	if !ok {
+		prober = NewMetalinkProber(r.Config)
+	}
+	ml, err := prober.Load(ctx, r.Resource)
+	if err != nil {
+		return fmt.Errorf("failed to load metalink %s: %w", r.Resource, err)
+	}
+	r.result.File = r.Resource
+
+	for _, f := range ml.Files {
+		if len(f.URLs) == 0 {
+			return fmt.Errorf("metalink entry %s has no http/ftp urls", f.Name)
+		}
+		child := NewRequester(f.URLs[0].URL, r.Config)
+		child.Fetcher = r.Fetcher
+		child.OnProgress = r.OnProgress
+		child.OnChunkComplete = r.OnChunkComplete
+		child.SubmitTask = r.SubmitTask
+		child.FileName = sanitizeRelativePath(f.Name)
+		child.Digest = bestDigest(f.Hashes)
+		child.result = r.result // one Result per URL given to the Downloader
+		child.Cluster = r.Cluster
+		child.ClusterID = r.ClusterID
+		for _, u := range f.URLs[1:] {
+			child.Mirrors = append(child.Mirrors, u.URL)
+		}
+		if len(f.PieceHashes) > 0 && f.PieceLength > 0 {
+			if _, err := newHash(f.PieceType); err == nil {
+				child.ChunkSize = f.PieceLength
+				child.PieceHashType = f.PieceType
+				child.PieceHashes = f.PieceHashes
+			}
+		}
+		if err := child.PrepareTasks(ctx); err != nil {
+			return fmt.Errorf("metalink entry %s: %w", f.Name, err)
+		}
+		r.children = append(r.children, child)
+	}
+	return nil
+}
+
+// verifyPiece re-reads a finished chunk from storage and checks it against the
+// expected piece hash.
+func (r *Requester) verifyPiece(task *ChunkTask) error {
+	if task.ChunkID >= len(r.PieceHashes) {
+		return nil
+	}
+	h, err := newHash(r.PieceHashType)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(h, io.NewSectionReader(task.StorageHandler, task.Offset, task.Length)); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != r.PieceHashes[task.ChunkID] {
+		return fmt.Errorf("%w: piece %d of %s: got %s %s, want %s",
+			ErrChecksumMismatch, task.ChunkID, task.FileID, r.PieceHashType, got, r.PieceHashes[task.ChunkID])
+	}
+	return nil
+}
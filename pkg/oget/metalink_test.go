@@ -0,0 +1,149 @@
+package oget
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qtopie/oget/ogettest"
+)
+
+func TestParseMetalink(t *testing.T) {
+	v4 := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="example.iso">
+    <size>14471447</size>
+    <hash type="sha-256">ABCDEF</hash>
+    <pieces length="262144" type="sha-1"><hash>aa</hash><hash>bb</hash></pieces>
+    <pieces length="262144" type="sha-256"><hash>cc</hash><hash>dd</hash></pieces>
+    <url location="de" priority="2">http://de.example.com/example.iso</url>
+    <url location="us" priority="1">ftp://us.example.com/example.iso</url>
+    <url>http://fallback.example.com/example.iso</url>
+    <metaurl mediatype="torrent">http://example.com/example.iso.torrent</metaurl>
+  </file>
+</metalink>`
+
+	ml, err := ParseMetalink([]byte(v4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := ml.Files[0]
+	if f.Name != "example.iso" || f.Size != 14471447 || f.Hashes["sha256"] != "abcdef" {
+		t.Errorf("unexpected file metadata: %+v", f)
+	}
+	if f.PieceType != "sha256" || f.PieceLength != 262144 || strings.Join(f.PieceHashes, ",") != "cc,dd" {
+		t.Errorf("expected the sha-256 pieces to win, got %s %v", f.PieceType, f.PieceHashes)
+	}
+	if len(f.URLs) != 3 || f.URLs[0].URL != "ftp://us.example.com/example.iso" || f.URLs[2].URL != "http://fallback.example.com/example.iso" {
+		t.Errorf("urls not ordered by priority: %+v", f.URLs)
+	}
+
+	v3 := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+  <files>
+    <file name="dir/example.tar.gz">
+      <size>100</size>
+      <verification>
+        <hash type="md5">0123</hash>
+        <pieces length="50" type="sha1"><hash piece="0">p0</hash><hash piece="1">p1</hash></pieces>
+      </verification>
+      <resources>
+        <url type="bittorrent" preference="100">http://example.com/x.torrent</url>
+        <url type="http" preference="90">http://a.example.com/example.tar.gz</url>
+        <url type="http" preference="100">http://b.example.com/example.tar.gz</url>
+      </resources>
+    </file>
+  </files>
+</metalink>`
+
+	ml, err = ParseMetalink([]byte(v3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = ml.Files[0]
+	if f.Hashes["md5"] != "0123" || f.PieceType != "sha1" || len(f.PieceHashes) != 2 {
+		t.Errorf("unexpected v3 verification data: %+v", f)
+	}
+	if len(f.URLs) != 2 || f.URLs[0].URL != "http://b.example.com/example.tar.gz" {
+		t.Errorf("v3 urls not ordered by preference: %+v", f.URLs)
+	}
+}
+
+func TestSanitizeRelativePath(t *testing.T) {
+	tests := map[string]string{
+		"file.iso":          "file.iso",
+		"dir/file.iso":      filepath.Join("dir", "file.iso"),
+		"../../etc/passwd":  "passwd",
+		"/etc/passwd":       "passwd",
+		"a/../../b":         "b",
+		"..":                "download",
+		`..\windows\system`: "system",
+	}
+	for in, want := range tests {
+		if got := sanitizeRelativePath(in); got != want {
+			t.Errorf("sanitizeRelativePath(%q) => %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDownloader_Metalink(t *testing.T) {
+	good := ogettest.NewLargeRangeServer(2)
+	defer good.Close()
+
+	// A mirror with the right size but the wrong bytes.
+	corrupt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(make([]byte, good.Content.Size)))
+	}))
+	defer corrupt.Close()
+
+	const pieceLength = 256 * 1024
+	content, _ := io.ReadAll(&ogettest.DummyContent{Size: good.Content.Size})
+	var pieces strings.Builder
+	for off := 0; off < len(content); off += pieceLength {
+		sum := sha256.Sum256(content[off : off+pieceLength])
+		fmt.Fprintf(&pieces, "<hash>%s</hash>", hex.EncodeToString(sum[:]))
+	}
+
+	dir, err := os.MkdirTemp("", "oget-metalink-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	meta4 := filepath.Join(dir, "data.meta4")
+	doc := fmt.Sprintf(`<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="out/data.bin">
+    <size>%d</size>
+    <pieces length="%d" type="sha-256">%s</pieces>
+    <url priority="1">%s/data.bin</url>
+    <url priority="2">%s/data.bin</url>
+  </file>
+</metalink>`, good.Content.Size, pieceLength, pieces.String(), corrupt.URL, good.URL)
+	if err := os.WriteFile(meta4, []byte(doc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDownloader([]string{meta4}, 4)
+	d.Config.AutoTune = false
+	d.Config.OutputDir = dir
+	d.Fetcher = &HttpFetcher{Client: &http.Client{}, Config: d.Config}
+	d.Download(context.Background())
+
+	data, err := os.ReadFile(filepath.Join(dir, "out", "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Error("corrupt pieces from the bad mirror were not re-fetched")
+	}
+}
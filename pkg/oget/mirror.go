@@ -0,0 +1,194 @@
+package oget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// mirrorDemoteBase is how long a failing mirror is avoided after its first error.
+	// Each consecutive failure doubles the penalty up to mirrorDemoteMax.
+	mirrorDemoteBase = 5 * time.Second
+	mirrorDemoteMax  = 5 * time.Minute
+	// mirrorSpeedAlpha is the weight of the newest sample in the speed average.
+	mirrorSpeedAlpha = 0.3
+)
+
+// errMirrorStalled is reported when a mirror stops sending data mid-chunk.
+var errMirrorStalled = errors.New("mirror stalled")
+
+// Mirror is one source URL of a multi-source download together with its health.
+type Mirror struct {
+	URL      string
+	Priority int // lower is preferred, as in metalink; only used to break ties
+
+	speed        float64 // moving average of bytes/sec
+	inflight     int
+	failures     int
+	demotedUntil time.Time
+}
+
+// MirrorSet spreads the chunks of one file over several URLs serving identical
+// content. Faster mirrors receive more work; mirrors that error or stall are
+// demoted for a while.
+type MirrorSet struct {
+	// StallTimeout cancels a chunk that received no data for this long.
+	StallTimeout time.Duration
+	Verbose      bool
+
+	mu      sync.Mutex
+	mirrors []*Mirror
+}
+
+// NewMirrorSet creates a set from urls, in order of preference.
+func NewMirrorSet(urls []string, stallTimeout time.Duration) *MirrorSet {
+	s := &MirrorSet{StallTimeout: stallTimeout}
+	for i, u := range urls {
+		s.mirrors = append(s.mirrors, &Mirror{URL: u, Priority: i})
+	}
+	return s
+}
+
+// URLs returns the mirror URLs in the set.
+func (s *MirrorSet) URLs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	urls := make([]string, len(s.mirrors))
+	for i, m := range s.mirrors {
+		urls[i] = m.URL
+	}
+	return urls
+}
+
+// pick chooses the mirror with the best expected throughput for one more
+// connection. Mirrors that have not been measured yet are tried first.
+func (s *MirrorSet) pick() *Mirror {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var best, fallback *Mirror
+	var bestScore float64
+	for _, m := range s.mirrors {
+		if now.Before(m.demotedUntil) {
+			if fallback == nil || m.demotedUntil.Before(fallback.demotedUntil) {
+				fallback = m
+			}
+			continue
+		}
+		score := m.speed / float64(m.inflight+1)
+		if m.speed == 0 && m.inflight == 0 {
+			score = math.Inf(1) // unmeasured and idle: always worth a try
+		}
+		if best == nil || score > bestScore ||
+			(score == bestScore && (m.inflight < best.inflight ||
+				(m.inflight == best.inflight && m.Priority < best.Priority))) {
+			best, bestScore = m, score
+		}
+	}
+	if best == nil {
+		// Every mirror is demoted: use the one that recovers first rather than stalling.
+		best = fallback
+	}
+	best.inflight++
+	return best
+}
+
+// report records the outcome of one fetch from m.
+func (s *MirrorSet) report(m *Mirror, bytes int64, elapsed time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m.inflight--
+	if err != nil {
+		m.failures++
+		penalty := mirrorDemoteBase << uint(m.failures-1)
+		if penalty > mirrorDemoteMax || penalty <= 0 {
+			penalty = mirrorDemoteMax
+		}
+		m.demotedUntil = time.Now().Add(penalty)
+		if s.Verbose {
+			log.Printf("[Mirror] Demoting %s for %v: %v", m.URL, penalty, err)
+		}
+		return
+	}
+
+	m.failures = 0
+	if elapsed > 0 && bytes > 0 {
+		sample := float64(bytes) / elapsed.Seconds()
+		if m.speed == 0 {
+			m.speed = sample
+		} else {
+			m.speed = mirrorSpeedAlpha*sample + (1-mirrorSpeedAlpha)*m.speed
+		}
+	}
+}
+
+// Fetch runs a copy of task against the best mirror using fetcher and feeds
+// the result back into the mirror statistics. task keeps its own URL, so
+// retries and state never see the mirror's; only the progress is copied back.
+func (s *MirrorSet) Fetch(ctx context.Context, fetcher Fetcher, task *ChunkTask) error {
+	m := s.pick()
+	attempt := *task
+	attempt.URL = m.URL
+	defer func() { task.Written = attempt.Written }()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var received int64
+	var lastProgress int64 = time.Now().UnixNano()
+	onProgress := task.OnProgress
+	attempt.OnProgress = func(n int) {
+		atomic.AddInt64(&received, int64(n))
+		atomic.StoreInt64(&lastProgress, time.Now().UnixNano())
+		if onProgress != nil {
+			onProgress(n)
+		}
+	}
+
+	var stalled int32
+	if s.StallTimeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			ticker := time.NewTicker(s.StallTimeout / 4)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ctx.Done():
+					return
+				case now := <-ticker.C:
+					if now.Sub(time.Unix(0, atomic.LoadInt64(&lastProgress))) > s.StallTimeout {
+						atomic.StoreInt32(&stalled, 1)
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	start := time.Now()
+	err := fetcher.Fetch(ctx, &attempt)
+	if atomic.LoadInt32(&stalled) == 1 && err != nil {
+		err = fmt.Errorf("%s: %w", m.URL, errMirrorStalled)
+	}
+	// A cancelled parent (shutdown or a lost endgame race) says nothing about the mirror.
+	if err != nil && ctx.Err() != nil && atomic.LoadInt32(&stalled) == 0 {
+		s.mu.Lock()
+		m.inflight--
+		s.mu.Unlock()
+		return err
+	}
+	s.report(m, atomic.LoadInt64(&received), time.Since(start), err)
+	return err
+}
@@ -0,0 +1,142 @@
+package oget
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qtopie/oget/ogettest"
+)
+
+func TestMirrorSet_DemotesFailingMirror(t *testing.T) {
+	s := NewMirrorSet([]string{"http://a/f", "http://b/f"}, 0)
+
+	first := s.pick()
+	s.report(first, 0, time.Second, errors.New("boom"))
+
+	for i := 0; i < 5; i++ {
+		m := s.pick()
+		if m == first {
+			t.Fatalf("demoted mirror %s was picked again", m.URL)
+		}
+		s.report(m, RangeSize, 100*time.Millisecond, nil)
+	}
+}
+
+func TestDownloader_Mirrors(t *testing.T) {
+	good1 := ogettest.NewLargeRangeServer(16)
+	defer good1.Close()
+	// Another server of the same file: its weak ETag is its own, but the
+	// modification time was kept when it was mirrored.
+	good2 := ogettest.NewLargeRangeServer(16)
+	defer good2.Close()
+	good2.ETag = `W/"mirror-etag"`
+	good2.ModTime = good1.ModTime
+	var good2Hits int32
+	handler := good2.Config.Handler
+	good2.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&good2Hits, 1)
+		}
+		handler.ServeHTTP(w, r)
+	})
+
+	// A mirror that probes fine but fails every chunk request.
+	var badHits int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			good1.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		atomic.AddInt32(&badHits, 1)
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+
+	dir, err := os.MkdirTemp("", "oget-mirror-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	primary := good1.URL + "/testfile.bin"
+	d := NewDownloader([]string{primary}, 4)
+	d.Config.AutoTune = false
+	d.Config.OutputDir = dir
+	d.Mirrors = map[string][]string{primary: {bad.URL + "/testfile.bin", good2.URL + "/testfile.bin"}}
+	d.Fetcher = &HttpFetcher{Client: &http.Client{}, Config: d.Config}
+	d.Quiet = true
+	if _, err := d.Download(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "testfile.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != good1.Content.CalculateSHA256() {
+		t.Error("downloaded file does not match the mirrored content")
+	}
+	// The failing mirror is demoted for five seconds after its first error,
+	// longer than the download takes: it gets no second chunk.
+	if hits := atomic.LoadInt32(&badHits); hits != 1 {
+		t.Errorf("bad mirror got %d requests of 16 chunks, want 1 before demotion", hits)
+	}
+	if hits := atomic.LoadInt32(&good2Hits); hits == 0 {
+		t.Error("the mirror with another ETag was dropped")
+	}
+}
+
+func TestProbeMirrors_SameContent(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	// mirror serves 1000 bytes with the given validators.
+	mirror := func(etag, digest string, modTime time.Time) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if etag != "" {
+				w.Header().Set("ETag", etag)
+			}
+			if digest != "" {
+				w.Header().Set("Repr-Digest", digest)
+			}
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(make([]byte, 1000)))
+		}))
+		t.Cleanup(server.Close)
+		return server.URL + "/f.bin"
+	}
+	const sumA, sumB = "sha-256=:YWFhYQ==:", "sha-256=:YmJiYg==:"
+
+	tests := []struct {
+		name     string
+		primary  string
+		mirror   string
+		wantKept bool
+	}{
+		{"strong ETags differ", mirror(`"a"`, "", modTime), mirror(`"b"`, "", modTime), false},
+		{"strong ETags match", mirror(`"a"`, "", modTime), mirror(`"a"`, "", modTime.Add(time.Hour)), true},
+		{"weak ETag, same time", mirror(`"a"`, "", modTime), mirror(`W/"b"`, "", modTime), true},
+		{"weak ETag, other time", mirror(`"a"`, "", modTime), mirror(`W/"b"`, "", modTime.Add(time.Hour)), false},
+		{"hashes differ", mirror("", sumA, modTime), mirror("", sumB, modTime), false},
+		{"hashes match, ETags differ", mirror(`"a"`, sumA, modTime), mirror(`"b"`, sumA, modTime.Add(time.Hour)), true},
+	}
+	for _, tt := range tests {
+		config := DefaultConfig()
+		config.Timeout = 5
+		r := &Requester{Resource: tt.primary, Mirrors: []string{tt.mirror}, Prober: NewHttpProber(config), Config: config}
+		if _, err := r.probeMirrors(context.Background()); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if kept := len(r.mirrorSet.mirrors) == 2; kept != tt.wantKept {
+			t.Errorf("%s: mirror kept = %v, want %v", tt.name, kept, tt.wantKept)
+		}
+	}
+}
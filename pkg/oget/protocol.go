@@ -17,7 +17,6 @@ import (
 	"time"
 
 	"github.com/cenkalti/rain/torrent"
-	"github.com/jlaffaye/ftp"
 )
 
 var (
@@ -330,6 +329,10 @@ func getRainSession(config *Config) (*torrent.Session, error) {
 		cfg.DataDir = "." // Download directly to current directory for consistency
 		cfg.Database = filepath.Join(metaDir, "session.db")
 		cfg.TrackerHTTPVerifyTLS = false // Bypass TLS verification for trackers
+		if config != nil && config.RateLimit > 0 {
+			// rain limits in KB/s and only at session creation
+			cfg.SpeedLimitDownload = (config.RateLimit + 1023) / 1024
+		}
 		rainSession, err = torrent.NewSession(cfg)
 
 		if err == nil {
@@ -376,16 +379,23 @@ func startJanitor(s *torrent.Session) {
 }
 
 // CleanupProtocols handles resource cleanup for all protocols.
-func CleanupProtocols(config *Config) {
+// Seeding is skipped, or cut short, once ctx is done (e.g. on interrupt).
+func CleanupProtocols(ctx context.Context, config *Config) {
+	closeFtpPools()
+	closeSftpPools()
+	saveCookieJars()
 	if rainSession != nil {
 		duration := 30
 		if config != nil {
 			duration = config.SeedingDuration
 		}
 
-		if duration > 0 {
+		if duration > 0 && ctx.Err() == nil {
 			fmt.Printf("\n[BitTorrent] All tasks finished. Seeding for %ds (Privacy Grace Period)...\n", duration)
-			time.Sleep(time.Duration(duration) * time.Second)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(duration) * time.Second):
+			}
 		}
 		rainSession.Close()
 		fmt.Println("[BitTorrent] Seeding stopped. Privacy secured.")
@@ -437,6 +447,12 @@ func GetProber(resource string, config *Config) Prober {
 	if isTorrentResource(resource) {
 		return NewTorrentProber(config)
 	}
+	if isMetalinkResource(resource) {
+		return NewMetalinkProber(config)
+	}
+	if isMediaManifest(resource) {
+		return NewMediaProber(config)
+	}
 
 	u, err := url.Parse(resource)
 	if err != nil {
@@ -444,8 +460,12 @@ func GetProber(resource string, config *Config) Prober {
 	}
 
 	switch strings.ToLower(u.Scheme) {
-	case "ftp":
+	case "ftp", "ftps", "ftpes":
 		return NewFtpProber(config)
+	case "sftp", "scp":
+		return NewSftpProber(config)
+	case "s3":
+		return NewS3Prober(config)
 	case "magnet":
 		return NewMagnetProber(config)
 	default:
@@ -465,8 +485,12 @@ func GetFetcher(resource string, config *Config) Fetcher {
 	}
 
 	switch strings.ToLower(u.Scheme) {
-	case "ftp":
+	case "ftp", "ftps", "ftpes":
 		return NewFtpFetcher(config)
+	case "sftp", "scp":
+		return NewSftpFetcher(config)
+	case "s3":
+		return NewS3Fetcher(config)
 	case "magnet":
 		return NewMagnetFetcher(config)
 	default:
@@ -474,151 +498,6 @@ func GetFetcher(resource string, config *Config) Fetcher {
 	}
 }
 
-// FtpProber implements Prober for FTP protocol.
-type FtpProber struct {
-	Config *Config
-}
-
-func NewFtpProber(config *Config) *FtpProber {
-	return &FtpProber{Config: config}
-}
-
-func (p *FtpProber) Probe(ctx context.Context, resource string) (*ResourceMetadata, error) {
-	c, err := dialFtp(resource, p.Config.Timeout)
-	if err != nil {
-		return nil, err
-	}
-	defer c.Quit()
-
-	u, _ := url.Parse(resource)
-	size, err := c.FileSize(u.Path)
-	if err != nil {
-		// Fallback: try to list and find the file
-		dir := filepath.Dir(u.Path)
-		base := filepath.Base(u.Path)
-		entries, err := c.List(dir)
-		if err == nil {
-			for _, entry := range entries {
-				if entry.Name == base {
-					return &ResourceMetadata{
-						Size: int64(entry.Size),
-					}, nil
-				}
-			}
-		}
-		return nil, fmt.Errorf("failed to get ftp file size: %w", err)
-	}
-
-	return &ResourceMetadata{
-		Size: size,
-	}, nil
-}
-
-// FtpFetcher implements Fetcher for FTP protocol.
-type FtpFetcher struct {
-	Config *Config
-}
-
-func NewFtpFetcher(config *Config) *FtpFetcher {
-	return &FtpFetcher{Config: config}
-}
-
-func (f *FtpFetcher) Fetch(ctx context.Context, task *ChunkTask) error {
-	c, err := dialFtp(task.URL, f.Config.Timeout)
-	if err != nil {
-		return err
-	}
-	defer c.Quit()
-
-	u, _ := url.Parse(task.URL)
-	resp, err := c.RetrFrom(u.Path, uint64(task.Offset))
-	if err != nil {
-		return fmt.Errorf("ftp RETR failed: %w", err)
-	}
-	defer resp.Close()
-
-	var written int64
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
-
-		remaining := task.Length - written
-		if task.Length == -1 {
-			remaining = 32 * 1024
-		}
-		if remaining <= 0 && task.Length != -1 {
-			break
-		}
-
-		lr := io.LimitReader(resp, remaining)
-		n, err := task.StorageHandler.ReadAtFrom(lr, task.Offset+written, remaining)
-		if n > 0 {
-			written += n
-			if task.OnProgress != nil {
-				task.OnProgress(int(n))
-			}
-		}
-
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
-		if n == 0 {
-			break
-		}
-	}
-
-	if task.Length != -1 && written < task.Length {
-		return fmt.Errorf("ftp download incomplete: got %d bytes, want %d", written, task.Length)
-	}
-
-	if task.OnChunkComplete != nil {
-		task.OnChunkComplete(task.ChunkID, "")
-	}
-
-	return nil
-}
-
-func dialFtp(resource string, timeout int) (*ftp.ServerConn, error) {
-	u, err := url.Parse(resource)
-	if err != nil {
-		return nil, err
-	}
-
-	host := u.Host
-	if !strings.Contains(host, ":") {
-		host += ":21"
-	}
-
-	c, err := ftp.Dial(host, ftp.DialWithTimeout(time.Duration(timeout)*time.Second))
-	if err != nil {
-		return nil, err
-	}
-
-	user := "anonymous"
-	pass := "anonymous"
-	if u.User != nil {
-		user = u.User.Username()
-		p, ok := u.User.Password()
-		if ok {
-			pass = p
-		}
-	}
-
-	err = c.Login(user, pass)
-	if err != nil {
-		c.Quit()
-		return nil, err
-	}
-
-	return c, nil
-}
-
 func addTrackersInBatches(ctx context.Context, t *torrent.Torrent, trackers []string, verbose bool) {
 	go func() {
 		batchSize := 30
@@ -0,0 +1,223 @@
+package oget
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// TokenBucket is a byte-rate limiter. A rate of 0 means unlimited.
+// The rate may be changed at any time and takes effect on the next read.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   int64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a bucket allowing rate bytes per second.
+func NewTokenBucket(rate int64) *TokenBucket {
+	return &TokenBucket{rate: rate, last: time.Now()}
+}
+
+// SetRate changes the allowed bytes per second. 0 disables limiting.
+func (b *TokenBucket) SetRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = rate
+	b.tokens = 0
+	b.last = time.Now()
+}
+
+// Rate returns the current bytes per second, 0 meaning unlimited.
+func (b *TokenBucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// burst returns the largest single read the bucket lets through at once.
+// It is kept around 1/10s worth of data so throttling stays smooth.
+func (b *TokenBucket) burst() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	burst := b.rate / 10
+	if burst < 1024 {
+		burst = 1024
+	}
+	return int(burst)
+}
+
+// Take consumes n bytes worth of tokens, waiting until they are available or
+// ctx is done, in which case it returns ctx.Err().
+func (b *TokenBucket) Take(ctx context.Context, n int) error {
+	b.mu.Lock()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if max := float64(b.rate); b.tokens > max {
+		b.tokens = max // allow at most one second of accumulated burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// BandwidthLimiter holds the global, per-host and per-URL token buckets
+// shared by all workers of a Downloader.
+type BandwidthLimiter struct {
+	global *TokenBucket
+	mu     sync.RWMutex
+	hosts  map[string]*TokenBucket
+	urls   map[string]*TokenBucket
+}
+
+// NewBandwidthLimiter creates a limiter from the rate settings in config.
+func NewBandwidthLimiter(config *Config) *BandwidthLimiter {
+	l := &BandwidthLimiter{
+		global: NewTokenBucket(0),
+		hosts:  make(map[string]*TokenBucket),
+		urls:   make(map[string]*TokenBucket),
+	}
+	if config == nil {
+		return l
+	}
+	l.global.SetRate(config.RateLimit)
+	for host, rate := range config.HostRateLimits {
+		l.SetHostRate(host, rate)
+	}
+	for u, rate := range config.URLRateLimits {
+		l.SetURLRate(u, rate)
+	}
+	return l
+}
+
+// SetRate changes the global bytes per second cap. 0 disables it.
+func (l *BandwidthLimiter) SetRate(rate int64) {
+	l.global.SetRate(rate)
+}
+
+// SetHostRate caps the bytes per second for all downloads from host.
+func (l *BandwidthLimiter) SetHostRate(host string, rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.hosts[host]; ok {
+		b.SetRate(rate)
+		return
+	}
+	l.hosts[host] = NewTokenBucket(rate)
+}
+
+// SetURLRate caps the bytes per second for a single resource.
+func (l *BandwidthLimiter) SetURLRate(resource string, rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.urls[resource]; ok {
+		b.SetRate(rate)
+		return
+	}
+	l.urls[resource] = NewTokenBucket(rate)
+}
+
+// buckets returns every bucket that applies to resource.
+func (l *BandwidthLimiter) buckets(resource string) []*TokenBucket {
+	host := ""
+	if u, err := url.Parse(resource); err == nil {
+		host = u.Host
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	buckets := []*TokenBucket{l.global}
+	if b, ok := l.hosts[host]; ok {
+		buckets = append(buckets, b)
+	}
+	if b, ok := l.urls[resource]; ok {
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// Wrap returns a StorageHandler whose ReadAtFrom is throttled by the buckets
+// for resource. The buckets are looked up on every read so runtime changes
+// apply; a read waiting for tokens gives up when ctx is done.
+func (l *BandwidthLimiter) Wrap(ctx context.Context, storage StorageHandler, resource string) StorageHandler {
+	if storage == nil {
+		return nil
+	}
+	return &rateLimitedStorage{StorageHandler: storage, ctx: ctx, limiter: l, resource: resource}
+}
+
+type rateLimitedStorage struct {
+	StorageHandler
+	ctx      context.Context
+	limiter  *BandwidthLimiter
+	resource string
+}
+
+func (s *rateLimitedStorage) ReadAtFrom(r io.Reader, off int64, count int64) (int64, error) {
+	return s.StorageHandler.ReadAtFrom(&rateLimitedReader{ctx: s.ctx, r: r, buckets: s.limiter.buckets(s.resource)}, off, count)
+}
+
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*TokenBucket
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// Never read more than the tightest bucket lets through at once.
+	for _, b := range r.buckets {
+		if burst := b.burst(); burst > 0 && len(p) > burst {
+			p = p[:burst]
+		}
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		for _, b := range r.buckets {
+			if werr := b.Take(r.ctx, n); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
+
+// limitedFetcher throttles each fetch by the buckets of the URL it actually
+// fetches from, which for a mirrored chunk is only known once the mirror set
+// has picked one.
+type limitedFetcher struct {
+	Fetcher
+	limiter *BandwidthLimiter
+}
+
+func (f *limitedFetcher) Fetch(ctx context.Context, task *ChunkTask) error {
+	storage := task.StorageHandler
+	task.StorageHandler = f.limiter.Wrap(ctx, storage, task.URL)
+	defer func() { task.StorageHandler = storage }()
+	return f.Fetcher.Fetch(ctx, task)
+}
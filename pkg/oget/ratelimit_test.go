@@ -0,0 +1,97 @@
+package oget
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "test_ratelimit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	ctx := context.Background()
+
+	config := DefaultConfig()
+	config.HostRateLimits = map[string]int64{"slow.example.com": 200 * 1024}
+	limiter := NewBandwidthLimiter(config)
+
+	// Unlimited host: no throttling at all.
+	fast := limiter.Wrap(ctx, &FileStorageHandler{File: file}, "http://fast.example.com/f")
+	start := time.Now()
+	if _, err := fast.ReadAtFrom(bytes.NewReader(make([]byte, 512*1024)), 0, 512*1024); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("unlimited read took %v", elapsed)
+	}
+
+	// 400KB at 200KB/s takes about two seconds starting from an empty bucket.
+	slow := limiter.Wrap(ctx, &FileStorageHandler{File: file}, "http://slow.example.com/f")
+	start = time.Now()
+	if _, err := slow.ReadAtFrom(bytes.NewReader(make([]byte, 400*1024)), 0, 400*1024); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Errorf("limited read finished too fast: %v", elapsed)
+	}
+
+	// Lifting the limit at runtime takes effect on the next read.
+	limiter.SetHostRate("slow.example.com", 0)
+	start = time.Now()
+	if _, err := slow.ReadAtFrom(bytes.NewReader(make([]byte, 512*1024)), 0, 512*1024); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("read after lifting the limit took %v", elapsed)
+	}
+}
+
+func TestTokenBucketCancel(t *testing.T) {
+	b := NewTokenBucket(1024)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// 10KB at 1KB/s would take ten seconds.
+	if err := b.Take(ctx, 10*1024); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Take = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled Take returned after %v", elapsed)
+	}
+}
+
+// resourceFetcher records the resource the storage it is handed is throttled by.
+type resourceFetcher struct {
+	resource string
+}
+
+func (f *resourceFetcher) Fetch(ctx context.Context, task *ChunkTask) error {
+	if s, ok := task.StorageHandler.(*rateLimitedStorage); ok {
+		f.resource = s.resource
+	}
+	return nil
+}
+
+func TestLimitedFetcherMirror(t *testing.T) {
+	inner := &resourceFetcher{}
+	fetcher := &limitedFetcher{Fetcher: inner, limiter: NewBandwidthLimiter(nil)}
+	mirrors := NewMirrorSet([]string{"http://mirror.example.com/f"}, 0)
+	storage := &FileStorageHandler{}
+	task := &ChunkTask{URL: "http://origin.example.com/f", StorageHandler: storage}
+	if err := mirrors.Fetch(context.Background(), fetcher, task); err != nil {
+		t.Fatal(err)
+	}
+	if inner.resource != "http://mirror.example.com/f" {
+		t.Errorf("throttled as %q, want the mirror's URL", inner.resource)
+	}
+	if task.StorageHandler != storage || task.URL != "http://origin.example.com/f" {
+		t.Errorf("the task kept the attempt's storage or URL %s", task.URL)
+	}
+}
@@ -0,0 +1,228 @@
+package oget
+
+import (
+	"context"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+/*
+Recursive mirroring (oget -r) walks Apache/nginx autoindex listings and
+other HTML pages below a base URL and turns every file it finds into an
+InputEntry, so the files go through the normal Downloader pipeline.
+
+Links ending in "/" are directory listings and links to .html/.htm pages
+are pages: both are fetched and parsed for more links, and only pages are
+also downloaded. Everything else is a file. Only links under the base
+directory are followed on the base host, like wget --no-parent, which also
+drops the "Parent Directory" and column-sort links of autoindex pages.
+*/
+
+// maxCrawlPage caps how much of a page is parsed for links.
+const maxCrawlPage = 16 << 20
+
+// CrawlOptions selects what Crawl follows and keeps.
+type CrawlOptions struct {
+	MaxDepth  int      // link hops from the base page to follow; 0 for no limit
+	Accept    []string // globs a file name must match; every file if empty
+	Reject    []string // globs a file name must not match
+	SpanHosts bool     // also follow links to other hosts, saved under a directory named after each
+}
+
+// Crawl walks the pages under base and returns an entry per file found, in
+// discovery order, with Out set to its path relative to the base directory.
+func Crawl(ctx context.Context, config *Config, base string, opts CrawlOptions) ([]*InputEntry, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	c := &crawler{
+		config: config,
+		client: NewHttpProber(config).httpClient(),
+		opts:   opts,
+		seen:   make(map[string]bool),
+	}
+
+	// The base is resolved after redirects, so "/pub" crawls "/pub/".
+	baseURL, links, err := c.fetchPage(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	c.base = baseURL
+	c.baseDir = baseURL.Path[:strings.LastIndex(baseURL.Path, "/")+1]
+	c.seen[linkKey(baseURL)] = true
+
+	type page struct {
+		links []*url.URL
+		depth int
+	}
+	queue := []page{{links: links}}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		for _, link := range p.links {
+			out, ok := c.outputPath(link)
+			if !ok {
+				continue
+			}
+			key := linkKey(link)
+			if c.seen[key] {
+				continue
+			}
+			c.seen[key] = true
+
+			if isCrawlPage(link) && (opts.MaxDepth == 0 || p.depth+1 < opts.MaxDepth) {
+				_, links, err := c.fetchPage(ctx, link.String())
+				if err != nil {
+					if ctx.Err() != nil {
+						return nil, ctx.Err()
+					}
+					log.Printf("Warning: skipping %s: %v", link, err)
+				} else {
+					queue = append(queue, page{links: links, depth: p.depth + 1})
+				}
+			}
+			if !strings.HasSuffix(link.Path, "/") && c.accepts(path.Base(link.Path)) {
+				c.entries = append(c.entries, &InputEntry{URL: link.String(), Out: out})
+			}
+		}
+	}
+	return c.entries, nil
+}
+
+type crawler struct {
+	config  *Config
+	client  *http.Client
+	opts    CrawlOptions
+	base    *url.URL
+	baseDir string
+	seen    map[string]bool // by linkKey
+	entries []*InputEntry
+}
+
+// fetchPage downloads an HTML page and returns its final URL and the
+// http(s) links on it, resolved and without fragments.
+func (c *crawler) fetchPage(ctx context.Context, rawURL string) (*url.URL, []*url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	setRequestHeaders(req, c.config, c.config.Headers)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &StatusError{URL: rawURL, StatusCode: resp.StatusCode}
+	}
+	final := resp.Request.URL
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		// Not a listing after all, e.g. a directory-like URL serving a file.
+		return final, nil, nil
+	}
+
+	pageURL := final
+	var links []*url.URL
+	z := html.NewTokenizer(io.LimitReader(resp.Body, maxCrawlPage))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		name, hasAttr := z.TagName()
+		tag := string(name)
+		if !hasAttr || tag != "a" && tag != "area" && tag != "base" {
+			continue
+		}
+		for {
+			key, val, more := z.TagAttr()
+			if string(key) == "href" {
+				ref, err := pageURL.Parse(strings.TrimSpace(string(val)))
+				if err == nil && (ref.Scheme == "http" || ref.Scheme == "https") {
+					ref.Fragment, ref.RawFragment = "", ""
+					if tag == "base" {
+						pageURL = ref
+					} else {
+						links = append(links, ref)
+					}
+				}
+				break
+			}
+			if !more {
+				break
+			}
+		}
+	}
+	return final, links, nil
+}
+
+// outputPath returns where a link is saved relative to the output directory,
+// or false if it is not to be followed.
+func (c *crawler) outputPath(link *url.URL) (string, bool) {
+	var rel string
+	if link.Host == c.base.Host {
+		if !strings.HasPrefix(link.Path, c.baseDir) {
+			return "", false
+		}
+		rel = strings.TrimPrefix(link.Path, c.baseDir)
+	} else {
+		if !c.opts.SpanHosts {
+			return "", false
+		}
+		rel = sanitizeFileName(link.Host) + link.Path // host_port
+	}
+	if rel == "" {
+		return "", false // the base listing itself
+	}
+	for _, part := range strings.Split(strings.TrimSuffix(rel, "/"), "/") {
+		if part == "" || part == "." || part == ".." || sanitizeFileName(part) != part {
+			return "", false
+		}
+	}
+	return rel, true
+}
+
+// accepts reports whether a file name passes the accept and reject globs.
+func (c *crawler) accepts(name string) bool {
+	if len(c.opts.Accept) > 0 && !matchAny(c.opts.Accept, name) {
+		return false
+	}
+	return !matchAny(c.opts.Reject, name)
+}
+
+func matchAny(globs []string, name string) bool {
+	for _, g := range globs {
+		if ok, _ := path.Match(g, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isCrawlPage reports whether a link is parsed for more links.
+func isCrawlPage(u *url.URL) bool {
+	if strings.HasSuffix(u.Path, "/") {
+		return true
+	}
+	switch strings.ToLower(path.Ext(u.Path)) {
+	case ".html", ".htm":
+		return true
+	}
+	return false
+}
+
+// linkKey identifies a link for deduplication. The query is ignored: it does
+// not change the output path, and autoindex pages use it for sort links.
+func linkKey(u *url.URL) string {
+	return u.Host + u.Path
+}
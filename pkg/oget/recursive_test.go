@@ -0,0 +1,139 @@
+package oget
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCrawl(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("elsewhere"))
+	}))
+	defer other.Close()
+
+	root, err := os.MkdirTemp("", "oget-crawl-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		"secret.txt":              "outside the base",
+		"pub/a.iso":               "iso image",
+		"pub/a.iso.sha256":        "checksum",
+		"pub/docs/readme.txt":     "readme",
+		"pub/docs/deep/b.iso":     "nested image",
+		"pub/docs/deep/b.iso.sig": "signature",
+		"pub/notes.html": `<html><body><a href="docs/readme.txt#top">readme</a>
+<a href="../secret.txt">up</a> <a href="` + other.URL + `/ext.iso">mirror</a>
+<a href="mailto:ops@example.com">mail</a></body></html>`,
+	}
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fileServer := http.FileServer(http.Dir(root))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pub/" {
+			// An Apache autoindex page, with its sort and parent links.
+			w.Header().Set("Content-Type", "text/html;charset=UTF-8")
+			w.Write([]byte(`<html><head><title>Index of /pub</title></head><body>
+<table><tr><th><a href="?C=N;O=D">Name</a></th><th><a href="?C=M;O=A">Last modified</a></th></tr>
+<tr><td><a href="/">Parent Directory</a></td></tr>
+<tr><td><a href="a.iso">a.iso</a></td></tr>
+<tr><td><a href="a.iso.sha256">a.iso.sha256</a></td></tr>
+<tr><td><a href="docs/">docs/</a></td></tr>
+<tr><td><a href="notes.html">notes.html</a></td></tr>
+</table></body></html>`))
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	crawl := func(opts CrawlOptions) []string {
+		t.Helper()
+		// No trailing slash: the server redirects to the listing.
+		entries, err := Crawl(context.Background(), nil, server.URL+"/pub", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var outs []string
+		for _, e := range entries {
+			if strings.HasPrefix(e.URL, server.URL) && e.URL != server.URL+"/pub/"+e.Out {
+				t.Errorf("entry %s saved as %s", e.URL, e.Out)
+			}
+			outs = append(outs, e.Out)
+		}
+		sort.Strings(outs)
+		return outs
+	}
+
+	if got, want := crawl(CrawlOptions{}), []string{
+		"a.iso", "a.iso.sha256", "docs/deep/b.iso", "docs/deep/b.iso.sig", "docs/readme.txt", "notes.html",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("crawl = %q, want %q", got, want)
+	}
+	if got, want := crawl(CrawlOptions{MaxDepth: 2, Accept: []string{"*.iso", "*.txt"}}), []string{
+		"a.iso", "docs/readme.txt",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("crawl with depth 2 and accept = %q, want %q", got, want)
+	}
+	if got, want := crawl(CrawlOptions{Reject: []string{"*.sha256", "*.sig", "*.html"}}), []string{
+		"a.iso", "docs/deep/b.iso", "docs/readme.txt",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("crawl with reject = %q, want %q", got, want)
+	}
+	otherHost := strings.ReplaceAll(strings.TrimPrefix(other.URL, "http://"), ":", "_")
+	if got := crawl(CrawlOptions{SpanHosts: true, Accept: []string{"*.iso"}}); !reflect.DeepEqual(got, []string{
+		otherHost + "/ext.iso", "a.iso", "docs/deep/b.iso",
+	}) {
+		t.Errorf("crawl spanning hosts = %q", got)
+	}
+
+	// The crawled entries download into the same tree under OutputDir.
+	entries, err := Crawl(context.Background(), nil, server.URL+"/pub/", CrawlOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(root, "mirror")
+	d := NewDownloader(nil, 4)
+	d.Config.AutoTune = false
+	d.Config.OutputDir = out
+	d.Fetcher = &HttpFetcher{Client: &http.Client{}, Config: d.Config}
+	d.Quiet = true
+	for _, e := range entries {
+		if err := d.AddEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results, err := d.Download(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(entries) {
+		t.Fatalf("got %d results for %d entries", len(results), len(entries))
+	}
+	for name, content := range files {
+		rel, ok := strings.CutPrefix(name, "pub/")
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(rel)))
+		if err != nil || string(data) != content {
+			t.Errorf("%s = %q, %v; want %q", rel, data, err, content)
+		}
+	}
+}
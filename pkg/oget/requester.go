@@ -2,14 +2,20 @@ package oget
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,6 +24,12 @@ type ResourceMetadata struct {
 	Size         int64
 	ETag         string
 	LastModified string
+	AcceptRanges bool   // the server answered a range request with 206; otherwise the file is fetched as one stream
+	FileName     string // from Content-Disposition, unsanitised
+	FinalURL     string // the URL after following redirects
+	// Digests are whole-file hashes the server reported (Repr-Digest or
+	// Digest), base64 by lowercase algorithm, e.g. "sha-256".
+	Digests map[string]string
 }
 
 // Prober defines the interface for resource discovery.
@@ -34,7 +46,21 @@ type Requester struct {
 	OnProgress      func(int)
 	OnChunkComplete func(int, string)
 	SubmitTask      func(...*ChunkTask)
+	Mirrors         []string // Additional URLs serving the same file as Resource
+	FileName        string   // Output path relative to OutputDir; derived from Resource if empty
+	ChunkSize       int64    // Size of each ChunkTask; RangeSize if zero
+	PieceHashType   string   // Hash type of PieceHashes, e.g. "sha256"
+	PieceHashes     []string // Expected hex digest per chunk, verified before a chunk is marked complete
+	Digest          string   // Expected whole-file digest ("sha256:hex"), verified after Cleanup
+	Cluster         ClusterStore // Shares the download with other processes, see cluster.go
+	ClusterID       string       // This process in Cluster; hostname and PID if empty
 	storages        []StorageHandler // tracked for Sync/Close on cleanup
+	state           *DownloadState   // kept open until Cleanup so completed chunks are recorded
+	store           StateStore       // where state is saved, from Config.StateStoreType
+	mirrorSet       *MirrorSet
+	children        []*Requester // per-file requesters of a metalink
+	media           *mediaDownload // segments of an HLS or DASH stream
+	result          *Result
 }
 
 func NewRequester(resource string, config *Config) *Requester {
@@ -46,20 +72,90 @@ func NewRequester(resource string, config *Config) *Requester {
 		Fetcher:  GetFetcher(resource, config),
 		Prober:   GetProber(resource, config),
 		Config:   config,
+		result:   newResult(resource),
 	}
 }
 
-func (r *Requester) getStateFileName(fileName string) string {
-	dir := filepath.Dir(fileName)
-	base := filepath.Base(fileName)
-	return filepath.Join(dir, "."+base+".oget")
+// Result returns the outcome of downloading the resource, filled in by Downloader.Download.
+func (r *Requester) Result() *Result {
+	return r.result
+}
+
+// outputPath returns the path the resource is written to.
+func (r *Requester) outputPath() string {
+	fileName := r.FileName
+	if fileName == "" {
+		fileName = parseFileName(r.Resource)
+	}
+	if r.Config != nil && r.Config.OutputDir != "" && r.Config.OutputDir != "." {
+		fileName = filepath.Join(r.Config.OutputDir, fileName)
+	}
+	return fileName
+}
+
+// serverFileName picks an output name from what the probe saw, following
+// Config.Naming: "auto" prefers Content-Disposition, then the URL after
+// redirects; "final-url" uses only the latter; "url" neither. It returns ""
+// to name the file after Resource.
+func (r *Requester) serverFileName(meta *ResourceMetadata) string {
+	switch r.Config.Naming {
+	case "url":
+		return ""
+	case "final-url":
+	default:
+		if name := sanitizeFileName(meta.FileName); name != "" {
+			return name
+		}
+	}
+	if meta.FinalURL == "" || meta.FinalURL == r.Resource {
+		return ""
+	}
+	// A redirect to a directory or the site root says nothing about the name.
+	if u, err := url.Parse(meta.FinalURL); err != nil || u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return ""
+	}
+	return sanitizeFileName(parseFileName(meta.FinalURL))
+}
+
+func (r *Requester) chunkSize() int64 {
+	if r.ChunkSize > 0 {
+		return r.ChunkSize
+	}
+	if r.Cluster != nil && r.Config.ClusterChunkSize > 0 {
+		return r.Config.ClusterChunkSize
+	}
+	return RangeSize
+}
+
+// stateKey names the download in its StateStore. Cluster hosts may mount the
+// shared output under different paths, so there the resource identifies it.
+func (r *Requester) stateKey() string {
+	if r.Cluster != nil {
+		return r.Resource
+	}
+	return r.outputPath()
+}
+
+// openStateStore returns the store for the download's state: the cluster's,
+// or the one Config selects.
+func (r *Requester) openStateStore() (StateStore, error) {
+	if r.Cluster != nil {
+		return clusterStateStore{cluster: r.Cluster}, nil
+	}
+	return OpenStateStore(r.Config)
 }
 
 func (r *Requester) createStorageHandler(file *os.File, length int64) (StorageHandler, error) {
 	switch r.Config.StorageType {
 	case "uring":
-		log.Printf("Using standard file storage (io_uring is disabled due to environment compatibility)")
-		return &FileStorageHandler{File: file}, nil
+		// Size the ring so every worker can keep a full batch in flight.
+		h, err := NewURingStorageHandler(file, uint(r.Config.Concurrency*4))
+		if err != nil {
+			log.Printf("Warning: io_uring unavailable (%v), falling back to standard file", err)
+			return &FileStorageHandler{File: file}, nil
+		}
+		log.Printf("Using io_uring storage backend")
+		return h, nil
 	case "mmap":
 		if length <= 0 {
 			log.Printf("Warning: cannot use mmap for unknown length, falling back to standard file")
@@ -74,9 +170,21 @@ func (r *Requester) createStorageHandler(file *os.File, length int64) (StorageHa
 
 // PrepareTasks probes the resource and splits it into ChunkTasks.
 func (r *Requester) PrepareTasks(ctx context.Context) error {
+	if isMetalinkResource(r.Resource) {
+		return r.prepareMetalink(ctx)
+	}
+	if isMediaManifest(r.Resource) {
+		return r.prepareMedia(ctx)
+	}
 	isBitTorrent := strings.HasPrefix(strings.ToLower(r.Resource), "magnet:") || isTorrentResource(r.Resource)
 
-	meta, err := r.Prober.Probe(ctx, r.Resource)
+	var meta *ResourceMetadata
+	var err error
+	if len(r.Mirrors) > 0 && !isBitTorrent {
+		meta, err = r.probeMirrors(ctx)
+	} else {
+		meta, err = r.Prober.Probe(ctx, r.Resource)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to probe resource %s: %w", r.Resource, err)
 	}
@@ -84,39 +192,58 @@ func (r *Requester) PrepareTasks(ctx context.Context) error {
 	length := meta.Size
 	etag := meta.ETag
 	lastModified := meta.LastModified
+	if r.FileName == "" {
+		r.FileName = r.serverFileName(meta)
+	}
 
-	fileName := parseFileName(r.Resource)
-	if r.Config != nil && r.Config.OutputDir != "" && r.Config.OutputDir != "." {
-		fileName = filepath.Join(r.Config.OutputDir, fileName)
+	fileName := r.outputPath()
+	chunkSize := r.chunkSize()
+	// Without proven range support the file is one chunk fetched as a
+	// single stream; splitting it would write whole bodies at chunk offsets.
+	sequential := length > 0 && !meta.AcceptRanges && !isBitTorrent
+	if sequential {
+		log.Printf("%s does not support range requests, downloading as a single stream", r.Resource)
+		chunkSize = length
+	}
+	r.result.File = fileName
+	if dir := filepath.Dir(fileName); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+	}
+
+	if r.store == nil {
+		r.store, err = r.openStateStore()
+		if err != nil {
+			return err
+		}
 	}
-	stateFileName := r.getStateFileName(fileName)
 
 	var state *DownloadState
+	resumed := false
 	// Try to load existing state
-	if _, err := os.Stat(stateFileName); err == nil {
-		s, err := LoadState(stateFileName)
-		if err == nil {
-			// Verify if server file has changed and target file exists
-			if s.FileSize == length && !s.IsServerChanged(etag, lastModified) {
-				if _, err := os.Stat(fileName); err == nil {
-					log.Printf("Found existing state and file for %s, resuming download...", fileName)
-					state = s
-				} else {
-					log.Printf("Target file %s missing, restarting download", fileName)
-				}
+	if s, err := r.store.Load(r.stateKey()); err == nil {
+		// Verify if server file has changed and target file exists
+		if s.FileSize == length && s.ChunkSize == chunkSize && !s.IsServerChanged(etag, lastModified) {
+			if _, err := os.Stat(fileName); err == nil {
+				log.Printf("Found existing state and file for %s, resuming download...", fileName)
+				state = s
+				resumed = true
 			} else {
-				log.Printf("Server file changed or size mismatch, restarting download for %s", fileName)
-			}
-			if state == nil {
-				s.Close()
+				log.Printf("Target file %s missing, restarting download", fileName)
 			}
 		} else {
-			log.Printf("Failed to load existing state: %v", err)
+			log.Printf("Server file changed or size mismatch, restarting download for %s", fileName)
 		}
+		if state == nil {
+			s.Close()
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to load existing state: %v", err)
 	}
 
 	if state == nil {
-		state, err = NewDownloadState(r.Resource, length, RangeSize, stateFileName)
+		state, err = r.store.Create(r.stateKey(), r.Resource, length, chunkSize)
 		if err != nil {
 			return fmt.Errorf("failed to create download state: %w", err)
 		}
@@ -127,14 +254,15 @@ func (r *Requester) PrepareTasks(ctx context.Context) error {
 			log.Printf("Warning: failed to save initial state: %v", err)
 		}
 	}
-	defer state.Close()
+	r.state = state
 
 	log.Printf("Preparing tasks for %s (%s, size: %s, progress: %.2f%%)",
 		r.Resource, fileName, humanizeSize(length), state.PercentComplete())
 
 	var storage StorageHandler
+	var file *os.File
 	if !isBitTorrent {
-		file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0666)
+		file, err = os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0666)
 		if err != nil {
 			return fmt.Errorf("failed to create/open file %s: %w", fileName, err)
 		}
@@ -160,8 +288,18 @@ func (r *Requester) PrepareTasks(ctx context.Context) error {
 		r.storages = append(r.storages, storage)
 	}
 
+	if storage != nil {
+		state.SetDataSync(storage.Sync)
+	}
+
 	// Define a common OnChunkComplete that saves state
 	onChunkComplete := func(chunkID int, hash string) {
+		if r.Cluster != nil && storage != nil {
+			// Other hosts read the chunk as soon as it is marked done.
+			if err := storage.Sync(); err != nil {
+				log.Printf("Warning: failed to sync %s: %v", fileName, err)
+			}
+		}
 		state.MarkComplete(chunkID, hash)
 		if r.OnChunkComplete != nil {
 			r.OnChunkComplete(chunkID, hash)
@@ -171,6 +309,10 @@ func (r *Requester) PrepareTasks(ctx context.Context) error {
 		// The bitset is already updated via mmap in state.MarkComplete.
 	}
 
+	if r.Cluster != nil && (isBitTorrent || length <= 0) {
+		log.Printf("Warning: %s cannot be split into leased chunks, downloading it without the cluster", r.Resource)
+	}
+
 	// Split tasks.
 	if isBitTorrent {
 		// Single task for BitTorrent (which handles its own internal concurrency/P2P)
@@ -184,6 +326,9 @@ func (r *Requester) PrepareTasks(ctx context.Context) error {
 		task.FetcherHandler = r.Fetcher
 		task.OnProgress = r.OnProgress
 		task.OnChunkComplete = onChunkComplete
+		task.ETag = state.ETag
+		task.LastModified = state.LastModified
+		task.Result = r.result
 		if r.SubmitTask != nil {
 			r.SubmitTask(task)
 		}
@@ -191,35 +336,90 @@ func (r *Requester) PrepareTasks(ctx context.Context) error {
 	}
 
 	if length <= 0 {
-		// Single task for unknown length (no resume support for unknown length yet)
+		// Single task streaming to EOF. The state tracks how far it got, so a
+		// restart resumes with "Range: bytes=N-".
+		if resumed && state.StreamSize > 0 {
+			log.Printf("%s already complete (%s)", fileName, humanizeSize(state.StreamSize))
+			return nil
+		}
+		stream := newStreamStorage(storage, state)
 		task := NewChunkTask()
 		task.FileID = fileName
 		task.ChunkID = 0
 		task.Offset = 0
 		task.Length = -1 // -1 means until EOF
+		task.Written = stream.Offset()
 		task.URL = r.Resource
-		task.StorageHandler = storage
+		task.StorageHandler = stream
 		task.FetcherHandler = r.Fetcher
 		task.OnProgress = r.OnProgress
-		task.OnChunkComplete = onChunkComplete
+		task.OnChunkComplete = func(chunkID int, hash string) {
+			// EOF: the size is now known. Drop any tail left by an earlier,
+			// longer version of the file and record the size in the state.
+			size := stream.Offset()
+			if err := file.Truncate(size); err != nil {
+				log.Printf("Warning: failed to truncate %s to %d bytes: %v", fileName, size, err)
+			}
+			if err := state.SetStreamSize(size); err != nil {
+				log.Printf("Warning: failed to save state for %s: %v", fileName, err)
+			}
+			onChunkComplete(chunkID, hash)
+		}
+		task.ETag = state.ETag
+		task.LastModified = state.LastModified
+		task.Headers = r.Config.Headers
+		task.Result = r.result
+		if task.Written > 0 {
+			log.Printf("Resuming %s of unknown length from %s", fileName, humanizeSize(task.Written))
+		}
 		if r.SubmitTask != nil {
 			r.SubmitTask(task)
 		}
 		return nil
 	}
 
-	// Use the global RangeSize (1MB) defined in fetcher.go.
-	chunkCount := int(length / RangeSize)
-	if length%RangeSize != 0 {
+	// Chunks default to the global RangeSize (1MB) defined in fetcher.go.
+	chunkCount := int(length / chunkSize)
+	if length%chunkSize != 0 {
 		chunkCount++
 	}
 
+	var verify func(*ChunkTask) error
+	if len(r.PieceHashes) > 0 && sequential {
+		log.Printf("Warning: cannot verify pieces of %s without range support, relying on the file digest", fileName)
+	} else if len(r.PieceHashes) > 0 {
+		if len(r.PieceHashes) != chunkCount {
+			log.Printf("Warning: %s lists %d piece hashes for %d pieces, verifying what is available",
+				fileName, len(r.PieceHashes), chunkCount)
+		}
+		verify = r.verifyPiece
+	}
+
+	var lease *clusterLease
+	if r.Cluster != nil {
+		owner := r.ClusterID
+		if owner == "" {
+			owner = clusterOwner()
+		}
+		ttl := time.Duration(r.Config.LeaseTTL) * time.Second
+		if ttl <= 0 {
+			ttl = time.Minute
+		}
+		lease = &clusterLease{cluster: r.Cluster, key: r.stateKey(), owner: owner, ttl: ttl}
+	}
+
 	batchSize := r.Config.TaskBatchSize
 	if batchSize <= 0 {
 		batchSize = 100
 	}
 	var batch []*ChunkTask
 
+	if resumed && r.Config.VerifyOnResume {
+		if err := r.reverifyChunks(ctx, state, storage, chunkCount, chunkSize, length); err != nil {
+			return err
+		}
+	}
+
 	for i := 0; i < chunkCount; i++ {
 		// Skip completed chunks
 		if state.IsComplete(i) {
@@ -232,8 +432,8 @@ func (r *Requester) PrepareTasks(ctx context.Context) error {
 		default:
 		}
 
-		offset := int64(i) * RangeSize
-		chunkLength := RangeSize
+		offset := int64(i) * chunkSize
+		chunkLength := chunkSize
 		if i == chunkCount-1 {
 			chunkLength = length - offset
 		}
@@ -248,6 +448,14 @@ func (r *Requester) PrepareTasks(ctx context.Context) error {
 		task.FetcherHandler = r.Fetcher
 		task.OnProgress = r.OnProgress
 		task.OnChunkComplete = onChunkComplete
+		task.ETag = state.ETag
+		task.LastModified = state.LastModified
+		task.Headers = r.Config.Headers
+		task.Result = r.result
+		task.Mirrors = r.mirrorSet
+		task.Verify = verify
+		task.Sequential = sequential
+		task.lease = lease
 		
 		batch = append(batch, task)
 		if len(batch) >= batchSize {
@@ -266,6 +474,201 @@ func (r *Requester) PrepareTasks(ctx context.Context) error {
 	return nil
 }
 
+// reverifyChunks re-hashes the chunks a resumed state marks complete and
+// clears those whose data on disk no longer matches the recorded SHA-256, so
+// a crash mid-write cannot leave garbage behind a set bit. Chunks completed
+// without a recorded digest are trusted as before.
+func (r *Requester) reverifyChunks(ctx context.Context, state *DownloadState, storage StorageHandler, chunkCount int, chunkSize, length int64) error {
+	var checked, requeued, unverified int
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+	h := sha256.New()
+
+	for i := 0; i < chunkCount; i++ {
+		if !state.IsComplete(i) {
+			continue
+		}
+		want := state.ChunkHash(i)
+		if want == "" {
+			unverified++
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		offset := int64(i) * chunkSize
+		chunkLength := chunkSize
+		if i == chunkCount-1 {
+			chunkLength = length - offset
+		}
+		h.Reset()
+		_, err := io.CopyBuffer(h, io.NewSectionReader(storage, offset, chunkLength), buf)
+		checked++
+		if err != nil || hex.EncodeToString(h.Sum(nil)) != want {
+			if r.Config.Verbose {
+				log.Printf("Chunk %d of %s failed re-verification, downloading it again", i, r.Resource)
+			}
+			state.ClearComplete(i)
+			requeued++
+		}
+	}
+
+	log.Printf("Re-verified %d completed chunks of %s: %d corrupt, %d without a recorded digest",
+		checked, r.Resource, requeued, unverified)
+	return nil
+}
+
+// probeMirrors probes the resource and all its mirrors concurrently. The first
+// URL (in declaration order) that answers becomes the reference; mirrors are
+// kept only if they agree with it on size and serve the same content: the
+// same hash when both report one in the same algorithm, else the same ETag
+// when every mirror sends a strong one, else the same Last-Modified when both
+// report one.
+func (r *Requester) probeMirrors(ctx context.Context) (*ResourceMetadata, error) {
+	urls := append([]string{r.Resource}, r.Mirrors...)
+	metas := make([]*ResourceMetadata, len(urls))
+	errs := make([]error, len(urls))
+
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		prober := r.Prober
+		if i > 0 {
+			prober = GetProber(u, r.Config)
+		}
+		wg.Add(1)
+		go func(i int, u string, prober Prober) {
+			defer wg.Done()
+			metas[i], errs[i] = prober.Probe(ctx, u)
+		}(i, u, prober)
+	}
+	wg.Wait()
+
+	// ETags only identify the content across servers if they all send a
+	// strong one; weak or missing ones are common on plain mirrors.
+	allStrong := true
+	for i := range urls {
+		if errs[i] == nil && (metas[i].ETag == "" || strings.HasPrefix(metas[i].ETag, "W/")) {
+			allStrong = false
+		}
+	}
+
+	var ref *ResourceMetadata
+	var healthy []string
+	for i, u := range urls {
+		if errs[i] != nil {
+			log.Printf("Warning: mirror %s failed to probe, skipping: %v", u, errs[i])
+			continue
+		}
+		m := metas[i]
+		if ref == nil {
+			ref = m
+		} else if m.Size != ref.Size {
+			log.Printf("Warning: mirror %s reports size %d, expected %d, skipping", u, m.Size, ref.Size)
+			continue
+		} else if ref.AcceptRanges && !m.AcceptRanges {
+			log.Printf("Warning: mirror %s does not support range requests, skipping", u)
+			continue
+		} else if same, ok := sameDigest(m.Digests, ref.Digests); ok {
+			if !same {
+				log.Printf("Warning: mirror %s reports another hash of the file, skipping", u)
+				continue
+			}
+		} else if allStrong {
+			if m.ETag != ref.ETag {
+				log.Printf("Warning: mirror %s reports ETag %s, expected %s, skipping", u, m.ETag, ref.ETag)
+				continue
+			}
+		} else if !sameModTime(m.LastModified, ref.LastModified) {
+			log.Printf("Warning: mirror %s reports Last-Modified %s, expected %s, skipping", u, m.LastModified, ref.LastModified)
+			continue
+		}
+		healthy = append(healthy, u)
+	}
+	if ref == nil {
+		return nil, fmt.Errorf("no mirror answered: %w", errs[0])
+	}
+	if (ref.Size <= 0 || !ref.AcceptRanges) && len(healthy) > 1 {
+		// Without a known size and ranges chunks cannot be spread; stick to one source.
+		log.Printf("Warning: unknown size or no range support, downloading %s from a single mirror", r.Resource)
+		healthy = healthy[:1]
+	}
+
+	if len(healthy) > 1 {
+		// Chunks are validated against ETag/Last-Modified on every request,
+		// so keep only validators all mirrors share: an ETag that differs or
+		// is missing on one would fail If-Range, and so might a Last-Modified
+		// formatted differently.
+		meta := *ref
+		meta.LastModified = ""
+		for i, u := range urls {
+			if slices.Contains(healthy, u) && metas[i].ETag != ref.ETag {
+				meta.ETag = ""
+			}
+		}
+		ref = &meta
+	}
+
+	log.Printf("Using %d of %d mirrors for %s", len(healthy), len(urls), r.Resource)
+	r.mirrorSet = NewMirrorSet(healthy, time.Duration(r.Config.Timeout)*time.Second)
+	r.mirrorSet.Verbose = r.Config.Verbose
+	return ref, nil
+}
+
+// sameDigest compares the hashes two servers reported for a file in the
+// algorithms both used; comparable is false if they have none in common.
+func sameDigest(a, b map[string]string) (same, comparable bool) {
+	for algo, va := range a {
+		if vb, ok := b[algo]; ok {
+			if va != vb {
+				return false, true
+			}
+			comparable = true
+		}
+	}
+	return comparable, comparable
+}
+
+// parseDigestHeaders reads the whole-file hashes in Repr-Digest (RFC 9530,
+// sha-256=:base64:) and the older Digest (RFC 3230, SHA-256=base64).
+func parseDigestHeaders(h http.Header) map[string]string {
+	var digests map[string]string
+	for _, name := range []string{"Digest", "Repr-Digest"} {
+		for _, v := range h.Values(name) {
+			for _, item := range strings.Split(v, ",") {
+				algo, value, _ := strings.Cut(strings.TrimSpace(item), "=")
+				algo = strings.ToLower(strings.TrimSpace(algo))
+				value = strings.Trim(strings.TrimSpace(value), ":")
+				if algo == "" || value == "" {
+					continue
+				}
+				if digests == nil {
+					digests = make(map[string]string)
+				}
+				digests[algo] = value
+			}
+		}
+	}
+	return digests
+}
+
+// sameModTime reports whether two Last-Modified values name the same time.
+// A missing or unparsable value matches anything.
+func sameModTime(a, b string) bool {
+	if a == "" || b == "" {
+		return true
+	}
+	ta, errA := http.ParseTime(a)
+	tb, errB := http.ParseTime(b)
+	if errA != nil || errB != nil {
+		return true
+	}
+	return ta.Equal(tb)
+}
+
 // HttpProber implements Prober for HTTP protocol.
 type HttpProber struct {
 	Config *Config
@@ -283,8 +686,10 @@ func (p *HttpProber) httpClient() *http.Client {
 		}
 	}
 	return &http.Client{
-		Timeout:   time.Second * time.Duration(p.Config.Timeout),
-		Transport: transport,
+		Timeout:       time.Second * time.Duration(p.Config.Timeout),
+		Transport:     newAuthTransport(p.Config, newHostHeaderTransport(p.Config, transport)),
+		CheckRedirect: checkRedirect,
+		Jar:           cookieJarFor(p.Config),
 	}
 }
 
@@ -295,6 +700,11 @@ func (p *HttpProber) Probe(ctx context.Context, url string) (*ResourceMetadata,
 		meta := &ResourceMetadata{
 			ETag:         resp.Header.Get("ETag"),
 			LastModified: resp.Header.Get("Last-Modified"),
+			FileName:     contentDispositionFileName(resp.Header.Get("Content-Disposition")),
+			Digests:      parseDigestHeaders(resp.Header),
+		}
+		if resp.Request != nil {
+			meta.FinalURL = resp.Request.URL.String()
 		}
 		if attr := resp.Header.Get("Content-Length"); attr != "" {
 			if l, err := strconv.ParseInt(attr, 10, 64); err == nil {
@@ -304,69 +714,107 @@ func (p *HttpProber) Probe(ctx context.Context, url string) (*ResourceMetadata,
 		return meta
 	}
 
-	// 1. Try HEAD with Range (most efficient for probing)
+	// 1. Try HEAD with Range (most efficient for probing). A 206 proves
+	// range support.
 	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
 	if err == nil {
-		req.Header.Set("User-Agent", "oget/"+Version)
+		setRequestHeaders(req, p.Config, p.Config.Headers)
 		req.Header.Set("Range", "bytes=0-0")
 		resp, err := client.Do(req)
 		if err == nil {
 			defer resp.Body.Close()
 			if resp.StatusCode == http.StatusPartialContent {
 				meta := extractMeta(resp)
-				contentRange := resp.Header.Get("Content-Range")
-				if contentRange != "" {
-					var start, end, total int64
-					fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &total)
+				if _, _, total, err := parseContentRange(resp.Header.Get("Content-Range")); err == nil && total >= 0 {
 					meta.Size = total
+					meta.AcceptRanges = true
 					return meta, nil
 				}
 			}
 		}
 	}
 
-	// 2. Try standard HEAD
+	// 2. Try standard HEAD. Many servers ignore Range on HEAD only, so unless
+	// ranges are refused outright, support is checked with a GET below.
+	var head *ResourceMetadata
 	req, err = http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
 	if err == nil {
-		req.Header.Set("User-Agent", "oget/"+Version)
+		setRequestHeaders(req, p.Config, p.Config.Headers)
 		resp, err := client.Do(req)
 		if err == nil {
 			defer resp.Body.Close()
 			if resp.StatusCode == http.StatusOK {
-				return extractMeta(resp), nil
+				head = extractMeta(resp)
+				if head.Size <= 0 || strings.EqualFold(resp.Header.Get("Accept-Ranges"), "none") {
+					return head, nil
+				}
 			}
 		}
 	}
 
 	// 3. Fallback to GET with limit (if HEAD failed or returned 302/405/etc)
-	// We use a limited GET to just see the headers and maybe the first byte
+	// We ask for the first byte only; a 200 means ranges are not supported.
 	req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("User-Agent", "oget/"+Version)
+	setRequestHeaders(req, p.Config, p.Config.Headers)
+	req.Header.Set("Range", "bytes=0-0")
 	// We don't want the whole body yet, just the response headers
 	resp, err := client.Do(req)
 	if err != nil {
+		if head != nil {
+			return head, nil
+		}
 		// If even GET fails, we can't do much
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		meta := extractMeta(resp)
+		meta.Size = 0
+		if head != nil {
+			meta.Size = head.Size
+		}
+		if _, _, total, err := parseContentRange(resp.Header.Get("Content-Range")); err == nil && total >= 0 {
+			meta.Size = total
+		}
+		meta.AcceptRanges = meta.Size > 0
+		return meta, nil
+	case http.StatusOK:
 		return extractMeta(resp), nil
+	case http.StatusNotFound, http.StatusGone:
+		return nil, &StatusError{URL: url, StatusCode: resp.StatusCode}
 	}
-	
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("resource not found (404): %s", url)
+	if head != nil {
+		return head, nil
 	}
 
 	// If we got here, we still return what we have (even if Size 0) to allow direct download attempt
 	return &ResourceMetadata{Size: 0}, nil
 }
 
-// Cleanup syncs data to disk and removes the state file associated with the resource.
-func (r *Requester) Cleanup() {
+// Close syncs and closes the storage handlers and the download state, keeping
+// the saved state so an interrupted download can be resumed later.
+func (r *Requester) Close() {
+	for _, child := range r.children {
+		child.Close()
+	}
+	r.closeFiles()
+	if r.store != nil {
+		r.store.Close()
+		r.store = nil
+	}
+}
+
+// closeFiles syncs and closes the storage handlers and the download state.
+func (r *Requester) closeFiles() {
+	if r.state != nil {
+		// The storages are synced right here, and closed before the state is.
+		r.state.SetDataSync(nil)
+	}
 	// Sync and close all storage handlers to ensure data is flushed (especially for mmap backend)
 	for _, s := range r.storages {
 		if err := s.Sync(); err != nil {
@@ -378,15 +826,41 @@ func (r *Requester) Cleanup() {
 	}
 	r.storages = nil
 
-	fileName := parseFileName(r.Resource)
-	if r.Config != nil && r.Config.OutputDir != "" && r.Config.OutputDir != "." {
-		fileName = filepath.Join(r.Config.OutputDir, fileName)
+	// Data first, then the bitset: a chunk must never be marked done on disk
+	// before its bytes are.
+	if r.state != nil {
+		if err := r.state.Sync(); err != nil {
+			log.Printf("Warning: failed to sync state for %s: %v", r.Resource, err)
+		}
+		r.state.Close()
+		r.state = nil
 	}
-	stateFileName := r.getStateFileName(fileName)
-	dir := filepath.Dir(fileName)
-	base := filepath.Base(fileName)
-	bitsetFileName := filepath.Join(dir, "."+base+".oget.bits")
+}
 
-	_ = os.Remove(stateFileName)
-	_ = os.Remove(bitsetFileName)
+// Cleanup syncs data to disk and removes the saved state of the resource.
+func (r *Requester) Cleanup() {
+	for _, child := range r.children {
+		child.Cleanup()
+	}
+	if len(r.children) > 0 {
+		return
+	}
+
+	r.closeFiles()
+	if r.media != nil {
+		return // segments are tracked by their files, not a state store
+	}
+	if r.store == nil {
+		store, err := r.openStateStore()
+		if err != nil {
+			log.Printf("Warning: failed to remove state for %s: %v", r.Resource, err)
+			return
+		}
+		r.store = store
+	}
+	if err := r.store.Remove(r.stateKey()); err != nil {
+		log.Printf("Warning: failed to remove state for %s: %v", r.Resource, err)
+	}
+	r.store.Close()
+	r.store = nil
 }
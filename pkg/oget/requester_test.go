@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -70,6 +71,90 @@ func TestRequester_ProbeFallbackGet(t *testing.T) {
 	}
 }
 
+func TestRequester_ProbeAcceptRanges(t *testing.T) {
+	ranged := ogettest.NewLargeRangeServer(1)
+	defer ranged.Close()
+
+	// Advertises ranges but always sends the whole body.
+	ignoring := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", "12")
+		io.WriteString(w, "Hello World!")
+	}))
+	defer ignoring.Close()
+
+	tests := []struct {
+		url  string
+		size int64
+		want bool
+	}{
+		{ranged.URL + "/testfile.bin", ranged.Content.Size, true},
+		{ignoring.URL, 12, false},
+	}
+	for _, tt := range tests {
+		r := NewRequester(tt.url, DefaultConfig())
+		meta, err := r.Prober.Probe(context.Background(), r.Resource)
+		if err != nil {
+			t.Fatalf("probe %s failed: %v", tt.url, err)
+		}
+		if meta.Size != tt.size || meta.AcceptRanges != tt.want {
+			t.Errorf("probe %s: size %d, AcceptRanges %v, want %d, %v", tt.url, meta.Size, meta.AcceptRanges, tt.size, tt.want)
+		}
+	}
+}
+
+func TestRequester_ServerFileName(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="report.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`)
+		io.WriteString(w, "Hello World!")
+	})
+	mux.HandleFunc("/evil", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="../../escape.sh"`)
+		io.WriteString(w, "Hello World!")
+	})
+	mux.HandleFunc("/latest", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/files/app-1.2.tar.gz?sig=abc", http.StatusFound)
+	})
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "Hello World!")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "oget-naming-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		path, naming, want string
+	}{
+		{"/download?id=123", "auto", "résumé.pdf"},
+		{"/download?id=123", "final-url", "download"},
+		{"/download?id=123", "url", "download"},
+		{"/evil", "auto", "escape.sh"},
+		{"/latest", "auto", "app-1.2.tar.gz"},
+		{"/latest", "final-url", "app-1.2.tar.gz"},
+		{"/latest", "url", "latest"},
+	}
+	for _, tt := range tests {
+		config := DefaultConfig()
+		config.OutputDir = dir
+		config.Naming = tt.naming
+		r := NewRequester(server.URL+tt.path, config)
+		r.Fetcher = &HttpFetcher{Client: &http.Client{}, Config: config}
+		if err := r.PrepareTasks(context.Background()); err != nil {
+			t.Fatalf("%s (%s): %v", tt.path, tt.naming, err)
+		}
+		r.Cleanup()
+		if got := r.Result().File; got != filepath.Join(dir, tt.want) {
+			t.Errorf("%s (%s): saved as %q, want %q", tt.path, tt.naming, got, filepath.Join(dir, tt.want))
+		}
+	}
+}
+
 func TestRequester_ProbeRedirect(t *testing.T) {
 	// Start a server that redirects to another server
 	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -106,7 +191,9 @@ func TestRequester_PrepareTasks(t *testing.T) {
 	defer os.Remove(fileName + ".oget.state.json")
 	defer file.Close()
 
-	r := NewRequester(server.URL, DefaultConfig())
+	config := DefaultConfig()
+	config.OutputDir = t.TempDir()
+	r := NewRequester(server.URL, config)
 	r.Fetcher = &HttpFetcher{Client: &http.Client{}}
 	
 	var tasks []*ChunkTask
@@ -123,3 +210,66 @@ func TestRequester_PrepareTasks(t *testing.T) {
 		t.Errorf("expected tasks, got 0")
 	}
 }
+
+func TestRequester_ReverifyOnResume(t *testing.T) {
+	server := ogettest.NewLargeRangeServer(4)
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "oget-reverify-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig()
+	config.OutputDir = dir
+	config.VerifyOnResume = true
+	u := server.URL + "/testfile.bin"
+
+	// First run: fetch every chunk but the last, then stop without Cleanup.
+	r := NewRequester(u, config)
+	r.Fetcher = &HttpFetcher{Client: &http.Client{}, Config: config}
+	r.SubmitTask = func(tasks ...*ChunkTask) {
+		for _, task := range tasks {
+			if task.ChunkID == 3 {
+				continue
+			}
+			if err := task.FetcherHandler.Fetch(context.Background(), task); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := r.PrepareTasks(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range r.storages {
+		s.Close()
+	}
+	r.state.Close()
+
+	// Simulate a torn write in chunk 1.
+	f, err := os.OpenFile(filepath.Join(dir, "testfile.bin"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(make([]byte, 4096), RangeSize+100); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	r = NewRequester(u, config)
+	var resumed []int
+	r.SubmitTask = func(tasks ...*ChunkTask) {
+		for _, task := range tasks {
+			resumed = append(resumed, task.ChunkID)
+		}
+	}
+	if err := r.PrepareTasks(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	r.Cleanup()
+
+	if len(resumed) != 2 || resumed[0] != 1 || resumed[1] != 3 {
+		t.Errorf("expected chunks [1 3] to be queued on resume, got %v", resumed)
+	}
+}
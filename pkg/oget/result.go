@@ -0,0 +1,104 @@
+package oget
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status is the outcome of downloading one URL.
+type Status string
+
+const (
+	StatusCompleted   Status = "completed"
+	StatusFailed      Status = "failed"
+	StatusInterrupted Status = "interrupted"
+)
+
+// Result reports how the download of a single URL went.
+type Result struct {
+	URL      string
+	File     string // output path
+	Status   Status
+	Bytes    int64 // bytes fetched in this run
+	Duration time.Duration
+	Protocol string // "http", "https", "ftp", "bittorrent", "magnet", "metalink"
+	Retries  int    // chunk fetches that were retried
+	Err      error  // nil on success; matches ErrNotFound, ErrServerChanged, ErrChecksumMismatch, ...
+
+	mu      sync.Mutex
+	start   time.Time
+	pending int64 // chunks not yet completed or abandoned
+}
+
+func newResult(resource string) *Result {
+	return &Result{URL: resource, Protocol: protocolOf(resource), start: time.Now()}
+}
+
+// protocolOf names the protocol used to fetch resource.
+func protocolOf(resource string) string {
+	switch {
+	case strings.HasPrefix(strings.ToLower(resource), "magnet:"):
+		return "magnet"
+	case isTorrentResource(resource):
+		return "bittorrent"
+	case isMetalinkResource(resource):
+		return "metalink"
+	}
+	if u, err := url.Parse(resource); err == nil && u.Scheme != "" {
+		return strings.ToLower(u.Scheme)
+	}
+	return "http"
+}
+
+func (r *Result) addBytes(n int) {
+	atomic.AddInt64(&r.Bytes, int64(n))
+}
+
+func (r *Result) addRetry() {
+	r.mu.Lock()
+	r.Retries++
+	r.mu.Unlock()
+}
+
+// fail records err unless an earlier error is already recorded.
+func (r *Result) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err == nil {
+		r.Err = err
+	}
+}
+
+func (r *Result) err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Err
+}
+
+// chunkDone marks one chunk as settled and stops the clock after the last one.
+func (r *Result) chunkDone() {
+	if atomic.AddInt64(&r.pending, -1) == 0 {
+		r.mu.Lock()
+		r.Duration = time.Since(r.start)
+		r.mu.Unlock()
+	}
+}
+
+// finish sets the final status, taking the failure recorded so far into account.
+func (r *Result) finish(status Status, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err == nil {
+		r.Err = err
+	}
+	if r.Err != nil && status == StatusCompleted {
+		status = StatusFailed
+	}
+	r.Status = status
+	if r.Duration == 0 || status != StatusCompleted {
+		r.Duration = time.Since(r.start)
+	}
+}
@@ -0,0 +1,116 @@
+package oget
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRetryAfter bounds how long a server may ask us to wait via Retry-After.
+const maxRetryAfter = 10 * time.Minute
+
+// RetryPolicy decides whether and when a failed chunk is fetched again.
+type RetryPolicy struct {
+	MaxAttempts int           // total attempts per chunk, including the first
+	BaseDelay   time.Duration // delay before the first retry, doubled on each further one
+	MaxDelay    time.Duration // cap for the exponential backoff
+	Jitter      float64       // fraction of the delay randomly taken off, 0..1
+}
+
+// NewRetryPolicy builds the policy described by config.
+func NewRetryPolicy(config *Config) RetryPolicy {
+	p := RetryPolicy{
+		MaxAttempts: config.RetryMaxAttempts,
+		BaseDelay:   time.Duration(config.RetryBaseDelay) * time.Millisecond,
+		MaxDelay:    time.Duration(config.RetryMaxDelay) * time.Millisecond,
+		Jitter:      config.RetryJitter,
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = MaxFetchRetries
+	}
+	if p.MaxDelay < p.BaseDelay {
+		p.MaxDelay = p.BaseDelay
+	}
+	if p.Jitter < 0 {
+		p.Jitter = 0
+	} else if p.Jitter > 1 {
+		p.Jitter = 1
+	}
+	return p
+}
+
+// Backoff returns how long to wait before retry number attempt (1 for the
+// first retry). A Retry-After sent with err overrides a shorter backoff.
+func (p RetryPolicy) Backoff(attempt int, err error) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 && delay > 0 {
+		delay -= time.Duration(p.Jitter * rand.Float64() * float64(delay))
+	}
+
+	var se *StatusError
+	if errors.As(err, &se) && se.RetryAfter > delay {
+		delay = min(se.RetryAfter, maxRetryAfter)
+	}
+	return delay
+}
+
+// IsRetryable classifies a fetch error. Client errors such as 403, 404 and
+// 410, permanent FTP errors (5xx), SFTP logins and files that fail for good,
+// a resource that changed on the server and a server ignoring ranges are
+// fatal; rate limiting (429), server errors
+// (5xx), transient FTP errors (4xx), network failures and bad data are
+// retried.
+func IsRetryable(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, ErrServerChanged), errors.Is(err, ErrRangeNotSupported):
+		return false
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		switch {
+		case se.StatusCode == http.StatusTooManyRequests, se.StatusCode == http.StatusRequestTimeout:
+			return true
+		case se.StatusCode >= 400 && se.StatusCode < 500:
+			return false
+		}
+	}
+	var fe *FtpError
+	if errors.As(err, &fe) {
+		return fe.Code < 500
+	}
+	var sfe *SftpError
+	if errors.As(err, &sfe) {
+		return false
+	}
+	return true
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
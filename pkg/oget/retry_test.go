@@ -0,0 +1,135 @@
+package oget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qtopie/oget/ogettest"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&StatusError{StatusCode: http.StatusNotFound}, false},
+		{&StatusError{StatusCode: http.StatusGone}, false},
+		{&StatusError{StatusCode: http.StatusForbidden}, false},
+		{&StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{&StatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&StatusError{StatusCode: http.StatusInternalServerError}, true},
+		{fmt.Errorf("%w: etag", ErrServerChanged), false},
+		{fmt.Errorf("%w: piece 3", ErrChecksumMismatch), true},
+		{io.ErrUnexpectedEOF, true},
+		{context.Canceled, false},
+	}
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		if got := p.Backoff(attempt+1, nil); got != want*time.Millisecond {
+			t.Errorf("attempt %d: backoff %v, want %v", attempt+1, got, want*time.Millisecond)
+		}
+	}
+
+	limited := &StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: 5 * time.Second}
+	if got := p.Backoff(1, limited); got != 5*time.Second {
+		t.Errorf("Retry-After not honoured: %v", got)
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.Backoff(3, nil); got < 200*time.Millisecond || got > 400*time.Millisecond {
+			t.Fatalf("jittered backoff %v outside [200ms, 400ms]", got)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"-1":                            0,
+		"soon":                          0,
+		"Fri, 02 Jan 2026 03:04:35 GMT": 30 * time.Second,
+		"Fri, 02 Jan 2026 03:00:00 GMT": 0,
+	}
+	for in, want := range tests {
+		if got := parseRetryAfter(in, now); got != want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestDownloader_RetryPolicy(t *testing.T) {
+	good := ogettest.NewLargeRangeServer(1)
+	defer good.Close()
+
+	// Rate limits the first chunk request, then serves normally.
+	var limited int32
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && atomic.CompareAndSwapInt32(&limited, 0, 1) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		good.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer busy.Close()
+
+	// Probes fine, then denies every chunk.
+	var denied int32
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			good.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		atomic.AddInt32(&denied, 1)
+		http.Error(w, "denied", http.StatusForbidden)
+	}))
+	defer forbidden.Close()
+
+	dir, err := os.MkdirTemp("", "oget-retry-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := NewDownloader([]string{busy.URL + "/busy.bin", forbidden.URL + "/forbidden.bin"}, 2)
+	d.Config.AutoTune = false
+	d.Config.Endgame = false
+	d.Config.OutputDir = dir
+	d.Config.RetryBaseDelay = 10
+	d.Fetcher = &HttpFetcher{Client: &http.Client{}, Config: d.Config}
+
+	start := time.Now()
+	results, _ := d.Download(context.Background())
+	if r := results[0]; r.Status != StatusCompleted || r.Retries != 1 {
+		t.Errorf("busy: %s %v after %d retries", r.Status, r.Err, r.Retries)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Retry-After: 1 not honoured, finished in %v", elapsed)
+	}
+	if r := results[1]; r.Status != StatusFailed || r.Retries != 0 || atomic.LoadInt32(&denied) != 1 {
+		t.Errorf("forbidden: %s %v, %d requests, %d retries", r.Status, r.Err, denied, r.Retries)
+	}
+	var se *StatusError
+	if !errors.As(results[1].Err, &se) || se.StatusCode != http.StatusForbidden {
+		t.Errorf("forbidden: expected a 403 StatusError, got %v", results[1].Err)
+	}
+}
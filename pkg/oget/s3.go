@@ -0,0 +1,439 @@
+package oget
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+S3 support: s3://bucket/key URLs are turned into requests to the bucket's
+endpoint signed with AWS Signature Version 4, then probed with a HEAD
+(HeadObject) and fetched in ranged GETs (GetObject) by HttpFetcher, so its
+transport with BBR, HTTP/2 and the proxy is used as for any HTTP download.
+Signing happens in the transport, after HttpFetcher has set Range and its
+other headers.
+
+Credentials come from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+AWS_SESSION_TOKEN, or else from the profile (Config.S3Profile, AWS_PROFILE or
+"default") in ~/.aws/credentials. Without any, requests go unsigned, which
+is enough for public buckets.
+
+Config.S3Endpoint (or AWS_ENDPOINT_URL_S3 / AWS_ENDPOINT_URL) points at
+S3-compatible storage such as MinIO or Ceph. Buckets are addressed in the
+host name (bucket.endpoint/key) unless Config.S3PathStyle is set, the
+endpoint is an IP address or localhost, or the bucket name is not a valid
+host name label; then the path is used (endpoint/bucket/key).
+*/
+
+// s3EmptyPayload is the SHA-256 of an empty body, that of every request
+// sent: HEAD and GET.
+const s3EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3BucketRegions remembers the regions AWS redirected buckets to.
+var s3BucketRegions sync.Map // bucket -> region
+
+// s3Credentials are the keys requests are signed with.
+type s3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// s3Client builds and signs the requests for objects.
+type s3Client struct {
+	config    *Config
+	creds     *s3Credentials // nil for anonymous requests
+	region    string         // default region
+	endpoint  *url.URL       // nil for AWS
+	pathStyle bool
+}
+
+func newS3Client(config *Config) (*s3Client, error) {
+	profile := config.S3Profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	c := &s3Client{config: config, pathStyle: config.S3PathStyle}
+
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		c.creds = &s3Credentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}
+	} else {
+		file := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+		if file == "" {
+			file = awsConfigPath("credentials")
+		}
+		values, err := readAwsProfile(file, profile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if values["aws_access_key_id"] != "" {
+			c.creds = &s3Credentials{
+				AccessKeyID:     values["aws_access_key_id"],
+				SecretAccessKey: values["aws_secret_access_key"],
+				SessionToken:    values["aws_session_token"],
+			}
+		}
+	}
+
+	c.region = config.S3Region
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if c.region == "" {
+			c.region = os.Getenv(env)
+		}
+	}
+	if c.region == "" {
+		file := os.Getenv("AWS_CONFIG_FILE")
+		if file == "" {
+			file = awsConfigPath("config")
+		}
+		section := "profile " + profile
+		if profile == "default" {
+			section = "default"
+		}
+		values, err := readAwsProfile(file, section)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		c.region = values["region"]
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+
+	endpoint := config.S3Endpoint
+	for _, env := range []string{"AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"} {
+		if endpoint == "" {
+			endpoint = os.Getenv(env)
+		}
+	}
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+		}
+		c.endpoint = u
+		host := u.Hostname()
+		if net.ParseIP(host) != nil || host == "localhost" {
+			c.pathStyle = true
+		}
+	}
+	return c, nil
+}
+
+// awsConfigPath returns the path of a file in ~/.aws.
+func awsConfigPath(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".aws", name)
+}
+
+// readAwsProfile returns the keys of a section of an AWS INI file.
+func readAwsProfile(file, section string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := make(map[string]string)
+	in := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[':
+			in = strings.TrimSpace(strings.Trim(line, "[]")) == section
+		case in:
+			if k, v, ok := strings.Cut(line, "="); ok {
+				values[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+			}
+		}
+	}
+	return values, scanner.Err()
+}
+
+// objectURL returns the HTTP URL of an s3:// URL and the region of its
+// bucket.
+func (c *s3Client) objectURL(resource string) (string, string, error) {
+	u, err := url.Parse(resource)
+	if err != nil {
+		return "", "", err
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" || strings.HasSuffix(key, "/") {
+		return "", "", fmt.Errorf("%s does not name an object (s3://bucket/key)", resource)
+	}
+	region := c.region
+	if r, ok := s3BucketRegions.Load(bucket); ok {
+		region = r.(string)
+	}
+
+	target := &url.URL{Scheme: "https", Host: "s3." + region + ".amazonaws.com"}
+	if c.endpoint != nil {
+		target.Scheme, target.Host = c.endpoint.Scheme, c.endpoint.Host
+		target.Path = strings.TrimSuffix(c.endpoint.Path, "/")
+	}
+	if c.pathStyle || !isS3HostBucket(bucket, target.Scheme) {
+		target.Path += "/" + bucket + "/" + key
+	} else {
+		target.Host = bucket + "." + target.Host
+		target.Path += "/" + key
+	}
+	target.RawPath = s3EscapePath(target.Path)
+	return target.String(), region, nil
+}
+
+// isS3HostBucket reports whether bucket can be part of a host name. Over
+// HTTPS dots are not allowed either: the certificate covers only one level.
+func isS3HostBucket(bucket, scheme string) bool {
+	if len(bucket) < 3 || len(bucket) > 63 || net.ParseIP(bucket) != nil {
+		return false
+	}
+	for _, label := range strings.Split(bucket, ".") {
+		if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+				return false
+			}
+		}
+	}
+	return scheme == "http" || !strings.Contains(bucket, ".")
+}
+
+// s3EscapePath percent-encodes every byte of p but unreserved characters
+// and slashes, as SigV4 expects of the request path.
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3RegionKey carries the region to sign a request for in its context.
+type s3RegionKey struct{}
+
+// s3Transport signs requests for S3 before passing them on.
+type s3Transport struct {
+	next  http.RoundTripper
+	creds *s3Credentials
+	now   func() time.Time
+}
+
+func (t *s3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.creds == nil {
+		return t.next.RoundTrip(req)
+	}
+	region, _ := req.Context().Value(s3RegionKey{}).(string)
+	req = req.Clone(req.Context()) // a RoundTripper must not change the request
+	signS3Request(req, t.creds, region, t.now())
+	return t.next.RoundTrip(req)
+}
+
+// signS3Request adds SigV4 headers to a request without a body. Host, Range
+// and the x-amz-* headers are signed.
+func signS3Request(req *http.Request, creds *s3Credentials, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3EmptyPayload)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.Join(values, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.Join(strings.Fields(headers[name]), " ") + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// The query, sorted by key, with SigV4's escaping; url.Values sorts
+	// but escapes spaces as "+".
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		vs := query[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			params = append(params, s3EscapeQuery(k)+"="+s3EscapeQuery(v))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3EmptyPayload,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3EscapeQuery is s3EscapePath for query keys and values, where slashes
+// are escaped too.
+func s3EscapeQuery(s string) string {
+	return strings.ReplaceAll(s3EscapePath(s), "/", "%2F")
+}
+
+// newS3HttpFetcher returns an HttpFetcher whose transport signs for c. It
+// signs last, after the per-host headers are set, so nothing changes a
+// request once signed.
+func newS3HttpFetcher(c *s3Client) *HttpFetcher {
+	return newHttpFetcher(c.config, func(next http.RoundTripper) http.RoundTripper {
+		return &s3Transport{next: next, creds: c.creds, now: time.Now}
+	})
+}
+
+// S3Prober implements Prober for s3:// URLs with HeadObject.
+type S3Prober struct {
+	Config *Config
+}
+
+func NewS3Prober(config *Config) *S3Prober {
+	return &S3Prober{Config: config}
+}
+
+func (p *S3Prober) Probe(ctx context.Context, resource string) (*ResourceMetadata, error) {
+	c, err := newS3Client(p.Config)
+	if err != nil {
+		return nil, err
+	}
+	client := newS3HttpFetcher(c).Client
+	for redirected := false; ; redirected = true {
+		target, region, err := c.objectURL(resource)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(context.WithValue(ctx, s3RegionKey{}, region), http.MethodHead, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		setRequestHeaders(req, p.Config, p.Config.Headers)
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+
+		// AWS answers requests to the wrong region with the right one.
+		if r := resp.Header.Get("X-Amz-Bucket-Region"); r != "" && r != region && !redirected && resp.StatusCode != http.StatusOK {
+			u, _ := url.Parse(resource)
+			s3BucketRegions.Store(u.Host, r)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, &StatusError{
+				URL:        resource,
+				StatusCode: resp.StatusCode,
+				RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+			}
+		}
+		return &ResourceMetadata{
+			Size:         resp.ContentLength,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			AcceptRanges: resp.ContentLength > 0,
+			FileName:     contentDispositionFileName(resp.Header.Get("Content-Disposition")),
+		}, nil
+	}
+}
+
+// S3Fetcher implements Fetcher for s3:// URLs with ranged GetObject calls.
+type S3Fetcher struct {
+	Config *Config
+
+	once   sync.Once
+	client *s3Client
+	http   *HttpFetcher
+	err    error
+}
+
+func NewS3Fetcher(config *Config) *S3Fetcher {
+	return &S3Fetcher{Config: config}
+}
+
+func (f *S3Fetcher) Fetch(ctx context.Context, task *ChunkTask) error {
+	f.once.Do(func() {
+		if f.client, f.err = newS3Client(f.Config); f.err == nil {
+			f.http = newS3HttpFetcher(f.client)
+		}
+	})
+	if f.err != nil {
+		return f.err
+	}
+	target, region, err := f.client.objectURL(task.URL)
+	if err != nil {
+		return err
+	}
+
+	// HttpFetcher fetches the object's URL; the task keeps the s3:// one.
+	resource := task.URL
+	task.URL = target
+	err = f.http.Fetch(context.WithValue(ctx, s3RegionKey{}, region), task)
+	task.URL = resource
+	return err
+}
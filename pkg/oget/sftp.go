@@ -0,0 +1,577 @@
+package oget
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+/*
+SFTP support: sftp:// URLs, and scp:// ones, which are fetched over SFTP as
+well since SCP cannot read ranges and OpenSSH servers offering scp serve
+SFTP too. A path starting with "/~/" is relative to the home directory.
+
+Logins use the keys of ssh-agent (SSH_AUTH_SOCK) and of Config.SSHKeyFiles,
+or a password given in the URL. Host keys are checked against known_hosts;
+hosts missing from it are refused, never trusted on first use.
+
+There is one SSH connection per server and account, over which up to
+Config.Concurrency SFTP sessions, each on its own channel, read chunks in
+parallel. Servers cap the sessions of a connection (OpenSSH's MaxSessions,
+10 by default); when a channel is refused the pool makes do with the
+sessions already open.
+*/
+
+// sftpReadSize is how much is requested from the server at a time. The
+// client splits it into packets sent without waiting for each other.
+const sftpReadSize = 1 << 20
+
+// sftpSession is an SFTP session on a pooled SSH connection.
+type sftpSession struct {
+	*sftp.Client
+	conn *ssh.Client
+}
+
+// sftpPools holds the SSH connection and idle sessions per server and
+// account. They are closed by CleanupProtocols.
+var (
+	sftpPoolsMu sync.Mutex
+	sftpPools   = make(map[string]*sftpPool)
+)
+
+type sftpPool struct {
+	url    *url.URL
+	config *Config
+
+	dialMu   sync.Mutex // held while dialling conn
+	mu       sync.Mutex
+	conn     *ssh.Client // nil until dialled and once lost
+	idle     []*sftpSession
+	open     int
+	limit    int
+	released chan struct{} // closed when a session is returned or dropped
+}
+
+// getSftpPool returns the pool for the server and account of u; sftp://
+// and scp:// URLs share it.
+func getSftpPool(u *url.URL, config *Config) *sftpPool {
+	key := u.User.String() + "@" + u.Host
+	sftpPoolsMu.Lock()
+	defer sftpPoolsMu.Unlock()
+	if p, ok := sftpPools[key]; ok {
+		return p
+	}
+	p := &sftpPool{
+		url:      &url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host},
+		config:   config,
+		limit:    max(config.Concurrency, 1),
+		released: make(chan struct{}),
+	}
+	sftpPools[key] = p
+	return p
+}
+
+// get returns an idle session or opens a new one, waiting while the pool
+// is at its limit.
+func (p *sftpPool) get(ctx context.Context) (*sftpSession, error) {
+	for {
+		p.mu.Lock()
+		for len(p.idle) > 0 {
+			s := p.idle[len(p.idle)-1]
+			p.idle = p.idle[:len(p.idle)-1]
+			if s.conn == p.conn {
+				p.mu.Unlock()
+				return s, nil
+			}
+			s.Close() // its connection was lost
+			p.open--
+		}
+		if p.open < p.limit {
+			p.open++
+			p.mu.Unlock()
+			s, err := p.newSession(ctx)
+			if err == nil {
+				return s, nil
+			}
+			p.mu.Lock()
+			p.open--
+			p.notify()
+			var oce *ssh.OpenChannelError
+			if errors.As(err, &oce) && p.open > 0 {
+				p.limit = p.open
+				if p.config.Verbose {
+					log.Printf("%s allows %d SFTP sessions per connection", p.url.Host, p.limit)
+				}
+				p.mu.Unlock()
+				continue
+			}
+			p.mu.Unlock()
+			return nil, err
+		}
+		released := p.released
+		p.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// newSession opens a session, dialling the connection first if needed.
+func (p *sftpPool) newSession(ctx context.Context) (*sftpSession, error) {
+	conn, err := p.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c, err := sftp.NewClient(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpSession{Client: c, conn: conn}, nil
+}
+
+func (p *sftpPool) connect(ctx context.Context) (*ssh.Client, error) {
+	p.dialMu.Lock()
+	defer p.dialMu.Unlock()
+	p.mu.Lock()
+	conn := p.conn
+	p.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	conn, err := dialSsh(ctx, p.url, p.config)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.conn = conn
+	p.mu.Unlock()
+	go func() {
+		conn.Wait()
+		p.mu.Lock()
+		if p.conn == conn {
+			p.conn = nil
+		}
+		p.mu.Unlock()
+	}()
+	return conn, nil
+}
+
+// put returns a session to the pool, or closes it if it is not usable.
+func (p *sftpPool) put(s *sftpSession, usable bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if usable && s.conn == p.conn {
+		p.idle = append(p.idle, s)
+	} else {
+		s.Close()
+		p.open--
+	}
+	p.notify()
+}
+
+func (p *sftpPool) notify() {
+	close(p.released)
+	p.released = make(chan struct{})
+}
+
+// closeSftpPools closes every idle session and pooled connection.
+func closeSftpPools() {
+	sftpPoolsMu.Lock()
+	pools := sftpPools
+	sftpPools = make(map[string]*sftpPool)
+	sftpPoolsMu.Unlock()
+	for _, p := range pools {
+		p.mu.Lock()
+		for _, s := range p.idle {
+			s.Close()
+		}
+		p.open -= len(p.idle)
+		p.idle = nil
+		if p.conn != nil {
+			p.conn.Close()
+			p.conn = nil
+		}
+		p.mu.Unlock()
+	}
+}
+
+// dialSsh connects and logs in to the server of u.
+func dialSsh(ctx context.Context, u *url.URL, config *Config) (*ssh.Client, error) {
+	hostKeys, err := sshHostKeyCallback(config)
+	if err != nil {
+		return nil, &SftpError{Err: err}
+	}
+	auth, done := sshAuth(u, config)
+	defer done()
+	clientConfig := &ssh.ClientConfig{
+		User:            sshUser(u),
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         time.Duration(config.Timeout) * time.Second,
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	conn, err := sshHandshake(ctx, addr, clientConfig)
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) && len(keyErr.Want) > 0 {
+		// The server offered a type of host key other than those known
+		// for it: ask for one of those instead.
+		for _, k := range keyErr.Want {
+			if t := k.Key.Type(); t == ssh.KeyAlgoRSA {
+				clientConfig.HostKeyAlgorithms = append(clientConfig.HostKeyAlgorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, t)
+			} else {
+				clientConfig.HostKeyAlgorithms = append(clientConfig.HostKeyAlgorithms, t)
+			}
+		}
+		conn, err = sshHandshake(ctx, addr, clientConfig)
+	}
+	if err != nil {
+		// ssh reports failed logins only in the message.
+		if errors.As(err, &keyErr) || strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, &SftpError{Err: err}
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+func sshHandshake(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	d := &net.Dialer{Timeout: config.Timeout}
+	raw, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.Timeout > 0 {
+		raw.SetDeadline(time.Now().Add(config.Timeout))
+	}
+	stop := context.AfterFunc(ctx, func() { raw.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(raw, addr, config)
+	if !stop() {
+		if err == nil {
+			c.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	raw.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// sshHostKeyCallback checks host keys against Config.KnownHostsFile.
+func sshHostKeyCallback(config *Config) (ssh.HostKeyCallback, error) {
+	file := config.KnownHostsFile
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	known, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("known hosts: %w", err)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := known(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			return fmt.Errorf("%w: %s host key of %s is not in %s", err, key.Type(), hostname, file)
+		}
+		return err
+	}, nil
+}
+
+// sshAuth returns the login methods for u; done releases the agent.
+func sshAuth(u *url.URL, config *Config) (methods []ssh.AuthMethod, done func()) {
+	done = func() {}
+	var signers []ssh.Signer
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err == nil {
+			done = func() { conn.Close() }
+			signers, err = agent.NewClient(conn).Signers()
+		}
+		if err != nil && config.Verbose {
+			log.Printf("ssh-agent: %v", err)
+		}
+	}
+	signers = append(signers, sshKeyFileSigners(config)...)
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if password, ok := u.User.Password(); ok {
+		methods = append(methods, ssh.Password(password))
+	}
+	return methods, done
+}
+
+// sshKeyFileSigners loads the keys of Config.SSHKeyFiles, or the default
+// ones that exist.
+func sshKeyFileSigners(config *Config) []ssh.Signer {
+	files := config.SSHKeyFiles
+	explicit := len(files) > 0
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			files = append(files, filepath.Join(home, ".ssh", name))
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			if explicit || !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Warning: SSH key %s: %v", file, err)
+			}
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			// Keys with a passphrase are only usable through ssh-agent.
+			var pme *ssh.PassphraseMissingError
+			if errors.As(err, &pme) {
+				err = errors.New("protected by a passphrase; add it to ssh-agent instead")
+			}
+			if explicit || config.Verbose {
+				log.Printf("Warning: SSH key %s: %v", file, err)
+			}
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return signers
+}
+
+// sshUser returns the login name of u, or the local user's.
+func sshUser(u *url.URL) string {
+	if name := u.User.Username(); name != "" {
+		return name
+	}
+	if cur, err := user.Current(); err == nil {
+		return cur.Username
+	}
+	return os.Getenv("USER")
+}
+
+// sftpPath returns the file path of an SFTP URL.
+func sftpPath(u *url.URL) (string, error) {
+	if u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return "", fmt.Errorf("%s does not name a file", u.Redacted())
+	}
+	if rel, ok := strings.CutPrefix(u.Path, "/~/"); ok {
+		return rel, nil
+	}
+	return u.Path, nil
+}
+
+// sftpError marks the errors retrying cannot fix as SftpError.
+func sftpError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		return &SftpError{Err: err}
+	}
+	return err
+}
+
+// isSftpReply reports whether err is the server's answer to a request,
+// after which the session can still be used.
+func isSftpReply(err error) bool {
+	var se *sftp.StatusError
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) || errors.As(err, &se)
+}
+
+// SftpProber implements Prober for SFTP.
+type SftpProber struct {
+	Config *Config
+}
+
+func NewSftpProber(config *Config) *SftpProber {
+	return &SftpProber{Config: config}
+}
+
+func (p *SftpProber) Probe(ctx context.Context, resource string) (*ResourceMetadata, error) {
+	u, err := url.Parse(resource)
+	if err != nil {
+		return nil, err
+	}
+	path, err := sftpPath(u)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := getSftpPool(u, p.Config)
+	s, err := pool.get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", u.Redacted(), err)
+	}
+	fi, err := s.Stat(path)
+	pool.put(s, err == nil || isSftpReply(err))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", u.Redacted(), sftpError(err))
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, &SftpError{Err: fmt.Errorf("%s is not a regular file", u.Redacted())}
+	}
+	return &ResourceMetadata{
+		Size:         fi.Size(),
+		LastModified: fi.ModTime().UTC().Format(http.TimeFormat),
+		AcceptRanges: fi.Size() > 0,
+	}, nil
+}
+
+// SftpFetcher implements Fetcher for SFTP.
+type SftpFetcher struct {
+	Config *Config
+}
+
+func NewSftpFetcher(config *Config) *SftpFetcher {
+	return &SftpFetcher{Config: config}
+}
+
+func (f *SftpFetcher) Fetch(ctx context.Context, task *ChunkTask) error {
+	u, err := url.Parse(task.URL)
+	if err != nil {
+		return err
+	}
+	path, err := sftpPath(u)
+	if err != nil {
+		return err
+	}
+	pool := getSftpPool(u, f.Config)
+	s, err := pool.get(ctx)
+	if err != nil {
+		return fmt.Errorf("sftp %s: %w", u.Redacted(), err)
+	}
+
+	// Cancelling the download or a stalled read closes the session, which
+	// fails the read in progress. A timeout of 0 never stalls, as with HTTP.
+	timeout := time.Duration(f.Config.Timeout) * time.Second
+	var stall *time.Timer
+	progress := func() {}
+	if timeout > 0 {
+		stall = time.AfterFunc(timeout, func() { s.Close() })
+		progress = func() { stall.Reset(timeout) }
+	}
+	stop := context.AfterFunc(ctx, func() { s.Close() })
+	written, err := f.read(s, path, task, progress)
+	stalled := stall != nil && !stall.Stop()
+	canceled := !stop()
+	pool.put(s, !stalled && !canceled && (err == nil || isSftpReply(err)))
+
+	switch {
+	case canceled:
+		err = ctx.Err()
+	case stalled:
+		err = fmt.Errorf("no data for %v", timeout)
+	case err == nil && task.Length != -1 && written < task.Length:
+		err = fmt.Errorf("sftp download incomplete: got %d bytes, want %d", written, task.Length)
+	}
+	if err != nil {
+		task.Written = written // save progress for resume
+		return fmt.Errorf("sftp %s: %w", u.Redacted(), sftpError(err))
+	}
+	return nil
+}
+
+// read copies the chunk from the file to storage, calling progress after
+// every read from the server.
+func (f *SftpFetcher) read(s *sftpSession, path string, task *ChunkTask, progress func()) (written int64, err error) {
+	written = task.Written
+	file, err := s.Open(path)
+	if err != nil {
+		return written, err
+	}
+	defer file.Close()
+
+	length := int64(math.MaxInt64 - task.Offset - written)
+	if task.Length != -1 {
+		length = task.Length - written
+	}
+	var body io.Reader = bufio.NewReaderSize(&sftpChunkReader{
+		r:        io.NewSectionReader(file, task.Offset+written, length),
+		progress: progress,
+	}, sftpReadSize)
+	var h hash.Hash
+	if f.Config != nil && (f.Config.Checksum || f.Config.VerifyOnResume) && written == 0 {
+		h = sha256.New()
+		body = io.TeeReader(body, h)
+	}
+
+	for task.Length == -1 || written < task.Length {
+		remaining := task.Length - written
+		if task.Length == -1 {
+			remaining = sftpReadSize
+		}
+		n, err := task.StorageHandler.ReadAtFrom(body, task.Offset+written, remaining)
+		if n > 0 {
+			written += n
+			if task.OnProgress != nil {
+				task.OnProgress(int(n))
+			}
+		}
+		if err == io.EOF || err == nil && n < remaining {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if task.Length != -1 && written < task.Length {
+		return written, nil
+	}
+	if task.OnChunkComplete != nil {
+		var hashStr string
+		if h != nil {
+			hashStr = hex.EncodeToString(h.Sum(nil))
+		}
+		task.OnChunkComplete(task.ChunkID, hashStr)
+	}
+	return written, nil
+}
+
+// sftpChunkReader reports every read to progress.
+type sftpChunkReader struct {
+	r        io.Reader
+	progress func()
+}
+
+func (r *sftpChunkReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.progress()
+	return n, err
+}
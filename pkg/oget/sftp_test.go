@@ -0,0 +1,288 @@
+package oget
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/qtopie/oget/ogettest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sftpTestHome points HOME at a temporary directory, so the user's own SSH
+// setup is not used, and unsets SSH_AUTH_SOCK. It returns the directory.
+func sftpTestHome(t *testing.T) string {
+	t.Helper()
+	home := t.TempDir()
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	return home
+}
+
+// newSshKey returns a new client key, written to file unless it is empty.
+func newSshKey(t *testing.T, file string) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file != "" {
+		block, err := ssh.MarshalPrivateKey(key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return key
+}
+
+func sshPublicKey(t *testing.T, key ed25519.PrivateKey) ssh.PublicKey {
+	t.Helper()
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+// trustSftpServer adds the host key of server to known_hosts in home.
+func trustSftpServer(t *testing.T, home string, server *ogettest.SftpServer) {
+	t.Helper()
+	f, err := os.OpenFile(filepath.Join(home, ".ssh", "known_hosts"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(server.KnownHostsLine() + "\n"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newSftpDownloader returns a downloader of rawURL into dir.
+func newSftpDownloader(rawURL, dir string, concurrency int) *Downloader {
+	d := NewDownloader([]string{rawURL}, concurrency)
+	d.Config.AutoTune = false
+	d.Config.Endgame = false
+	d.Config.OutputDir = dir
+	d.Config.Timeout = 5
+	d.Quiet = true
+	return d
+}
+
+// downloadSftp fetches rawURL with the given number of workers and returns
+// its content.
+func downloadSftp(t *testing.T, rawURL string, concurrency int) []byte {
+	t.Helper()
+	dir := t.TempDir()
+	results, err := newSftpDownloader(rawURL, dir, concurrency).Download(context.Background())
+	closeSftpPools()
+	if err != nil {
+		t.Fatalf("download %s: %v", rawURL, err)
+	}
+	data, err := os.ReadFile(results[0].File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSftpDownload(t *testing.T) {
+	home := sftpTestHome(t)
+	key := newSshKey(t, filepath.Join(home, ".ssh", "id_ed25519"))
+	content := randomContent(t, 6*RangeSize+12345)
+	server := ogettest.NewUnstartedSftpServer(map[string][]byte{"/pub/data.bin": content})
+	server.AuthorizedKeys = []ssh.PublicKey{sshPublicKey(t, key)}
+	server.MaxSessions = 3
+	server.Start()
+	defer server.Close()
+	trustSftpServer(t, home, server)
+
+	// The pool shrinks to the sessions the server allows on one connection.
+	if got := downloadSftp(t, server.URL+"/pub/data.bin", 5); !bytes.Equal(got, content) {
+		t.Fatalf("downloaded %d bytes that differ from the %d served", len(got), len(content))
+	}
+	if n := server.Logins.Load(); n != 1 {
+		t.Errorf("logged in %d times, want 1", n)
+	}
+	if n := server.PeakSessions.Load(); n < 2 || n > 3 {
+		t.Errorf("%d sessions open at once, want 2-3", n)
+	}
+
+	// "/~/" starts a path relative to the home directory, the root here.
+	if got := downloadSftp(t, server.URL+"/~/pub/data.bin", 2); !bytes.Equal(got, content) {
+		t.Error("home-relative download differs")
+	}
+}
+
+func TestSftpDownload_Auth(t *testing.T) {
+	home := sftpTestHome(t)
+	key := newSshKey(t, "")
+	content := randomContent(t, 2*RangeSize+1)
+	server := ogettest.NewUnstartedSftpServer(map[string][]byte{"/f.bin": content})
+	server.User = "alice"
+	server.Password = "s3cret"
+	server.AuthorizedKeys = []ssh.PublicKey{sshPublicKey(t, key)}
+	server.Start()
+	defer server.Close()
+	trustSftpServer(t, home, server)
+
+	// A key held by ssh-agent.
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(home, "agent.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+	if got := downloadSftp(t, "sftp://alice@"+server.Addr+"/f.bin", 2); !bytes.Equal(got, content) {
+		t.Error("download with an agent key differs")
+	}
+
+	// A password in an scp:// URL.
+	t.Setenv("SSH_AUTH_SOCK", "")
+	if got := downloadSftp(t, "scp://alice:s3cret@"+server.Addr+"/f.bin", 2); !bytes.Equal(got, content) {
+		t.Error("download with a password differs")
+	}
+	if n := server.Logins.Load(); n != 2 {
+		t.Errorf("logged in %d times, want 2", n)
+	}
+}
+
+func TestSftpDownload_Resume(t *testing.T) {
+	home := sftpTestHome(t)
+	key := newSshKey(t, filepath.Join(home, ".ssh", "id_ed25519"))
+	content := randomContent(t, 8*1024*1024)
+	server := ogettest.NewSftpServer(map[string][]byte{"/big.bin": content}, sshPublicKey(t, key))
+	defer server.Close()
+	trustSftpServer(t, home, server)
+	dir := t.TempDir()
+	u := server.URL + "/big.bin"
+
+	// Throttle the first run so the interrupt lands mid-download.
+	first := newSftpDownloader(u, dir, 2)
+	first.Config.RateLimit = 2 * 1024 * 1024
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	if _, err := first.Download(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected an interrupted download, got %v", err)
+	}
+	closeSftpPools()
+	if _, err := os.Stat(filepath.Join(dir, ".big.bin.oget")); err != nil {
+		t.Fatalf("state file not kept after interrupt: %v", err)
+	}
+
+	second := newSftpDownloader(u, dir, 2)
+	_, err := second.Download(context.Background())
+	closeSftpPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.TotalSize >= int64(len(content)) {
+		t.Errorf("resume re-downloaded everything (%d bytes)", second.TotalSize)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha256.Sum256(data) != sha256.Sum256(content) {
+		t.Error("resumed file does not match the served content")
+	}
+}
+
+func TestSftpDownload_NoTimeout(t *testing.T) {
+	home := sftpTestHome(t)
+	key := newSshKey(t, filepath.Join(home, ".ssh", "id_ed25519"))
+	content := randomContent(t, 2*RangeSize+1)
+	server := ogettest.NewSftpServer(map[string][]byte{"/f.bin": content}, sshPublicKey(t, key))
+	defer server.Close()
+	trustSftpServer(t, home, server)
+
+	// A timeout of 0 means none, as for HTTP, not an immediate stall.
+	d := newSftpDownloader(server.URL+"/f.bin", t.TempDir(), 2)
+	d.Config.Timeout = 0
+	results, err := d.Download(context.Background())
+	closeSftpPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(results[0].File); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("downloaded %d bytes, %v; want the %d served", len(got), err, len(content))
+	}
+}
+
+func TestSftpProbe(t *testing.T) {
+	home := sftpTestHome(t)
+	key := newSshKey(t, filepath.Join(home, ".ssh", "id_ed25519"))
+	server := ogettest.NewSftpServer(map[string][]byte{"/a.bin": make([]byte, 1000)}, sshPublicKey(t, key))
+	defer server.Close()
+	defer closeSftpPools()
+	trustSftpServer(t, home, server)
+	config := DefaultConfig()
+	config.Timeout = 5
+
+	meta, err := NewSftpProber(config).Probe(context.Background(), server.URL+"/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != 1000 || !meta.AcceptRanges || meta.LastModified != "Wed, 01 May 2024 12:00:00 GMT" {
+		t.Errorf("Probe = %+v", meta)
+	}
+
+	_, err = NewSftpProber(config).Probe(context.Background(), server.URL+"/missing.bin")
+	if !errors.Is(err, ErrNotFound) || IsRetryable(err) {
+		t.Errorf("probing a missing file: %v, want a fatal ErrNotFound", err)
+	}
+	// Both probes shared one login.
+	if n := server.Logins.Load(); n != 1 {
+		t.Errorf("logged in %d times, want 1", n)
+	}
+
+	// A host missing from known_hosts is refused, however good the login.
+	unknown := ogettest.NewSftpServer(nil, sshPublicKey(t, key))
+	defer unknown.Close()
+	_, err = NewSftpProber(config).Probe(context.Background(), unknown.URL+"/a.bin")
+	var sfe *SftpError
+	if !errors.As(err, &sfe) || IsRetryable(err) || unknown.Logins.Load() != 0 {
+		t.Errorf("unknown host: %v, want a fatal SftpError", err)
+	}
+
+	// So is a login with a key the server does not know.
+	otherKey := ogettest.NewSftpServer(nil, sshPublicKey(t, newSshKey(t, "")))
+	defer otherKey.Close()
+	trustSftpServer(t, home, otherKey)
+	_, err = NewSftpProber(config).Probe(context.Background(), otherKey.URL+"/a.bin")
+	if !errors.As(err, &sfe) || IsRetryable(err) {
+		t.Errorf("unauthorized key: %v, want a fatal SftpError", err)
+	}
+}
@@ -1,9 +1,14 @@
 package oget
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -20,75 +25,167 @@ The file is a CBOR Sequence:
    - "bits": Byte String (The completion bitset)
 
 To maintain mmap performance, the "bits" data is padded to start at a 16KB boundary.
+
+Since version 2 the bitset is followed by one raw SHA-256 digest per chunk
+(all zeros when no digest was recorded), mapped together with the bitset.
+Version 1 files have no digest region; LoadState extends them in place.
+
+This is the default "json" state store: one hidden .name.oget file next to
+each download. The "bolt" store (state_bolt.go) keeps the same metadata and
+chunk digests in a single database instead.
 */
 
 const (
-	stateVersion    = 1
+	stateVersion    = 2
 	stateHeaderSize = 16384 // We reserve 16KB for CBOR header + padding to ensure page alignment for mmap
+	chunkHashSize   = sha256.Size
 )
 
 // DownloadState represents the metadata of a download task.
 type DownloadState struct {
+	Version      int               `cbor:"ver"`
 	URL          string            `cbor:"url"`
 	FileSize     int64             `cbor:"file_size"`
 	ETag         string            `cbor:"etag"`
 	LastModified string            `cbor:"last_modified"`
 	ChunkSize    int64             `cbor:"chunk_size"`
 	UpdatedAt    time.Time         `cbor:"updated_at"`
+	StreamOffset int64             `cbor:"stream_offset"` // bytes on disk for a download of unknown length
+	StreamSize   int64             `cbor:"stream_size"`   // final size of a download of unknown length, set at EOF
 	
+	lastSave     time.Time         `cbor:"-"`
+
 	// Internal state
-	bitset       *mmapBitset       `cbor:"-"`
+	bits         []byte            `cbor:"-"` // completion bitset, one bit per chunk
+	hashes       []byte            `cbor:"-"` // raw SHA-256 per chunk, zeros when none was recorded
+	backend      stateBackend      `cbor:"-"` // persists the state; nil once closed
+	syncData     func() error      `cbor:"-"` // makes the downloaded data durable; see SetDataSync
 	mu           sync.RWMutex      `cbor:"-"`
-	filePath     string            `cbor:"-"`
 }
 
-type mmapBitset struct {
+// stateBackend persists one DownloadState for its StateStore. Methods are
+// called with the state's mutex held.
+type stateBackend interface {
+	saveMeta(s *DownloadState) error              // write the header fields
+	saveChunk(s *DownloadState, chunkID int) error // the bit or digest of a chunk changed
+	sync(s *DownloadState) error                  // make saved chunks durable
+	close() error
+}
+
+// fileBackend keeps a state in its own file: the CBOR header, then the
+// bitset and digests, mapped into memory when possible.
+type fileBackend struct {
+	path   string
 	file   *os.File
-	data   []byte
+	data   []byte // completion bits followed by the per-chunk digests
 	isMmap bool
 }
 
+// stateLayout returns the number of chunks and the size of the bitset for a download.
+func stateLayout(fileSize, chunkSize int64) (numChunks, numBytes int64) {
+	if chunkSize <= 0 || fileSize <= 0 {
+		return 0, 0
+	}
+	numChunks = (fileSize + chunkSize - 1) / chunkSize
+	return numChunks, (numChunks + 7) / 8
+}
+
+// mapBitset maps the bitset and digest regions of an open state file into s,
+// falling back to reading them into memory when mmap is unavailable.
+func (s *DownloadState) mapBitset(f *os.File, statePath string, numChunks, numBytes int64) error {
+	size := numBytes + numChunks*chunkHashSize
+	data, err := mmapFileOffset(f, int(size), stateHeaderSize)
+	isMmap := true
+	if err != nil {
+		data = make([]byte, size)
+		if _, rErr := f.ReadAt(data, stateHeaderSize); rErr != nil && rErr != io.EOF {
+			return rErr
+		}
+		isMmap = false
+	}
+	s.bits = data[:numBytes]
+	s.hashes = data[numBytes:]
+	s.backend = &fileBackend{path: statePath, file: f, data: data, isMmap: isMmap}
+	return nil
+}
+
+func (b *fileBackend) saveMeta(s *DownloadState) error {
+	data, err := cbor.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if len(data) > stateHeaderSize {
+		return fmt.Errorf("metadata too large for reserved header space")
+	}
+
+	// Write at the beginning of the file. We don't pad with zeros explicitly
+	// as the file is already truncated and the bitset starts at stateHeaderSize.
+	if _, err := b.file.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return b.file.Sync()
+}
+
+func (b *fileBackend) saveChunk(s *DownloadState, chunkID int) error {
+	if b.isMmap {
+		return nil // written through the mapping
+	}
+	hashOff := chunkID * chunkHashSize
+	if _, err := b.file.WriteAt(s.hashes[hashOff:hashOff+chunkHashSize], int64(stateHeaderSize+len(s.bits)+hashOff)); err != nil {
+		return err
+	}
+	_, err := b.file.WriteAt(s.bits[chunkID/8:chunkID/8+1], int64(stateHeaderSize+chunkID/8))
+	return err
+}
+
+func (b *fileBackend) sync(s *DownloadState) error {
+	if b.isMmap && len(b.data) > 0 {
+		return msyncFile(b.data)
+	}
+	return nil
+}
+
+func (b *fileBackend) close() error {
+	var err error
+	if b.isMmap {
+		err = munmapFile(b.data)
+	}
+	b.file.Close()
+	return err
+}
+
 // NewDownloadState creates a new state file using CBOR.
 func NewDownloadState(url string, fileSize, chunkSize int64, statePath string) (*DownloadState, error) {
 	s := &DownloadState{
+		Version:   stateVersion,
 		URL:       url,
 		FileSize:  fileSize,
 		ChunkSize: chunkSize,
 		UpdatedAt: time.Now(),
-		filePath:  statePath,
 	}
 	
-	numChunks := (fileSize + chunkSize - 1) / chunkSize
-	numBytes := (numChunks + 7) / 8
-	
-	totalSize := int64(stateHeaderSize) + numBytes
+	numChunks, numBytes := stateLayout(fileSize, chunkSize)
+	totalSize := int64(stateHeaderSize) + numBytes + numChunks*chunkHashSize
 	
 	f, err := os.OpenFile(statePath, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, err
 	}
 	
-	if err := f.Truncate(totalSize); err != nil {
+	// Truncate to zero first so a stale file at this path leaves no set bits behind.
+	if err := f.Truncate(0); err != nil {
 		f.Close()
 		return nil, err
 	}
-	
-	// Map the bitset part (starting from 4096)
-	data, err := mmapFileOffset(f, int(numBytes), stateHeaderSize)
-	isMmap := true
-	if err != nil {
-		data = make([]byte, numBytes)
-		if _, wErr := f.WriteAt(data, stateHeaderSize); wErr != nil {
-			f.Close()
-			return nil, wErr
-		}
-		isMmap = false
+	if err := f.Truncate(totalSize); err != nil {
+		f.Close()
+		return nil, err
 	}
 	
-	s.bitset = &mmapBitset{
-		file:   f,
-		data:   data,
-		isMmap: isMmap,
+	// Map the bitset part (starting from stateHeaderSize)
+	if err := s.mapBitset(f, statePath, numChunks, numBytes); err != nil {
+		f.Close()
+		return nil, err
 	}
 	
 	return s, nil
@@ -116,32 +213,42 @@ func LoadState(statePath string) (*DownloadState, error) {
 		f.Close()
 		return nil, fmt.Errorf("failed to decode cbor state: %w", err)
 	}
-	state.filePath = statePath
+	if state.Version > stateVersion {
+		f.Close()
+		return nil, fmt.Errorf("unsupported state version %d", state.Version)
+	}
 	
-	// Initialize mmap bitset
-	numChunks := (state.FileSize + state.ChunkSize - 1) / state.ChunkSize
-	numBytes := (numChunks + 7) / 8
+	numChunks, numBytes := stateLayout(state.FileSize, state.ChunkSize)
 	
-	data, err := mmapFileOffset(f, int(numBytes), stateHeaderSize)
-	isMmap := true
-	if err != nil {
-		data = make([]byte, numBytes)
-		if _, rErr := f.ReadAt(data, stateHeaderSize); rErr != nil && rErr != io.EOF {
+	// Version 1 files end after the bitset; grow them by a zeroed digest
+	// region, which reads as "no digest recorded" for every chunk.
+	migrate := state.Version < stateVersion
+	if migrate {
+		if err := f.Truncate(int64(stateHeaderSize) + numBytes + numChunks*chunkHashSize); err != nil {
 			f.Close()
-			return nil, rErr
+			return nil, fmt.Errorf("failed to migrate state from version %d: %w", state.Version, err)
 		}
-		isMmap = false
+		state.Version = stateVersion
 	}
 	
-	state.bitset = &mmapBitset{
-		file:   f,
-		data:   data,
-		isMmap: isMmap,
+	// Initialize mmap bitset
+	if err := state.mapBitset(f, statePath, numChunks, numBytes); err != nil {
+		f.Close()
+		return nil, err
+	}
+	
+	if migrate {
+		if err := state.Save(); err != nil {
+			state.Close()
+			return nil, err
+		}
 	}
 	
 	return &state, nil
 }
 
+// MarkComplete sets the completion bit of a chunk and records its hex SHA-256
+// digest. An empty or non-SHA-256 hash clears any digest recorded earlier.
 func (s *DownloadState) MarkComplete(chunkID int, hash string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -149,11 +256,34 @@ func (s *DownloadState) MarkComplete(chunkID int, hash string) {
 	byteIdx := chunkID / 8
 	bitIdx := uint(chunkID % 8)
 	
-	if s.bitset != nil && byteIdx < len(s.bitset.data) {
-		s.bitset.data[byteIdx] |= (1 << bitIdx)
+	hashOff := chunkID * chunkHashSize
+	if chunkID >= 0 && byteIdx < len(s.bits) && hashOff+chunkHashSize <= len(s.hashes) {
+		sum, err := hex.DecodeString(hash)
+		if err != nil || len(sum) != chunkHashSize {
+			sum = make([]byte, chunkHashSize)
+		}
+		copy(s.hashes[hashOff:hashOff+chunkHashSize], sum)
+		s.bits[byteIdx] |= (1 << bitIdx)
+		s.UpdatedAt = time.Now()
+		if s.backend != nil {
+			_ = s.backend.saveChunk(s, chunkID)
+		}
+	}
+}
+
+// ClearComplete unsets the completion bit of a chunk so it is downloaded again.
+func (s *DownloadState) ClearComplete(chunkID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byteIdx := chunkID / 8
+	bitIdx := uint(chunkID % 8)
+	
+	if chunkID >= 0 && byteIdx < len(s.bits) && (chunkID+1)*chunkHashSize <= len(s.hashes) {
+		s.bits[byteIdx] &^= (1 << bitIdx)
 		s.UpdatedAt = time.Now()
-		if !s.bitset.isMmap {
-			_, _ = s.bitset.file.WriteAt([]byte{s.bitset.data[byteIdx]}, int64(stateHeaderSize+byteIdx))
+		if s.backend != nil {
+			_ = s.backend.saveChunk(s, chunkID)
 		}
 	}
 }
@@ -164,12 +294,29 @@ func (s *DownloadState) IsComplete(chunkID int) bool {
 
 	byteIdx := chunkID / 8
 	bitIdx := uint(chunkID % 8)
-	if s.bitset != nil && byteIdx < len(s.bitset.data) {
-		return (s.bitset.data[byteIdx] & (1 << bitIdx)) != 0
+	if chunkID >= 0 && byteIdx < len(s.bits) {
+		return (s.bits[byteIdx] & (1 << bitIdx)) != 0
 	}
 	return false
 }
 
+// ChunkHash returns the hex SHA-256 digest recorded for a chunk, or "" if none was.
+func (s *DownloadState) ChunkHash(chunkID int) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if chunkID < 0 || (chunkID+1)*chunkHashSize > len(s.hashes) {
+		return ""
+	}
+	sum := s.hashes[chunkID*chunkHashSize : (chunkID+1)*chunkHashSize]
+	for _, b := range sum {
+		if b != 0 {
+			return hex.EncodeToString(sum)
+		}
+	}
+	return ""
+}
+
 func (s *DownloadState) IsServerChanged(newETag, newLastModified string) bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -187,12 +334,12 @@ func (s *DownloadState) PercentComplete() float64 {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	if s.FileSize <= 0 || s.bitset == nil {
+	if s.FileSize <= 0 || len(s.bits) == 0 {
 		return 0
 	}
 	
 	count := 0
-	for _, b := range s.bitset.data {
+	for _, b := range s.bits {
 		for i := 0; i < 8; i++ {
 			if (b & (1 << uint(i))) != 0 {
 				count++
@@ -200,53 +347,150 @@ func (s *DownloadState) PercentComplete() float64 {
 		}
 	}
 	
-	numChunks := (s.FileSize + s.ChunkSize - 1) / s.ChunkSize
+	numChunks, _ := stateLayout(s.FileSize, s.ChunkSize)
 	return float64(count) / float64(numChunks) * 100
 }
 
-// Save writes the metadata part to the file using CBOR.
+// Save writes the metadata to the state store.
 func (s *DownloadState) Save() error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	if s.backend == nil {
+		return fmt.Errorf("state of %s is closed", s.URL)
+	}
+	return s.backend.saveMeta(s)
+}
 
-	// Create a buffer for the CBOR header
-	data, err := cbor.Marshal(s)
-	if err != nil {
-		return err
+// SetDataSync sets the function that makes the download's data durable. A
+// backend that commits completed chunks in the background calls it first, so
+// a chunk is never marked done on disk before its bytes are.
+func (s *DownloadState) SetDataSync(sync func() error) {
+	s.mu.Lock()
+	s.syncData = sync
+	s.mu.Unlock()
+}
+
+// SetStreamOffset records how far a download of unknown length has got. The
+// header is rewritten at most once per second, after flush has made the data
+// up to offset durable, so a crash never resumes past bytes that were lost;
+// Sync persists the latest value.
+func (s *DownloadState) SetStreamOffset(offset int64, flush func() error) {
+	s.mu.Lock()
+	s.StreamOffset = offset
+	due := s.backend != nil && time.Since(s.lastSave) >= time.Second
+	if due {
+		s.lastSave = time.Now()
 	}
+	s.mu.Unlock()
+	if !due {
+		return
+	}
+	if flush != nil {
+		if err := flush(); err != nil {
+			log.Printf("Warning: failed to sync %s, not recording its offset: %v", s.URL, err)
+			return
+		}
+	}
+	_ = s.Save()
+}
 
-	if len(data) > stateHeaderSize {
-		return fmt.Errorf("metadata too large for reserved header space")
+// SetStreamSize records the final size of a download of unknown length once EOF is reached.
+func (s *DownloadState) SetStreamSize(size int64) error {
+	s.mu.Lock()
+	s.StreamOffset = size
+	s.StreamSize = size
+	s.UpdatedAt = time.Now()
+	hasStore := s.backend != nil
+	s.mu.Unlock()
+	if !hasStore {
+		return nil
 	}
+	return s.Save()
+}
 
-	// Write at the beginning of the file
-	if _, err := s.bitset.file.WriteAt(data, 0); err != nil {
+// Sync flushes the bitset and digests, then rewrites the header, so an
+// interrupted download resumes from the chunks completed so far.
+func (s *DownloadState) Sync() error {
+	s.mu.RLock()
+	if s.backend == nil {
+		s.mu.RUnlock()
+		return nil
+	}
+	err := s.backend.sync(s)
+	s.mu.RUnlock()
+	if err != nil {
 		return err
 	}
-	
-	// We don't pad with zeros explicitly as the file is already truncated 
-	// and we know the bitset starts at stateHeaderSize.
-	
-	return s.bitset.file.Sync()
+	return s.Save()
 }
 
 func (s *DownloadState) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.bitset != nil {
-		var err error
-		if s.bitset.isMmap {
-			err = munmapFile(s.bitset.data)
-		}
-		s.bitset.file.Close()
-		s.bitset = nil
+	if s.backend != nil {
+		err := s.backend.close()
+		s.backend = nil
+		// A mapped bitset is gone with the mapping.
+		s.bits, s.hashes = nil, nil
 		return err
 	}
 	return nil
 }
 
+// StateStore keeps the resume state of downloads, keyed by output path.
 type StateStore interface {
+	// Load returns the saved state for key, or an error wrapping
+	// os.ErrNotExist if there is none.
+	Load(key string) (*DownloadState, error)
+	// Create starts a new state for key, replacing any saved one.
+	Create(key, url string, fileSize, chunkSize int64) (*DownloadState, error)
+	// Remove deletes the saved state for key.
+	Remove(key string) error
+	// Close releases the store. States it returned must be closed first.
 	io.Closer
-	Sync() error
 }
+
+// OpenStateStore opens the store selected by config.StateStoreType: "json"
+// (the default, a state file next to each download) or "bolt" (one database
+// under config.ManifestPath).
+func OpenStateStore(config *Config) (StateStore, error) {
+	switch config.StateStoreType {
+	case "", "json":
+		return fileStateStore{}, nil
+	case "bolt":
+		dir := config.ManifestPath
+		if dir == "" {
+			dir = "."
+		}
+		return OpenBoltStateStore(filepath.Join(dir, boltStateFile))
+	default:
+		return nil, fmt.Errorf("unsupported state_store_type %q", config.StateStoreType)
+	}
+}
+
+// fileStateStore keeps each state in a hidden .name.oget file beside the download.
+type fileStateStore struct{}
+
+func (fileStateStore) path(key string) string {
+	return filepath.Join(filepath.Dir(key), "."+filepath.Base(key)+".oget")
+}
+
+func (st fileStateStore) Load(key string) (*DownloadState, error) {
+	return LoadState(st.path(key))
+}
+
+func (st fileStateStore) Create(key, url string, fileSize, chunkSize int64) (*DownloadState, error) {
+	return NewDownloadState(url, fileSize, chunkSize, st.path(key))
+}
+
+func (st fileStateStore) Remove(key string) error {
+	// .oget.bits is left behind by older versions.
+	_ = os.Remove(st.path(key) + ".bits")
+	if err := os.Remove(st.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (fileStateStore) Close() error { return nil }
@@ -0,0 +1,326 @@
+package oget
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+The bolt state store keeps every download's state in one bbolt database,
+so download directories stay free of .oget files and one query lists all
+unfinished downloads. The layout is:
+
+	downloads/                 bucket
+	  <absolute output path>/  bucket per download
+	    meta                   CBOR of the DownloadState header fields
+	    chunks/                bucket: 4-byte big-endian chunk ID -> SHA-256
+	                           (empty when none was recorded), one key per
+	                           completed chunk
+
+Completed chunks are committed at most once a second and on Sync, each time
+after the download's data has been synced, so a crash loses at most the last
+second of bookkeeping, never data: those chunks are downloaded again.
+*/
+
+const boltStateFile = "oget.db"
+
+var (
+	boltDownloadsBucket = []byte("downloads")
+	boltMetaKey         = []byte("meta")
+	boltChunksBucket    = []byte("chunks")
+)
+
+// The database is locked by the process that opens it, so every Requester
+// and daemon job in this process shares one handle per path.
+var (
+	boltStoresMu sync.Mutex
+	boltStores   = make(map[string]*BoltStateStore)
+)
+
+// BoltStateStore is a StateStore backed by a bbolt database.
+type BoltStateStore struct {
+	db   *bolt.DB
+	path string
+	refs int // guarded by boltStoresMu
+}
+
+// OpenBoltStateStore opens the database at path, creating it if needed.
+// Each call must be matched by a Close.
+func OpenBoltStateStore(path string) (*BoltStateStore, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	boltStoresMu.Lock()
+	defer boltStoresMu.Unlock()
+	if st, ok := boltStores[abs]; ok {
+		st.refs++
+		return st, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(abs, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		if errors.Is(err, bolt.ErrTimeout) {
+			return nil, fmt.Errorf("state database %s is in use by another oget process", abs)
+		}
+		return nil, fmt.Errorf("failed to open state database %s: %w", abs, err)
+	}
+	st := &BoltStateStore{db: db, path: abs, refs: 1}
+	boltStores[abs] = st
+	return st, nil
+}
+
+// Close releases this handle; the database is closed with the last one.
+func (st *BoltStateStore) Close() error {
+	boltStoresMu.Lock()
+	defer boltStoresMu.Unlock()
+	st.refs--
+	if st.refs > 0 {
+		return nil
+	}
+	delete(boltStores, st.path)
+	return st.db.Close()
+}
+
+func boltKey(key string) ([]byte, error) {
+	abs, err := filepath.Abs(key)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(abs), nil
+}
+
+func chunkKey(chunkID int) []byte {
+	k := make([]byte, 4)
+	binary.BigEndian.PutUint32(k, uint32(chunkID))
+	return k
+}
+
+// Load returns the saved state for key.
+func (st *BoltStateStore) Load(key string) (*DownloadState, error) {
+	k, err := boltKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var state *DownloadState
+	err = st.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDownloadsBucket)
+		if b != nil {
+			b = b.Bucket(k)
+		}
+		if b == nil {
+			return fmt.Errorf("no saved state for %s: %w", key, os.ErrNotExist)
+		}
+		state, err = decodeBoltState(b)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	state.backend = &boltBackend{store: st, key: k, dirty: make(map[int]struct{})}
+	return state, nil
+}
+
+// decodeBoltState reads one download's bucket into a DownloadState without a backend.
+func decodeBoltState(b *bolt.Bucket) (*DownloadState, error) {
+	var state DownloadState
+	if err := cbor.Unmarshal(b.Get(boltMetaKey), &state); err != nil {
+		return nil, fmt.Errorf("failed to decode cbor state: %w", err)
+	}
+	if state.Version > stateVersion {
+		return nil, fmt.Errorf("unsupported state version %d", state.Version)
+	}
+	state.Version = stateVersion
+
+	numChunks, numBytes := stateLayout(state.FileSize, state.ChunkSize)
+	state.bits = make([]byte, numBytes)
+	state.hashes = make([]byte, numChunks*chunkHashSize)
+	if chunks := b.Bucket(boltChunksBucket); chunks != nil {
+		err := chunks.ForEach(func(k, v []byte) error {
+			if len(k) != 4 {
+				return nil
+			}
+			id := int64(binary.BigEndian.Uint32(k))
+			if id >= numChunks {
+				return nil
+			}
+			state.bits[id/8] |= 1 << uint(id%8)
+			if len(v) == chunkHashSize {
+				copy(state.hashes[id*chunkHashSize:], v)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &state, nil
+}
+
+// Create starts a new state for key, dropping any saved one.
+func (st *BoltStateStore) Create(key, url string, fileSize, chunkSize int64) (*DownloadState, error) {
+	k, err := boltKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.Remove(key); err != nil {
+		return nil, err
+	}
+	numChunks, numBytes := stateLayout(fileSize, chunkSize)
+	return &DownloadState{
+		Version:   stateVersion,
+		URL:       url,
+		FileSize:  fileSize,
+		ChunkSize: chunkSize,
+		UpdatedAt: time.Now(),
+		bits:      make([]byte, numBytes),
+		hashes:    make([]byte, numChunks*chunkHashSize),
+		backend:   &boltBackend{store: st, key: k, dirty: make(map[int]struct{})},
+	}, nil
+}
+
+// Remove deletes the saved state for key.
+func (st *BoltStateStore) Remove(key string) error {
+	k, err := boltKey(key)
+	if err != nil {
+		return err
+	}
+	return st.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDownloadsBucket)
+		if b == nil {
+			return nil
+		}
+		if err := b.DeleteBucket(k); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		return nil
+	})
+}
+
+// List returns the saved state of every unfinished download, keyed by
+// output path. The states are snapshots and cannot be saved.
+func (st *BoltStateStore) List() (map[string]*DownloadState, error) {
+	states := make(map[string]*DownloadState)
+	err := st.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDownloadsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEachBucket(func(k []byte) error {
+			state, err := decodeBoltState(b.Bucket(k))
+			if err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			states[string(k)] = state
+			return nil
+		})
+	})
+	return states, err
+}
+
+// boltBackend saves one download's state into a BoltStateStore.
+type boltBackend struct {
+	store *BoltStateStore
+	key   []byte
+
+	mu         sync.Mutex
+	dirty      map[int]struct{} // chunks changed since the last commit
+	lastCommit time.Time
+}
+
+func (b *boltBackend) saveMeta(s *DownloadState) error {
+	return b.commit(s)
+}
+
+func (b *boltBackend) saveChunk(s *DownloadState, chunkID int) error {
+	b.mu.Lock()
+	b.dirty[chunkID] = struct{}{}
+	due := time.Since(b.lastCommit) >= time.Second
+	b.mu.Unlock()
+	if !due {
+		return nil
+	}
+	return b.commit(s)
+}
+
+// sync has nothing to flush beyond what Save commits.
+func (b *boltBackend) sync(s *DownloadState) error {
+	return nil
+}
+
+func (b *boltBackend) close() error {
+	return nil
+}
+
+// commit writes the header and the changed chunks in one transaction.
+func (b *boltBackend) commit(s *DownloadState) error {
+	meta, err := cbor.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.dirty) > 0 && s.syncData != nil {
+		if err := s.syncData(); err != nil {
+			return fmt.Errorf("failed to sync data before committing chunks: %w", err)
+		}
+	}
+	err = b.store.db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(boltDownloadsBucket)
+		if err != nil {
+			return err
+		}
+		dl, err := root.CreateBucketIfNotExists(b.key)
+		if err != nil {
+			return err
+		}
+		if err := dl.Put(boltMetaKey, meta); err != nil {
+			return err
+		}
+		chunks, err := dl.CreateBucketIfNotExists(boltChunksBucket)
+		if err != nil {
+			return err
+		}
+		for id := range b.dirty {
+			if s.bits[id/8]&(1<<uint(id%8)) == 0 {
+				err = chunks.Delete(chunkKey(id))
+			} else {
+				err = chunks.Put(chunkKey(id), boltChunkHash(s, id))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.dirty = make(map[int]struct{})
+	b.lastCommit = time.Now()
+	return nil
+}
+
+// boltChunkHash returns the recorded digest of a chunk, or nil if none was.
+func boltChunkHash(s *DownloadState, chunkID int) []byte {
+	sum := s.hashes[chunkID*chunkHashSize : (chunkID+1)*chunkHashSize]
+	for _, c := range sum {
+		if c != 0 {
+			return sum
+		}
+	}
+	return nil
+}
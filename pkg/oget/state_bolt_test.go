@@ -0,0 +1,235 @@
+package oget
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBoltStateStore(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "oget-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dbPath := filepath.Join(tmpDir, "oget.db")
+	key := filepath.Join(tmpDir, "downloads", "testfile")
+
+	store, err := OpenBoltStateStore(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(key); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist before any state is saved, got %v", err)
+	}
+
+	state, err := store.Create(key, "http://example.com/testfile", 10*1024*1024, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.ETag = `"test-etag"`
+	sum := sha256.Sum256([]byte("chunk 3"))
+	state.MarkComplete(3, hex.EncodeToString(sum[:]))
+	state.MarkComplete(4, "")
+	state.MarkComplete(5, "")
+	state.ClearComplete(5)
+	if err := state.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	state.Close()
+
+	// A second handle shares the open database.
+	other, err := OpenBoltStateStore(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+	store.Close()
+
+	store, err = OpenBoltStateStore(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	reloaded, err := store.Load(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if reloaded.URL != "http://example.com/testfile" || reloaded.FileSize != 10*1024*1024 || reloaded.ETag != `"test-etag"` {
+		t.Errorf("metadata mismatch: %+v", reloaded)
+	}
+	if !reloaded.IsComplete(3) || !reloaded.IsComplete(4) || reloaded.IsComplete(5) || reloaded.IsComplete(0) {
+		t.Error("completed chunks not persisted")
+	}
+	if got := reloaded.ChunkHash(3); got != hex.EncodeToString(sum[:]) {
+		t.Errorf("chunk 3 hash not persisted, got %q", got)
+	}
+	if got := reloaded.PercentComplete(); got != 20 {
+		t.Errorf("expected 20%% complete, got %.1f%%", got)
+	}
+
+	states, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states[key] == nil || !states[key].IsComplete(3) {
+		t.Errorf("List() = %v", states)
+	}
+
+	if err := store.Remove(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(key); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("state still present after Remove: %v", err)
+	}
+}
+
+func TestBoltStateStore_SyncsDataFirst(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenBoltStateStore(filepath.Join(dir, "oget.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	key := filepath.Join(dir, "testfile")
+	state, err := store.Create(key, "http://example.com/testfile", 4*1024*1024, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	var syncs int
+	syncErr := errors.New("disk gone")
+	state.SetDataSync(func() error {
+		syncs++
+		return syncErr
+	})
+	// A second after the last commit, a chunk is committed at once; its data
+	// could not be synced.
+	state.backend.(*boltBackend).lastCommit = time.Time{}
+	state.MarkComplete(0, "")
+	if syncs != 1 {
+		t.Fatalf("%d data syncs before committing a chunk, want 1", syncs)
+	}
+	loaded, err := store.Load(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.IsComplete(0) {
+		t.Error("chunk committed although its data was not synced")
+	}
+	loaded.Close()
+
+	syncErr = nil
+	if err := state.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err = store.Load(key); err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	if !loaded.IsComplete(0) || syncs != 2 {
+		t.Errorf("chunk committed: %v after %d syncs, want true after 2", loaded.IsComplete(0), syncs)
+	}
+}
+
+func TestDownloader_BoltStateStore(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4*1024*1024/16)
+	var stall atomic.Bool
+	stall.Store(true)
+	var served atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hold every chunk past the first two until the second run.
+		if stall.Load() && r.Method == http.MethodGet && !strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") &&
+			!strings.HasPrefix(r.Header.Get("Range"), "bytes=1048576-") {
+			<-r.Context().Done()
+			return
+		}
+		if r.Method == http.MethodGet && r.Header.Get("Range") != "bytes=0-0" {
+			served.Add(1)
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "oget-bolt-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manifest := filepath.Join(dir, "manifest")
+	out := filepath.Join(dir, "out")
+
+	newDownloader := func() *Downloader {
+		d := NewDownloader([]string{server.URL + "/data.bin"}, 4)
+		d.Config.AutoTune = false
+		d.Config.Endgame = false
+		d.Config.OutputDir = out
+		d.Config.StateStoreType = "bolt"
+		d.Config.ManifestPath = manifest
+		d.Fetcher = &HttpFetcher{Client: &http.Client{}, Config: d.Config}
+		return d
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	if _, err := newDownloader().Download(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected an interrupted download, got %v", err)
+	}
+	cancel()
+
+	entries, _ := os.ReadDir(out)
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".oget") {
+			t.Errorf("state file %s written next to the download", e.Name())
+		}
+	}
+	store, err := OpenBoltStateStore(filepath.Join(manifest, "oget.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	states, err := store.List()
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := states[filepath.Join(out, "data.bin")]
+	if len(states) != 1 || state == nil || !state.IsComplete(0) || !state.IsComplete(1) || state.IsComplete(2) {
+		t.Fatalf("unexpected saved states after interrupt: %v", states)
+	}
+
+	stall.Store(false)
+	served.Store(0)
+	if _, err := newDownloader().Download(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(out, "data.bin"))
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("resumed file differs: %d bytes, %v", len(data), err)
+	}
+	if n := served.Load(); n != 2 {
+		t.Errorf("resume fetched %d chunks, want the 2 missing ones", n)
+	}
+
+	store, err = OpenBoltStateStore(filepath.Join(manifest, "oget.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if states, _ := store.List(); len(states) != 0 {
+		t.Errorf("state kept after the download completed: %v", states)
+	}
+}
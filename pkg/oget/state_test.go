@@ -1,9 +1,15 @@
 package oget
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
 )
 
 func TestDownloadState(t *testing.T) {
@@ -70,3 +76,157 @@ func TestDownloadState(t *testing.T) {
 		t.Errorf("expected %.1f%% complete, got %.1f%%", expected, percent)
 	}
 }
+
+func TestDownloadState_ChunkHashes(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "oget-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	statePath := filepath.Join(tmpDir, "test.oget")
+	state, err := NewDownloadState("http://example.com/testfile", 10*1024*1024, 1024*1024, statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("chunk 3"))
+	state.MarkComplete(3, hex.EncodeToString(sum[:]))
+	state.MarkComplete(4, "")
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+	state.Close()
+
+	reloaded, err := LoadState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if reloaded.Version != stateVersion {
+		t.Errorf("expected version %d, got %d", stateVersion, reloaded.Version)
+	}
+	if got := reloaded.ChunkHash(3); got != hex.EncodeToString(sum[:]) {
+		t.Errorf("chunk 3 hash not persisted, got %q", got)
+	}
+	if got := reloaded.ChunkHash(4); got != "" || !reloaded.IsComplete(4) {
+		t.Errorf("chunk 4 should be complete without a hash, got %q", got)
+	}
+
+	reloaded.ClearComplete(3)
+	if reloaded.IsComplete(3) {
+		t.Error("chunk 3 still complete after ClearComplete")
+	}
+}
+
+func TestLoadState_MigratesVersion1(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "oget-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// A version 1 file: CBOR header without "ver", then a bare bitset.
+	statePath := filepath.Join(tmpDir, "old.oget")
+	header, err := cbor.Marshal(map[string]interface{}{
+		"url":        "http://example.com/testfile",
+		"file_size":  int64(10 * 1024 * 1024),
+		"chunk_size": int64(1024 * 1024),
+		"etag":       "v1-etag",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, stateHeaderSize+2)
+	copy(data, header)
+	data[stateHeaderSize] = 0x05 // chunks 0 and 2
+	if err := os.WriteFile(statePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := LoadState(statePath)
+	if err != nil {
+		t.Fatalf("failed to load version 1 state: %v", err)
+	}
+	if state.Version != stateVersion || state.ETag != "v1-etag" {
+		t.Errorf("unexpected migrated state: %+v", state)
+	}
+	if !state.IsComplete(0) || state.IsComplete(1) || !state.IsComplete(2) {
+		t.Error("bitset not preserved by migration")
+	}
+	if state.ChunkHash(0) != "" {
+		t.Error("migrated chunks should have no recorded hash")
+	}
+	state.MarkComplete(9, "")
+	state.Close()
+
+	// The migrated file must load again as the current version.
+	reloaded, err := LoadState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if reloaded.Version != stateVersion || !reloaded.IsComplete(9) {
+		t.Errorf("migrated state not persisted: version %d", reloaded.Version)
+	}
+}
+
+// syncCountingStorage counts Sync calls and can make them fail.
+type syncCountingStorage struct {
+	FileStorageHandler
+	syncs   int
+	syncErr error
+}
+
+func (s *syncCountingStorage) Sync() error {
+	s.syncs++
+	return s.syncErr
+}
+
+func TestStreamStorage_SyncsBeforeOffset(t *testing.T) {
+	dir := t.TempDir()
+	file, err := os.Create(filepath.Join(dir, "stream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	statePath := filepath.Join(dir, "stream.oget")
+	state, err := NewDownloadState("http://example.com/stream", -1, RangeSize, statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+	storage := &syncCountingStorage{FileStorageHandler: FileStorageHandler{File: file}, syncErr: errors.New("disk gone")}
+	stream := newStreamStorage(storage, state)
+
+	// The data could not be made durable, so the offset must not be saved.
+	if _, err := stream.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if storage.syncs != 1 {
+		t.Fatalf("%d syncs before saving the offset, want 1", storage.syncs)
+	}
+	saved := func() int64 {
+		t.Helper()
+		reloaded, err := LoadState(statePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reloaded.Close()
+		return reloaded.StreamOffset
+	}
+	if n := saved(); n != 0 {
+		t.Errorf("offset %d saved although the data was not synced", n)
+	}
+
+	storage.syncErr = nil
+	state.lastSave = time.Time{}
+	if _, err := stream.WriteAt([]byte(" world"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if n := saved(); n != 11 || storage.syncs != 2 {
+		t.Errorf("saved offset %d after %d syncs, want 11 after 2", n, storage.syncs)
+	}
+	state.Close()
+}
@@ -0,0 +1,54 @@
+package oget
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// streamStorage wraps the storage of a download of unknown length and keeps
+// the state's StreamOffset at the end of the most recent write. The stream is
+// written sequentially, so that is the point a restart resumes from; if the
+// server ignores the range and the stream restarts at zero, so does the mark.
+type streamStorage struct {
+	StorageHandler
+	state  *DownloadState
+	offset int64
+}
+
+func newStreamStorage(storage StorageHandler, state *DownloadState) *streamStorage {
+	return &streamStorage{StorageHandler: storage, state: state, offset: state.StreamOffset}
+}
+
+func (s *streamStorage) advance(end int64) {
+	atomic.StoreInt64(&s.offset, end)
+	s.state.SetStreamOffset(end, s.StorageHandler.Sync)
+}
+
+// Offset returns the end of the most recent write.
+func (s *streamStorage) Offset() int64 {
+	return atomic.LoadInt64(&s.offset)
+}
+
+func (s *streamStorage) ReadAtFrom(r io.Reader, off int64, count int64) (int64, error) {
+	n, err := s.StorageHandler.ReadAtFrom(r, off, count)
+	if n > 0 {
+		s.advance(off + n)
+	}
+	return n, err
+}
+
+func (s *streamStorage) SpliceFrom(fd uintptr, off int64, count int64) (int64, error) {
+	n, err := s.StorageHandler.SpliceFrom(fd, off, count)
+	if n > 0 {
+		s.advance(off + n)
+	}
+	return n, err
+}
+
+func (s *streamStorage) WriteAt(p []byte, off int64) (int, error) {
+	n, err := s.StorageHandler.WriteAt(p, off)
+	if n > 0 {
+		s.advance(off + int64(n))
+	}
+	return n, err
+}
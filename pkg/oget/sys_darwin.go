@@ -37,3 +37,19 @@ func mmapFileOffset(f *os.File, length int, offset int64) ([]byte, error) {
 func munmapFile(data []byte) error {
 	return unix.Munmap(data)
 }
+
+func msyncFile(data []byte) error {
+	return unix.Msync(data, unix.MS_SYNC)
+}
+
+// lockFile takes an exclusive POSIX record lock on f, waiting for it. Unlike
+// flock these locks also work on NFS. Closing f releases it.
+func lockFile(f *os.File) error {
+	lk := unix.Flock_t{Type: unix.F_WRLCK, Whence: 0}
+	for {
+		err := unix.FcntlFlock(f.Fd(), unix.F_SETLKW, &lk)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
@@ -34,6 +34,14 @@ func munmapFile(data []byte) error {
 	return errors.New("munmap is only supported on linux")
 }
 
+func msyncFile(data []byte) error {
+	return errors.New("msync is only supported on linux")
+}
+
 func NewMmapStorageHandler(file *os.File, length int64) (StorageHandler, error) {
 	return nil, errors.New("mmap storage is only supported on linux")
 }
+
+func lockFile(f *os.File) error {
+	return errors.New("cluster lock files are only supported on linux and darwin")
+}
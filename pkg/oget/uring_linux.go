@@ -0,0 +1,423 @@
+//go:build linux
+// +build linux
+
+package oget
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+Minimal io_uring binding used by URingStorageHandler.
+
+Only the pieces oget needs are implemented: a single submission/completion
+ring, registered (fixed) buffers and the WRITEV / WRITE_FIXED / NOP opcodes.
+Layouts follow include/uapi/linux/io_uring.h.
+*/
+
+const (
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	uringFeatSingleMmap = 1 << 0
+
+	uringEnterGetEvents = 1 << 0
+
+	uringRegisterBuffers = 0
+
+	uringOpNop        = 0
+	uringOpWritev     = 2
+	uringOpWriteFixed = 5
+
+	// uringWakeupData tags the NOP used to wake the completion reaper on close.
+	uringWakeupData = ^uint64(0)
+)
+
+type uringSQRingOffsets struct {
+	Head        uint32
+	Tail        uint32
+	RingMask    uint32
+	RingEntries uint32
+	Flags       uint32
+	Dropped     uint32
+	Array       uint32
+	Resv1       uint32
+	UserAddr    uint64
+}
+
+type uringCQRingOffsets struct {
+	Head        uint32
+	Tail        uint32
+	RingMask    uint32
+	RingEntries uint32
+	Overflow    uint32
+	CQEs        uint32
+	Flags       uint32
+	Resv1       uint32
+	UserAddr    uint64
+}
+
+type uringParams struct {
+	SQEntries    uint32
+	CQEntries    uint32
+	Flags        uint32
+	SQThreadCPU  uint32
+	SQThreadIdle uint32
+	Features     uint32
+	WQFd         uint32
+	Resv         [3]uint32
+	SQOff        uringSQRingOffsets
+	CQOff        uringCQRingOffsets
+}
+
+type uringSQE struct {
+	Opcode      uint8
+	Flags       uint8
+	IOPrio      uint16
+	Fd          int32
+	Off         uint64
+	Addr        uint64
+	Len         uint32
+	OpFlags     uint32
+	UserData    uint64
+	BufIndex    uint16
+	Personality uint16
+	SpliceFdIn  int32
+	_           [2]uint64
+}
+
+type uringCQE struct {
+	UserData uint64
+	Res      int32
+	Flags    uint32
+}
+
+// uringWrite describes a single write to be submitted to the ring.
+type uringWrite struct {
+	fd       int
+	buf      []byte
+	off      int64
+	bufIndex int // index into the registered buffers, -1 if not registered
+}
+
+// uringRing owns the shared submission and completion queues.
+// Submissions are serialized by mu; completions are dispatched by a reaper goroutine.
+type uringRing struct {
+	fd int
+
+	sqRing []byte
+	cqRing []byte
+	sqes   []byte
+
+	sqHead    *uint32
+	sqTail    *uint32
+	sqMask    uint32
+	sqEntries uint32
+	sqArray   unsafe.Pointer
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   unsafe.Pointer
+
+	fixed   bool
+	iovecs  []unix.Iovec // registered buffers, kept alive for the kernel
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]*uringOp
+	done    chan struct{}
+	closed  bool
+}
+
+// uringOp tracks a submitted SQE until its completion is reaped.
+type uringOp struct {
+	result chan int32
+	iov    *unix.Iovec
+}
+
+// newURingRing sets up an io_uring instance with the given queue depth.
+// It returns an error when the kernel (or a seccomp policy) rejects io_uring_setup.
+func newURingRing(entries uint32) (*uringRing, error) {
+	var p uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup: %w", errno)
+	}
+
+	r := &uringRing{
+		fd:      int(fd),
+		pending: make(map[uint64]*uringOp),
+		done:    make(chan struct{}),
+	}
+
+	sqSize := int(p.SQOff.Array + p.SQEntries*4)
+	cqSize := int(p.CQOff.CQEs + p.CQEntries*uint32(unsafe.Sizeof(uringCQE{})))
+	if p.Features&uringFeatSingleMmap != 0 && cqSize > sqSize {
+		sqSize = cqSize
+	}
+
+	var err error
+	r.sqRing, err = unix.Mmap(r.fd, uringOffSQRing, sqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		unix.Close(r.fd)
+		return nil, fmt.Errorf("mmap sq ring: %w", err)
+	}
+	if p.Features&uringFeatSingleMmap != 0 {
+		r.cqRing = r.sqRing
+	} else {
+		r.cqRing, err = unix.Mmap(r.fd, uringOffCQRing, cqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+		if err != nil {
+			r.unmap()
+			return nil, fmt.Errorf("mmap cq ring: %w", err)
+		}
+	}
+	r.sqes, err = unix.Mmap(r.fd, uringOffSQEs, int(p.SQEntries)*int(unsafe.Sizeof(uringSQE{})), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.unmap()
+		return nil, fmt.Errorf("mmap sqes: %w", err)
+	}
+
+	sq := unsafe.Pointer(&r.sqRing[0])
+	r.sqHead = (*uint32)(unsafe.Add(sq, p.SQOff.Head))
+	r.sqTail = (*uint32)(unsafe.Add(sq, p.SQOff.Tail))
+	r.sqMask = *(*uint32)(unsafe.Add(sq, p.SQOff.RingMask))
+	r.sqEntries = *(*uint32)(unsafe.Add(sq, p.SQOff.RingEntries))
+	r.sqArray = unsafe.Add(sq, p.SQOff.Array)
+
+	cq := unsafe.Pointer(&r.cqRing[0])
+	r.cqHead = (*uint32)(unsafe.Add(cq, p.CQOff.Head))
+	r.cqTail = (*uint32)(unsafe.Add(cq, p.CQOff.Tail))
+	r.cqMask = *(*uint32)(unsafe.Add(cq, p.CQOff.RingMask))
+	r.cqes = unsafe.Add(cq, p.CQOff.CQEs)
+
+	go r.reap()
+	return r, nil
+}
+
+// registerBuffers pins bufs in the kernel so writes can use IORING_OP_WRITE_FIXED.
+// On failure (typically RLIMIT_MEMLOCK) the ring keeps working with plain WRITEV.
+func (r *uringRing) registerBuffers(bufs [][]byte) error {
+	iovecs := make([]unix.Iovec, len(bufs))
+	for i, b := range bufs {
+		iovecs[i].Base = &b[0]
+		iovecs[i].SetLen(len(b))
+	}
+	r.iovecs = iovecs
+
+	_, _, errno := unix.Syscall6(unix.SYS_IO_URING_REGISTER, uintptr(r.fd), uringRegisterBuffers,
+		uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("io_uring_register buffers: %w", errno)
+	}
+	r.fixed = true
+	return nil
+}
+
+func (r *uringRing) sqe(idx uint32) *uringSQE {
+	return (*uringSQE)(unsafe.Add(unsafe.Pointer(&r.sqes[0]), uintptr(idx)*unsafe.Sizeof(uringSQE{})))
+}
+
+// prepare fills the next free SQE. The caller must hold r.mu.
+func (r *uringRing) prepare(fill func(*uringSQE)) bool {
+	head := atomic.LoadUint32(r.sqHead)
+	tail := *r.sqTail
+	if tail-head >= r.sqEntries {
+		return false
+	}
+	idx := tail & r.sqMask
+	sqe := r.sqe(idx)
+	*sqe = uringSQE{}
+	fill(sqe)
+	*(*uint32)(unsafe.Add(r.sqArray, uintptr(idx)*4)) = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+	return true
+}
+
+// enter submits toSubmit SQEs and optionally waits for minComplete completions.
+func (r *uringRing) enter(toSubmit, minComplete uint32, flags uint32) (int, error) {
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), uintptr(flags), 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return int(n), errno
+		}
+		return int(n), nil
+	}
+}
+
+// submitWrites queues all writes with a single io_uring_enter call and returns
+// one result channel per write. Each channel yields the CQE result (bytes written
+// or negative errno).
+func (r *uringRing) submitWrites(writes []uringWrite) ([]chan int32, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, errors.New("io_uring ring is closed")
+	}
+
+	results := make([]chan int32, 0, len(writes))
+	ids := make([]uint64, 0, len(writes))
+	for _, w := range writes {
+		r.nextID++
+		id := r.nextID
+		op := &uringOp{result: make(chan int32, 1)}
+		ok := r.prepare(func(sqe *uringSQE) {
+			sqe.Fd = int32(w.fd)
+			sqe.Off = uint64(w.off)
+			sqe.UserData = id
+			if r.fixed && w.bufIndex >= 0 {
+				sqe.Opcode = uringOpWriteFixed
+				sqe.Addr = uint64(uintptr(unsafe.Pointer(&w.buf[0])))
+				sqe.Len = uint32(len(w.buf))
+				sqe.BufIndex = uint16(w.bufIndex)
+			} else {
+				// The iovec must stay reachable until the kernel has consumed it,
+				// so it is kept alongside the pending op.
+				op.iov = &unix.Iovec{Base: &w.buf[0]}
+				op.iov.SetLen(len(w.buf))
+				sqe.Opcode = uringOpWritev
+				sqe.Addr = uint64(uintptr(unsafe.Pointer(op.iov)))
+				sqe.Len = 1
+			}
+		})
+		if !ok {
+			break
+		}
+		r.pending[id] = op
+		ids = append(ids, id)
+		results = append(results, op.result)
+	}
+
+	if len(ids) == 0 {
+		return nil, errors.New("io_uring submission queue is full")
+	}
+	if _, err := r.enter(uint32(len(ids)), 0, 0); err != nil {
+		// Nothing was consumed by the kernel, so the SQEs can be taken back.
+		atomic.StoreUint32(r.sqTail, *r.sqTail-uint32(len(ids)))
+		for _, id := range ids {
+			delete(r.pending, id)
+		}
+		return nil, fmt.Errorf("io_uring_enter: %w", err)
+	}
+	return results, nil
+}
+
+// reap waits for completions and dispatches them to the submitters.
+func (r *uringRing) reap() {
+	defer close(r.done)
+	for {
+		if _, err := r.enter(0, 1, uringEnterGetEvents); err != nil {
+			r.failPending(err)
+			return
+		}
+
+		head := *r.cqHead
+		tail := atomic.LoadUint32(r.cqTail)
+		stop := false
+		for ; head != tail; head++ {
+			cqe := (*uringCQE)(unsafe.Add(r.cqes, uintptr(head&r.cqMask)*unsafe.Sizeof(uringCQE{})))
+			if cqe.UserData == uringWakeupData {
+				stop = true
+				continue
+			}
+			r.mu.Lock()
+			op, ok := r.pending[cqe.UserData]
+			delete(r.pending, cqe.UserData)
+			r.mu.Unlock()
+			if ok {
+				op.result <- cqe.Res
+			}
+		}
+		atomic.StoreUint32(r.cqHead, head)
+		if stop {
+			return
+		}
+	}
+}
+
+func (r *uringRing) failPending(err error) {
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		errno = syscall.EIO
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, op := range r.pending {
+		op.result <- -int32(errno)
+		delete(r.pending, id)
+	}
+}
+
+// Close stops the reaper and releases the ring. The rings are only unmapped
+// once the reaper has returned, as it may be blocked in io_uring_enter on them.
+func (r *uringRing) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.mu.Unlock()
+
+	// The wakeup NOP may not fit or be taken while the queues are busy: try
+	// again after the reaper has drained more completions, unless it has
+	// stopped on an error already.
+wait:
+	for !r.wake() {
+		select {
+		case <-r.done:
+			break wait
+		case <-time.After(time.Millisecond):
+		}
+	}
+	<-r.done
+	r.unmap()
+	return nil
+}
+
+// wake queues the NOP that stops the reaper, along with any SQEs an earlier
+// io_uring_enter left behind, and reports whether the kernel took them all.
+func (r *uringRing) wake() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	queued := r.prepare(func(sqe *uringSQE) {
+		sqe.Opcode = uringOpNop
+		sqe.UserData = uringWakeupData
+	})
+	if _, err := r.enter(*r.sqTail-atomic.LoadUint32(r.sqHead), 0, 0); err != nil {
+		if queued {
+			// Nothing was consumed, so the NOP can be taken back.
+			atomic.StoreUint32(r.sqTail, *r.sqTail-1)
+		}
+		return false
+	}
+	return queued && atomic.LoadUint32(r.sqHead) == *r.sqTail
+}
+
+func (r *uringRing) unmap() {
+	if r.sqes != nil {
+		_ = unix.Munmap(r.sqes)
+		r.sqes = nil
+	}
+	if r.cqRing != nil && len(r.cqRing) > 0 && (r.sqRing == nil || &r.cqRing[0] != &r.sqRing[0]) {
+		_ = unix.Munmap(r.cqRing)
+	}
+	r.cqRing = nil
+	if r.sqRing != nil {
+		_ = unix.Munmap(r.sqRing)
+		r.sqRing = nil
+	}
+	unix.Close(r.fd)
+}
@@ -1,27 +1,239 @@
+//go:build linux
+// +build linux
+
 package oget
 
 import (
+	"fmt"
 	"io"
+	"log"
 	"os"
+	"sync/atomic"
+	"syscall"
 )
 
-// URingStorageHandler is currently a placeholder to ensure the project builds.
-// In this environment, it delegates to FileStorageHandler.
+// uringBatchSize is the number of buffers a single ReadAtFrom call fills
+// before submitting them to the ring in one io_uring_enter.
+const uringBatchSize = 4
+
+// URingStorageHandler implements StorageHandler on top of an io_uring instance.
+// Writes coming from ReadAtFrom are batched into the submission queue using
+// buffers taken from bufPool and registered with the kernel. If the ring stops
+// working at runtime the handler transparently falls back to pwrite.
 type URingStorageHandler struct {
 	FileStorageHandler
+	ring     *uringRing
+	bufs     [][]byte
+	freeBufs chan int
+	disabled int32 // set to 1 once the ring failed and pwrite is used instead
 }
 
-// NewURingStorageHandler creates a placeholder for uring storage.
+// NewURingStorageHandler creates an io_uring backed storage handler with the given queue depth.
+// It returns an error if the kernel does not support io_uring, so callers can fall back.
 func NewURingStorageHandler(file *os.File, entries uint) (*URingStorageHandler, error) {
+	if entries == 0 {
+		entries = 64
+	}
+	ring, err := newURingRing(uint32(entries))
+	if err != nil {
+		return nil, err
+	}
+
+	bufs := make([][]byte, entries)
+	freeBufs := make(chan int, entries)
+	for i := range bufs {
+		bufs[i] = bufPool.Get().([]byte)
+		freeBufs <- i
+	}
+	if err := ring.registerBuffers(bufs); err != nil {
+		log.Printf("Warning: %v, io_uring will use unregistered buffers", err)
+	}
+
 	return &URingStorageHandler{
 		FileStorageHandler: FileStorageHandler{File: file},
+		ring:               ring,
+		bufs:               bufs,
+		freeBufs:           freeBufs,
 	}, nil
 }
 
+// ReadAtFrom reads from r into registered buffers and writes them through the ring.
 func (h *URingStorageHandler) ReadAtFrom(r io.Reader, off int64, count int64) (int64, error) {
-	return h.FileStorageHandler.ReadAtFrom(r, off, count)
+	if atomic.LoadInt32(&h.disabled) == 1 {
+		return h.FileStorageHandler.ReadAtFrom(r, off, count)
+	}
+
+	var total int64
+	var held []int
+	var writes []uringWrite
+	defer func() {
+		for _, idx := range held {
+			h.freeBufs <- idx
+		}
+	}()
+
+	// flush submits the pending writes and hands their buffers back.
+	flush := func() error {
+		if len(writes) > 0 {
+			n, err := h.writeBatch(writes)
+			total += n
+			writes = writes[:0]
+			if err != nil {
+				return err
+			}
+		}
+		for _, idx := range held {
+			h.freeBufs <- idx
+		}
+		held = held[:0]
+		return nil
+	}
+
+	for pos := int64(0); pos < count; {
+		idx, ok := h.acquire(len(held) == 0)
+		if !ok {
+			// Every buffer is in use: push what we have to make room.
+			if err := flush(); err != nil {
+				return total, err
+			}
+			continue
+		}
+		held = append(held, idx)
+
+		buf := h.bufs[idx]
+		if rem := count - pos; rem < int64(len(buf)) {
+			buf = buf[:rem]
+		}
+		nr, er := readFull(r, buf)
+		if nr > 0 {
+			writes = append(writes, uringWrite{fd: int(h.Fd()), buf: buf[:nr], off: off + pos, bufIndex: idx})
+			pos += int64(nr)
+		}
+
+		if er != nil || len(writes) >= uringBatchSize {
+			if err := flush(); err != nil {
+				return total, err
+			}
+		}
+		if er != nil {
+			if er == io.EOF {
+				return total, nil
+			}
+			return total, er
+		}
+	}
+	return total, flush()
+}
+
+// readFull reads into buf until it is full or r fails. Unlike io.ReadFull it
+// keeps the reader's error, so a clean io.EOF stays apart from a body cut
+// short (io.ErrUnexpectedEOF from r).
+func readFull(r io.Reader, buf []byte) (int, error) {
+	var n int
+	for n < len(buf) {
+		nr, err := r.Read(buf[n:])
+		n += nr
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// acquire takes a free registered buffer, blocking only if the caller holds none.
+func (h *URingStorageHandler) acquire(block bool) (int, bool) {
+	if block {
+		return <-h.freeBufs, true
+	}
+	select {
+	case idx := <-h.freeBufs:
+		return idx, true
+	default:
+		return 0, false
+	}
+}
+
+// writeBatch submits writes in a single io_uring_enter and waits for all completions.
+// Short writes are completed with pwrite so the caller always sees a contiguous result.
+func (h *URingStorageHandler) writeBatch(writes []uringWrite) (int64, error) {
+	results, err := h.ring.submitWrites(writes)
+	if err != nil {
+		h.disable(err)
+		return h.pwriteAll(writes)
+	}
+
+	var total int64
+	var firstErr error
+	for i, w := range writes {
+		if i >= len(results) {
+			// Submission queue was full; write the rest synchronously.
+			n, err := h.pwriteAll(writes[i:])
+			total += n
+			if firstErr == nil {
+				firstErr = err
+			}
+			break
+		}
+		res := <-results[i]
+		if res < 0 {
+			errno := syscall.Errno(-res)
+			if errno == syscall.EINVAL || errno == syscall.EOPNOTSUPP || errno == syscall.ENOSYS {
+				h.disable(errno)
+				n, err := h.pwriteAll([]uringWrite{w})
+				total += n
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			if firstErr == nil {
+				firstErr = fmt.Errorf("io_uring write at %d: %w", w.off, errno)
+			}
+			continue
+		}
+		total += int64(res)
+		if int(res) < len(w.buf) {
+			n, err := h.WriteAt(w.buf[res:], w.off+int64(res))
+			total += int64(n)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return total, firstErr
+}
+
+func (h *URingStorageHandler) pwriteAll(writes []uringWrite) (int64, error) {
+	var total int64
+	for _, w := range writes {
+		n, err := h.WriteAt(w.buf, w.off)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (h *URingStorageHandler) disable(err error) {
+	if atomic.CompareAndSwapInt32(&h.disabled, 0, 1) {
+		log.Printf("Warning: io_uring unavailable (%v), falling back to standard file writes", err)
+	}
 }
 
 func (h *URingStorageHandler) SpliceFrom(fd uintptr, off int64, count int64) (int64, error) {
 	return h.FileStorageHandler.SpliceFrom(fd, off, count)
 }
+
+// Close releases the ring, returns the buffers to bufPool and closes the file.
+func (h *URingStorageHandler) Close() error {
+	if h.ring != nil {
+		_ = h.ring.Close()
+		h.ring = nil
+		for _, b := range h.bufs {
+			bufPool.Put(b)
+		}
+		h.bufs = nil
+	}
+	return h.FileStorageHandler.Close()
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package oget
+
+import (
+	"errors"
+	"os"
+)
+
+// URingStorageHandler is only available on linux.
+type URingStorageHandler struct {
+	FileStorageHandler
+}
+
+// NewURingStorageHandler always fails on non-linux platforms so callers fall back.
+func NewURingStorageHandler(file *os.File, entries uint) (*URingStorageHandler, error) {
+	return nil, errors.New("io_uring is only supported on linux")
+}
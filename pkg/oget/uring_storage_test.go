@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package oget
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestURingStorageHandler(t *testing.T) {
+	fileName := "test_uring"
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fileName)
+
+	handler, err := NewURingStorageHandler(file, 8)
+	if err != nil {
+		t.Skipf("io_uring not available: %v", err)
+	}
+
+	// Several writers share the ring and compete for the registered buffers.
+	const parts = 4
+	const partSize = 300 * 1024
+	want := make([]byte, parts*partSize)
+	for i := range want {
+		want[i] = byte(i % 251)
+	}
+
+	var wg sync.WaitGroup
+	for p := 0; p < parts; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			off := int64(p * partSize)
+			n, err := handler.ReadAtFrom(bytes.NewReader(want[off:off+partSize]), off, partSize)
+			if err != nil || n != partSize {
+				t.Errorf("ReadAtFrom part %d: n=%d, err=%v", p, n, err)
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	// A short reader must stop at EOF without error.
+	n, err := handler.ReadAtFrom(bytes.NewReader([]byte("tail")), int64(len(want)), 100)
+	if err != nil || n != 4 {
+		t.Errorf("ReadAtFrom short reader: n=%d, err=%v", n, err)
+	}
+
+	// A body cut short must not pass for a clean end.
+	truncated := io.MultiReader(bytes.NewReader([]byte("cut")), iotest.ErrReader(io.ErrUnexpectedEOF))
+	if _, err := handler.ReadAtFrom(truncated, int64(len(want)), 100); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadAtFrom truncated reader: err=%v, want io.ErrUnexpectedEOF", err)
+	}
+	n, err = handler.ReadAtFrom(bytes.NewReader([]byte("tail")), int64(len(want)), 100)
+	if err != nil || n != 4 {
+		t.Errorf("ReadAtFrom rewrite: n=%d, err=%v", n, err)
+	}
+
+	if err := handler.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := os.ReadFile(fileName)
+	if !bytes.Equal(got, append(want, "tail"...)) {
+		t.Errorf("file content mismatch: got %d bytes, want %d", len(got), len(want)+4)
+	}
+}
+
+func TestURingRingCloseFullQueue(t *testing.T) {
+	ring, err := newURingRing(4)
+	if err != nil {
+		t.Skipf("io_uring not available: %v", err)
+	}
+	// Fill the submission queue without entering, so the wakeup NOP does
+	// not fit at first.
+	ring.mu.Lock()
+	for ring.prepare(func(sqe *uringSQE) { sqe.Opcode = uringOpNop }) {
+	}
+	ring.mu.Unlock()
+
+	closed := make(chan error, 1)
+	go func() { closed <- ring.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	// The rings were unmapped only after the reaper stopped using them.
+	select {
+	case <-ring.done:
+	default:
+		t.Error("Close returned while the reaper was still running")
+	}
+}
@@ -2,8 +2,12 @@ package oget
 
 import (
 	"fmt"
+	"mime"
 	"net/url"
+	"path"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 func parseFileName(uri string) string {
@@ -48,6 +52,48 @@ func parseFileName(uri string) string {
 	return fileName
 }
 
+// contentDispositionFileName returns the file name of a Content-Disposition
+// header, decoding an RFC 5987 filename* (which takes precedence) if present.
+func contentDispositionFileName(header string) string {
+	if header == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
+
+// maxFileNameLen is the longest name most file systems accept, in bytes.
+const maxFileNameLen = 255
+
+// sanitizeFileName reduces a name supplied by a server to a single path
+// element: directories are dropped, control and reserved characters removed
+// and leading dots stripped so the file is neither hidden nor outside the
+// output directory. It returns "" if nothing usable is left.
+func sanitizeFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "/" {
+		return ""
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20, r == 0x7f, r == utf8.RuneError:
+			return -1
+		case strings.ContainsRune(`<>:"|?*/`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	for len(name) > maxFileNameLen {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
 // validate check wether the url is valid
 func validateURL(uri string) bool {
 	_, err := url.ParseRequestURI(uri)
@@ -70,3 +116,33 @@ func humanizeSize(bytes int64) string {
 	}
 	return fmt.Sprintf("%.2f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
+
+// ParseByteSize parses sizes such as "512K", "10M" or "1.5G" (binary units) into bytes.
+func ParseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	multiplier := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		multiplier = 1 << 10
+	case 'M':
+		multiplier = 1 << 20
+	case 'G':
+		multiplier = 1 << 30
+	case 'T':
+		multiplier = 1 << 40
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(v * float64(multiplier)), nil
+}
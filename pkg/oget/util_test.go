@@ -1,6 +1,7 @@
 package oget
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -44,3 +45,69 @@ func TestValidateURL(t *testing.T) {
 		}
 	}
 }
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"1024", 1024, true},
+		{"500K", 500 * 1024, true},
+		{"10M", 10 * 1024 * 1024, true},
+		{"1.5G", 3 * 1024 * 1024 * 1024 / 2, true},
+		{"2MiB", 2 * 1024 * 1024, true},
+		{"", 0, false},
+		{"fast", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseByteSize(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseByteSize(%q) => %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{`..\..\windows\win.ini`, "win.ini"},
+		{"/abs/path/file.txt", "file.txt"},
+		{".bashrc", "bashrc"},
+		{"..", ""},
+		{"/", ""},
+		{"", ""},
+		{"a\x00b\nc.txt", "abc.txt"},
+		{`what?.txt`, "what_.txt"},
+		{"  spaced name.zip ", "spaced name.zip"},
+		{strings.Repeat("é", 200), strings.Repeat("é", 127)},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFileName(tt.in); got != tt.want {
+			t.Errorf("sanitizeFileName(%q) => %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestContentDispositionFileName(t *testing.T) {
+	tests := []struct {
+		header, want string
+	}{
+		{`attachment; filename="report.pdf"`, "report.pdf"},
+		{`attachment; filename=plain.txt`, "plain.txt"},
+		{`attachment; filename="fallback.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`, "résumé.pdf"},
+		{`attachment; filename*=UTF-8''%E2%82%AC%20rates.csv`, "€ rates.csv"},
+		{`inline`, ""},
+		{``, ""},
+		{`attachment; filename="unterminated`, ""},
+	}
+	for _, tt := range tests {
+		if got := contentDispositionFileName(tt.header); got != tt.want {
+			t.Errorf("contentDispositionFileName(%q) => %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}